@@ -7,6 +7,7 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 func BenchmarkActorDrawChannel(b *testing.B) {
@@ -16,7 +17,7 @@ func BenchmarkActorDrawChannel(b *testing.B) {
 			{ItemID: "gold", Quantity: b.N, Probability: 1.0},
 		},
 	)
-	w := &utils.MockWAL{}
+	w := wal.NewMemoryWAL()
 	ctx.WAL = w
 
 	opt := &actor.SystemOptional{RequestBufferSize: b.N}
@@ -9,6 +9,7 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 func BenchmarkPoolDrawNoWalChannel(b *testing.B) {
@@ -18,7 +19,7 @@ func BenchmarkPoolDrawNoWalChannel(b *testing.B) {
 		},
 	)
 	ctx := &types.Context{
-		WAL:   &utils.MockWAL{},
+		WAL:   wal.NewMemoryWAL(),
 		Utils: &utils.MockUtils{},
 	}
 
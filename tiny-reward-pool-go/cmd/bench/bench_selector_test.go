@@ -9,6 +9,7 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/selector"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 func BenchmarkDrawChannel_PrefixSumSelector(b *testing.B) {
@@ -25,7 +26,7 @@ func BenchmarkDrawChannel_PrefixSumSelector(b *testing.B) {
 			Selector: selector.NewPrefixSumSelector(),
 		},
 	)
-	w := &utils.MockWAL{}
+	w := wal.NewMemoryWAL()
 	ctx.WAL = w
 
 	opt := &actor.SystemOptional{RequestBufferSize: b.N, FlushAfterNDraw: 1000}
@@ -68,7 +69,7 @@ func BenchmarkDrawChannel_FenwickTreeSelector(b *testing.B) {
 			Selector: selector.NewFenwickTreeSelector(),
 		},
 	)
-	w := &utils.MockWAL{}
+	w := wal.NewMemoryWAL()
 	ctx.WAL = w
 
 	opt := &actor.SystemOptional{RequestBufferSize: b.N, FlushAfterNDraw: 1000}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// BenchmarkSnapshotLargeCatalog measures a snapshot of a 100k items pool:
+// the capture run on the actor goroutine, and the persist of each format.
+//
+//	go test ./cmd/bench -run ^$ -bench SnapshotLargeCatalog
+func BenchmarkSnapshotLargeCatalog(b *testing.B) {
+	catalog := make([]types.PoolReward, 100_000)
+	for i := range catalog {
+		catalog[i] = types.PoolReward{ItemID: fmt.Sprintf("item-%06d", i), Quantity: 1000, Probability: int64(i%100 + 1)}
+	}
+	pool := rewardpool.NewPool(catalog)
+
+	b.Run("capture", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := snapshot.Capture(pool, uint64(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	view, err := snapshot.Capture(pool, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpDir := filepath.Join("_tmp")
+	_ = os.MkdirAll(tmpDir, 0755)
+	for _, format := range []string{snapshot.FormatJSON, snapshot.FormatBinary} {
+		b.Run("persist_"+format, func(b *testing.B) {
+			path := filepath.Join(tmpDir, snapshot.FileName(format))
+			for i := 0; i < b.N; i++ {
+				if err := snapshot.Persist(view, path, snapshot.PersistOptional{Format: format}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if info, err := os.Stat(path); err == nil {
+				b.ReportMetric(float64(info.Size()), "file_bytes")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	walcompress "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	walstorage "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+// BenchmarkPoolDrawWithCompressedWAL compares the draw throughput and the
+// WAL bytes per draw of the compression codecs, with the batch size of the
+// sample config.
+//
+//	go test ./cmd/bench -run ^$ -bench CompressedWAL
+func BenchmarkPoolDrawWithCompressedWAL(b *testing.B) {
+	for _, codec := range []uint32{types.WALCodecNone, types.WALCodecZstd, types.WALCodecSnappy} {
+		b.Run(walcompress.CodecName(codec), func(b *testing.B) {
+			benchmarkCompressedWAL(b, codec)
+		})
+	}
+}
+
+func benchmarkCompressedWAL(b *testing.B, codec uint32) {
+	tmpDir := filepath.Join("_tmp")
+	_ = os.MkdirAll(tmpDir, 0755)
+	walPath := filepath.Join(tmpDir, "wal_"+walcompress.CodecName(codec)+".log")
+	_ = os.Remove(walPath)
+
+	format := walcompress.NewFormatter(walformatter.NewJSONFormatter(), codec)
+	fileStorage, err := walstorage.NewFileStorage(walPath, 0, walstorage.FileStorageOpt{Codec: codec})
+	if err != nil {
+		b.Fatalf("failed to create file storage: %v", err)
+	}
+	w, err := wal.NewWAL(walPath, 0, format, fileStorage)
+	if err != nil {
+		b.Fatalf("failed to create WAL: %v", err)
+	}
+
+	pool := rewardpool.NewPool(
+		[]types.PoolReward{
+			{ItemID: "gold", Quantity: 1000000, Probability: 1.0},
+			{ItemID: "silver", Quantity: -1, Probability: 3.0},
+		},
+	)
+	ctx := &types.Context{
+		WAL:   w,
+		Utils: &utils.MockUtils{},
+	}
+
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{
+		RequestBufferSize: b.N,
+		FlushAfterNDraw:   200,
+	})
+	if err != nil {
+		b.Error(err)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	var memStatsStart, memStatsEnd runtime.MemStats
+
+	runtime.ReadMemStats(&memStatsStart)
+
+	resChans := make([]<-chan actor.DrawResponse, b.N)
+	for i := 0; i < b.N; i++ {
+		resChans[i] = sys.Draw()
+	}
+
+	for _, ch := range resChans {
+		<-ch
+	}
+
+	runtime.ReadMemStats(&memStatsEnd)
+	elapsed := time.Since(start)
+
+	b.StopTimer()
+	// Flushes the last batch and closes the WAL.
+	sys.Stop()
+
+	walInfo, _ := os.Stat(walPath)
+	walSize := float64(walInfo.Size() - types.WALHeaderSize)
+
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "draws/sec")
+	b.ReportMetric(float64(memStatsEnd.TotalAlloc-memStatsStart.TotalAlloc)/float64(b.N), "bytes/draw")
+	b.ReportMetric(walSize/float64(b.N), "wal_bytes/draw")
+	b.ReportMetric(walSize, "wal_file_size")
+}
@@ -7,21 +7,29 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"sync/atomic"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/cmd/cli/tui"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
 	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
 	walstorage "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
 	rewardpool_grpc_service "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/pkg/rewardpool-grpc-service"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
@@ -41,30 +49,58 @@ func main() {
 		log.Fatalf("LoadConfig failed: %v", err)
 	}
 
+	tracerProvider, shutdownTracing, err := tracing.NewProviderFromConfig(cfg.Tracing.Exporter, cfg.Tracing.FilePath, cfg.Tracing.SampleRatio)
+	if err != nil {
+		log.Fatalf("Tracing setup failed: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	for {
-		sys, writer, err := setup(cfg)
+		var walSizeKB atomic.Int64
+		walSizeKB.Store(int64(cfg.WAL.MaxFileSizeKB))
+		sys, writer, m, err := setup(cfg, &walSizeKB)
 		if err != nil {
 			log.Fatalf("Setup failed: %v", err)
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 
+		service := rewardpool_grpc_service.NewRewardPoolService(sys, serviceOptional(cfg, tracerProvider))
 		if cfg.GRPC.Enabled {
 			go func() {
 				log.Printf("server listening at %v", cfg.GRPC.ListenAddress)
-				if err := rewardpool_grpc_service.ListenAndServe(ctx, sys, cfg.GRPC.ListenAddress); err != nil {
+				if err := rewardpool_grpc_service.ServeService(ctx, service, cfg.GRPC.ListenAddress); err != nil {
 					log.Fatalf("failed to serve: %v", err)
 				}
 			}()
 		}
 
-		m := tui.NewModel(sys, writer.GetReaderChan())
-		p := tea.NewProgram(m)
+		reloader := config.NewReloader(configPath, cfg, sys)
+		reloader.OnReload(func(prev, next config.YAMLConfig) {
+			service.SetLimits(serviceOptional(next, tracerProvider))
+			walSizeKB.Store(int64(next.WAL.MaxFileSizeKB))
+			sys.SetRotationPolicy(rotationPolicy(next))
+			sys.SetSnapshotPolicy(snapshotPolicy(next))
+		})
+
+		if cfg.Metrics.Enabled {
+			go func() {
+				log.Printf("metrics listening at %v", cfg.Metrics.ListenAddress)
+				if err := metrics.ListenAndServe(ctx, m, cfg.Metrics.ListenAddress); err != nil {
+					log.Printf("failed to serve metrics: %v", err)
+				}
+			}()
+		}
+
+		model := tui.NewModel(sys, writer.GetReaderChan())
+		model.SetReloader(reloader)
+		p := tea.NewProgram(model)
 		finalModel, err := p.Run()
 
+		// Stop the listeners first so no request reaches a stopped system.
+		cancel()
 		sys.Stop()
 		fmt.Println("Shutdown complete.")
-		cancel()
 
 		writer.Close()
 
@@ -75,7 +111,10 @@ func main() {
 		}
 
 		if finalModel.(tui.Model).ShouldReload {
-			fmt.Println("Reloading...")
+			fmt.Println("Restarting...")
+			if cfg, err = c.LoadYAML(configPath); err != nil {
+				log.Fatalf("LoadConfig failed: %v", err)
+			}
 			continue
 		}
 
@@ -83,7 +122,40 @@ func main() {
 	}
 }
 
-func setup(cfg config.YAMLConfig) (*actor.System, *tui.ChannelWriter, error) {
+func serviceOptional(cfg config.YAMLConfig, tp trace.TracerProvider) rewardpool_grpc_service.ServiceOptional {
+	return rewardpool_grpc_service.ServiceOptional{
+		MaxDrawCount:   cfg.GRPC.MaxDrawCount,
+		GlobalRate:     cfg.GRPC.RateLimit.GlobalRPS,
+		GlobalBurst:    cfg.GRPC.RateLimit.GlobalBurst,
+		PerClientRate:  cfg.GRPC.RateLimit.PerClientRPS,
+		PerClientBurst: cfg.GRPC.RateLimit.PerClientBurst,
+		TracerProvider: tp,
+	}
+}
+
+// rotationPolicy returns the WAL rotation policy of cfg. With a growable
+// WAL, the file is rotated once it reaches max_file_size_kb.
+func rotationPolicy(cfg config.YAMLConfig) actor.RotationPolicy {
+	p := actor.RotationPolicy{
+		MaxEntries: cfg.WAL.Rotation.MaxEntries,
+		MaxAge:     time.Duration(cfg.WAL.Rotation.MaxAgeSec) * time.Second,
+	}
+	if cfg.WAL.Growable {
+		// types.WAL.Size does not count the header.
+		p.MaxSizeBytes = int64(cfg.WAL.MaxFileSizeKB*1024) - types.WALHeaderSize
+	}
+	return p
+}
+
+// snapshotPolicy returns the background snapshot policy of cfg.
+func snapshotPolicy(cfg config.YAMLConfig) actor.SnapshotPolicy {
+	return actor.SnapshotPolicy{
+		EveryNDraws: cfg.Snapshot.EveryNDraws,
+		Interval:    time.Duration(cfg.Snapshot.IntervalSec) * time.Second,
+	}
+}
+
+func setup(cfg config.YAMLConfig, walSizeKB *atomic.Int64) (*actor.System, *tui.ChannelWriter, *metrics.Metrics, error) {
 	// Setup paths
 	baseDir := "."
 	tmpDir := baseDir + "/" + cfg.WorkingDir
@@ -97,15 +169,39 @@ func setup(cfg config.YAMLConfig) (*actor.System, *tui.ChannelWriter, error) {
 	writer := &tui.ChannelWriter{Ch: logChan}
 
 	utils := utils.NewDefaultUtils(tmpDir, tmpDir, slog.LevelDebug, writer)
+	snapshotFormat, err := snapshot.ParseFormat(cfg.Snapshot.Format)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	utils.SetSnapshotName(snapshot.FileName(snapshotFormat))
 
-	var walFormatter types.LogFormatter
-	switch cfg.WAL.Formatter {
-	case "json":
-		walFormatter = walformatter.NewJSONFormatter()
-	case "string_line":
-		walFormatter = walformatter.NewStringLineFormatter()
-	default:
-		return nil, nil, fmt.Errorf("unsupported WAL formatter: %s", cfg.WAL.Formatter)
+	walFormatter, formatterID, err := walformatter.ByName(cfg.WAL.Formatter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	codec, err := compress.ParseCodec(cfg.WAL.Compression)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	walFormatter = compress.NewFormatter(walFormatter, codec)
+	// Set when wal.encryption is enabled.
+	var keyring *crypt.Keyring
+	var keyID uint32
+	if cfg.WAL.Encryption.Enabled {
+		keyFiles := make(map[uint32]string, len(cfg.WAL.Encryption.Keys))
+		for _, k := range cfg.WAL.Encryption.Keys {
+			keyFiles[k.ID] = k.KeyFile
+		}
+		if keyring, err = crypt.LoadKeyring(cfg.WAL.Encryption.ActiveKeyID, keyFiles); err != nil {
+			return nil, nil, nil, fmt.Errorf("WAL encryption setup failed: %w", err)
+		}
+		keyID = keyring.Active()
+		walFormatter = crypt.NewFormatter(walFormatter, keyring)
+	}
+
+	var m *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		m = metrics.NewMetrics()
 	}
 
 	// Create a pool from the config
@@ -113,7 +209,24 @@ func setup(cfg config.YAMLConfig) (*actor.System, *tui.ChannelWriter, error) {
 
 	pool, lastRequestID, lastWalPath, err := recovery.RecoverPoolFromConfig(initialPool, walFormatter, utils)
 	if err != nil {
-		return nil, nil, fmt.Errorf("recovery failed: %w", err)
+		return nil, nil, nil, fmt.Errorf("recovery failed: %w", err)
+	}
+
+	manifest, err := wal.OpenManifest(tmpDir, wal.ManifestOptional{Formatter: walFormatter, Logger: utils.GetLogger()})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("WAL manifest failed: %w", err)
+	}
+
+	if lastWalPath != "" {
+		// A WAL file is only continued with the header it would be created
+		// with, otherwise the next one starts with a snapshot.
+		hdr, err := wal.ReadHeader(lastWalPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if hdr.Version != types.WALVersion2 || hdr.FormatterID != formatterID || hdr.KeyID != keyID || hdr.Codec != codec {
+			lastWalPath = ""
+		}
 	}
 
 	var w types.WAL
@@ -122,20 +235,27 @@ func setup(cfg config.YAMLConfig) (*actor.System, *tui.ChannelWriter, error) {
 		var newWalPath string
 		newWalPath, seqNo, err = utils.GenNextWALPath()
 		if err != nil {
-			return nil, nil, fmt.Errorf("error generating new WAL path: %w", err)
+			return nil, nil, nil, fmt.Errorf("error generating new WAL path: %w", err)
 		}
 		lastWalPath = newWalPath
+	} else if seqNo, err = wal.ParseSeqNo(lastWalPath); err != nil {
+		return nil, nil, nil, err
 	}
 
 	fileStorage, err := walstorage.NewFileMMapStorage(lastWalPath, seqNo, walstorage.FileMMapStorageOps{
 		MMapFileSizeInBytes: int64(cfg.WAL.MaxFileSizeKB * 1024), // From KB to Bytes
+		Growable:            cfg.WAL.Growable,
+		GrowChunkInBytes:    int64(cfg.WAL.GrowChunkKB * 1024),
+		KeyID:               keyID,
+		Codec:               codec,
+		FormatterID:         formatterID,
 	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating file storage: %w", err)
+		return nil, nil, nil, fmt.Errorf("error creating file storage: %w", err)
 	}
-	w, err = wal.NewWAL(lastWalPath, seqNo, walFormatter, fileStorage)
+	w, err = wal.NewWAL(lastWalPath, seqNo, walFormatter, fileStorage, wal.WALOptional{Metrics: m, Manifest: manifest})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error opening WAL: %w", err)
+		return nil, nil, nil, fmt.Errorf("error opening WAL: %w", err)
 	}
 
 	ctx := &types.Context{
@@ -147,26 +267,39 @@ func setup(cfg config.YAMLConfig) (*actor.System, *tui.ChannelWriter, error) {
 
 	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
 		fileStorage, err := walstorage.NewFileMMapStorage(path, seqNo, walstorage.FileMMapStorageOps{
-			MMapFileSizeInBytes: int64(cfg.WAL.MaxFileSizeKB * 1024), // From KB to Bytes
+			MMapFileSizeInBytes: walSizeKB.Load() * 1024, // From KB to Bytes
+			Growable:            cfg.WAL.Growable,
+			GrowChunkInBytes:    int64(cfg.WAL.GrowChunkKB * 1024),
+			KeyID:               keyID,
+			Codec:               codec,
+			FormatterID:         formatterID,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("error creating file storage: %w", err)
 		}
-		return wal.NewWAL(path, seqNo, walFormatter, fileStorage)
+		return wal.NewWAL(path, seqNo, walFormatter, fileStorage, wal.WALOptional{Metrics: m, Manifest: manifest})
 	}
 
-	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{
+	sysOpt := &actor.SystemOptional{
 		FlushAfterNDraw:   cfg.WAL.FlushAfterNDraw,
 		RequestBufferSize: cfg.WAL.MaxRequestBuffer,
 		LastRequestID:     lastRequestID,
 		WALStreamer:       walStreamer,
 		WALFactory:        walFactory,
-	})
+		Metrics:           m,
+		RotationPolicy:    rotationPolicy(cfg),
+		SnapshotFormat:    snapshotFormat,
+		SnapshotPolicy:    snapshotPolicy(cfg),
+	}
+	if keyring != nil {
+		sysOpt.SnapshotSealer = keyring
+	}
+	sys, err := actor.NewSystem(ctx, pool, sysOpt)
 	if err != nil {
-		return nil, nil, fmt.Errorf("system startup error: %w", err)
+		return nil, nil, nil, fmt.Errorf("system startup error: %w", err)
 	}
 	sys.SetRequestID(lastRequestID)
 
 	utils.GetLogger().Debug(fmt.Sprintf("Config: %+v", cfg))
-	return sys, writer, nil
+	return sys, writer, m, nil
 }
\ No newline at end of file
@@ -13,6 +13,7 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 )
 
@@ -25,6 +26,7 @@ var (
 
 type Model struct {
 	system          *actor.System
+	reloader        *config.Reloader
 	chartView       viewport.Model
 	historyView     viewport.Model
 	textInput       textinput.Model
@@ -71,6 +73,11 @@ func NewModel(system *actor.System, logChan <-chan string) Model {
 	}
 }
 
+// SetReloader enables the hot reload command. Without it, `r` restarts the system.
+func (m *Model) SetReloader(reloader *config.Reloader) {
+	m.reloader = reloader
+}
+
 func (m Model) Init() tea.Cmd {
 	return tea.Batch(textinput.Blink, waitForLog(m.logChan), waitForTick(m.ticker))
 }
@@ -253,6 +260,26 @@ func (m *Model) onUserCommand(command string, args []string, cmds []tea.Cmd) []t
 			cmds = append(cmds, refreshState(m.system))
 		}
 	case "r":
+		if m.reloader == nil {
+			m.ShouldReload = true
+			m.ticker.Stop()
+			return append(cmds, tea.Quit)
+		}
+		result, err := m.reloader.Reload()
+		if err != nil {
+			m.history = append(m.history, fmt.Sprintf("Reload failed: %v", err))
+			break
+		}
+		m.history = append(m.history, fmt.Sprintf("Config reloaded, %d item update(s)", len(result.Updates)))
+		for _, u := range result.Updates {
+			m.history = append(m.history, fmt.Sprintf("  %s quantity=%d weight=%d", u.ItemID, u.Quantity, u.Probability))
+		}
+		if len(result.RestartRequired) > 0 {
+			m.history = append(m.history, fmt.Sprintf("Needs restart (R): %s", strings.Join(result.RestartRequired, ", ")))
+		}
+		m.initCachedState = m.system.State()
+		cmds = append(cmds, refreshState(m.system))
+	case "R":
 		m.ShouldReload = true
 		m.ticker.Stop()
 		return append(cmds, tea.Quit)
@@ -308,7 +335,8 @@ func getHelp() string {
 		"  s          - Show pool status\n" +
 		"  d [n]      - Draw [n] items (default: 1)\n" +
 		"  u <id> <qty> <w> - Update item quantity and weight\n" +
-		"  r          - Reload pool from config\n" +
+		"  r          - Reload config without stopping the system\n" +
+		"  R          - Restart the system from config\n" +
 		"  q          - Quit\n"
 }
 func (m *Model) getStatus() string {
@@ -9,6 +9,7 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/selector"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 func TestRewardDistributionReport(t *testing.T) {
@@ -36,7 +37,7 @@ func TestRewardDistributionReport(t *testing.T) {
 					Selector: s.selector,
 				},
 			)
-			w := &utils.MockWAL{}
+			w := wal.NewMemoryWAL()
 			ctx.WAL = w
 
 			opt := &actor.SystemOptional{RequestBufferSize: 1000, FlushAfterNDraw: 1000}
@@ -97,7 +98,7 @@ func TestQuantityExhaustion(t *testing.T) {
 					Selector: s.selector,
 				},
 			)
-			w := &utils.MockWAL{}
+			w := wal.NewMemoryWAL()
 			ctx.WAL = w
 
 			opt := &actor.SystemOptional{RequestBufferSize: 100, FlushAfterNDraw: 10}
@@ -171,7 +172,7 @@ func TestItemUpdateDistribution(t *testing.T) {
 					Selector: s.selector,
 				},
 			)
-			w := &utils.MockWAL{}
+			w := wal.NewMemoryWAL()
 			ctx.WAL = w
 
 			opt := &actor.SystemOptional{RequestBufferSize: 1000, FlushAfterNDraw: 1000}
@@ -270,7 +271,7 @@ func TestRewardDistributionWithUnlimitedQuantity(t *testing.T) {
 					Selector: s.selector,
 				},
 			)
-			w := &utils.MockWAL{}
+			w := wal.NewMemoryWAL()
 			ctx.WAL = w
 
 			opt := &actor.SystemOptional{RequestBufferSize: 1000, FlushAfterNDraw: 1000}
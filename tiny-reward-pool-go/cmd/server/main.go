@@ -0,0 +1,825 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/cluster"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/election"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/objectstore"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replica"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compactor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	walstorage "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+	rewardpool_grpc_service "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/pkg/rewardpool-grpc-service"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+const (
+	defaultDrainTimeout   = 10 * time.Second
+	defaultReloadInterval = time.Second
+)
+
+// Headless server: gRPC + health checks + metrics, no TUI.
+//
+// Lifecycle:
+//  1. The gRPC listener starts right away with health NOT_SERVING.
+//  2. Recovery runs; once the actor system is up, health switches to SERVING.
+//  3. On SIGHUP (or a file change when reload.watch is set) the config is
+//     reloaded: catalog changes are written through the actor, and WAL and
+//     gRPC limits are applied without restarting.
+//  4. On SIGTERM/SIGINT: health goes NOT_SERVING, new draws are rejected,
+//     in-flight streams get drain_timeout_sec to finish, then the system is
+//     flushed, snapshotted and stopped.
+//
+// With replication.role "primary", committed WAL entries are also shipped to
+// replicas on replication.listen_address. With "replica", no actor system is
+// started: the server follows replication.primary_address and only serves GetState.
+//
+// With election.enabled, roles are not configured: the node holding the lease
+// file runs the actor system and streams on replication.listen_address, the
+// others follow it and redirect draws to election.advertise_address of the
+// leader. A follower taking the lease continues from its replicated state.
+//
+// With sink.enabled, committed WAL entries are also published to a message
+// broker, with a spill file in sink.spill_dir while the broker is down.
+// With webhooks.enabled, the matching entries are POSTed to partner endpoints
+// from a durable queue in webhooks.queue_dir.
+//
+// With object_store.enabled, every finalized WAL file and its snapshot are
+// uploaded to an S3-compatible bucket. A server starting on an empty
+// working_dir restores the latest of them first.
+//
+// With wal.compaction.enabled, the closed WAL files older than the latest
+// snapshot are deleted or gzipped to wal.compaction.archive_dir.
+func main() {
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "path to the config.yaml file")
+	flag.Parse()
+
+	if configPath == "" {
+		fmt.Println("Error: config file path is required.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	c := &config.ConfigImpl{}
+	cfg, err := c.LoadYAML(configPath)
+	if err != nil {
+		log.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if err := run(configPath, cfg); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+func run(configPath string, cfg config.YAMLConfig) error {
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+
+	tracerProvider, shutdownTracing, err := tracing.NewProviderFromConfig(cfg.Tracing.Exporter, cfg.Tracing.FilePath, cfg.Tracing.SampleRatio)
+	if err != nil {
+		return fmt.Errorf("tracing setup failed: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	var m *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		m = metrics.NewMetrics()
+	}
+
+	listenCtx, stopListeners := context.WithCancel(context.Background())
+	defer stopListeners()
+
+	if cfg.Metrics.Enabled {
+		go func() {
+			log.Printf("metrics listening at %v", cfg.Metrics.ListenAddress)
+			if err := metrics.ListenAndServe(listenCtx, m, cfg.Metrics.ListenAddress); err != nil {
+				log.Printf("failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	// 1. Start the gRPC listener first so health checks answer during recovery.
+	lis, err := net.Listen("tcp", cfg.GRPC.ListenAddress)
+	if err != nil {
+		return err
+	}
+	service := rewardpool_grpc_service.NewRewardPoolService(nil, serviceOptional(cfg, tracerProvider))
+	grpcServer, healthServer := rewardpool_grpc_service.NewGRPCServer(service)
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("server listening at %v", cfg.GRPC.ListenAddress)
+		serveErr <- grpcServer.Serve(lis)
+	}()
+
+	var walSizeKB atomic.Int64
+	walSizeKB.Store(int64(cfg.WAL.MaxFileSizeKB))
+
+	if cfg.Replication.Role == config.ReplicationRoleReplica && !cfg.Election.Enabled {
+		return runReplica(sigCtx, cfg, service, grpcServer, healthServer, serveErr)
+	}
+
+	// Stopped last, once the actor system has streamed its final flush.
+	streamers, stopStreamers, err := startStreamers(cfg)
+	if err != nil {
+		grpcServer.Stop()
+		return err
+	}
+	defer stopStreamers()
+
+	// Stopped after the actor system too, to upload its last WAL file.
+	archiver, stopArchiver, err := startArchiver(cfg)
+	if err != nil {
+		grpcServer.Stop()
+		return err
+	}
+	defer stopArchiver()
+
+	// Registers the WAL files of every actor system started below.
+	manifest, err := openManifest(cfg)
+	if err != nil {
+		grpcServer.Stop()
+		return err
+	}
+
+	stopCompactor, err := startCompactor(cfg, manifest)
+	if err != nil {
+		grpcServer.Stop()
+		return err
+	}
+	defer stopCompactor()
+
+	if cfg.Election.Enabled {
+		return runCluster(sigCtx, cfg, m, &walSizeKB, streamers, archiver, manifest, service, grpcServer, healthServer, serveErr)
+	}
+
+	// 2. Recover and start the actor system, then report ready.
+	sys, streamer, err := setup(cfg, m, &walSizeKB, setupOptional{streamers: streamers, archiver: archiver, manifest: manifest})
+	if err != nil {
+		grpcServer.Stop()
+		return err
+	}
+	// Replicas keep following until the final flush is streamed.
+	replicationCtx, stopReplication := context.WithCancel(context.Background())
+	defer stopReplication()
+	if streamer != nil {
+		go func() {
+			log.Printf("replication listening at %v", cfg.Replication.ListenAddress)
+			if err := streamer.ListenAndServe(replicationCtx, cfg.Replication.ListenAddress); err != nil {
+				log.Printf("failed to serve replication: %v", err)
+			}
+		}()
+	}
+	service.SetSystem(sys)
+	rewardpool_grpc_service.SetServingStatus(healthServer, true)
+	log.Printf("ready, last request id %d", sys.GetRequestID())
+
+	// 3. Hot reload.
+	reloader := config.NewReloader(configPath, cfg, sys)
+	reloader.OnReload(func(prev, next config.YAMLConfig) {
+		service.SetLimits(serviceOptional(next, tracerProvider))
+		// Applies to the WAL files created after the next rotation.
+		walSizeKB.Store(int64(next.WAL.MaxFileSizeKB))
+		sys.SetRotationPolicy(rotationPolicy(next))
+		sys.SetSnapshotPolicy(snapshotPolicy(next))
+	})
+	if cfg.Reload.Watch {
+		interval := defaultReloadInterval
+		if cfg.Reload.IntervalMs > 0 {
+			interval = time.Duration(cfg.Reload.IntervalMs) * time.Millisecond
+		}
+		go reloader.Watch(listenCtx, interval, logReload)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+wait:
+	for {
+		select {
+		case <-hup:
+			logReload(reloader.Reload())
+		case <-sigCtx.Done():
+			log.Printf("signal received, draining")
+			break wait
+		case err := <-serveErr:
+			log.Printf("gRPC server stopped: %v", err)
+			break wait
+		}
+	}
+
+	// 4. Drain: stop accepting draws, let in-flight streams finish.
+	drain(service, grpcServer, healthServer, reloader.Current().GRPC.DrainTimeoutSec)
+	stopListeners()
+
+	// 5. Persist everything before exit.
+	if err := sys.Flush(); err != nil {
+		log.Printf("final flush failed: %v", err)
+	}
+	if err := sys.Snapshot(); err != nil {
+		log.Printf("final snapshot failed: %v", err)
+	}
+	sys.Stop()
+	stopReplication()
+	log.Printf("shutdown complete")
+	return nil
+}
+
+// runReplica serves GetState from a replica following the primary.
+// Health reports SERVING once the first snapshot is applied.
+func runReplica(sigCtx context.Context, cfg config.YAMLConfig, service *rewardpool_grpc_service.RewardPoolService, grpcServer *grpc.Server, healthServer *health.Server, serveErr <-chan error) error {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	r := replica.NewReplica(cfg.Replication.PrimaryAddress, replica.ReplicaOptional{Logger: logger})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+
+	log.Printf("following primary at %v", cfg.Replication.PrimaryAddress)
+	if err := r.WaitReady(sigCtx); err == nil {
+		service.SetSystem(r)
+		rewardpool_grpc_service.SetServingStatus(healthServer, true)
+		log.Printf("replica ready, last request id %d", r.GetRequestID())
+
+		select {
+		case <-sigCtx.Done():
+			log.Printf("signal received, draining")
+		case err := <-serveErr:
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}
+
+	drain(service, grpcServer, healthServer, cfg.GRPC.DrainTimeoutSec)
+	cancel()
+	<-done
+	log.Printf("shutdown complete")
+	return nil
+}
+
+// runCluster takes part in the leader election. Health reports SERVING once
+// the node knows its role. The config is not hot-reloaded in this mode.
+func runCluster(sigCtx context.Context, cfg config.YAMLConfig, m *metrics.Metrics, walSizeKB *atomic.Int64, streamers []walstream.WALStreamer, archiver *objectstore.Archiver, manifest *wal.Manifest, service *rewardpool_grpc_service.RewardPoolService, grpcServer *grpc.Server, healthServer *health.Server, serveErr <-chan error) error {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if err := os.MkdirAll(filepath.Dir(cfg.Election.LeasePath), 0755); err != nil {
+		grpcServer.Stop()
+		return err
+	}
+
+	ttl := time.Duration(cfg.Election.LeaseTTLMs) * time.Millisecond
+	elector := election.NewLeaseElector(cfg.Election.LeasePath, election.Candidate{
+		ID:                 cfg.Election.NodeID,
+		Address:            cfg.Election.AdvertiseAddress,
+		ReplicationAddress: cfg.Election.AdvertiseReplicationAddress,
+	}, election.LeaseElectorOptional{TTL: ttl})
+	service.SetLeaderAddress(func() string {
+		lease := elector.Lease()
+		if !time.Now().Before(lease.ExpiresAt) {
+			return ""
+		}
+		return lease.Address
+	})
+
+	start := func(snapshot *types.PoolSnapshot, token uint64, fence func() error) (*actor.System, *walstream.TCPStreamer, error) {
+		return setup(cfg, m, walSizeKB, setupOptional{snapshot: snapshot, fencingToken: token, fence: fence, streamers: streamers, archiver: archiver, manifest: manifest})
+	}
+	node := cluster.NewNode(elector, cfg.Replication.ListenAddress, start, cluster.NodeOptional{
+		Logger: logger,
+		OnRoleChange: func(role cluster.Role, sys cluster.ActorSystem) {
+			service.SetSystem(sys)
+			rewardpool_grpc_service.SetServingStatus(healthServer, true)
+			log.Printf("node %s is now %v", cfg.Election.NodeID, role)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		node.Run(ctx)
+	}()
+
+	select {
+	case <-sigCtx.Done():
+		log.Printf("signal received, draining")
+	case err := <-serveErr:
+		log.Printf("gRPC server stopped: %v", err)
+	}
+
+	// The leader flushes, snapshots and releases the lease once the streams are drained.
+	drain(service, grpcServer, healthServer, cfg.GRPC.DrainTimeoutSec)
+	cancel()
+	<-done
+	log.Printf("shutdown complete")
+	return nil
+}
+
+// backgroundStreamer is a WALStreamer delivering from its own goroutine.
+type backgroundStreamer interface {
+	walstream.WALStreamer
+	Run(ctx context.Context)
+	Close() error
+}
+
+// startStreamers starts the event sink and the webhooks enabled in cfg.
+// The returned stop function persists what was not delivered yet; call it
+// once the actor system is stopped.
+func startStreamers(cfg config.YAMLConfig) ([]walstream.WALStreamer, func(), error) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	var started []backgroundStreamer
+	var closers []func() error
+
+	if cfg.Sink.Enabled {
+		if cfg.Sink.Kind != config.SinkKindNATS {
+			return nil, nil, fmt.Errorf("unsupported sink kind: %s", cfg.Sink.Kind)
+		}
+		client := walstream.NewNATSClient(cfg.Sink.Address)
+		sink, err := walstream.NewSinkStreamer(client, cfg.Sink.Subject, cfg.Sink.SpillDir, walstream.SinkStreamerOptional{
+			BatchSize:     cfg.Sink.BatchSize,
+			FlushInterval: time.Duration(cfg.Sink.FlushIntervalMs) * time.Millisecond,
+			MaxRetries:    cfg.Sink.MaxRetries,
+			MaxBuffered:   cfg.Sink.MaxBuffered,
+			Logger:        logger,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("sink setup failed: %w", err)
+		}
+		started = append(started, sink)
+		closers = append(closers, client.Close)
+		log.Printf("sink publishing to %s on %q, last acknowledged request id %d", cfg.Sink.Address, cfg.Sink.Subject, sink.LastAckedRequestID())
+	}
+
+	if cfg.Webhooks.Enabled {
+		targets := make([]walstream.WebhookTarget, 0, len(cfg.Webhooks.Targets))
+		for _, t := range cfg.Webhooks.Targets {
+			logTypes, err := t.ParseLogTypes()
+			if err != nil {
+				closeAll(started)
+				return nil, nil, err
+			}
+			targets = append(targets, walstream.WebhookTarget{
+				Name:     t.Name,
+				URL:      t.URL,
+				Secret:   []byte(t.Secret),
+				ItemIDs:  t.ItemIDs,
+				LogTypes: logTypes,
+			})
+		}
+		opt := walstream.WebhookStreamerOptional{
+			MaxAttempts:    cfg.Webhooks.MaxAttempts,
+			InitialBackoff: time.Duration(cfg.Webhooks.InitialBackoffMs) * time.Millisecond,
+			MaxBackoff:     time.Duration(cfg.Webhooks.MaxBackoffMs) * time.Millisecond,
+			Logger:         logger,
+		}
+		if cfg.Webhooks.TimeoutMs > 0 {
+			opt.Client = &http.Client{Timeout: time.Duration(cfg.Webhooks.TimeoutMs) * time.Millisecond}
+		}
+		webhooks, err := walstream.NewWebhookStreamer(cfg.Webhooks.QueueDir, targets, opt)
+		if err != nil {
+			closeAll(started)
+			return nil, nil, fmt.Errorf("webhooks setup failed: %w", err)
+		}
+		started = append(started, webhooks)
+		log.Printf("webhooks delivering to %d targets", len(targets))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	streamers := make([]walstream.WALStreamer, 0, len(started))
+	for _, s := range started {
+		streamers = append(streamers, s)
+		closers = append(closers, s.Close)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
+	}
+
+	return streamers, func() {
+		cancel()
+		wg.Wait()
+		for _, close := range closers {
+			close()
+		}
+	}, nil
+}
+
+// startArchiver starts uploading the finalized WAL files when
+// object_store.enabled is set, and returns a nil archiver otherwise. The
+// returned stop function uploads what is still queued; call it once the
+// actor system is stopped.
+func startArchiver(cfg config.YAMLConfig) (*objectstore.Archiver, func(), error) {
+	if !cfg.ObjectStore.Enabled {
+		return nil, func() {}, nil
+	}
+	client, err := objectstore.NewS3Client(cfg.ObjectStore.Endpoint, cfg.ObjectStore.Bucket, objectstore.Credentials{
+		AccessKeyID:     cfg.ObjectStore.AccessKeyID,
+		SecretAccessKey: cfg.ObjectStore.SecretAccessKey,
+	}, objectstore.S3ClientOptional{Region: cfg.ObjectStore.Region})
+	if err != nil {
+		return nil, nil, fmt.Errorf("object store setup failed: %w", err)
+	}
+	walFormatter, err := newWALFormatter(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	archiver := objectstore.NewArchiver(client, objectstore.ArchiverOptional{
+		Prefix:     cfg.ObjectStore.Prefix,
+		Formatter:  walFormatter,
+		MaxPending: cfg.ObjectStore.MaxPending,
+		Logger:     slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})),
+	})
+	log.Printf("archiving WAL files to %s/%s", cfg.ObjectStore.Endpoint, cfg.ObjectStore.Bucket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		archiver.Run(ctx)
+	}()
+	return archiver, func() {
+		cancel()
+		<-done
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), defaultDrainTimeout)
+		defer cancelFlush()
+		if err := archiver.Flush(flushCtx); err != nil {
+			log.Printf("final archive upload failed, %d upload(s) lost: %v", archiver.Pending(), err)
+		}
+	}, nil
+}
+
+// openManifest opens the manifest of the WAL files in working_dir, built
+// from the directory on the first start.
+func openManifest(cfg config.YAMLConfig) (*wal.Manifest, error) {
+	walFormatter, err := newWALFormatter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := wal.OpenManifest("./"+cfg.WorkingDir, wal.ManifestOptional{
+		Formatter: walFormatter,
+		Logger:    slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("WAL manifest failed: %w", err)
+	}
+	return manifest, nil
+}
+
+// startCompactor starts compacting the WAL files when
+// wal.compaction.enabled is set.
+func startCompactor(cfg config.YAMLConfig, manifest *wal.Manifest) (func(), error) {
+	if !cfg.WAL.Compaction.Enabled {
+		return func() {}, nil
+	}
+	action, err := compactor.ParseAction(cfg.WAL.Compaction.Action)
+	if err != nil {
+		return nil, err
+	}
+	walFormatter, err := newWALFormatter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := compactor.NewCompactor(manifest, compactor.CompactorOptional{
+		Action:       action,
+		ArchiveDir:   cfg.WAL.Compaction.ArchiveDir,
+		AuditDir:     cfg.WAL.Compaction.AuditDir,
+		KeepSegments: cfg.WAL.Compaction.KeepSegments,
+		Interval:     time.Duration(cfg.WAL.Compaction.IntervalMs) * time.Millisecond,
+		Formatter:    walFormatter,
+		Logger:       slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("compactor setup failed: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// newWALFormatter returns the formatter named by wal.formatter, compressing
+// the batches with wal.compression and encrypting them when wal.encryption
+// is enabled. Compressed batches are read even when wal.compression is
+// "none".
+func newWALFormatter(cfg config.YAMLConfig) (types.LogFormatter, error) {
+	format, _, err := walformatter.ByName(cfg.WAL.Formatter)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := compress.ParseCodec(cfg.WAL.Compression)
+	if err != nil {
+		return nil, err
+	}
+	format = compress.NewFormatter(format, codec)
+	if !cfg.WAL.Encryption.Enabled {
+		return format, nil
+	}
+	keyFiles := make(map[uint32]string, len(cfg.WAL.Encryption.Keys))
+	for _, k := range cfg.WAL.Encryption.Keys {
+		keyFiles[k.ID] = k.KeyFile
+	}
+	ring, err := crypt.LoadKeyring(cfg.WAL.Encryption.ActiveKeyID, keyFiles)
+	if err != nil {
+		return nil, fmt.Errorf("WAL encryption setup failed: %w", err)
+	}
+	return crypt.NewFormatter(format, ring), nil
+}
+
+// rotationPolicy returns the WAL rotation policy of cfg. With a growable
+// WAL, the file is rotated once it reaches max_file_size_kb.
+func rotationPolicy(cfg config.YAMLConfig) actor.RotationPolicy {
+	p := actor.RotationPolicy{
+		MaxEntries: cfg.WAL.Rotation.MaxEntries,
+		MaxAge:     time.Duration(cfg.WAL.Rotation.MaxAgeSec) * time.Second,
+	}
+	if cfg.WAL.Growable {
+		// types.WAL.Size does not count the header.
+		p.MaxSizeBytes = int64(cfg.WAL.MaxFileSizeKB*1024) - types.WALHeaderSize
+	}
+	return p
+}
+
+// snapshotPolicy returns the background snapshot policy of cfg.
+func snapshotPolicy(cfg config.YAMLConfig) actor.SnapshotPolicy {
+	return actor.SnapshotPolicy{
+		EveryNDraws: cfg.Snapshot.EveryNDraws,
+		Interval:    time.Duration(cfg.Snapshot.IntervalSec) * time.Second,
+	}
+}
+
+func closeAll(streamers []backgroundStreamer) {
+	for _, s := range streamers {
+		s.Close()
+	}
+}
+
+// drain reports NOT_SERVING, rejects new draws and waits up to
+// drainTimeoutSec for in-flight streams before closing them.
+func drain(service *rewardpool_grpc_service.RewardPoolService, grpcServer *grpc.Server, healthServer *health.Server, drainTimeoutSec int) {
+	rewardpool_grpc_service.SetServingStatus(healthServer, false)
+	service.Drain()
+
+	drainTimeout := defaultDrainTimeout
+	if drainTimeoutSec > 0 {
+		drainTimeout = time.Duration(drainTimeoutSec) * time.Second
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(drainTimeout):
+		log.Printf("drain timeout after %v, closing remaining streams", drainTimeout)
+		grpcServer.Stop()
+	}
+}
+
+func serviceOptional(cfg config.YAMLConfig, tp trace.TracerProvider) rewardpool_grpc_service.ServiceOptional {
+	return rewardpool_grpc_service.ServiceOptional{
+		MaxDrawCount:   cfg.GRPC.MaxDrawCount,
+		GlobalRate:     cfg.GRPC.RateLimit.GlobalRPS,
+		GlobalBurst:    cfg.GRPC.RateLimit.GlobalBurst,
+		PerClientRate:  cfg.GRPC.RateLimit.PerClientRPS,
+		PerClientBurst: cfg.GRPC.RateLimit.PerClientBurst,
+		TracerProvider: tp,
+	}
+}
+
+func logReload(result config.ReloadResult, err error) {
+	if err != nil {
+		log.Printf("config reload failed: %v", err)
+		return
+	}
+	log.Printf("config reloaded, %d item update(s)", len(result.Updates))
+	if len(result.RestartRequired) > 0 {
+		log.Printf("config changes that need a restart: %v", result.RestartRequired)
+	}
+}
+
+// setupOptional is set when a node is promoted to leader.
+type setupOptional struct {
+	// snapshot is the replicated state to start from instead of the local WAL.
+	snapshot     *types.PoolSnapshot
+	fencingToken uint64
+	fence        func() error
+	// streamers also receive the committed entries.
+	streamers []walstream.WALStreamer
+	// archiver uploads the finalized WAL files, and restores an empty
+	// working dir. Nil when the object store is disabled.
+	archiver *objectstore.Archiver
+	// manifest registers the WAL files.
+	manifest *wal.Manifest
+}
+
+// setup recovers the pool and starts the actor system.
+// walSizeKB is read each time a WAL file is created, so reloads can change it.
+// The returned streamer is nil unless the server is a replication primary or
+// an elected leader.
+func setup(cfg config.YAMLConfig, m *metrics.Metrics, walSizeKB *atomic.Int64, opt setupOptional) (*actor.System, *walstream.TCPStreamer, error) {
+	// Setup paths
+	baseDir := "."
+	tmpDir := baseDir + "/" + cfg.WorkingDir
+
+	// Create tmpDir if not exists
+	if _, err := os.Stat(tmpDir); os.IsNotExist(err) {
+		os.MkdirAll(tmpDir, 0755)
+	}
+
+	utils := utils.NewDefaultUtils(tmpDir, tmpDir, slog.LevelInfo, os.Stdout)
+	snapshotFormat, err := snapshot.ParseFormat(cfg.Snapshot.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+	utils.SetSnapshotName(snapshot.FileName(snapshotFormat))
+
+	walFormatter, err := newWALFormatter(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	streamOverflow, err := actor.ParseStreamOverflowPolicy(cfg.WAL.StreamOverflowPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Set when wal.encryption is enabled.
+	var keyring *crypt.Keyring
+	var keyID uint32
+	if f, ok := walFormatter.(*crypt.Formatter); ok {
+		keyring, keyID = f.Keyring(), f.Keyring().Active()
+	}
+	// Validated by newWALFormatter.
+	_, formatterID, _ := walformatter.ByName(cfg.WAL.Formatter)
+	codec, _ := compress.ParseCodec(cfg.WAL.Compression)
+
+	// Create a pool from the config
+	initialPool := rewardpool.CreatePoolFromConfig(cfg.Pool)
+
+	var pool *rewardpool.Pool
+	var lastRequestID uint64
+	var lastWalPath string
+	if opt.archiver != nil {
+		pool, lastRequestID, lastWalPath, err = recovery.RecoverPoolFromArchive(context.Background(), initialPool, walFormatter, utils, opt.archiver, tmpDir)
+	} else {
+		pool, lastRequestID, lastWalPath, err = recovery.RecoverPoolFromConfig(initialPool, walFormatter, utils)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("recovery failed: %w", err)
+	}
+	if opt.snapshot == nil && opt.fencingToken > 0 && lastWalPath != "" {
+		// Every leader takes a new token, so a WAL file with the same or a
+		// newer one was not written by a previous leader, e.g. the lease
+		// file was reset.
+		hdr, err := wal.ReadHeader(lastWalPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.FencingToken >= opt.fencingToken {
+			return nil, nil, fmt.Errorf("%w: %s has token %d, the lease %d", types.ErrStaleFencingToken, lastWalPath, hdr.FencingToken, opt.fencingToken)
+		}
+	}
+	if opt.snapshot != nil {
+		// Promoted follower: the replicated state is newer than the local WAL.
+		// A new WAL file starts with a snapshot of it.
+		pool = rewardpool.NewPool(opt.snapshot.Catalog)
+		lastRequestID = opt.snapshot.LastRequestID
+		lastWalPath = ""
+	}
+
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		fileStorage, err := walstorage.NewFileMMapStorage(path, seqNo, walstorage.FileMMapStorageOps{
+			MMapFileSizeInBytes: walSizeKB.Load() * 1024, // From KB to Bytes
+			FencingToken:        opt.fencingToken,
+			Growable:            cfg.WAL.Growable,
+			GrowChunkInBytes:    int64(cfg.WAL.GrowChunkKB * 1024),
+			KeyID:               keyID,
+			Codec:               codec,
+			FormatterID:         formatterID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating file storage: %w", err)
+		}
+		var store types.Storage = fileStorage
+		if opt.archiver != nil {
+			store = objectstore.NewStorage(fileStorage, path, opt.archiver)
+		}
+		return wal.NewWAL(path, seqNo, walFormatter, store, wal.WALOptional{Metrics: m, Manifest: opt.manifest})
+	}
+
+	if lastWalPath != "" {
+		// A WAL file is only continued with the header it would be created
+		// with, otherwise the next one starts with a snapshot.
+		hdr, err := wal.ReadHeader(lastWalPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Version != types.WALVersion2 || hdr.FormatterID != formatterID || hdr.KeyID != keyID || hdr.Codec != codec {
+			lastWalPath = ""
+		}
+	}
+
+	var seqNo uint64
+	if lastWalPath == "" {
+		lastWalPath, seqNo, err = utils.GenNextWALPath()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating new WAL path: %w", err)
+		}
+	} else if seqNo, err = wal.ParseSeqNo(lastWalPath); err != nil {
+		return nil, nil, err
+	}
+	w, err := walFactory(lastWalPath, seqNo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening WAL: %w", err)
+	}
+
+	ctx := &types.Context{
+		WAL:   w,
+		Utils: utils,
+	}
+
+	var walStreamer walstream.WALStreamer = walstream.NewNoOpStreamer()
+	var tcpStreamer *walstream.TCPStreamer
+	if cfg.Replication.Role == config.ReplicationRolePrimary || cfg.Election.Enabled {
+		// Nothing was drawn yet, so the pool state matches the end of the WAL files.
+		tcpStreamer = walstream.NewTCPStreamer(pool.State(), lastRequestID, walstream.TCPStreamerOptional{
+			BacklogSize: cfg.Replication.BacklogSize,
+			Utils:       utils,
+			Formatter:   walFormatter,
+			Logger:      utils.GetLogger(),
+		})
+		walStreamer = tcpStreamer
+	}
+	if len(opt.streamers) > 0 {
+		streamers := opt.streamers
+		if tcpStreamer != nil {
+			streamers = append([]walstream.WALStreamer{tcpStreamer}, streamers...)
+		}
+		walStreamer = walstream.NewMultiStreamer(streamers...)
+	}
+
+	sysOpt := &actor.SystemOptional{
+		FlushAfterNDraw:   cfg.WAL.FlushAfterNDraw,
+		RequestBufferSize: cfg.WAL.MaxRequestBuffer,
+		LastRequestID:     lastRequestID,
+		WALStreamer:       walStreamer,
+		WALFactory:        walFactory,
+		Metrics:           m,
+		Fence:             opt.fence,
+		StreamOverflow:    streamOverflow,
+		WALFormatter:      walFormatter,
+		RotationPolicy:    rotationPolicy(cfg),
+		SnapshotFormat:    snapshotFormat,
+		SnapshotPolicy:    snapshotPolicy(cfg),
+	}
+	if keyring != nil {
+		sysOpt.SnapshotSealer = keyring
+	}
+	sys, err := actor.NewSystem(ctx, pool, sysOpt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("system startup error: %w", err)
+	}
+	sys.SetRequestID(lastRequestID)
+
+	return sys, tcpStreamer, nil
+}
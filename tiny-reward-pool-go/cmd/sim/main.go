@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/sim"
+)
+
+// Simulation runner: runs the actor system under sim.Simulation with the
+// seeds -seed, -seed+1, ... and prints the first failure, with the last
+// events of its run. A failing seed is replayed with -seed <seed> -runs 1.
+func main() {
+	var (
+		seed     int64
+		runs     int
+		steps    int
+		parallel int
+		noFaults bool
+		events   int
+	)
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "seed of the first run")
+	flag.IntVar(&runs, "runs", 100, "number of runs")
+	flag.IntVar(&steps, "steps", 2000, "events per run")
+	flag.IntVar(&parallel, "parallel", runtime.GOMAXPROCS(0), "runs at the same time")
+	flag.BoolVar(&noFaults, "no-faults", false, "disable the storage faults and crashes")
+	flag.IntVar(&events, "events", 50, "events printed before a failure")
+	flag.Parse()
+
+	log.Printf("seeds %d to %d, %d steps", seed, seed+int64(runs)-1, steps)
+	start := time.Now()
+	var next, done atomic.Int64
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := next.Add(1) - 1
+				if i >= int64(runs) {
+					return
+				}
+				trace, err := run(seed+i, steps, noFaults)
+				if err != nil {
+					if failed.CompareAndSwap(false, true) {
+						for _, event := range trace[max(0, len(trace)-events):] {
+							fmt.Println(event)
+						}
+						log.Printf("FAIL: %v", err)
+					}
+					return
+				}
+				if n := done.Add(1); n%1000 == 0 {
+					log.Printf("%d runs", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		os.Exit(1)
+	}
+	log.Printf("%d runs passed in %v", done.Load(), time.Since(start).Round(time.Millisecond))
+}
+
+func run(seed int64, steps int, noFaults bool) ([]string, error) {
+	dir, err := os.MkdirTemp("", "sim")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := sim.NewSimulation(seed, dir, sim.SimulationOptional{NoFaults: noFaults})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	err = s.Run(steps)
+	return s.Trace(), err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+)
+
+// WAL maintenance commands:
+//
+//	walctl decrypt [-config config.yaml] [-key id=path] -o out <file>
+//	walctl genkey
+//
+// decrypt writes the plaintext of an encrypted WAL or snapshot file. The
+// keys come from wal.encryption of the server's config.yaml, or from -key.
+// genkey prints a new AES-256 key, hex encoded, for wal.encryption.keys.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "decrypt":
+		decrypt(os.Args[2:])
+	case "genkey":
+		genkey()
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: walctl decrypt [-config config.yaml] [-key id=path] -o out <file>")
+	fmt.Fprintln(os.Stderr, "       walctl genkey")
+	os.Exit(2)
+}
+
+// keyFlags collects the -key id=path flags.
+type keyFlags map[uint32]string
+
+func (k keyFlags) String() string {
+	return fmt.Sprint(map[uint32]string(k))
+}
+
+func (k keyFlags) Set(value string) error {
+	id, path, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected id=path, got %q", value)
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid key id %q: %w", id, err)
+	}
+	k[uint32(n)] = path
+	return nil
+}
+
+func decrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the server's config.yaml file")
+	out := fs.String("o", "", "output file")
+	keys := keyFlags{}
+	fs.Var(keys, "key", "key file as id=path, hex encoded (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *out == "" {
+		usage()
+	}
+
+	if *configPath != "" {
+		cfg, err := (&config.ConfigImpl{}).LoadYAML(*configPath)
+		if err != nil {
+			log.Fatalf("LoadConfig failed: %v", err)
+		}
+		for _, k := range cfg.WAL.Encryption.Keys {
+			if _, ok := keys[k.ID]; !ok {
+				keys[k.ID] = k.KeyFile
+			}
+		}
+	}
+	if len(keys) == 0 {
+		log.Fatal("no key: use -config or -key")
+	}
+	// Only opening frames, any key can be the active one.
+	ids := make([]uint32, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	ring, err := crypt.LoadKeyring(slices.Min(ids), keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	content, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	plain, err := crypt.DecryptFile(content, ring)
+	if err != nil {
+		log.Fatalf("failed to decrypt %s: %v", fs.Arg(0), err)
+	}
+	if err := os.WriteFile(*out, plain, 0600); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func genkey() {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(hex.EncodeToString(key))
+}
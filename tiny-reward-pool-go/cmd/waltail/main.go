@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// WAL tailer: follows the WAL files written by a running server and prints
+// every committed entry as a line of JSON on stdout.
+//
+// The WAL directory and formatter come from the server's config.yaml, or
+// from -dir and -formatter. Encrypted WAL files are read with the keys of
+// wal.encryption in the config. With -checkpoint, the position is saved after
+// every batch and a restarted tailer continues from it. It exits with an
+// error when a WAL file was removed before it was read.
+func main() {
+	var (
+		configPath     string
+		dir            string
+		formatterName  string
+		checkpointPath string
+		pollInterval   time.Duration
+		encryption     config.YAMLConfigEncryption
+	)
+	flag.StringVar(&configPath, "config", "", "path to the server's config.yaml file")
+	flag.StringVar(&dir, "dir", "", "WAL directory, overrides working_dir of the config")
+	flag.StringVar(&formatterName, "formatter", "", "WAL formatter (json or string_line), overrides wal.formatter of the config")
+	flag.StringVar(&checkpointPath, "checkpoint", "", "file keeping the position across restarts")
+	flag.DurationVar(&pollInterval, "poll", 100*time.Millisecond, "how often to check for new entries")
+	flag.Parse()
+
+	if configPath != "" {
+		cfg, err := (&config.ConfigImpl{}).LoadYAML(configPath)
+		if err != nil {
+			log.Fatalf("LoadConfig failed: %v", err)
+		}
+		if dir == "" {
+			dir = cfg.WorkingDir
+		}
+		if formatterName == "" {
+			formatterName = cfg.WAL.Formatter
+		}
+		encryption = cfg.WAL.Encryption
+	}
+	if dir == "" {
+		fmt.Println("Error: -config or -dir is required.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var format types.LogFormatter
+	switch formatterName {
+	case "", "json":
+		format = walformatter.NewJSONFormatter()
+	case "string_line":
+		format = walformatter.NewStringLineFormatter()
+	default:
+		log.Fatalf("unsupported WAL formatter: %s", formatterName)
+	}
+	// Reads the compressed batches whatever the codec.
+	format = compress.NewFormatter(format, types.WALCodecNone)
+	if encryption.Enabled {
+		keyFiles := make(map[uint32]string, len(encryption.Keys))
+		for _, k := range encryption.Keys {
+			keyFiles[k.ID] = k.KeyFile
+		}
+		ring, err := crypt.LoadKeyring(encryption.ActiveKeyID, keyFiles)
+		if err != nil {
+			log.Fatalf("WAL encryption setup failed: %v", err)
+		}
+		format = crypt.NewFormatter(format, ring)
+	}
+
+	tailer, err := walstream.NewTailer(dir, walstream.TailerOptional{
+		Formatter:      format,
+		CheckpointPath: checkpointPath,
+		PollInterval:   pollInterval,
+		Logger:         slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	})
+	if err != nil {
+		log.Fatalf("Tailer setup failed: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := tailer.Run(ctx, &printStreamer{enc: json.NewEncoder(os.Stdout)}); err != nil {
+		log.Fatalf("Tailer failed: %v", err)
+	}
+}
+
+// printStreamer writes every entry to stdout.
+type printStreamer struct {
+	enc *json.Encoder
+}
+
+func (s *printStreamer) Stream(log types.WalLogEntry) {
+	if err := s.enc.Encode(log); err != nil {
+		slog.Error("failed to write entry", "error", err)
+	}
+}
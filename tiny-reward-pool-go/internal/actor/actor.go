@@ -2,14 +2,32 @@ package actor
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// SnapshotSealer encrypts the snapshot files, e.g. a crypt.Keyring.
+type SnapshotSealer interface {
+	Seal(plain []byte) ([]byte, error)
+}
+
+// contextFlusher is implemented by WALs that can trace their flush steps.
+type contextFlusher interface {
+	FlushContext(ctx context.Context) error
+}
+
 // RewardProcessorActor encapsulates the state and behavior of the reward processing.
 // It is designed to be run in a single goroutine, processing messages from its mailbox.
 type RewardProcessorActor struct {
@@ -20,7 +38,46 @@ type RewardProcessorActor struct {
 	pendingLogs      []types.WalLogEntry
 	requestID        uint64
 	streamingChannel chan<- types.WalLogEntry
+	streamOverflow   *streamOverflow
 	walFactory       func(path string, seqNo uint64) (types.WAL, error)
+	metrics          *metrics.Metrics
+	drawRecorder     *metrics.DrawRecorder
+	fence            func() error
+	follower         bool
+
+	clock          Clock
+	rotation       RotationPolicy
+	snapshotSealer SnapshotSealer
+	snapshotFormat string
+	// walEntries and walOpenedAt describe the current WAL file for the
+	// rotation policy.
+	walEntries  int
+	walOpenedAt time.Time
+	// walGeneration is incremented when the WAL file changes.
+	walGeneration uint64
+	// updatesBase is the state of the pool before the updates staged in
+	// the pending logs, without the staged draws. Unlike draws, updates are
+	// applied when staged, a failed flush reverts them to it.
+	updatesBase []types.PoolReward
+	// walSnapshot is the snapshot entry the current WAL file starts with,
+	// until it is flushed, see rotateWAL.
+	walSnapshot *types.WalLogSnapshotItem
+
+	snapshotPolicy SnapshotPolicy
+	snapshotTicker Ticker
+	// drawsSinceSnapshot and lastSnapshotAt describe the last snapshot for
+	// the snapshot policy.
+	drawsSinceSnapshot int
+	lastSnapshotAt     time.Time
+	// bgSnapshot is the background snapshot in progress, nil when there is
+	// none. The worker posts a snapshotDoneMessage to the mailbox.
+	bgSnapshot *backgroundSnapshot
+	// spawn runs the worker of a background snapshot, on a new goroutine
+	// unless a Scheduler runs the actors.
+	spawn func(worker func())
+	// snapshotPath is the file of the last snapshot entry flushed, removed
+	// once the next one is.
+	snapshotPath string
 }
 
 // Init performs the initial setup for the actor, like creating an initial
@@ -40,7 +97,10 @@ func (a *RewardProcessorActor) Init() error {
 			return fmt.Errorf("failed to create initial snapshot: %w", err)
 		}
 		// The snapshot log is staged in the WAL's buffer, flush it to disk.
-		return a.ctx.WAL.Flush()
+		if err := a.ctx.WAL.Flush(); err != nil {
+			return err
+		}
+		a.snapshotsFlushed(a.pendingLogs)
 	}
 
 	return nil
@@ -57,6 +117,10 @@ func NewRewardProcessorActor(ctx *types.Context, pool types.RewardPool, mailboxS
 		requestID:        requestID,
 		streamingChannel: nil,
 		walFactory:       walFactory,
+		clock:            realClock{},
+		walOpenedAt:      time.Now(),
+		lastSnapshotAt:   time.Now(),
+		spawn:            func(worker func()) { go worker() },
 	}
 }
 
@@ -64,6 +128,60 @@ func (a *RewardProcessorActor) SetStreamChannel(streamingChannel chan<- types.Wa
 	a.streamingChannel = streamingChannel
 }
 
+// setStreamOverflow sets the policy applied when the streaming channel is
+// full. Without it, flush blocks until there is room.
+func (a *RewardProcessorActor) setStreamOverflow(o *streamOverflow) {
+	a.streamOverflow = o
+}
+
+// SetMetrics enables metrics collection. A nil value disables it.
+func (a *RewardProcessorActor) SetMetrics(m *metrics.Metrics) {
+	a.metrics = m
+	a.drawRecorder = m.NewDrawRecorder()
+}
+
+// SetFence sets a check run before every draw and WAL flush, e.g. that the
+// node still holds its leader lease. When it fails, the pending logs are
+// reverted and the actor stops accepting draws and updates.
+func (a *RewardProcessorActor) SetFence(fence func() error) {
+	a.fence = fence
+}
+
+// SetClock sets the clock of the rotation and snapshot policies. Nil is
+// the system clock.
+func (a *RewardProcessorActor) SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	a.clock = c
+	a.walOpenedAt = c.Now()
+	a.lastSnapshotAt = c.Now()
+	// Restarts the ticker on the clock.
+	a.setSnapshotPolicy(a.snapshotPolicy)
+}
+
+// SetRotationPolicy sets when the WAL is rotated before it is full.
+func (a *RewardProcessorActor) SetRotationPolicy(p RotationPolicy) {
+	a.rotation = p
+}
+
+// SetSnapshotSealer encrypts the snapshot files written from now on. Nil
+// writes them in clear.
+func (a *RewardProcessorActor) SetSnapshotSealer(s SnapshotSealer) {
+	a.snapshotSealer = s
+}
+
+// SetSnapshotFormat sets the format of the snapshot files written from now
+// on, see snapshot.ParseFormat. "" is JSON.
+func (a *RewardProcessorActor) SetSnapshotFormat(format string) {
+	a.snapshotFormat = format
+}
+
+// SetSnapshotPolicy sets when a snapshot is taken in the background.
+func (a *RewardProcessorActor) SetSnapshotPolicy(p SnapshotPolicy) {
+	a.setSnapshotPolicy(p)
+}
+
 // Receive starts the actor's message processing loop.
 // This method is expected to be called in its own goroutine.
 func (a *RewardProcessorActor) Receive(ctx context.Context) {
@@ -71,6 +189,8 @@ func (a *RewardProcessorActor) Receive(ctx context.Context) {
 		select {
 		case msg := <-a.mailbox:
 			a.handleMessage(msg)
+		case <-a.snapshotTick():
+			a.onSnapshotTick()
 		case <-ctx.Done():
 			// Context was cancelled, perform graceful shutdown.
 			a.shutdown()
@@ -80,6 +200,11 @@ func (a *RewardProcessorActor) Receive(ctx context.Context) {
 }
 
 func (a *RewardProcessorActor) handleMessage(msg interface{}) {
+	// Dropped before it uses a request ID or stock, its caller gave up.
+	if err := cancelled(msg); err != nil {
+		a.reject(msg, err)
+		return
+	}
 	switch m := msg.(type) {
 	case DrawMessage:
 		a.handleDraw(m)
@@ -92,6 +217,8 @@ func (a *RewardProcessorActor) handleMessage(msg interface{}) {
 		m.ResponseChan <- a.snapshot()
 	case UpdateMessage:
 		a.handleUpdate(m)
+	case UpdateCatalogMessage:
+		a.handleUpdateCatalog(m)
 	case StateMessage:
 		// This is a read-only operation, so it's safe to do directly.
 		// Note: In a more complex actor, even reads might be message-based
@@ -102,13 +229,81 @@ func (a *RewardProcessorActor) handleMessage(msg interface{}) {
 	case SetRequestIDMessage:
 		a.requestID = m.ID
 		close(m.ResponseChan)
+	case SetFlushAfterNDrawMessage:
+		if m.N > 0 {
+			a.flushAfterNDraw = m.N
+		}
+		// Apply the new threshold to the logs already staged.
+		if len(a.pendingLogs) >= a.flushAfterNDraw {
+			a.flush()
+		}
+		close(m.ResponseChan)
+	case SetRotationPolicyMessage:
+		a.rotation = m.Policy
+		close(m.ResponseChan)
+	case snapshotDoneMessage:
+		a.finishBackgroundSnapshot(m.err)
+	case SetSnapshotPolicyMessage:
+		a.setSnapshotPolicy(m.Policy)
+		close(m.ResponseChan)
+	case SetLeaderMessage:
+		if !m.Leader {
+			// Flush what was staged as leader, the fence decides if it is still allowed.
+			a.flush()
+		}
+		a.follower = !m.Leader
+		close(m.ResponseChan)
+	}
+}
+
+// checkLeader returns types.ErrNotLeader when the actor is a follower or its
+// fence fails.
+func (a *RewardProcessorActor) checkLeader() error {
+	if a.follower {
+		return types.ErrNotLeader
+	}
+	if a.fence != nil {
+		if err := a.fence(); err != nil {
+			a.follower = true
+			if logger := a.ctx.Utils.GetLogger(); logger != nil {
+				logger.Warn("[Actor] Fence check failed, rejecting draws and updates.", "error", err)
+			}
+			return types.ErrNotLeader
+		}
 	}
+	return nil
 }
 
 func (a *RewardProcessorActor) handleDraw(m DrawMessage) {
+	ctx := m.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tracer := tracing.Tracer(ctx)
+	if !m.EnqueuedAt.IsZero() {
+		_, waitSpan := tracer.Start(ctx, "actor.mailbox_wait", trace.WithTimestamp(m.EnqueuedAt))
+		waitSpan.End()
+	}
+	ctx, span := tracer.Start(ctx, "actor.draw")
+	defer span.End()
+
+	// Rejected before a request ID is used, the new leader continues the sequence.
+	if err := a.checkLeader(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		a.drawRecorder.Inc("", metrics.OutcomeError)
+		m.ResponseChan <- DrawResponse{Err: err}
+		return
+	}
+
 	a.requestID += 1
 	reqID := a.requestID
+	a.drawsSinceSnapshot++
+	span.SetAttributes(attribute.Int64("request_id", int64(reqID)))
+
+	_, selectSpan := tracer.Start(ctx, "pool.select")
 	item, err := a.pool.SelectItem(a.ctx)
+	selectSpan.SetAttributes(attribute.String("item_id", item))
+	selectSpan.End()
 	var walErr error
 
 	logItem := types.WalLogDrawItem{
@@ -123,11 +318,17 @@ func (a *RewardProcessorActor) handleDraw(m DrawMessage) {
 		logItem.Error = types.ErrorPoolEmpty
 	}
 
+	_, appendSpan := tracer.Start(ctx, "wal.append")
 	walErr = a.ctx.WAL.LogDraw(logItem)
+	appendSpan.End()
 	a.pendingLogs = append(a.pendingLogs, &logItem)
+	a.metrics.SetPendingLogs(len(a.pendingLogs))
 
 	if len(a.pendingLogs) >= a.flushAfterNDraw {
-		a.flush()
+		// The draw that triggered a failed flush was reverted with its batch.
+		if flushErr := a.flushCtx(ctx); flushErr != nil && walErr == nil {
+			walErr = flushErr
+		}
 	}
 
 	resp := DrawResponse{RequestID: reqID, Err: err}
@@ -137,36 +338,135 @@ func (a *RewardProcessorActor) handleDraw(m DrawMessage) {
 		resp.Err = walErr
 	}
 
+	if resp.Err != nil {
+		span.SetStatus(codes.Error, resp.Err.Error())
+	}
+
+	switch {
+	case resp.Err == nil:
+		a.drawRecorder.Inc(item, metrics.OutcomeSuccess)
+	case resp.Err == types.ErrEmptyRewardPool:
+		a.drawRecorder.Inc("", metrics.OutcomePoolEmpty)
+	default:
+		a.drawRecorder.Inc(item, metrics.OutcomeError)
+	}
+
 	m.ResponseChan <- resp
 }
 
 func (a *RewardProcessorActor) handleUpdate(m UpdateMessage) {
-	err := a.pool.UpdateItem(m.ItemID, m.Quantity, m.Probability)
-	if err != nil {
+	if err := a.checkLeader(); err != nil {
 		m.ResponseChan <- err
 		return
 	}
+	m.ResponseChan <- a.updateItem(m.ItemID, m.Quantity, m.Probability)
+}
+
+func (a *RewardProcessorActor) handleUpdateCatalog(m UpdateCatalogMessage) {
+	if err := a.checkLeader(); err != nil {
+		m.ResponseChan <- UpdateCatalogResponse{Err: err}
+		return
+	}
+	updates := m.Diff(a.pool.State())
+	applied := make([]types.PoolReward, 0, len(updates))
+	for _, u := range updates {
+		if err := a.updateItem(u.ItemID, u.Quantity, u.Probability); err != nil {
+			m.ResponseChan <- UpdateCatalogResponse{Updates: applied, Err: err}
+			return
+		}
+		applied = append(applied, u)
+	}
+	// Make the whole batch durable before reporting it as applied.
+	m.ResponseChan <- UpdateCatalogResponse{Updates: applied, Err: a.flush()}
+}
+
+// revertUpdates reverts the updates staged in the pending logs, once the
+// staged draws are reverted.
+func (a *RewardProcessorActor) revertUpdates() {
+	if a.updatesBase == nil {
+		return
+	}
+	a.pool.LoadSnapshot(&types.PoolSnapshot{LastRequestID: a.requestID, Catalog: a.updatesBase})
+	a.updatesBase = nil
+}
+
+// unstagedState returns the state of the pool without the draws staged in
+// the pending logs.
+func (a *RewardProcessorActor) unstagedState() []types.PoolReward {
+	state := a.pool.State()
+	index := make(map[string]int, len(state))
+	for i, item := range state {
+		index[item.ItemID] = i
+	}
+	for _, entry := range a.pendingLogs {
+		draw, ok := entry.(*types.WalLogDrawItem)
+		if !ok || !draw.Success {
+			continue
+		}
+		if i, ok := index[draw.ItemID]; ok && state[i].Quantity != types.UnlimitedQuantity {
+			state[i].Quantity++
+		}
+	}
+	return state
+}
+
+func (a *RewardProcessorActor) updateItem(itemID string, quantity int, probability int64) error {
+	if a.updatesBase == nil {
+		a.updatesBase = a.unstagedState()
+	}
+	err := a.pool.UpdateItem(itemID, quantity, probability)
+	if err != nil {
+		return err
+	}
 
 	logItem := types.WalLogUpdateItem{
 		WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeUpdate},
-		ItemID:          m.ItemID,
-		Quantity:        m.Quantity,
-		Probability:     m.Probability,
+		ItemID:          itemID,
+		Quantity:        quantity,
+		Probability:     probability,
 	}
 
 	walErr := a.ctx.WAL.LogUpdate(logItem)
 	if walErr == nil {
 		a.pendingLogs = append(a.pendingLogs, &logItem)
+		a.metrics.SetPendingLogs(len(a.pendingLogs))
+		a.metrics.IncUpdates()
 	}
-	m.ResponseChan <- walErr
+	return walErr
 }
 
 func (a *RewardProcessorActor) flush() error {
+	return a.flushCtx(context.Background())
+}
+
+// flushCtx flushes the pending logs. ctx only carries the trace of the
+// request that triggered the flush.
+func (a *RewardProcessorActor) flushCtx(ctx context.Context) error {
 	if len(a.pendingLogs) == 0 {
 		return nil
 	}
 
-	flushErr := a.ctx.WAL.Flush()
+	ctx, span := tracing.Tracer(ctx).Start(ctx, "wal.flush", trace.WithAttributes(attribute.Int("batch_size", len(a.pendingLogs))))
+	defer span.End()
+
+	a.streamOverflow.lock()
+	defer a.streamOverflow.unlock()
+
+	start := time.Now()
+	var flushErr error
+	if a.fence != nil && a.checkLeader() != nil {
+		// Never write or stream logs staged by a deposed leader.
+		flushErr = types.ErrNotLeader
+	} else if w, ok := a.ctx.WAL.(contextFlusher); ok {
+		flushErr = w.FlushContext(ctx)
+	} else {
+		flushErr = a.ctx.WAL.Flush()
+	}
+	a.metrics.ObserveFlush(time.Since(start))
+	if flushErr != nil {
+		span.SetStatus(codes.Error, flushErr.Error())
+	}
+	defer func() { a.metrics.SetPendingLogs(len(a.pendingLogs)) }()
 
 	if flushErr != nil {
 		if flushErr == types.ErrWALFull {
@@ -175,8 +475,10 @@ func (a *RewardProcessorActor) flush() error {
 
 		// Another flush error. Revert draws.
 		a.pool.RevertDraw()
+		a.revertUpdates()
 		a.pendingLogs = a.pendingLogs[:0]
 		a.ctx.WAL.Reset() // Clear the unflushed buffer
+		a.stageWALSnapshot()
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
 			logger.Error("[Actor] WAL Flush failed, reverting draws.", "error", flushErr)
 		}
@@ -185,6 +487,8 @@ func (a *RewardProcessorActor) flush() error {
 
 	// Flush was successful. Commit draws.
 	a.pool.CommitDraw()
+	a.updatesBase = nil
+	a.walSnapshot = nil
 
 	if logger := a.ctx.Utils.GetLogger(); logger != nil {
 		logger.Debug(fmt.Sprintf("[Actor] WAL Flush and Commit - %d logs", len(a.pendingLogs)))
@@ -192,15 +496,76 @@ func (a *RewardProcessorActor) flush() error {
 
 	// Stream the logs
 	if a.streamingChannel != nil {
-		for _, logEntry := range a.pendingLogs {
-			a.streamingChannel <- logEntry
-		}
+		a.stream(a.pendingLogs)
 	}
 
+	a.snapshotsFlushed(a.pendingLogs)
+	a.walEntries += len(a.pendingLogs)
 	a.pendingLogs = a.pendingLogs[:0]
+
+	if a.rotation.due(a.ctx.WAL, a.walEntries, a.walOpenedAt, a.clock.Now()) {
+		// The draws are committed, a failed rotation does not fail them.
+		if err := a.rotateWAL(); err != nil {
+			if logger := a.ctx.Utils.GetLogger(); logger != nil {
+				logger.Error("[Actor] WAL rotation failed.", "error", err)
+			}
+			return nil
+		}
+		a.snapshotsFlushed(a.pendingLogs)
+		if a.streamingChannel != nil {
+			a.stream(a.pendingLogs)
+		}
+		a.walEntries = len(a.pendingLogs)
+		a.pendingLogs = a.pendingLogs[:0]
+	}
+	a.maybeStartBackgroundSnapshot()
 	return nil
 }
 
+// stream hands the committed logs to the StreamingActor, applying the
+// overflow policy when its mailbox is full.
+func (a *RewardProcessorActor) stream(logs []types.WalLogEntry) {
+	o := a.streamOverflow
+	if o == nil || o.policy == StreamOverflowBlock {
+		for _, logEntry := range logs {
+			a.streamingChannel <- logEntry
+		}
+		return
+	}
+
+	if o.policy == StreamOverflowResume {
+		for _, logEntry := range logs {
+			o.committed.Advance(logEntry)
+		}
+	}
+	for _, logEntry := range logs {
+		if o.behind.Load() {
+			// The StreamingActor reads it from the WAL when it catches up.
+			return
+		}
+		select {
+		case a.streamingChannel <- logEntry:
+			o.position.Advance(logEntry)
+			continue
+		default:
+		}
+
+		if o.policy == StreamOverflowDrop {
+			o.dropped.Add(1)
+			a.metrics.IncStreamDropped()
+			continue
+		}
+		o.behind.Store(true)
+		select {
+		case o.signal <- struct{}{}:
+		default:
+		}
+		if logger := a.ctx.Utils.GetLogger(); logger != nil {
+			logger.Warn("[Actor] Streaming mailbox is full, the streamer will resume from the WAL.", "after_request_id", o.position.RequestID)
+		}
+	}
+}
+
 func (a *RewardProcessorActor) handleWALFull() error {
 	if logger := a.ctx.Utils.GetLogger(); logger != nil {
 		logger.Info("WAL is full. Reverting draws, rotating WAL, and re-applying logs.")
@@ -210,10 +575,53 @@ func (a *RewardProcessorActor) handleWALFull() error {
 	logsToReplay := make([]types.WalLogEntry, len(a.pendingLogs))
 	copy(logsToReplay, a.pendingLogs)
 	a.pool.RevertDraw()
+	// The snapshot of the new WAL must not hold the updates either.
+	a.revertUpdates()
 	a.pendingLogs = a.pendingLogs[:0]
 	a.ctx.WAL.Reset() // Clear the unflushed buffer in the WAL
 
-	// 2. Finalize the old WAL
+	// 2. Finalize the old WAL and start a new one from a snapshot
+	if err := a.rotateWAL(); err != nil {
+		return err
+	}
+
+	// 3. Re-apply and re-log the preserved operations. They are applied,
+	// not staged, so the pool is captured to revert them.
+	before, err := snapshot.Capture(a.pool, a.requestID)
+	if err != nil {
+		return err
+	}
+	a.replayAndRelog(logsToReplay)
+
+	// 4. Final flush attempt on the new WAL
+	if err := a.ctx.WAL.Flush(); err != nil {
+		if logger := a.ctx.Utils.GetLogger(); logger != nil {
+			logger.Error("CRITICAL: Flush failed even after WAL rotation. Data may be lost.", "error", err)
+		}
+		// The new WAL starts with the snapshot, revert the re-applied
+		// operations and report the error.
+		a.pool.LoadSnapshot(&types.PoolSnapshot{LastRequestID: before.LastRequestID, Catalog: before.Catalog.Items()})
+		a.pendingLogs = a.pendingLogs[:0]
+		a.ctx.WAL.Reset()
+		return err
+	}
+
+	// The snapshot and the re-applied logs are in the new WAL, stream them
+	// now so a later failed flush does not discard them.
+	a.snapshotsFlushed(a.pendingLogs)
+	if a.streamingChannel != nil {
+		a.stream(a.pendingLogs)
+	}
+	a.walEntries = len(a.pendingLogs)
+	a.pendingLogs = a.pendingLogs[:0]
+	return nil
+}
+
+// rotateWAL finalizes the current WAL and opens the next one, starting
+// with a flushed snapshot. The snapshot entry is left in the pending logs
+// to be streamed.
+func (a *RewardProcessorActor) rotateWAL() error {
+	// Finalize the old WAL
 	if err := a.ctx.WAL.Close(); err != nil {
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
 			logger.Error("Failed to finalize old WAL.", "error", err)
@@ -221,7 +629,7 @@ func (a *RewardProcessorActor) handleWALFull() error {
 		return err
 	}
 
-	// 3. Create a new WAL
+	// Create a new WAL
 	newPath, newSeqNo, err := a.ctx.Utils.GenNextWALPath()
 	if err != nil {
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
@@ -237,8 +645,11 @@ func (a *RewardProcessorActor) handleWALFull() error {
 		return err
 	}
 	a.ctx.WAL = newWAL
+	a.walOpenedAt = a.clock.Now()
+	a.walGeneration++
+	a.walSnapshot = nil
 
-	// 4. Create and log a snapshot to the new WAL
+	// Create and log a snapshot to the new WAL
 	if err := a.snapshot(); err != nil {
 		// Also a critical failure.
 		return err
@@ -248,27 +659,34 @@ func (a *RewardProcessorActor) handleWALFull() error {
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
 			logger.Error("CRITICAL: Could not flush snapshot to new WAL. State may be inconsistent.", "error", err)
 		}
-		return err
-	}
-
-	// 5. Re-apply and re-log the preserved operations
-	a.replayAndRelog(logsToReplay)
-
-	// 6. Final flush attempt on the new WAL
-	if err := a.ctx.WAL.Flush(); err != nil {
-		if logger := a.ctx.Utils.GetLogger(); logger != nil {
-			logger.Error("CRITICAL: Flush failed even after WAL rotation. Data may be lost.", "error", err)
+		// The new WAL must start with the snapshot: it is staged again, and
+		// written first by the next flush.
+		if n := len(a.pendingLogs); n > 0 {
+			if item, ok := a.pendingLogs[n-1].(types.WalLogSnapshotItem); ok {
+				a.walSnapshot = &item
+			}
 		}
-		// At this point, recovery is difficult. We've already rotated and snapshotted.
-		// The best we can do is revert the re-staged draws and report the error.
-		a.pool.RevertDraw()
 		a.pendingLogs = a.pendingLogs[:0]
+		a.ctx.WAL.Reset()
+		a.stageWALSnapshot()
 		return err
 	}
 
+	a.metrics.IncWALRotations()
 	return nil
 }
 
+// stageWALSnapshot stages again the snapshot entry of the current WAL
+// file, when its flush failed.
+func (a *RewardProcessorActor) stageWALSnapshot() {
+	if a.walSnapshot == nil {
+		return
+	}
+	if err := a.ctx.WAL.LogSnapshot(*a.walSnapshot); err == nil {
+		a.pendingLogs = append(a.pendingLogs, *a.walSnapshot)
+	}
+}
+
 func (a *RewardProcessorActor) replayAndRelog(logsToReplay []types.WalLogEntry) {
 	if logger := a.ctx.Utils.GetLogger(); logger != nil {
 		logger.Info("Replaying pending logs to the new WAL.", "count", len(logsToReplay))
@@ -290,16 +708,20 @@ func (a *RewardProcessorActor) replayAndRelog(logsToReplay []types.WalLogEntry)
 }
 
 func (a *RewardProcessorActor) snapshot() error {
-	snapshotPath := a.ctx.Utils.GenSnapshotPath()
-	if snapshotPath == nil {
+	base := a.ctx.Utils.GenSnapshotPath()
+	if base == nil {
 		return nil // Snapshotting is disabled
 	}
+	snapshotPath := a.snapshotFile(*base)
 
 	if logger := a.ctx.Utils.GetLogger(); logger != nil {
-		logger.Info("Creating snapshot.", "path", *snapshotPath)
+		logger.Info("Creating snapshot.", "path", snapshotPath)
 	}
+	start := time.Now()
+	defer func() { a.metrics.ObserveSnapshot(time.Since(start)) }()
 
-	snap, err := a.pool.CreateSnapshot()
+	// The actor is the owner of the request ID, so it sets it on the snapshot.
+	view, err := snapshot.Capture(a.pool, a.requestID)
 	if err != nil {
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
 			logger.Error("Failed to create snapshot data.", "error", err)
@@ -307,23 +729,16 @@ func (a *RewardProcessorActor) snapshot() error {
 		return err
 	}
 
-	// The actor is the owner of the request ID, so it sets it on the snapshot.
-	snap.LastRequestID = a.requestID
-
-	file, err := os.Create(*snapshotPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	enc := json.NewEncoder(file)
-	if err := enc.Encode(snap); err != nil {
+	if err := snapshot.Persist(view, snapshotPath, snapshot.PersistOptional{
+		Format: a.snapshotFormat,
+		Sealer: a.snapshotSealer,
+	}); err != nil {
 		return err
 	}
 
 	logItem := types.WalLogSnapshotItem{
 		WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot},
-		Path:            *snapshotPath,
+		Path:            snapshotPath,
 	}
 	if err := a.ctx.WAL.LogSnapshot(logItem); err != nil {
 		if logger := a.ctx.Utils.GetLogger(); logger != nil {
@@ -333,21 +748,65 @@ func (a *RewardProcessorActor) snapshot() error {
 	}
 
 	a.pendingLogs = append(a.pendingLogs, logItem)
+	a.drawsSinceSnapshot = 0
+	a.lastSnapshotAt = a.clock.Now()
 
 	return nil
 }
 
+// snapshotFile returns the file of a snapshot taken now, next to base:
+// snapshot.json becomes snapshot-<requestID>.json. It is never the file of
+// a snapshot entry in the WAL: a snapshot written before its entry is
+// flushed must not replace the one recovery loads after a crash.
+func (a *RewardProcessorActor) snapshotFile(base string) string {
+	ext := filepath.Ext(base)
+	name := fmt.Sprintf("%s-%d", strings.TrimSuffix(base, ext), a.requestID)
+	path := name + ext
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) && (a.bgSnapshot == nil || a.bgSnapshot.path != path) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d%s", name, n, ext)
+	}
+}
+
+// snapshotsFlushed records the snapshot entries of logs, just flushed, and
+// removes the file of the previous one: recovery loads the last one.
+func (a *RewardProcessorActor) snapshotsFlushed(logs []types.WalLogEntry) {
+	for _, entry := range logs {
+		item, ok := entry.(types.WalLogSnapshotItem)
+		if !ok || item.Path == a.snapshotPath {
+			continue
+		}
+		if a.snapshotPath != "" {
+			os.Remove(a.snapshotPath)
+		}
+		a.snapshotPath = item.Path
+	}
+}
+
 func (a *RewardProcessorActor) shutdown() {
 	if a.ctx.Utils.GetLogger() != nil {
 		a.ctx.Utils.GetLogger().Debug("[Actor] Shutdown")
 	}
 
+	// No new background snapshot. The one in progress is waited for, its
+	// worker posts to the mailbox before it is closed.
+	a.setSnapshotPolicy(SnapshotPolicy{})
+	for a.bgSnapshot != nil {
+		msg := <-a.mailbox
+		if done, ok := msg.(snapshotDoneMessage); ok {
+			// Logged with the last flush.
+			a.finishBackgroundSnapshot(done.err)
+			continue
+		}
+		a.reject(msg, types.ErrShutingDown)
+	}
+
 	// Drain mailbox and cancel pending requests
 	close(a.mailbox)
 	for msg := range a.mailbox {
-		if m, ok := msg.(DrawMessage); ok {
-			m.ResponseChan <- DrawResponse{Err: types.ErrShutingDown}
-		}
+		a.reject(msg, types.ErrShutingDown)
 	}
 
 	a.flush()
@@ -358,3 +817,46 @@ func (a *RewardProcessorActor) shutdown() {
 		close(a.streamingChannel)
 	}
 }
+
+// cancelled returns the error of the caller's context of msg once it is done.
+func cancelled(msg interface{}) error {
+	var ctx context.Context
+	switch m := msg.(type) {
+	case DrawMessage:
+		ctx = m.Ctx
+	case FlushMessage:
+		ctx = m.Ctx
+	case SnapshotMessage:
+		ctx = m.Ctx
+	case UpdateMessage:
+		ctx = m.Ctx
+	case UpdateCatalogMessage:
+		ctx = m.Ctx
+	}
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// reject answers msg with err instead of handling it. The state and request
+// ID are still answered. The setters are not, System fails them with
+// types.ErrShutingDown.
+func (a *RewardProcessorActor) reject(msg interface{}, err error) {
+	switch m := msg.(type) {
+	case DrawMessage:
+		m.ResponseChan <- DrawResponse{Err: err}
+	case StateMessage:
+		m.ResponseChan <- a.pool.State()
+	case GetRequestIDMessage:
+		m.ResponseChan <- a.requestID
+	case FlushMessage:
+		m.ResponseChan <- err
+	case SnapshotMessage:
+		m.ResponseChan <- err
+	case UpdateMessage:
+		m.ResponseChan <- err
+	case UpdateCatalogMessage:
+		m.ResponseChan <- UpdateCatalogResponse{Err: err}
+	}
+}
@@ -148,7 +148,8 @@ func TestSystem_InitialSnapshotOnEmptyWAL(t *testing.T) {
 				loggedSnapshot, ok := wal.loggedVal.(*types.WalLogSnapshotItem)
 				require.True(t, ok, "Logged item is not a snapshot")
 				assert.Equal(t, types.LogTypeSnapshot, loggedSnapshot.Type)
-				assert.Equal(t, snapshotPath, loggedSnapshot.Path)
+				// Named after the last request ID.
+				assert.Equal(t, filepath.Join(tmpDir, "test-0.snapshot"), loggedSnapshot.Path)
 			} else {
 				assert.Nil(t, wal.loggedVal, "Snapshot should not have been logged")
 			}
@@ -1,17 +1,29 @@
 package actor_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestSystem_TransactionalDraw(t *testing.T) {
@@ -151,6 +163,70 @@ func TestSystem_WALRotation_WithCustomFactory(t *testing.T) {
 	sys.Stop()
 }
 
+func TestSystem_RotationPolicy(t *testing.T) {
+	walDir := t.TempDir()
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 100, Probability: 1}}
+
+	var createdWALs []*mockWAL
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		w := &mockWAL{size: 10}
+		createdWALs = append(createdWALs, w)
+		return w, nil
+	}
+	initialWAL, err := walFactory("", 0)
+	require.NoError(t, err)
+
+	ctx := &types.Context{WAL: initialWAL, Utils: utils.NewDefaultUtils(walDir, "", 0, nil)}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		WALFactory:      walFactory,
+		RotationPolicy:  actor.RotationPolicy{MaxEntries: 3},
+	})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	for range 3 {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	// Rotated after the flush, without reverting the draws.
+	require.Len(t, createdWALs, 2)
+	assert.Equal(t, 3, pool.committed)
+	assert.Equal(t, 0, pool.reverted)
+
+	sys.SetRotationPolicy(actor.RotationPolicy{MaxSizeBytes: 10})
+	require.NoError(t, (<-sys.Draw()).Err)
+	assert.Len(t, createdWALs, 3)
+
+	sys.SetRotationPolicy(actor.RotationPolicy{})
+	for range 5 {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	assert.Len(t, createdWALs, 3)
+	assert.Equal(t, 0, pool.reverted)
+}
+
+func TestSystem_SnapshotSealer(t *testing.T) {
+	dir := t.TempDir()
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 100, Probability: 1}}
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: make([]byte, 32)})
+	require.NoError(t, err)
+
+	u := utils.NewDefaultUtils(dir, dir, 0, io.Discard)
+	ctx := &types.Context{WAL: &mockWAL{}, Utils: u}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{SnapshotSealer: ring})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	// Written by Init, the WAL is empty.
+	content, err := os.ReadFile(filepath.Join(dir, "snapshot-0.json"))
+	require.NoError(t, err)
+	require.True(t, crypt.IsEncrypted(content))
+	plain, err := ring.Open(content)
+	require.NoError(t, err)
+	var snap types.PoolSnapshot
+	require.NoError(t, json.Unmarshal(plain, &snap))
+}
+
 // Mocks
 type mockPool struct {
 	item      types.PoolReward
@@ -269,3 +345,393 @@ func TestSystem_UpdateItem(t *testing.T) {
 	assert.Equal(t, updatedQuantity, updateLog.Quantity)
 	assert.Equal(t, updatedProbability, updateLog.Probability)
 }
+
+// blockingFlushWAL blocks inside Flush until release is closed.
+type blockingFlushWAL struct {
+	mockWAL
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingFlushWAL) Flush() error {
+	select {
+	case m.started <- struct{}{}:
+	default:
+	}
+	<-m.release
+	return m.mockWAL.Flush()
+}
+
+func TestSystem_TryDrawBusy(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &blockingFlushWAL{
+		mockWAL: mockWAL{size: 10},
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1, RequestBufferSize: 1})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	// First draw gets the actor stuck in Flush
+	first, err := sys.TryDraw()
+	require.NoError(t, err)
+	<-wal.started
+
+	// Second draw fills the mailbox
+	second, err := sys.TryDraw()
+	require.NoError(t, err)
+
+	// Third draw is rejected instead of blocking
+	_, err = sys.TryDraw()
+	assert.ErrorIs(t, err, types.ErrSystemBusy)
+
+	close(wal.release)
+	assert.NoError(t, (<-first).Err)
+	assert.NoError(t, (<-second).Err)
+}
+
+func TestSystem_Metrics(t *testing.T) {
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 2, Probability: 1}})
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	m := metrics.NewMetrics()
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1, Metrics: m})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	for i := 0; i < 3; i++ {
+		<-sys.Draw()
+	}
+	require.NoError(t, sys.UpdateItem("gold", 5, 1))
+
+	expected := `
+# HELP rewardpool_draws_total Number of draws by item and outcome.
+# TYPE rewardpool_draws_total counter
+rewardpool_draws_total{item="",outcome="pool_empty"} 1
+rewardpool_draws_total{item="gold",outcome="success"} 2
+# HELP rewardpool_item_remaining_quantity Remaining quantity per item. -1 means unlimited.
+# TYPE rewardpool_item_remaining_quantity gauge
+rewardpool_item_remaining_quantity{item="gold"} 5
+# HELP rewardpool_pending_logs Number of logs staged in the actor and not yet flushed.
+# TYPE rewardpool_pending_logs gauge
+rewardpool_pending_logs 1
+# HELP rewardpool_updates_total Number of item updates.
+# TYPE rewardpool_updates_total counter
+rewardpool_updates_total 1
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected),
+		"rewardpool_draws_total", "rewardpool_item_remaining_quantity", "rewardpool_pending_logs", "rewardpool_updates_total"))
+}
+
+func TestSystem_DrawTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	reqCtx, root := tp.Tracer("test").Start(context.Background(), "root")
+	resp := <-sys.DrawCtx(reqCtx)
+	root.End()
+	require.NoError(t, resp.Err)
+
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range exporter.GetSpans().Snapshots() {
+		names[s.Name()] = s
+		assert.Equal(t, root.SpanContext().TraceID(), s.SpanContext().TraceID())
+	}
+	for _, name := range []string{"actor.mailbox_wait", "actor.draw", "pool.select", "wal.append", "wal.flush"} {
+		assert.Contains(t, names, name)
+	}
+	assert.Equal(t, names["actor.draw"].SpanContext().SpanID(), names["wal.flush"].Parent().SpanID())
+}
+
+func TestSystem_SetFlushAfterNDraw(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 100})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	<-sys.Draw()
+	<-sys.Draw()
+	assert.Equal(t, 0, wal.flushCount)
+
+	// Lowering the threshold flushes the staged draws right away
+	sys.SetFlushAfterNDraw(2)
+	assert.Equal(t, 1, wal.flushCount)
+
+	<-sys.Draw()
+	<-sys.Draw()
+	assert.Equal(t, 2, wal.flushCount)
+}
+
+func TestSystem_UpdateCatalog(t *testing.T) {
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 10, Probability: 1}})
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 100})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	<-sys.Draw()
+
+	var seen []types.PoolReward
+	updates, err := sys.UpdateCatalog(func(live []types.PoolReward) []types.PoolReward {
+		seen = live
+		return []types.PoolReward{
+			{ItemID: "gold", Quantity: live[0].Quantity, Probability: 5},
+			{ItemID: "silver", Quantity: 3, Probability: 2},
+		}
+	})
+	require.NoError(t, err)
+
+	// The diff saw the staged draw and the batch was flushed with it
+	assert.Equal(t, 9, seen[0].Quantity)
+	assert.Len(t, updates, 2)
+	assert.Equal(t, 1, wal.flushCount)
+	assert.Len(t, wal.logged, 3)
+	assert.Equal(t, 3, pool.GetItemRemaining("silver"))
+}
+
+func TestSystem_Fence(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	var leaseLost atomic.Bool
+	fence := func() error {
+		if leaseLost.Load() {
+			return errors.New("lease lost")
+		}
+		return nil
+	}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 100, Fence: fence})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	resp := <-sys.Draw()
+	require.NoError(t, resp.Err)
+	assert.Equal(t, uint64(1), resp.RequestID)
+
+	// The lease is lost: the staged draw is not flushed and new draws are rejected
+	leaseLost.Store(true)
+	assert.ErrorIs(t, sys.Flush(), types.ErrNotLeader)
+	assert.Equal(t, 0, wal.flushCount)
+	assert.Equal(t, 0, pool.committed)
+	assert.Equal(t, 1, pool.reverted)
+
+	resp = <-sys.Draw()
+	assert.ErrorIs(t, resp.Err, types.ErrNotLeader)
+	assert.ErrorIs(t, sys.UpdateItem("gold", 1, 1), types.ErrNotLeader)
+	assert.Equal(t, uint64(1), sys.GetRequestID())
+}
+
+func TestSystem_SetLeader(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 100})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	<-sys.Draw()
+
+	// Demoting flushes the staged draw, then rejects draws without using a request ID
+	sys.SetLeader(false)
+	assert.Equal(t, 1, wal.flushCount)
+	resp := <-sys.Draw()
+	assert.ErrorIs(t, resp.Err, types.ErrNotLeader)
+
+	sys.SetLeader(true)
+	resp = <-sys.Draw()
+	require.NoError(t, resp.Err)
+	assert.Equal(t, uint64(2), resp.RequestID)
+}
+
+// ackedStreamer acknowledges entries only when told to.
+type ackedStreamer struct {
+	acked atomic.Uint64
+}
+
+func (s *ackedStreamer) Stream(log types.WalLogEntry) {}
+
+func (s *ackedStreamer) LastAckedRequestID() uint64 { return s.acked.Load() }
+
+func TestSystem_StreamLag(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	streamer := &ackedStreamer{}
+	m := metrics.NewMetrics()
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1, WALStreamer: streamer, Metrics: m})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	for i := 0; i < 3; i++ {
+		<-sys.Draw()
+	}
+	streamer.acked.Store(1)
+
+	require.Eventually(t, func() bool {
+		lag, ok := sys.StreamLag()
+		return ok && lag.StreamedRequestID == 3
+	}, time.Second, time.Millisecond)
+	lag, _ := sys.StreamLag()
+	assert.Equal(t, uint64(1), lag.AckedRequestID)
+
+	expected := `
+# HELP rewardpool_stream_acked_request_id Request ID of the last draw acknowledged by the stream receiver.
+# TYPE rewardpool_stream_acked_request_id gauge
+rewardpool_stream_acked_request_id 1
+# HELP rewardpool_stream_lag_request_ids Number of draws streamed but not yet acknowledged by the stream receiver.
+# TYPE rewardpool_stream_lag_request_ids gauge
+rewardpool_stream_lag_request_ids 2
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected),
+		"rewardpool_stream_acked_request_id", "rewardpool_stream_lag_request_ids"))
+}
+
+func TestSystem_StopConcurrently(t *testing.T) {
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: types.UnlimitedQuantity, Probability: 1}})
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 5, RequestBufferSize: 4})
+	require.NoError(t, err)
+	assert.Equal(t, actor.LifecycleRunning, sys.Lifecycle())
+
+	calls := []func() error{
+		func() error { return (<-sys.Draw()).Err },
+		func() error {
+			if respChan, err := sys.TryDraw(); err != nil {
+				return err
+			} else {
+				return (<-respChan).Err
+			}
+		},
+		sys.Flush,
+		func() error { return sys.UpdateItem("gold", types.UnlimitedQuantity, 2) },
+		func() error { _, err := sys.StateCtx(context.Background()); return err },
+		func() error { _, err := sys.GetRequestIDCtx(context.Background()); return err },
+		func() error { return sys.SetFlushAfterNDrawCtx(context.Background(), 3) },
+	}
+
+	var wg sync.WaitGroup
+	var shutDown atomic.Int64
+	for _, call := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shutDown.Load() < 10 {
+				err := call()
+				if errors.Is(err, types.ErrShutingDown) {
+					shutDown.Add(1)
+				} else if err != nil && !errors.Is(err, types.ErrSystemBusy) {
+					assert.NoError(t, err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	sys.Stop()
+	wg.Wait()
+	sys.Stop()
+	assert.Equal(t, actor.LifecycleStopped, sys.Lifecycle())
+	assert.ErrorIs(t, (<-sys.Draw()).Err, types.ErrShutingDown)
+	assert.ErrorIs(t, sys.Flush(), types.ErrShutingDown)
+	assert.Nil(t, sys.State())
+}
+
+func TestSystem_StopAnswersQueuedRequests(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &blockingFlushWAL{
+		mockWAL: mockWAL{size: 10},
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1, RequestBufferSize: 2})
+	require.NoError(t, err)
+
+	// The actor is stuck in the flush of the first draw.
+	first := sys.Draw()
+	<-wal.started
+
+	// Queued requests.
+	errs := make(chan error, 2)
+	go func() { errs <- sys.Flush() }()
+	go func() { errs <- sys.SetFlushAfterNDrawCtx(context.Background(), 5) }()
+	require.Eventually(t, func() bool {
+		_, err := sys.TryDraw()
+		return errors.Is(err, types.ErrSystemBusy)
+	}, time.Second, time.Millisecond)
+
+	// The mailbox is full.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sys.FlushCtx(cancelled), context.Canceled)
+	assert.ErrorIs(t, (<-sys.DrawCtx(cancelled)).Err, context.Canceled)
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sys.StopCtx(deadline), context.DeadlineExceeded)
+	assert.Equal(t, actor.LifecycleDraining, sys.Lifecycle())
+	assert.ErrorIs(t, sys.UpdateItem("gold", 1, 1), types.ErrShutingDown)
+
+	close(wal.release)
+	require.NoError(t, sys.StopCtx(context.Background()))
+	assert.NoError(t, (<-first).Err)
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err != nil {
+			assert.ErrorIs(t, err, types.ErrShutingDown)
+		}
+	}
+}
+
+func TestSystem_CancelledRequestsAreDropped(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &blockingFlushWAL{
+		mockWAL: mockWAL{size: 10},
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1})
+	require.NoError(t, err)
+	defer sys.Stop()
+
+	// The actor is stuck in the flush of the first draw.
+	first := sys.Draw()
+	<-wal.started
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	queued := sys.DrawCtx(reqCtx)
+	updated := make(chan error, 1)
+	go func() { updated <- sys.UpdateItemCtx(reqCtx, "gold", 100, 1) }()
+	cancel()
+	assert.ErrorIs(t, <-updated, context.Canceled)
+	next := sys.Draw()
+	close(wal.release)
+
+	assert.Equal(t, uint64(1), (<-first).RequestID)
+	resp := <-queued
+	assert.ErrorIs(t, resp.Err, context.Canceled)
+	assert.Zero(t, resp.RequestID)
+	assert.Equal(t, uint64(2), (<-next).RequestID)
+
+	// Neither the request ID, the stock nor the update were used.
+	require.NoError(t, sys.Flush())
+	assert.Equal(t, uint64(2), sys.GetRequestID())
+	assert.Equal(t, 2, pool.committed)
+	assert.Equal(t, 8, sys.State()[0].Quantity)
+}
@@ -0,0 +1,168 @@
+package actor
+
+import (
+	"os"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// SnapshotPolicy takes a snapshot in the background once enough draws or
+// time passed since the last one, to shorten the replay on recovery. It is
+// checked after each flush, and every Interval.
+// Zero fields are disabled.
+type SnapshotPolicy struct {
+	// EveryNDraws counts the draws since the last snapshot.
+	EveryNDraws int
+	// Interval only takes a snapshot when there was a draw since the last
+	// one.
+	Interval time.Duration
+}
+
+// due reports whether a snapshot must be taken at now, draws draws after
+// the last one, taken at lastAt.
+func (p SnapshotPolicy) due(draws int, lastAt, now time.Time) bool {
+	if draws == 0 {
+		return false
+	}
+	if p.EveryNDraws > 0 && draws >= p.EveryNDraws {
+		return true
+	}
+	return p.Interval > 0 && now.Sub(lastAt) >= p.Interval
+}
+
+// backgroundSnapshot is a snapshot being persisted by the worker goroutine.
+type backgroundSnapshot struct {
+	path string
+	// walGeneration and walEntries locate the capture in the WAL, see
+	// finishBackgroundSnapshot.
+	walGeneration uint64
+	walEntries    int
+}
+
+// setSnapshotPolicy applies p and restarts the ticker checking its Interval.
+func (a *RewardProcessorActor) setSnapshotPolicy(p SnapshotPolicy) {
+	a.snapshotPolicy = p
+	if a.snapshotTicker != nil {
+		a.snapshotTicker.Stop()
+		a.snapshotTicker = nil
+	}
+	if p.Interval > 0 {
+		a.snapshotTicker = a.clock.NewTicker(p.Interval)
+	}
+}
+
+// snapshotTick returns the channel of the Interval ticker, nil when it is
+// disabled.
+func (a *RewardProcessorActor) snapshotTick() <-chan time.Time {
+	if a.snapshotTicker == nil {
+		return nil
+	}
+	return a.snapshotTicker.C()
+}
+
+// onSnapshotTick flushes the pending logs, so the pool has no pending
+// draws, and starts a background snapshot when the policy is due.
+func (a *RewardProcessorActor) onSnapshotTick() {
+	if a.bgSnapshot != nil || !a.snapshotPolicy.due(a.drawsSinceSnapshot, a.lastSnapshotAt, a.clock.Now()) {
+		return
+	}
+	if err := a.flush(); err != nil {
+		return
+	}
+	a.maybeStartBackgroundSnapshot()
+}
+
+// maybeStartBackgroundSnapshot starts a background snapshot when the policy
+// is due. It must be called at a flush boundary: no pending logs and no
+// pending draws.
+func (a *RewardProcessorActor) maybeStartBackgroundSnapshot() {
+	if a.bgSnapshot != nil || len(a.pendingLogs) > 0 || !a.snapshotPolicy.due(a.drawsSinceSnapshot, a.lastSnapshotAt, a.clock.Now()) {
+		return
+	}
+	base := a.ctx.Utils.GenSnapshotPath()
+	if base == nil {
+		return // Snapshotting is disabled
+	}
+
+	// Only the copy of the catalog is done on the actor goroutine.
+	view, err := snapshot.Capture(a.pool, a.requestID)
+	if err != nil {
+		if logger := a.ctx.Utils.GetLogger(); logger != nil {
+			logger.Error("Failed to capture background snapshot.", "error", err)
+		}
+		return
+	}
+	job := &backgroundSnapshot{
+		path:          a.snapshotFile(*base),
+		walGeneration: a.walGeneration,
+		walEntries:    a.walEntries,
+	}
+	a.bgSnapshot = job
+	a.drawsSinceSnapshot = 0
+	a.lastSnapshotAt = a.clock.Now()
+
+	opt := snapshot.PersistOptional{Format: a.snapshotFormat, Sealer: a.snapshotSealer}
+	m := a.metrics
+	a.spawn(func() {
+		start := time.Now()
+		err := snapshot.Persist(view, job.path, opt)
+		m.ObserveSnapshot(time.Since(start))
+		a.mailbox <- snapshotDoneMessage{err: err}
+	})
+}
+
+// finishBackgroundSnapshot logs the snapshot persisted by the worker, and
+// flushes it. The entries written since the capture are before it in the
+// WAL, so the entry records them as Behind, and recovery replays them.
+//
+// The snapshot is dropped when the WAL file changed since the capture: the
+// new file starts with its own snapshot.
+func (a *RewardProcessorActor) finishBackgroundSnapshot(err error) {
+	job := a.bgSnapshot
+	a.bgSnapshot = nil
+	logger := a.ctx.Utils.GetLogger()
+	if err != nil {
+		if logger != nil {
+			logger.Error("Failed to persist background snapshot.", "path", job.path, "error", err)
+		}
+		return
+	}
+	if job.walGeneration != a.walGeneration {
+		os.Remove(job.path)
+		return
+	}
+
+	logItem := types.WalLogSnapshotItem{
+		WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot},
+		Path:            job.path,
+		Behind:          a.walEntries + len(a.pendingLogs) - job.walEntries,
+	}
+	if err := a.ctx.WAL.LogSnapshot(logItem); err != nil {
+		if logger != nil {
+			logger.Error("Failed to log snapshot to WAL.", "error", err)
+		}
+		os.Remove(job.path)
+		return
+	}
+	a.pendingLogs = append(a.pendingLogs, logItem)
+
+	// Flushed now rather than with the next batch. A failed flush reverts
+	// the entry, a full WAL is rotated and the entry dropped: the new file
+	// starts with its own snapshot.
+	generation := a.walGeneration
+	if err := a.flush(); err != nil {
+		os.Remove(job.path)
+		return
+	}
+	if a.walGeneration != generation && a.snapshotPath != job.path {
+		// Rotated by the flush: the entry was dropped with the full file, or
+		// flushed then replaced by the snapshot of the new file.
+		os.Remove(job.path)
+		return
+	}
+	if logger != nil {
+		logger.Info("Background snapshot logged.", "path", job.path, "behind", logItem.Behind)
+	}
+}
@@ -0,0 +1,197 @@
+package actor_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+// newFileWALSystem starts a System on a JSON WAL file in dir, with the
+// snapshots in dir too.
+func newFileWALSystem(t *testing.T, dir string, pool types.RewardPool, opt actor.SystemOptional) (*actor.System, *utils.DefaultUtils) {
+	u := utils.NewDefaultUtils(dir, dir, 0, io.Discard)
+	u.SetSnapshotName(snapshot.FileName(opt.SnapshotFormat))
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	w, err := wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), nil)
+	require.NoError(t, err)
+	opt.WALFactory = func(path string, seqNo uint64) (types.WAL, error) {
+		return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), nil)
+	}
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &opt)
+	require.NoError(t, err)
+	return sys, u
+}
+
+// snapshotEntries returns the snapshot entries of the WAL files of dir.
+func snapshotEntries(t *testing.T, u *utils.DefaultUtils) []*types.WalLogSnapshotItem {
+	files, err := u.GetWALFiles()
+	require.NoError(t, err)
+	var items []*types.WalLogSnapshotItem
+	for _, f := range files {
+		entries, _, err := wal.ReadWAL(f, formatter.NewJSONFormatter())
+		require.NoError(t, err)
+		for _, e := range entries {
+			if s, ok := e.(*types.WalLogSnapshotItem); ok {
+				items = append(items, s)
+			}
+		}
+	}
+	return items
+}
+
+func TestSystem_BackgroundSnapshotEveryNDraws(t *testing.T) {
+	dir := t.TempDir()
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}})
+	sys, u := newFileWALSystem(t, dir, pool, actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		SnapshotFormat:  snapshot.FormatBinary,
+		SnapshotPolicy:  actor.SnapshotPolicy{EveryNDraws: 10},
+	})
+
+	for n := 2; n <= 3; n++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, (<-sys.Draw()).Err)
+		}
+		// Logged by the actor once the worker has written it.
+		require.Eventually(t, func() bool {
+			return len(snapshotEntries(t, u)) == n
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	// The one started by the 30th draw is waited for and logged.
+	sys.Stop()
+
+	entries := snapshotEntries(t, u)
+	require.Len(t, entries, 4)
+	assert.Equal(t, filepath.Join(dir, "snapshot-0.bin"), entries[0].Path)
+	assert.Equal(t, filepath.Join(dir, "snapshot-10.bin"), entries[1].Path)
+	assert.Equal(t, filepath.Join(dir, "snapshot-20.bin"), entries[2].Path)
+	assert.Equal(t, filepath.Join(dir, "snapshot-30.bin"), entries[3].Path)
+	// A snapshot is removed once the next one is logged.
+	for _, e := range entries[:3] {
+		_, err := os.Stat(e.Path)
+		assert.True(t, os.IsNotExist(err), e.Path)
+	}
+
+	recovered, lastRequestID, _, err := recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), formatter.NewJSONFormatter(), u)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(30), lastRequestID)
+	assert.Equal(t, 970, recovered.GetItemRemaining("gold"))
+}
+
+func TestSystem_BackgroundSnapshotDrawsWhilePersisting(t *testing.T) {
+	dir := t.TempDir()
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 10000, Probability: 1}})
+	sys, u := newFileWALSystem(t, dir, pool, actor.SystemOptional{
+		FlushAfterNDraw: 4,
+		SnapshotPolicy:  actor.SnapshotPolicy{EveryNDraws: 50},
+	})
+
+	// Draws keep coming while the snapshots are written, the ones logged
+	// in between are replayed on recovery.
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	sys.Stop()
+	assert.Greater(t, len(snapshotEntries(t, u)), 1)
+
+	recovered, lastRequestID, _, err := recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), formatter.NewJSONFormatter(), u)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000), lastRequestID)
+	assert.Equal(t, 9000, recovered.GetItemRemaining("gold"))
+}
+
+func TestSystem_BackgroundSnapshotInterval(t *testing.T) {
+	dir := t.TempDir()
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 100, Probability: 1}})
+	sys, u := newFileWALSystem(t, dir, pool, actor.SystemOptional{
+		// Not flushed by the draws, the tick flushes them first.
+		FlushAfterNDraw: 100,
+	})
+	defer sys.Stop()
+
+	sys.SetSnapshotPolicy(actor.SnapshotPolicy{Interval: 20 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+	// Nothing was drawn since the initial snapshot.
+	require.Len(t, snapshotEntries(t, u), 1)
+
+	require.NoError(t, (<-sys.Draw()).Err)
+	require.Eventually(t, func() bool {
+		return len(snapshotEntries(t, u)) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, filepath.Join(dir, "snapshot-1.json"), snapshotEntries(t, u)[1].Path)
+}
+
+// fullOnSnapshotWAL reports the WAL full when a snapshot entry is flushed,
+// once armed.
+type fullOnSnapshotWAL struct {
+	types.WAL
+	armed    atomic.Bool
+	snapshot bool
+}
+
+func (w *fullOnSnapshotWAL) LogSnapshot(item types.WalLogSnapshotItem) error {
+	w.snapshot = w.armed.Load()
+	return w.WAL.LogSnapshot(item)
+}
+
+func (w *fullOnSnapshotWAL) Flush() error {
+	if w.snapshot && w.armed.CompareAndSwap(true, false) {
+		return types.ErrWALFull
+	}
+	return w.WAL.Flush()
+}
+
+func TestSystem_BackgroundSnapshotDroppedByFullWAL(t *testing.T) {
+	dir := t.TempDir()
+	u := utils.NewDefaultUtils(dir, dir, 0, io.Discard)
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	inner, err := wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), nil)
+	require.NoError(t, err)
+	w := &fullOnSnapshotWAL{WAL: inner}
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}})
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		SnapshotPolicy:  actor.SnapshotPolicy{EveryNDraws: 10},
+		WALFactory: func(path string, seqNo uint64) (types.WAL, error) {
+			return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), nil)
+		},
+	})
+	require.NoError(t, err)
+	w.armed.Store(true)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	// The flush of the background snapshot entry rotates the WAL.
+	require.Eventually(t, func() bool {
+		files, err := u.GetWALFiles()
+		require.NoError(t, err)
+		return len(files) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	sys.Stop()
+
+	// Only the snapshot of the new file is left.
+	entries := snapshotEntries(t, u)
+	files, err := filepath.Glob(filepath.Join(dir, "snapshot-*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{entries[len(entries)-1].Path}, files)
+}
@@ -0,0 +1,32 @@
+package actor
+
+import (
+	"time"
+)
+
+// Clock tells the actor the time of its rotation and snapshot policies, and
+// ticks the Interval of the SnapshotPolicy.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a Ticker sending the time every d, dropping the
+	// ticks its reader misses like time.Ticker.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -1,10 +1,21 @@
 package actor
 
-import "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+import (
+	"context"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
 
 // DrawMessage is sent to the actor to request a reward draw.
 type DrawMessage struct {
 	ResponseChan chan DrawResponse
+	// Ctx carries the caller's trace context. Nil means context.Background().
+	// The draw is dropped if Ctx is done before the actor gets to it.
+	Ctx context.Context
+	// EnqueuedAt is the time the message was put in the mailbox.
+	// It is used to record the mailbox wait span.
+	EnqueuedAt time.Time
 }
 
 // DrawResponse is the response sent back for a DrawMessage.
@@ -22,11 +33,17 @@ type StopMessage struct {
 // FlushMessage is sent to the actor to manually trigger a WAL flush.
 type FlushMessage struct {
 	ResponseChan chan error
+	// Ctx is the caller's context. The message is dropped if it is done
+	// before the actor gets to it. Nil means context.Background().
+	Ctx context.Context
 }
 
 // SnapshotMessage is sent to the actor to manually trigger a snapshot.
 type SnapshotMessage struct {
 	ResponseChan chan error
+	// Ctx is the caller's context. The message is dropped if it is done
+	// before the actor gets to it. Nil means context.Background().
+	Ctx context.Context
 }
 
 // StateMessage is sent to the actor to request the current pool state.
@@ -40,6 +57,26 @@ type UpdateMessage struct {
 	Quantity     int
 	Probability  int64
 	ResponseChan chan error
+	// Ctx is the caller's context. The message is dropped if it is done
+	// before the actor gets to it. Nil means context.Background().
+	Ctx context.Context
+}
+
+// UpdateCatalogMessage is sent to the actor to apply a batch of item updates.
+// Diff runs on the actor goroutine with the live state, so no draw can
+// happen between reading the state and applying the updates it returns.
+type UpdateCatalogMessage struct {
+	Diff         func(live []types.PoolReward) []types.PoolReward
+	ResponseChan chan UpdateCatalogResponse
+	// Ctx is the caller's context. The message is dropped if it is done
+	// before the actor gets to it. Nil means context.Background().
+	Ctx context.Context
+}
+
+// UpdateCatalogResponse contains the updates that were applied.
+type UpdateCatalogResponse struct {
+	Updates []types.PoolReward
+	Err     error
 }
 
 // GetRequestIDMessage is sent to the actor to get the current request ID.
@@ -52,3 +89,36 @@ type SetRequestIDMessage struct {
 	ID           uint64
 	ResponseChan chan struct{}
 }
+
+// SetFlushAfterNDrawMessage is sent to the actor to change how many logs are
+// buffered before an automatic flush.
+type SetFlushAfterNDrawMessage struct {
+	N            int
+	ResponseChan chan struct{}
+}
+
+// SetRotationPolicyMessage is sent to the actor to change when the WAL is
+// rotated before it is full.
+type SetRotationPolicyMessage struct {
+	Policy       RotationPolicy
+	ResponseChan chan struct{}
+}
+
+// SetSnapshotPolicyMessage is sent to the actor to change when a snapshot
+// is taken in the background.
+type SetSnapshotPolicyMessage struct {
+	Policy       SnapshotPolicy
+	ResponseChan chan struct{}
+}
+
+// snapshotDoneMessage is posted by the worker of a background snapshot once
+// it persisted the snapshot, or failed to.
+type snapshotDoneMessage struct {
+	err error
+}
+
+// SetLeaderMessage is sent to the actor to accept or reject draws and updates.
+type SetLeaderMessage struct {
+	Leader       bool
+	ResponseChan chan struct{}
+}
@@ -0,0 +1,38 @@
+package actor
+
+import (
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// RotationPolicy rotates the WAL after a successful flush, once the current
+// file reaches one of its limits. Unlike a full WAL, nothing has to be
+// reverted and replayed: the new file only starts with a snapshot.
+// Zero fields are disabled.
+type RotationPolicy struct {
+	// MaxSizeBytes is compared with types.WAL.Size. It pairs with a
+	// growable storage, which accepts writes up to a soft limit.
+	MaxSizeBytes int64
+	// MaxEntries counts the entries written since the file was opened.
+	MaxEntries int
+	// MaxAge is checked on flush, an idle file is rotated by the first
+	// flush after it.
+	MaxAge time.Duration
+}
+
+// due reports whether w, opened at openedAt with entries written since,
+// must be rotated at now.
+func (p RotationPolicy) due(w types.WAL, entries int, openedAt, now time.Time) bool {
+	if p.MaxEntries > 0 && entries >= p.MaxEntries {
+		return true
+	}
+	if p.MaxAge > 0 && now.Sub(openedAt) >= p.MaxAge {
+		return true
+	}
+	if p.MaxSizeBytes > 0 {
+		size, err := w.Size()
+		return err == nil && size >= p.MaxSizeBytes
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package actor
+
+import (
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// Scheduler runs the actors of a System one event at a time, on the
+// goroutine of its caller, instead of their own goroutines. It lets a
+// simulation pick the order of the events, see internal/sim.
+//
+// The requests still go through the System API: they wait in the mailbox
+// until Deliver hands them to the actor. The background snapshot workers
+// wait until RunWorker, which posts their result to the mailbox. The ticks
+// of the snapshot ticker, from the Clock of the System, wait until Tick.
+// Stop runs the waiting workers, the shutdown and the streaming of the last
+// logs.
+//
+// A Scheduler serves a single System. Its methods must not be called
+// concurrently, nor once Stop was called.
+type Scheduler struct {
+	processor *RewardProcessorActor
+	streamer  *StreamingActor
+	workers   []func()
+}
+
+// NewScheduler returns a Scheduler for SystemOptional.Scheduler.
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// bind is called by NewSystem with the actors of the System.
+func (s *Scheduler) bind(processor *RewardProcessorActor, streamer *StreamingActor) {
+	s.processor = processor
+	s.streamer = streamer
+	processor.spawn = func(worker func()) {
+		s.workers = append(s.workers, worker)
+	}
+}
+
+// Pending returns the number of messages waiting in the mailbox.
+func (s *Scheduler) Pending() int {
+	return len(s.processor.mailbox)
+}
+
+// Deliver hands the next message of the mailbox to the actor. It reports
+// whether it was a request of the System API, rather than the result of a
+// background snapshot worker.
+func (s *Scheduler) Deliver() bool {
+	msg := <-s.processor.mailbox
+	s.processor.handleMessage(msg)
+	_, done := msg.(snapshotDoneMessage)
+	return !done
+}
+
+// PendingStream returns the number of committed logs waiting to be
+// streamed, 0 without a WALStreamer.
+func (s *Scheduler) PendingStream() int {
+	if s.streamer == nil {
+		return 0
+	}
+	return len(s.streamer.mailbox)
+}
+
+// Stream hands the next committed log to the WALStreamer.
+func (s *Scheduler) Stream() {
+	s.streamer.stream(<-s.streamer.mailbox)
+}
+
+// Workers returns the number of background snapshot workers waiting.
+func (s *Scheduler) Workers() int {
+	return len(s.workers)
+}
+
+// RunWorker runs the next background snapshot worker.
+func (s *Scheduler) RunWorker() {
+	worker := s.workers[0]
+	s.workers = s.workers[1:]
+	worker()
+}
+
+// PendingTicks returns the number of ticks of the snapshot ticker waiting,
+// at most 1 as it drops the ticks it misses.
+func (s *Scheduler) PendingTicks() int {
+	return len(s.processor.snapshotTick())
+}
+
+// Tick hands the next tick of the snapshot ticker to the actor.
+func (s *Scheduler) Tick() {
+	<-s.processor.snapshotTick()
+	s.processor.onSnapshotTick()
+}
+
+// Idle reports whether every log was flushed and streamed.
+func (s *Scheduler) Idle() bool {
+	return len(s.processor.pendingLogs) == 0 && s.PendingStream() == 0
+}
+
+// State returns the state of the pool, without going through the mailbox.
+func (s *Scheduler) State() []types.PoolReward {
+	return s.processor.pool.State()
+}
+
+// shutdown stops the actors once the System is draining.
+func (s *Scheduler) shutdown() {
+	// The shutdown waits for the background snapshot in progress.
+	for len(s.workers) > 0 {
+		s.RunWorker()
+	}
+	s.processor.shutdown()
+	if s.streamer != nil {
+		// The processor closed the mailbox after its last flush.
+		for logEntry := range s.streamer.mailbox {
+			s.streamer.stream(logEntry)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package actor_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/sim"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+)
+
+func TestScheduler_Deliver(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	ctx := &types.Context{WAL: &mockWAL{size: 10}, Utils: &utils.MockUtils{}}
+	streamer := newStuckStreamer()
+	close(streamer.release)
+	sched := actor.NewScheduler()
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{
+		FlushAfterNDraw: 2,
+		WALStreamer:     streamer,
+		Scheduler:       sched,
+	})
+	require.NoError(t, err)
+
+	// The draws wait in the mailbox until delivered.
+	first, second, third := sys.Draw(), sys.Draw(), sys.Draw()
+	assert.Equal(t, 3, sched.Pending())
+	assert.Empty(t, first)
+
+	sched.Deliver()
+	assert.Equal(t, uint64(1), (<-first).RequestID)
+	assert.False(t, sched.Idle())
+	sched.Deliver()
+	assert.Equal(t, uint64(2), (<-second).RequestID)
+	// Flushed, the logs wait for the streamer.
+	assert.Equal(t, 2, sched.PendingStream())
+	sched.Stream()
+	sched.Stream()
+	assert.True(t, sched.Idle())
+	assert.Len(t, streamer.streamed(), 2)
+
+	// Stop answers the request left in the mailbox.
+	sys.Stop()
+	assert.ErrorIs(t, (<-third).Err, types.ErrShutingDown)
+	assert.Len(t, streamer.streamed(), 2)
+}
+
+func TestSystem_DrainingRejectsQueuedRequests(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 10, Probability: 1}}
+	wal := &mockWAL{size: 10}
+	ctx := &types.Context{WAL: wal, Utils: &utils.MockUtils{}}
+	sched := actor.NewScheduler()
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 1, Scheduler: sched})
+	require.NoError(t, err)
+
+	first, second := sys.Draw(), sys.Draw()
+	updated := make(chan error, 1)
+	go func() { updated <- sys.UpdateItem("gold", 5, 1) }()
+	require.Eventually(t, func() bool { return sched.Pending() == 3 }, time.Second, time.Millisecond)
+
+	// The queued requests are not processed, draws included.
+	sys.Stop()
+	assert.ErrorIs(t, (<-first).Err, types.ErrShutingDown)
+	assert.ErrorIs(t, (<-second).Err, types.ErrShutingDown)
+	assert.ErrorIs(t, <-updated, types.ErrShutingDown)
+	assert.Empty(t, wal.logged)
+	assert.Zero(t, pool.committed)
+}
+
+func TestScheduler_SnapshotTicker(t *testing.T) {
+	dir := t.TempDir()
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 100, Probability: 1}})
+	clock := sim.NewClock(time.Unix(0, 0))
+	sched := actor.NewScheduler()
+	sys, u := newFileWALSystem(t, dir, pool, actor.SystemOptional{
+		// Not flushed by the draws, the tick flushes them first.
+		FlushAfterNDraw: 100,
+		SnapshotPolicy:  actor.SnapshotPolicy{Interval: time.Second},
+		Clock:           clock,
+		Scheduler:       sched,
+	})
+	defer sys.Stop()
+
+	// The ticker runs on the clock.
+	clock.Advance(999 * time.Millisecond)
+	assert.Zero(t, sched.PendingTicks())
+	clock.Advance(time.Millisecond)
+	require.Equal(t, 1, sched.PendingTicks())
+	sched.Tick()
+	// Nothing was drawn since the initial snapshot.
+	assert.Zero(t, sched.Workers())
+
+	draw := sys.Draw()
+	sched.Deliver()
+	require.NoError(t, (<-draw).Err)
+	// Missed ticks are dropped.
+	clock.Advance(3 * time.Second)
+	require.Equal(t, 1, sched.PendingTicks())
+	sched.Tick()
+	require.Equal(t, 1, sched.Workers())
+
+	// The worker posts its result to the mailbox, the actor logs the snapshot.
+	sched.RunWorker()
+	require.Equal(t, 1, sched.Pending())
+	assert.False(t, sched.Deliver())
+	entries := snapshotEntries(t, u)
+	require.Len(t, entries, 2)
+	assert.Equal(t, filepath.Join(dir, "snapshot-1.json"), entries[1].Path)
+}
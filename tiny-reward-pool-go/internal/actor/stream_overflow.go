@@ -0,0 +1,101 @@
+package actor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// StreamOverflowPolicy decides what the RewardProcessorActor does with a
+// committed log when the StreamingActor mailbox is full.
+type StreamOverflowPolicy int
+
+const (
+	// StreamOverflowBlock waits for room in the mailbox, so a slow streamer
+	// stalls the draws. This is the default.
+	StreamOverflowBlock StreamOverflowPolicy = iota
+	// StreamOverflowDrop drops the log and counts it in StreamLag.Dropped.
+	StreamOverflowDrop
+	// StreamOverflowResume stops handing logs to the mailbox. Once the
+	// StreamingActor drained it, it streams the missed logs from the WAL
+	// files, starting after the last draw request ID it streamed, and then
+	// resumes live streaming. It needs a file WAL listed by
+	// Utils.GetWALFiles.
+	StreamOverflowResume
+)
+
+// ParseStreamOverflowPolicy parses "block", "drop" or "resume".
+// An empty string is StreamOverflowBlock.
+func ParseStreamOverflowPolicy(s string) (StreamOverflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return StreamOverflowBlock, nil
+	case "drop":
+		return StreamOverflowDrop, nil
+	case "resume":
+		return StreamOverflowResume, nil
+	}
+	return StreamOverflowBlock, fmt.Errorf("unknown stream overflow policy: %s", s)
+}
+
+func (p StreamOverflowPolicy) String() string {
+	switch p {
+	case StreamOverflowDrop:
+		return "drop"
+	case StreamOverflowResume:
+		return "resume"
+	}
+	return "block"
+}
+
+// streamOverflow is shared by the RewardProcessorActor and the
+// StreamingActor reading the same mailbox.
+//
+// Under StreamOverflowResume, the processor holds mu from its WAL flush
+// until the logs are handed over. While the StreamingActor holds it, the
+// WAL files therefore end with the last log the processor did not hand
+// over, and it can catch up without missing or repeating any.
+//
+// Without mu, the WAL files may end with a batch being flushed, which the
+// WAL drops again if the flush fails. The StreamingActor then only replays
+// up to committed.
+type streamOverflow struct {
+	policy  StreamOverflowPolicy
+	dropped atomic.Uint64
+
+	mu sync.Mutex
+	// behind is set by the processor when the mailbox is full and cleared
+	// by the StreamingActor once it caught up. It is only written under mu.
+	behind atomic.Bool
+	// position follows the last log handed over to the StreamingActor,
+	// counting every log, snapshots included.
+	position walstream.Position
+	// committed follows the last log flushed to the WAL.
+	committed walstream.Position
+	// signal wakes the StreamingActor up when behind is set.
+	signal chan struct{}
+}
+
+func newStreamOverflow(policy StreamOverflowPolicy, lastRequestID uint64) *streamOverflow {
+	return &streamOverflow{
+		policy:    policy,
+		position:  walstream.Position{RequestID: lastRequestID},
+		committed: walstream.Position{RequestID: lastRequestID},
+		signal:    make(chan struct{}, 1),
+	}
+}
+
+// lock is held by the processor around a flush under StreamOverflowResume.
+func (o *streamOverflow) lock() {
+	if o != nil && o.policy == StreamOverflowResume {
+		o.mu.Lock()
+	}
+}
+
+func (o *streamOverflow) unlock() {
+	if o != nil && o.policy == StreamOverflowResume {
+		o.mu.Unlock()
+	}
+}
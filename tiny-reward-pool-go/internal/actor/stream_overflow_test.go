@@ -0,0 +1,239 @@
+package actor_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+// stuckStreamer holds every Stream call until released.
+type stuckStreamer struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	entries []string
+}
+
+func newStuckStreamer() *stuckStreamer {
+	return &stuckStreamer{release: make(chan struct{})}
+}
+
+func (s *stuckStreamer) Stream(log types.WalLogEntry) {
+	<-s.release
+	data, _ := json.Marshal(log)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, string(data))
+}
+
+func (s *stuckStreamer) streamed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.entries...)
+}
+
+func TestSystem_StreamOverflowDrop(t *testing.T) {
+	pool := &mockPool{item: types.PoolReward{ItemID: "gold", Quantity: 20, Probability: 1}}
+	ctx := &types.Context{WAL: &mockWAL{size: 10}, Utils: &utils.MockUtils{}}
+	streamer := newStuckStreamer()
+	m := metrics.NewMetrics()
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{
+		FlushAfterNDraw:   1,
+		RequestBufferSize: 2,
+		WALStreamer:       streamer,
+		Metrics:           m,
+		StreamOverflow:    actor.StreamOverflowDrop,
+	})
+	require.NoError(t, err)
+
+	// The draws do not wait for the stuck streamer.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	lag, ok := sys.StreamLag()
+	require.True(t, ok)
+	assert.NotZero(t, lag.Dropped)
+
+	close(streamer.release)
+	sys.Stop()
+	// The last draws may have been answered before their flush.
+	lag, _ = sys.StreamLag()
+	assert.Equal(t, 20, len(streamer.streamed())+int(lag.Dropped))
+	expected := fmt.Sprintf(`
+# HELP rewardpool_stream_dropped_total Number of committed logs not streamed because the streaming mailbox was full.
+# TYPE rewardpool_stream_dropped_total counter
+rewardpool_stream_dropped_total %d
+`, lag.Dropped)
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "rewardpool_stream_dropped_total"))
+}
+
+func TestSystem_StreamOverflowResume(t *testing.T) {
+	walDir := t.TempDir()
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		// Small files, so the replay crosses rotations.
+		store, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4 * 1024})
+		if err != nil {
+			return nil, err
+		}
+		return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store)
+	}
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	w, err := walFactory(path, seqNo)
+	require.NoError(t, err)
+
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}})
+	streamer := newStuckStreamer()
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &actor.SystemOptional{
+		FlushAfterNDraw:   1,
+		RequestBufferSize: 4,
+		WALStreamer:       streamer,
+		WALFactory:        walFactory,
+		StreamOverflow:    actor.StreamOverflowResume,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	lag, _ := sys.StreamLag()
+	require.True(t, lag.Behind)
+
+	close(streamer.release)
+	require.Eventually(t, func() bool {
+		lag, _ := sys.StreamLag()
+		return !lag.Behind && lag.StreamedRequestID == 200
+	}, 5*time.Second, time.Millisecond)
+
+	// Live streaming resumed.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	sys.Stop()
+
+	// Every committed log was streamed once, in the WAL order.
+	paths, err := u.GetWALFiles()
+	require.NoError(t, err)
+	require.Greater(t, len(paths), 1)
+	var committed []string
+	for _, path := range paths {
+		entries, _, err := wal.ReadWAL(path, formatter.NewJSONFormatter())
+		require.NoError(t, err)
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			require.NoError(t, err)
+			committed = append(committed, string(data))
+		}
+	}
+	assert.Equal(t, committed, streamer.streamed())
+	assert.True(t, strings.Contains(committed[len(committed)-1], `"request_id":210`))
+}
+
+// pausingStreamer is a stuckStreamer that also holds the Stream call
+// after the pauseAt-th entry until resume is closed.
+type pausingStreamer struct {
+	*stuckStreamer
+	pauseAt int
+	resume  chan struct{}
+}
+
+func (s *pausingStreamer) Stream(log types.WalLogEntry) {
+	s.stuckStreamer.Stream(log)
+	if len(s.streamed()) == s.pauseAt {
+		<-s.resume
+	}
+}
+
+// failingFlushStorage fails a flush once armed, after the batch was written
+// to the mapped file, and holds it until release is closed.
+type failingFlushStorage struct {
+	*storage.FileMMapStorage
+	armed    atomic.Bool
+	flushing chan struct{}
+	release  chan struct{}
+}
+
+func (s *failingFlushStorage) Flush() error {
+	if s.armed.CompareAndSwap(true, false) {
+		close(s.flushing)
+		<-s.release
+		return types.ErrInjectedFault
+	}
+	return s.FileMMapStorage.Flush()
+}
+
+func TestSystem_StreamOverflowResumeFailedFlush(t *testing.T) {
+	walDir := t.TempDir()
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	mmapStorage, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 64 * 1024})
+	require.NoError(t, err)
+	store := &failingFlushStorage{FileMMapStorage: mmapStorage, flushing: make(chan struct{}), release: make(chan struct{})}
+	w, err := wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store)
+	require.NoError(t, err)
+
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}})
+	streamer := &pausingStreamer{stuckStreamer: newStuckStreamer(), pauseAt: 10, resume: make(chan struct{})}
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &actor.SystemOptional{
+		FlushAfterNDraw:   1,
+		RequestBufferSize: 4,
+		WALStreamer:       streamer,
+		StreamOverflow:    actor.StreamOverflowResume,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 40; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	lag, _ := sys.StreamLag()
+	require.True(t, lag.Behind)
+
+	// The streamer pauses while replaying the WAL file.
+	close(streamer.release)
+	require.Eventually(t, func() bool { return len(streamer.streamed()) == streamer.pauseAt }, 5*time.Second, time.Millisecond)
+
+	// The next batch is in the file while its flush is failing.
+	store.armed.Store(true)
+	draw := sys.Draw()
+	<-store.flushing
+	close(streamer.resume)
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	<-draw
+
+	require.Eventually(t, func() bool {
+		lag, _ := sys.StreamLag()
+		return !lag.Behind
+	}, 5*time.Second, time.Millisecond)
+	sys.Stop()
+
+	// The dropped batch was not streamed.
+	entries, _, err := wal.ReadWAL(path, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	var committed []string
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		require.NoError(t, err)
+		committed = append(committed, string(data))
+	}
+	assert.Equal(t, committed, streamer.streamed())
+}
@@ -2,8 +2,12 @@ package actor
 
 import (
 	"context"
+	"log/slog"
+	"sync/atomic"
 
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
 )
 
@@ -12,13 +16,63 @@ import (
 type StreamingActor struct {
 	walStreamer walstream.WALStreamer
 	mailbox     chan types.WalLogEntry
+	streamed    atomic.Uint64
+	overflow    *streamOverflow
+	utils       types.Utils
+	formatter   types.LogFormatter
+	metrics     *metrics.Metrics
+	logger      *slog.Logger
+}
+
+// StreamingActorOptional provides optional settings for the StreamingActor.
+type StreamingActorOptional struct {
+	// OverflowPolicy applies when the mailbox is full. Defaults to StreamOverflowBlock.
+	OverflowPolicy StreamOverflowPolicy
+	// LastRequestID is the request ID of the last draw committed before the
+	// actor started. StreamOverflowResume replays the logs after it.
+	LastRequestID uint64
+	// Utils lists the WAL files replayed under StreamOverflowResume.
+	Utils types.Utils
+	// Formatter decodes the WAL files. Defaults to JSON.
+	Formatter types.LogFormatter
+	Metrics   *metrics.Metrics
+	Logger    *slog.Logger
+}
+
+// StreamLag describes how far the streamer is behind the committed log.
+type StreamLag struct {
+	// Pending is the number of entries waiting in the mailbox.
+	Pending int
+	// StreamedRequestID is the request ID of the last draw handed to the streamer.
+	StreamedRequestID uint64
+	// AckedRequestID is the request ID of the last draw acknowledged by the
+	// receiver. It equals StreamedRequestID unless the streamer is a
+	// walstream.AckedStreamer.
+	AckedRequestID uint64
+	// Dropped is the number of logs dropped under StreamOverflowDrop.
+	Dropped uint64
+	// Behind is set under StreamOverflowResume while the committed logs are
+	// read from the WAL files instead of the mailbox.
+	Behind bool
 }
 
 // NewStreamingActor creates a new StreamingActor.
-func NewStreamingActor(walStreamer walstream.WALStreamer, mailboxSize int) *StreamingActor {
+func NewStreamingActor(walStreamer walstream.WALStreamer, mailboxSize int, opts ...StreamingActorOptional) *StreamingActor {
+	var opt StreamingActorOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
 	return &StreamingActor{
 		walStreamer: walStreamer,
 		mailbox:     make(chan types.WalLogEntry, mailboxSize),
+		overflow:    newStreamOverflow(opt.OverflowPolicy, opt.LastRequestID),
+		utils:       opt.Utils,
+		formatter:   opt.Formatter,
+		metrics:     opt.Metrics,
+		logger:      opt.Logger,
 	}
 }
 
@@ -30,14 +84,115 @@ func (a *StreamingActor) Init() error {
 func (a *StreamingActor) Receive(ctx context.Context) {
 	for {
 		select {
-		case logEntry := <-a.mailbox:
-			a.walStreamer.Stream(logEntry)
+		case logEntry, ok := <-a.mailbox:
+			if !ok {
+				// The processor stopped and closed the mailbox.
+				a.catchUp(ctx)
+				return
+			}
+			a.stream(logEntry)
+		case <-a.overflow.signal:
+			a.catchUp(ctx)
 		case <-ctx.Done():
 			// Drain the mailbox before shutting down
 			for logEntry := range a.mailbox {
-				a.walStreamer.Stream(logEntry)
+				a.stream(logEntry)
 			}
+			// The processor closed the mailbox after its last flush.
+			a.catchUp(ctx)
 			return
 		}
 	}
 }
+
+// catchUp streams the logs the processor did not hand over since the
+// mailbox overflowed. The WAL files are replayed without holding up the
+// processor until less than a mailbox worth of logs is left. The rest is
+// replayed while the processor waits to flush, then live streaming resumes.
+func (a *StreamingActor) catchUp(ctx context.Context) {
+	o := a.overflow
+	if !o.behind.Load() {
+		return
+	}
+	// Nothing is added to the mailbox while behind.
+	for len(a.mailbox) > 0 {
+		a.stream(<-a.mailbox)
+	}
+
+	o.mu.Lock()
+	pos := o.position
+	o.mu.Unlock()
+	for ctx.Err() == nil {
+		o.mu.Lock()
+		committed := o.committed
+		o.mu.Unlock()
+		next, n, err := a.replay(pos, committed)
+		// A failed pass, e.g. during a WAL rotation, is retried below.
+		if err != nil {
+			break
+		}
+		pos = next
+		if n < cap(a.mailbox) {
+			break
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	next, _, err := a.replay(pos, o.committed)
+	if err != nil && a.logger != nil {
+		a.logger.Error("[Streaming] Failed to replay the WAL, committed logs were not streamed.", "after_request_id", pos.RequestID, "error", err)
+	}
+	o.position = next
+	o.behind.Store(false)
+}
+
+// replay streams the logs after pos from the WAL files, up to committed,
+// and returns the position after the last one and how many were streamed.
+func (a *StreamingActor) replay(pos, committed walstream.Position) (walstream.Position, int, error) {
+	if a.utils == nil {
+		return pos, 0, nil
+	}
+	paths, err := a.utils.GetWALFiles()
+	if err != nil {
+		return pos, 0, err
+	}
+	logs, _, err := walstream.ReadAfter(paths, a.formatter, pos.RequestID)
+	if err != nil {
+		return pos, 0, err
+	}
+
+	n := 0
+	for _, logEntry := range logs[min(pos.Skip, len(logs)):] {
+		if pos.Compare(committed) >= 0 {
+			break
+		}
+		a.stream(logEntry)
+		pos.Advance(logEntry)
+		n++
+	}
+	a.metrics.AddStreamReplayed(n)
+	return pos, n, nil
+}
+
+func (a *StreamingActor) stream(logEntry types.WalLogEntry) {
+	a.walStreamer.Stream(logEntry)
+	if draw, ok := logEntry.(*types.WalLogDrawItem); ok {
+		a.streamed.Store(draw.RequestID)
+	}
+}
+
+// Lag returns the current StreamLag. It is safe for concurrent use.
+func (a *StreamingActor) Lag() StreamLag {
+	lag := StreamLag{
+		Pending:           len(a.mailbox),
+		StreamedRequestID: a.streamed.Load(),
+		Dropped:           a.overflow.dropped.Load(),
+		Behind:            a.overflow.behind.Load(),
+	}
+	lag.AckedRequestID = lag.StreamedRequestID
+	if acked, ok := a.walStreamer.(walstream.AckedStreamer); ok {
+		lag.AckedRequestID = acked.LastAckedRequestID()
+	}
+	return lag
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
@@ -19,6 +21,45 @@ type System struct {
 	cancel         context.CancelFunc
 	wg             sync.WaitGroup
 	stopOnce       sync.Once
+
+	// stopMu guards lifecycle. senders counts the sends in progress, the
+	// actor drains its mailbox once they are over.
+	stopMu    sync.RWMutex
+	lifecycle Lifecycle
+	senders   sync.WaitGroup
+	// draining is closed when the System starts draining, done once the
+	// actors have stopped.
+	draining chan struct{}
+	done     chan struct{}
+}
+
+// Lifecycle is the stage of a System, see System.Lifecycle.
+type Lifecycle int
+
+const (
+	// LifecycleStarting is the stage of a System until NewSystem returns.
+	LifecycleStarting Lifecycle = iota
+	// LifecycleRunning accepts requests.
+	LifecycleRunning
+	// LifecycleDraining rejects requests with types.ErrShutingDown, the
+	// ones queued in the mailbox included, while the actors flush the WAL.
+	LifecycleDraining
+	// LifecycleStopped rejects requests with types.ErrShutingDown.
+	LifecycleStopped
+)
+
+func (l Lifecycle) String() string {
+	switch l {
+	case LifecycleStarting:
+		return "starting"
+	case LifecycleRunning:
+		return "running"
+	case LifecycleDraining:
+		return "draining"
+	case LifecycleStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("Lifecycle(%d)", int(l))
 }
 
 // SystemOptional provides optional parameters for creating a new System.
@@ -28,6 +69,34 @@ type SystemOptional struct {
 	LastRequestID     uint64
 	WALStreamer       walstream.WALStreamer
 	WALFactory        func(path string, seqNo uint64) (types.WAL, error)
+	// Metrics enables Prometheus metrics collection. Nil disables it.
+	Metrics *metrics.Metrics
+	// Fence is checked before every draw and WAL flush. Nil disables it.
+	// See RewardProcessorActor.SetFence.
+	Fence func() error
+	// StreamOverflow applies when the WALStreamer falls a mailbox behind.
+	// Defaults to StreamOverflowBlock.
+	StreamOverflow StreamOverflowPolicy
+	// WALFormatter decodes the WAL files replayed under StreamOverflowResume.
+	// Defaults to JSON.
+	WALFormatter types.LogFormatter
+	// RotationPolicy rotates the WAL before it is full. The zero value only
+	// rotates a full WAL.
+	RotationPolicy RotationPolicy
+	// SnapshotSealer encrypts the snapshot files. Nil writes them in clear.
+	SnapshotSealer SnapshotSealer
+	// SnapshotFormat is the format of the snapshot files, see
+	// snapshot.ParseFormat. Defaults to JSON.
+	SnapshotFormat string
+	// SnapshotPolicy takes snapshots in the background. The zero value only
+	// takes them when the WAL is rotated.
+	SnapshotPolicy SnapshotPolicy
+	// Clock tells the time of the rotation and snapshot policies, and ticks
+	// the Interval of the SnapshotPolicy. Defaults to the system clock.
+	Clock Clock
+	// Scheduler runs the actors on the goroutine of its caller instead of
+	// their own goroutines. Nil runs them on their own.
+	Scheduler *Scheduler
 }
 
 // NewSystem creates, starts, and returns a new actor system.
@@ -51,7 +120,7 @@ func NewSystem(ctx *types.Context, pool types.RewardPool, opt *SystemOptional) (
 	} else {
 		// Default WALFactory
 		walFactory = func(path string, seqNo uint64) (types.WAL, error) {
-			fileStorage, err := storage.NewFileStorage(path, seqNo)
+			fileStorage, err := storage.NewFileStorage(path, seqNo, storage.FileStorageOpt{FormatterID: types.WALFormatterJSON})
 			if err != nil {
 				return nil, err
 			}
@@ -59,7 +128,21 @@ func NewSystem(ctx *types.Context, pool types.RewardPool, opt *SystemOptional) (
 		}
 	}
 
+	var m *metrics.Metrics
+	if opt != nil {
+		m = opt.Metrics
+	}
+
 	processorActor := NewRewardProcessorActor(ctx, pool, bufSize, flushN, lastRequestID, walFactory)
+	processorActor.SetMetrics(m)
+	if opt != nil {
+		processorActor.SetClock(opt.Clock)
+		processorActor.SetFence(opt.Fence)
+		processorActor.SetRotationPolicy(opt.RotationPolicy)
+		processorActor.SetSnapshotSealer(opt.SnapshotSealer)
+		processorActor.SetSnapshotFormat(opt.SnapshotFormat)
+		processorActor.SetSnapshotPolicy(opt.SnapshotPolicy)
+	}
 	if err := processorActor.Init(); err != nil {
 		// If init fails, we must ensure the WAL is closed if it was opened.
 		processorActor.ctx.WAL.Close()
@@ -68,12 +151,29 @@ func NewSystem(ctx *types.Context, pool types.RewardPool, opt *SystemOptional) (
 
 	var streamingActor *StreamingActor = nil
 	if opt != nil && opt.WALStreamer != nil {
-		streamingActor = NewStreamingActor(opt.WALStreamer, bufSize)
+		streamingActor = NewStreamingActor(opt.WALStreamer, bufSize, StreamingActorOptional{
+			OverflowPolicy: opt.StreamOverflow,
+			LastRequestID:  lastRequestID,
+			Utils:          ctx.Utils,
+			Formatter:      opt.WALFormatter,
+			Metrics:        m,
+			Logger:         ctx.Utils.GetLogger(),
+		})
 		if err := streamingActor.Init(); err != nil {
 			return nil, fmt.Errorf("streamingActor initialization failed: %w", err)
 		}
 
 		processorActor.SetStreamChannel(streamingActor.mailbox)
+		processorActor.setStreamOverflow(streamingActor.overflow)
+	}
+
+	m.RegisterMailboxDepth("processor", func() int { return len(processorActor.mailbox) })
+	if streamingActor != nil {
+		m.RegisterMailboxDepth("streaming", func() int { return len(streamingActor.mailbox) })
+		m.RegisterStreamLag(func() (uint64, uint64) {
+			lag := streamingActor.Lag()
+			return lag.StreamedRequestID, lag.AckedRequestID
+		})
 	}
 
 	actorCtx, cancel := context.WithCancel(context.Background())
@@ -82,85 +182,355 @@ func NewSystem(ctx *types.Context, pool types.RewardPool, opt *SystemOptional) (
 		processorActor: processorActor,
 		streamingActor: streamingActor,
 		cancel:         cancel,
+		lifecycle:      LifecycleStarting,
+		draining:       make(chan struct{}),
+		done:           make(chan struct{}),
 	}
 
-	sys.wg.Add(2)
-	go func() {
-		defer sys.wg.Done()
-		sys.processorActor.Receive(actorCtx)
-	}()
-	go func() {
-		defer sys.wg.Done()
-		if sys.streamingActor == nil {
-			return
-		}
-		sys.streamingActor.Receive(actorCtx)
-	}()
+	if opt != nil && opt.Scheduler != nil {
+		opt.Scheduler.bind(processorActor, streamingActor)
+		sys.wg.Add(1)
+		go func() {
+			defer sys.wg.Done()
+			<-actorCtx.Done()
+			opt.Scheduler.shutdown()
+		}()
+	} else {
+		sys.wg.Add(2)
+		go func() {
+			defer sys.wg.Done()
+			sys.processorActor.Receive(actorCtx)
+		}()
+		go func() {
+			defer sys.wg.Done()
+			if sys.streamingActor == nil {
+				return
+			}
+			sys.streamingActor.Receive(actorCtx)
+		}()
+	}
+
+	m.RegisterRemainingQuantity(sys.State)
 
+	sys.setLifecycle(LifecycleRunning)
 	return sys, nil
 }
 
+// Lifecycle returns the stage of the System.
+func (s *System) Lifecycle() Lifecycle {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+	return s.lifecycle
+}
+
+func (s *System) setLifecycle(l Lifecycle) {
+	s.stopMu.Lock()
+	s.lifecycle = l
+	s.stopMu.Unlock()
+}
+
+// send puts msg in the mailbox of the processor. It fails with
+// types.ErrShutingDown once the System is draining, or with the error of ctx
+// while the mailbox is full. With block false it fails with
+// types.ErrSystemBusy instead of waiting for a full mailbox.
+func (s *System) send(ctx context.Context, msg interface{}, block bool) error {
+	s.stopMu.RLock()
+	if s.lifecycle >= LifecycleDraining {
+		s.stopMu.RUnlock()
+		return types.ErrShutingDown
+	}
+	s.senders.Add(1)
+	s.stopMu.RUnlock()
+	defer s.senders.Done()
+
+	if !block {
+		select {
+		case s.processorActor.mailbox <- msg:
+			return nil
+		default:
+			return types.ErrSystemBusy
+		}
+	}
+	select {
+	case s.processorActor.mailbox <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.draining:
+		return types.ErrShutingDown
+	}
+}
+
+// request sends the message made by newMsg and waits for its response. The
+// messages still queued when the System stops are answered while the actor
+// drains its mailbox, or fail with types.ErrShutingDown.
+func request[T any](ctx context.Context, s *System, newMsg func(respChan chan T) interface{}) (T, error) {
+	var zero T
+	respChan := make(chan T, 1)
+	if err := s.send(ctx, newMsg(respChan), true); err != nil {
+		return zero, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case <-s.done:
+		select {
+		case resp := <-respChan:
+			return resp, nil
+		default:
+			return zero, types.ErrShutingDown
+		}
+	}
+}
+
 // Draw sends a draw request to the actor and waits for a response.
 func (s *System) Draw() <-chan DrawResponse {
+	return s.DrawCtx(context.Background())
+}
+
+// DrawCtx is like Draw but propagates the trace context in ctx to the actor.
+// If ctx is done while the draw is queued, the response carries its error
+// and the draw uses no request ID nor stock.
+func (s *System) DrawCtx(ctx context.Context) <-chan DrawResponse {
 	respChan := make(chan DrawResponse, 1)
-	msg := DrawMessage{ResponseChan: respChan}
-	s.processorActor.mailbox <- msg
+	msg := DrawMessage{ResponseChan: respChan, Ctx: ctx, EnqueuedAt: time.Now()}
+	if err := s.send(ctx, msg, true); err != nil {
+		respChan <- DrawResponse{Err: err}
+	}
 	return respChan
 }
 
+// TryDraw is the non-blocking version of Draw.
+// It returns ErrSystemBusy instead of waiting when the mailbox is full.
+func (s *System) TryDraw() (<-chan DrawResponse, error) {
+	return s.TryDrawCtx(context.Background())
+}
+
+// TryDrawCtx is like TryDraw but propagates the trace context in ctx to the actor.
+func (s *System) TryDrawCtx(ctx context.Context) (<-chan DrawResponse, error) {
+	respChan := make(chan DrawResponse, 1)
+	msg := DrawMessage{ResponseChan: respChan, Ctx: ctx, EnqueuedAt: time.Now()}
+	if err := s.send(ctx, msg, false); err != nil {
+		return nil, err
+	}
+	return respChan, nil
+}
+
 // Stop gracefully shuts down the actor system.
+// Calls made after Stop fail with types.ErrShutingDown, State returns an
+// empty state, instead of reaching the actor. It is safe to call Stop
+// concurrently with the other methods and more than once.
 func (s *System) Stop() {
+	s.StopCtx(context.Background())
+}
+
+// StopCtx is like Stop but stops waiting for the actors to drain their
+// mailboxes and flush the WAL when ctx is done, and returns its error. The
+// drain goes on in the background.
+func (s *System) StopCtx(ctx context.Context) error {
 	s.stopOnce.Do(func() {
-		s.cancel()  // Signal the actor to stop
-		s.wg.Wait() // Wait for the actor's goroutine to finish
+		s.setLifecycle(LifecycleDraining)
+		close(s.draining)
+		// The mailbox is closed by the actor, after the last send.
+		s.senders.Wait()
+		s.cancel() // Signal the actor to stop
+		go func() {
+			s.wg.Wait() // Wait for the actor's goroutine to finish
+			s.setLifecycle(LifecycleStopped)
+			close(s.done)
+		}()
 	})
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Flush manually triggers a WAL flush.
 func (s *System) Flush() error {
-	respChan := make(chan error, 1)
-	msg := FlushMessage{ResponseChan: respChan}
-	s.processorActor.mailbox <- msg
-	return <-respChan
+	return s.FlushCtx(context.Background())
+}
+
+// FlushCtx is like Flush but stops waiting when ctx is done. A flush still
+// queued is then dropped.
+func (s *System) FlushCtx(ctx context.Context) error {
+	err, reqErr := request(ctx, s, func(respChan chan error) interface{} {
+		return FlushMessage{ResponseChan: respChan, Ctx: ctx}
+	})
+	if reqErr != nil {
+		return reqErr
+	}
+	return err
 }
 
 // Snapshot manually triggers a snapshot.
 func (s *System) Snapshot() error {
-	respChan := make(chan error, 1)
-	msg := SnapshotMessage{ResponseChan: respChan}
-	s.processorActor.mailbox <- msg
-	return <-respChan
+	return s.SnapshotCtx(context.Background())
+}
+
+// SnapshotCtx is like Snapshot but stops waiting when ctx is done. A
+// snapshot still queued is then dropped.
+func (s *System) SnapshotCtx(ctx context.Context) error {
+	err, reqErr := request(ctx, s, func(respChan chan error) interface{} {
+		return SnapshotMessage{ResponseChan: respChan, Ctx: ctx}
+	})
+	if reqErr != nil {
+		return reqErr
+	}
+	return err
 }
 
 // UpdateItem sends a message to the actor to update an item and waits for a response.
 func (s *System) UpdateItem(itemID string, quantity int, probability int64) error {
-	respChan := make(chan error, 1)
-	s.processorActor.mailbox <- UpdateMessage{
-		ItemID:       itemID,
-		Quantity:     quantity,
-		Probability:  probability,
-		ResponseChan: respChan,
+	return s.UpdateItemCtx(context.Background(), itemID, quantity, probability)
+}
+
+// UpdateItemCtx is like UpdateItem but stops waiting when ctx is done. An
+// update still queued is then dropped.
+func (s *System) UpdateItemCtx(ctx context.Context, itemID string, quantity int, probability int64) error {
+	err, reqErr := request(ctx, s, func(respChan chan error) interface{} {
+		return UpdateMessage{
+			ItemID:       itemID,
+			Quantity:     quantity,
+			Probability:  probability,
+			ResponseChan: respChan,
+			Ctx:          ctx,
+		}
+	})
+	if reqErr != nil {
+		return reqErr
+	}
+	return err
+}
+
+// UpdateCatalog applies the updates returned by diff as WAL-logged item updates
+// and flushes them. diff is called on the actor goroutine with the live state
+// and must not call back into the System.
+func (s *System) UpdateCatalog(diff func(live []types.PoolReward) []types.PoolReward) ([]types.PoolReward, error) {
+	return s.UpdateCatalogCtx(context.Background(), diff)
+}
+
+// UpdateCatalogCtx is like UpdateCatalog but stops waiting when ctx is done.
+// diff is not called if it is still queued.
+func (s *System) UpdateCatalogCtx(ctx context.Context, diff func(live []types.PoolReward) []types.PoolReward) ([]types.PoolReward, error) {
+	resp, err := request(ctx, s, func(respChan chan UpdateCatalogResponse) interface{} {
+		return UpdateCatalogMessage{Diff: diff, ResponseChan: respChan, Ctx: ctx}
+	})
+	if err != nil {
+		return nil, err
 	}
-	return <-respChan
+	return resp.Updates, resp.Err
 }
 
-// State returns the current state of the reward pool.
+// State returns the current state of the reward pool, or nil once the
+// System is stopping.
 func (s *System) State() []types.PoolReward {
-	respChan := make(chan []types.PoolReward, 1)
-	s.processorActor.mailbox <- StateMessage{ResponseChan: respChan}
-	return <-respChan
+	state, _ := s.StateCtx(context.Background())
+	return state
+}
+
+// StateCtx is like State but stops waiting when ctx is done, and returns why
+// there is no state.
+func (s *System) StateCtx(ctx context.Context) ([]types.PoolReward, error) {
+	return request(ctx, s, func(respChan chan []types.PoolReward) interface{} {
+		return StateMessage{ResponseChan: respChan}
+	})
 }
 
 // GetRequestID returns the current request ID from the actor.
 func (s *System) GetRequestID() uint64 {
-	respChan := make(chan uint64, 1)
-	s.processorActor.mailbox <- GetRequestIDMessage{ResponseChan: respChan}
-	return <-respChan
+	id, _ := s.GetRequestIDCtx(context.Background())
+	return id
+}
+
+// GetRequestIDCtx is like GetRequestID but stops waiting when ctx is done.
+func (s *System) GetRequestIDCtx(ctx context.Context) (uint64, error) {
+	return request(ctx, s, func(respChan chan uint64) interface{} {
+		return GetRequestIDMessage{ResponseChan: respChan}
+	})
 }
 
 // SetRequestID sets the request ID on the actor.
 func (s *System) SetRequestID(id uint64) {
-	respChan := make(chan struct{}, 1)
-	s.processorActor.mailbox <- SetRequestIDMessage{ID: id, ResponseChan: respChan}
-	<-respChan
+	s.SetRequestIDCtx(context.Background(), id)
+}
+
+// SetRequestIDCtx is like SetRequestID but stops waiting when ctx is done.
+func (s *System) SetRequestIDCtx(ctx context.Context, id uint64) error {
+	_, err := request(ctx, s, func(respChan chan struct{}) interface{} {
+		return SetRequestIDMessage{ID: id, ResponseChan: respChan}
+	})
+	return err
+}
+
+// SetFlushAfterNDraw changes the automatic flush threshold at runtime.
+// Values <= 0 are ignored.
+func (s *System) SetFlushAfterNDraw(n int) {
+	s.SetFlushAfterNDrawCtx(context.Background(), n)
+}
+
+// SetFlushAfterNDrawCtx is like SetFlushAfterNDraw but stops waiting when
+// ctx is done.
+func (s *System) SetFlushAfterNDrawCtx(ctx context.Context, n int) error {
+	_, err := request(ctx, s, func(respChan chan struct{}) interface{} {
+		return SetFlushAfterNDrawMessage{N: n, ResponseChan: respChan}
+	})
+	return err
+}
+
+// SetRotationPolicy changes when the WAL is rotated at runtime. It applies
+// from the next flush.
+func (s *System) SetRotationPolicy(p RotationPolicy) {
+	s.SetRotationPolicyCtx(context.Background(), p)
+}
+
+// SetRotationPolicyCtx is like SetRotationPolicy but stops waiting when ctx
+// is done.
+func (s *System) SetRotationPolicyCtx(ctx context.Context, p RotationPolicy) error {
+	_, err := request(ctx, s, func(respChan chan struct{}) interface{} {
+		return SetRotationPolicyMessage{Policy: p, ResponseChan: respChan}
+	})
+	return err
+}
+
+// SetSnapshotPolicy changes when a snapshot is taken in the background at
+// runtime.
+func (s *System) SetSnapshotPolicy(p SnapshotPolicy) {
+	s.SetSnapshotPolicyCtx(context.Background(), p)
+}
+
+// SetSnapshotPolicyCtx is like SetSnapshotPolicy but stops waiting when ctx
+// is done.
+func (s *System) SetSnapshotPolicyCtx(ctx context.Context, p SnapshotPolicy) error {
+	_, err := request(ctx, s, func(respChan chan struct{}) interface{} {
+		return SetSnapshotPolicyMessage{Policy: p, ResponseChan: respChan}
+	})
+	return err
+}
+
+// StreamLag reports how far the WAL streamer is behind. ok is false when
+// streaming is disabled.
+func (s *System) StreamLag() (lag StreamLag, ok bool) {
+	if s.streamingActor == nil {
+		return StreamLag{}, false
+	}
+	return s.streamingActor.Lag(), true
+}
+
+// SetLeader switches the actor between leader and follower. A follower
+// rejects draws and updates with types.ErrNotLeader. A new System is a leader.
+func (s *System) SetLeader(leader bool) {
+	s.SetLeaderCtx(context.Background(), leader)
+}
+
+// SetLeaderCtx is like SetLeader but stops waiting when ctx is done.
+func (s *System) SetLeaderCtx(ctx context.Context, leader bool) error {
+	_, err := request(ctx, s, func(respChan chan struct{}) interface{} {
+		return SetLeaderMessage{Leader: leader, ResponseChan: respChan}
+	})
+	return err
 }
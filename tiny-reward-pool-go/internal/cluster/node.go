@@ -0,0 +1,318 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/election"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replica"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// Role is the role of a Node in the cluster.
+type Role int
+
+const (
+	RoleFollower Role = iota
+	RoleLeader
+)
+
+func (r Role) String() string {
+	if r == RoleLeader {
+		return "leader"
+	}
+	return "follower"
+}
+
+// ActorSystem is what a Node serves to clients: the leader's actor.System or
+// a follower's replica.Replica. It has the method set of the gRPC service's
+// ActorSystem.
+type ActorSystem interface {
+	State() []types.PoolReward
+	StateCtx(ctx context.Context) ([]types.PoolReward, error)
+	Draw() <-chan actor.DrawResponse
+	TryDrawCtx(ctx context.Context) (<-chan actor.DrawResponse, error)
+	Stop()
+	UpdateItem(id string, quantity int, weight int64) error
+	GetRequestID() uint64
+	SetRequestID(id uint64)
+}
+
+// LeaderFactory starts the actor system of a newly elected leader.
+//
+// snapshot is the state replicated from the previous leader, or nil when this
+// node has not replicated anything and must recover from its own WAL. Every
+// WAL file created by the system must carry token as its fencing token, and
+// fence must be passed to actor.SystemOptional.Fence. The returned streamer
+// ships the committed entries to the followers.
+type LeaderFactory func(snapshot *types.PoolSnapshot, token uint64, fence func() error) (*actor.System, *walstream.TCPStreamer, error)
+
+// Node takes part in the leader election and switches between roles.
+//
+// As a follower it replicates from the lease holder and serves reads. When
+// it takes the lease it promotes its replicated state to an actor system, so
+// the request ID sequence continues where the replication left off. When the
+// lease is lost the actor stops accepting draws before it is stopped, and
+// the node goes back to following.
+//
+// A node that saw another node hold the lease since it last led missed that
+// leader's entries. It does not take the lease until its replica is
+// bootstrapped, so it never reissues request IDs from its own stale state.
+//
+// Replication is asynchronous: entries committed by a leader that crashes
+// before streaming them are not on the new leader.
+type Node struct {
+	elector                  *election.LeaseElector
+	replicationListenAddress string
+	start                    LeaderFactory
+	renewInterval            time.Duration
+	retryInterval            time.Duration
+	logger                   *slog.Logger
+	onRoleChange             func(role Role, sys ActorSystem)
+}
+
+// NodeOptional provides optional settings for the Node.
+type NodeOptional struct {
+	// RenewInterval is how often the lease is renewed or checked. Defaults to a third of the TTL.
+	RenewInterval time.Duration
+	// RetryInterval is the replica reconnect delay.
+	RetryInterval time.Duration
+	Logger        *slog.Logger
+	// OnRoleChange is called with the system to serve after every role change.
+	OnRoleChange func(role Role, sys ActorSystem)
+}
+
+// NewNode creates a Node. replicationListenAddress is where the node ships
+// its WAL entries while it is the leader.
+func NewNode(elector *election.LeaseElector, replicationListenAddress string, start LeaderFactory, opts ...NodeOptional) *Node {
+	var opt NodeOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.RenewInterval <= 0 {
+		opt.RenewInterval = elector.TTL() / 3
+	}
+	if opt.OnRoleChange == nil {
+		opt.OnRoleChange = func(Role, ActorSystem) {}
+	}
+
+	return &Node{
+		elector:                  elector,
+		replicationListenAddress: replicationListenAddress,
+		start:                    start,
+		renewInterval:            opt.RenewInterval,
+		retryInterval:            opt.RetryInterval,
+		logger:                   opt.Logger,
+		onRoleChange:             opt.OnRoleChange,
+	}
+}
+
+// follower is the replica of a follower node.
+type follower struct {
+	replica *replica.Replica
+	address string
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+// Run takes part in the election until ctx is cancelled. A leader flushes,
+// snapshots and stops its actor system and releases the lease on the way out.
+func (n *Node) Run(ctx context.Context) error {
+	var f *follower
+	var last *types.PoolSnapshot // state of this node when it last stepped down
+	var lastToken uint64         // token of the lease this node last led with
+	var seen uint64              // highest token of a lease held by another node
+	defer func() {
+		if f != nil {
+			f.stop()
+		}
+	}()
+
+	for {
+		var lease election.Lease
+		var held bool
+		var err error
+		if seen > lastToken && (f == nil || !f.replica.Bootstrapped()) {
+			// Another node led since: last and the local WAL miss its entries.
+			lease, err = n.elector.Read()
+			if err == nil && n.logger != nil && !time.Now().Before(lease.ExpiresAt) {
+				n.logger.Warn("lease is free but this node missed the entries of a newer leader, not taking it", "seen_token", seen, "last_token", lastToken)
+			}
+		} else {
+			lease, held, err = n.elector.TryAcquire()
+			if err != nil && !errors.Is(err, election.ErrLeaseBusy) && n.logger != nil {
+				n.logger.Warn("lease acquire failed", "error", err)
+			}
+		}
+		if err == nil && !held {
+			seen = max(seen, lease.Token)
+		}
+
+		switch {
+		case held:
+			snapshot := last
+			if f != nil {
+				f.stop()
+				replicated, err := f.replica.Snapshot()
+				f = nil
+				if err != nil {
+					return err
+				}
+				if replicated != nil {
+					snapshot = replicated
+				}
+			}
+			stepped, ok := n.lead(ctx, lease.Token, snapshot)
+			if ok {
+				last, lastToken = stepped, lease.Token
+			} else if snapshot != last {
+				// The replicated state is as recent as the last seen lease.
+				last, lastToken = snapshot, seen
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+
+		case err == nil && lease.ReplicationAddress != "" && (f == nil || f.address != lease.ReplicationAddress):
+			if f != nil {
+				f.stop()
+			}
+			f = n.follow(lease.ReplicationAddress)
+			n.onRoleChange(RoleFollower, f.replica)
+		}
+
+		select {
+		case <-time.After(n.renewInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// follow starts a replica of the leader at address.
+func (n *Node) follow(address string) *follower {
+	if n.logger != nil {
+		n.logger.Info("following leader", "address", address)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		replica: replica.NewReplica(address, replica.ReplicaOptional{RetryInterval: n.retryInterval, Logger: n.logger}),
+		address: address,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(f.done)
+		f.replica.Run(ctx)
+	}()
+	return f
+}
+
+// lead runs the actor system while the lease with token is held.
+// When the lease is lost it returns the state the node stepped down with.
+// It reports false when the actor system failed to start.
+func (n *Node) lead(ctx context.Context, token uint64, snapshot *types.PoolSnapshot) (*types.PoolSnapshot, bool) {
+	fence := func() error { return n.elector.CheckFence(token) }
+	sys, streamer, err := n.start(snapshot, token, fence)
+	if err != nil {
+		if n.logger != nil {
+			n.logger.Error("failed to start as leader, releasing the lease", "error", err)
+		}
+		n.elector.Release()
+		return nil, false
+	}
+	if n.logger != nil {
+		n.logger.Info("elected leader", "token", token, "request_id", sys.GetRequestID())
+	}
+
+	streamCtx, stopStreaming := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if streamer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := streamer.ListenAndServe(streamCtx, n.replicationListenAddress); err != nil && n.logger != nil {
+				n.logger.Error("failed to serve replication", "error", err)
+			}
+		}()
+	}
+	defer func() {
+		stopStreaming()
+		wg.Wait()
+	}()
+
+	n.onRoleChange(RoleLeader, sys)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := sys.Flush(); err != nil && n.logger != nil {
+				n.logger.Error("final flush failed", "error", err)
+			}
+			if err := sys.Snapshot(); err != nil && n.logger != nil {
+				n.logger.Error("final snapshot failed", "error", err)
+			}
+			sys.Stop()
+			n.elector.Release()
+			return nil, true
+		case <-time.After(n.renewInterval):
+		}
+
+		lease, held, err := n.elector.TryAcquire()
+		if (held && lease.Token == token) || (err != nil && n.elector.CheckFence(token) == nil) {
+			// Renewed, or the renew failed but the lease has not expired yet.
+			continue
+		}
+
+		if n.logger != nil {
+			n.logger.Warn("leader lease lost, stepping down", "token", token, "error", err)
+		}
+		sys.SetLeader(false)
+		// Nothing staged after the fence failed was flushed, so this is the committed state.
+		stepped := &steppedDown{state: sys.State(), requestID: sys.GetRequestID()}
+		n.onRoleChange(RoleFollower, stepped)
+		sys.Stop()
+		return &types.PoolSnapshot{LastRequestID: stepped.requestID, Catalog: stepped.state}, true
+	}
+}
+
+// steppedDown is served by a former leader until it follows the new one.
+type steppedDown struct {
+	state     []types.PoolReward
+	requestID uint64
+}
+
+func (s *steppedDown) State() []types.PoolReward { return s.state }
+
+func (s *steppedDown) StateCtx(ctx context.Context) ([]types.PoolReward, error) {
+	return s.state, nil
+}
+
+func (s *steppedDown) Draw() <-chan actor.DrawResponse {
+	respChan := make(chan actor.DrawResponse, 1)
+	respChan <- actor.DrawResponse{Err: types.ErrNotLeader}
+	return respChan
+}
+
+func (s *steppedDown) TryDrawCtx(ctx context.Context) (<-chan actor.DrawResponse, error) {
+	return nil, types.ErrNotLeader
+}
+
+func (s *steppedDown) UpdateItem(id string, quantity int, weight int64) error {
+	return types.ErrNotLeader
+}
+
+func (s *steppedDown) Stop()                  {}
+func (s *steppedDown) GetRequestID() uint64   { return s.requestID }
+func (s *steppedDown) SetRequestID(id uint64) {}
@@ -0,0 +1,262 @@
+package cluster_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/cluster"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/election"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	walstorage "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+const leaseTTL = 500 * time.Millisecond
+
+type testNode struct {
+	dir  string
+	stop func()
+
+	mu   sync.Mutex
+	role cluster.Role
+	sys  cluster.ActorSystem
+}
+
+func (n *testNode) current() (cluster.Role, cluster.ActorSystem) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role, n.sys
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// startNode runs a Node with its own WAL directory and a lease file shared with the other nodes.
+// advertise replaces the replication address put in the lease.
+func startNode(t *testing.T, id, leasePath string, advertise ...string) *testNode {
+	t.Helper()
+	n := &testNode{dir: t.TempDir()}
+	replicationAddress := freeAddress(t)
+	advertiseAddress := replicationAddress
+	for _, a := range advertise {
+		advertiseAddress = a
+	}
+
+	start := func(snapshot *types.PoolSnapshot, token uint64, fence func() error) (*actor.System, *walstream.TCPStreamer, error) {
+		catalog := []types.PoolReward{
+			{ItemID: "gold", Quantity: 1000, Probability: 10},
+			{ItemID: "silver", Quantity: 1000, Probability: 10},
+		}
+		var lastRequestID uint64
+		if snapshot != nil {
+			catalog = snapshot.Catalog
+			lastRequestID = snapshot.LastRequestID
+		}
+		pool := rewardpool.NewPool(catalog)
+
+		u := utils.NewDefaultUtils(n.dir, n.dir, slog.LevelError, io.Discard)
+		walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+			storage, err := walstorage.NewFileStorage(path, seqNo, walstorage.FileStorageOpt{FencingToken: token})
+			if err != nil {
+				return nil, err
+			}
+			return wal.NewWAL(path, seqNo, walformatter.NewJSONFormatter(), storage)
+		}
+		path, seqNo, err := u.GenNextWALPath()
+		if err != nil {
+			return nil, nil, err
+		}
+		w, err := walFactory(path, seqNo)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		streamer := walstream.NewTCPStreamer(pool.State(), lastRequestID)
+		sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &actor.SystemOptional{
+			FlushAfterNDraw: 1,
+			LastRequestID:   lastRequestID,
+			WALStreamer:     streamer,
+			WALFactory:      walFactory,
+			Fence:           fence,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return sys, streamer, nil
+	}
+
+	elector := election.NewLeaseElector(leasePath, election.Candidate{ID: id, ReplicationAddress: advertiseAddress}, election.LeaseElectorOptional{TTL: leaseTTL})
+	node := cluster.NewNode(elector, replicationAddress, start, cluster.NodeOptional{
+		RenewInterval: leaseTTL / 5,
+		RetryInterval: 20 * time.Millisecond,
+		OnRoleChange: func(role cluster.Role, sys cluster.ActorSystem) {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			n.role, n.sys = role, sys
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		node.Run(ctx)
+	}()
+	n.stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(n.stop)
+	return n
+}
+
+func waitRole(t *testing.T, n *testNode, role cluster.Role) cluster.ActorSystem {
+	t.Helper()
+	var sys cluster.ActorSystem
+	require.Eventually(t, func() bool {
+		var r cluster.Role
+		r, sys = n.current()
+		return sys != nil && r == role
+	}, 5*time.Second, 10*time.Millisecond)
+	return sys
+}
+
+// lastWALHeader reads the header of the newest WAL file in dir.
+func lastWALHeader(t *testing.T, dir string) types.WALHeader {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "wal.*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	content, err := os.ReadFile(files[len(files)-1])
+	require.NoError(t, err)
+	var hdr types.WALHeader
+	require.NoError(t, binary.Read(bytes.NewReader(content[:types.WALHeaderSize]), binary.LittleEndian, &hdr))
+	return hdr
+}
+
+func TestNode_Failover(t *testing.T) {
+	leasePath := filepath.Join(t.TempDir(), "lease.json")
+
+	a := startNode(t, "a", leasePath)
+	leaderA := waitRole(t, a, cluster.RoleLeader)
+	b := startNode(t, "b", leasePath)
+	followerB := waitRole(t, b, cluster.RoleFollower)
+
+	// Followers reject draws
+	resp := <-followerB.Draw()
+	assert.ErrorIs(t, resp.Err, types.ErrReadOnlyReplica)
+
+	for i := 0; i < 7; i++ {
+		resp := <-leaderA.Draw()
+		require.NoError(t, resp.Err)
+	}
+	require.Eventually(t, func() bool { return followerB.GetRequestID() == 7 }, 5*time.Second, 10*time.Millisecond)
+
+	// a can no longer renew (e.g. cut off from the shared disk): it keeps
+	// drawing until the lease expires, then its fence rejects draws without
+	// using a request ID.
+	lockPath := leasePath + ".lock"
+	require.NoError(t, os.WriteFile(lockPath, nil, 0644))
+	var lastRequestID uint64
+	var drawErr error
+	require.Eventually(t, func() bool {
+		resp := <-leaderA.Draw()
+		if resp.Err == nil {
+			lastRequestID = resp.RequestID
+		}
+		drawErr = resp.Err
+		return drawErr != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// Rejected by the fence, or by the system a stopped after stepping down
+	assert.Contains(t, []error{types.ErrNotLeader, types.ErrShutingDown}, drawErr)
+	require.Eventually(t, func() bool { return followerB.GetRequestID() == lastRequestID }, 5*time.Second, 10*time.Millisecond)
+	replicated := followerB.State()
+
+	// a stays down, b takes over with the next fencing token and continues the sequence
+	a.stop()
+	require.NoError(t, os.Remove(lockPath))
+	leaderB := waitRole(t, b, cluster.RoleLeader)
+	assert.ElementsMatch(t, replicated, leaderB.State())
+	resp = <-leaderB.Draw()
+	require.NoError(t, resp.Err)
+	assert.Equal(t, lastRequestID+1, resp.RequestID)
+	assert.Equal(t, uint64(2), lastWALHeader(t, b.dir).FencingToken)
+	assert.Equal(t, uint64(1), lastWALHeader(t, a.dir).FencingToken)
+
+	// a comes back as a follower of the new leader
+	a = startNode(t, "a", leasePath)
+	followerA := waitRole(t, a, cluster.RoleFollower)
+	require.Eventually(t, func() bool { return followerA.GetRequestID() == lastRequestID+1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNode_GracefulHandover(t *testing.T) {
+	leasePath := filepath.Join(t.TempDir(), "lease.json")
+
+	a := startNode(t, "a", leasePath)
+	leaderA := waitRole(t, a, cluster.RoleLeader)
+	b := startNode(t, "b", leasePath)
+	followerB := waitRole(t, b, cluster.RoleFollower)
+
+	for i := 0; i < 3; i++ {
+		<-leaderA.Draw()
+	}
+	require.Eventually(t, func() bool { return followerB.GetRequestID() == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	// a releases the lease on shutdown, b does not wait for the TTL
+	a.stop()
+	leaderB := waitRole(t, b, cluster.RoleLeader)
+	resp := <-leaderB.Draw()
+	require.NoError(t, resp.Err)
+	assert.Equal(t, uint64(4), resp.RequestID)
+}
+
+func TestNode_NoLeadAfterMissedLeader(t *testing.T) {
+	leasePath := filepath.Join(t.TempDir(), "lease.json")
+
+	// Nobody can replicate from a
+	a := startNode(t, "a", leasePath, freeAddress(t))
+	leaderA := waitRole(t, a, cluster.RoleLeader)
+	b := startNode(t, "b", leasePath)
+	waitRole(t, b, cluster.RoleFollower)
+	for i := 0; i < 3; i++ {
+		resp := <-leaderA.Draw()
+		require.NoError(t, resp.Err)
+	}
+
+	// b saw a lead but missed its draws: it does not take the released lease
+	a.stop()
+	assert.Never(t, func() bool {
+		role, _ := b.current()
+		return role == cluster.RoleLeader
+	}, 3*leaseTTL, 20*time.Millisecond)
+	files, err := filepath.Glob(filepath.Join(b.dir, "wal.*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// a comes back and leads again, b follows it
+	a = startNode(t, "a", leasePath)
+	waitRole(t, a, cluster.RoleLeader)
+	role, _ := b.current()
+	assert.Equal(t, cluster.RoleFollower, role)
+}
@@ -28,6 +28,8 @@ func (c *ConfigImpl) LoadYAML(path string) (YAMLConfig, error) {
 	}
 	defer file.Close()
 	var cfg YAMLConfig
-	err = yaml.NewDecoder(file).Decode(&cfg)
-	return cfg, err
+	if err := yaml.NewDecoder(file).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.GRPC.Validate()
 }
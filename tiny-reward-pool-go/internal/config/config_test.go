@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -13,3 +14,47 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatalf("LoadConfig failed: %v", err)
 	}
 }
+
+func TestLoadYAML_WebhookLogTypes(t *testing.T) {
+	cfg, err := (&config.ConfigImpl{}).LoadYAML("../../samples/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadYAML failed: %v", err)
+	}
+	if len(cfg.Webhooks.Targets) == 0 {
+		t.Fatalf("expected webhook targets in the sample config")
+	}
+	logTypes, err := cfg.Webhooks.Targets[0].ParseLogTypes()
+	if err != nil {
+		t.Fatalf("ParseLogTypes failed: %v", err)
+	}
+	if len(logTypes) != 1 || logTypes[0] != types.LogTypeDraw {
+		t.Fatalf("expected [draw], got %v", logTypes)
+	}
+
+	invalid := config.YAMLConfigWebhookTarget{Name: "bad", LogTypes: []string{"rotate"}}
+	if _, err := invalid.ParseLogTypes(); err == nil {
+		t.Fatalf("expected an error for an unknown log type")
+	}
+}
+
+func TestYAMLConfigGRPC_Validate(t *testing.T) {
+	cfg := config.YAMLConfigGRPC{MaxDrawCount: 10}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("no rate limit: %v", err)
+	}
+
+	cfg.RateLimit = config.YAMLConfigRateLimit{PerClientRPS: 5, PerClientBurst: 10, GlobalRPS: 100, GlobalBurst: 5}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected max_draw_count above global_burst to be rejected")
+	}
+
+	cfg.RateLimit.GlobalBurst = 100
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("max_draw_count within the bursts: %v", err)
+	}
+
+	cfg.MaxDrawCount = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected an unbounded draw count to be rejected with a rate limit")
+	}
+}
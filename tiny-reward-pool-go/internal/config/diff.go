@@ -0,0 +1,54 @@
+package config
+
+import "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+
+// DiffCatalog returns the item updates that bring the live pool in line with next.
+//
+//   - Items missing from live are added with the configured quantity.
+//   - The configured quantity is only applied when it changed since previous
+//     (or the item was not configured before). Otherwise the live remaining
+//     quantity is kept, so a reload never refills already drawn stock.
+//   - Probabilities always follow next.
+//   - Items removed from the config are disabled (quantity 0, probability 0)
+//     since the pool cannot delete items.
+func DiffCatalog(previous, next types.ConfigPool, live []types.PoolReward) []types.PoolReward {
+	prevItems := make(map[string]types.PoolReward, len(previous.Catalog))
+	for _, item := range previous.Catalog {
+		prevItems[item.ItemID] = item
+	}
+	liveItems := make(map[string]types.PoolReward, len(live))
+	for _, item := range live {
+		liveItems[item.ItemID] = item
+	}
+
+	var updates []types.PoolReward
+	configured := make(map[string]bool, len(next.Catalog))
+	for _, item := range next.Catalog {
+		configured[item.ItemID] = true
+
+		liveItem, ok := liveItems[item.ItemID]
+		if !ok {
+			updates = append(updates, item)
+			continue
+		}
+
+		quantity := liveItem.Quantity
+		if prevItem, ok := prevItems[item.ItemID]; !ok || prevItem.Quantity != item.Quantity {
+			quantity = item.Quantity
+		}
+		if quantity != liveItem.Quantity || item.Probability != liveItem.Probability {
+			updates = append(updates, types.PoolReward{ItemID: item.ItemID, Quantity: quantity, Probability: item.Probability})
+		}
+	}
+
+	for _, item := range live {
+		if configured[item.ItemID] {
+			continue
+		}
+		if item.Quantity != 0 || item.Probability != 0 {
+			updates = append(updates, types.PoolReward{ItemID: item.ItemID, Quantity: 0, Probability: 0})
+		}
+	}
+
+	return updates
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// ReloadTarget is the part of actor.System a Reloader drives.
+type ReloadTarget interface {
+	UpdateCatalog(diff func(live []types.PoolReward) []types.PoolReward) ([]types.PoolReward, error)
+	SetFlushAfterNDraw(n int)
+}
+
+// ReloadResult describes what a reload changed.
+type ReloadResult struct {
+	// Updates are the item updates written to the WAL.
+	Updates []types.PoolReward
+	// RestartRequired lists changed settings that only apply after a restart.
+	RestartRequired []string
+}
+
+// Reloader re-reads the YAML config and applies it to a running system
+// without stopping it. In-flight draws are not affected: the catalog diff is
+// applied by the actor between two messages.
+type Reloader struct {
+	path   string
+	target ReloadTarget
+
+	mu      sync.Mutex
+	current YAMLConfig
+	hooks   []func(prev, next YAMLConfig)
+
+	// lastStat is the file info seen by Watch, starting with the file
+	// the system was started from.
+	lastStat os.FileInfo
+}
+
+// NewReloader creates a Reloader. current is the config the system was started with.
+func NewReloader(path string, current YAMLConfig, target ReloadTarget) *Reloader {
+	lastStat, _ := os.Stat(path)
+	return &Reloader{path: path, target: target, current: current, lastStat: lastStat}
+}
+
+// OnReload registers a hook called after each successful reload, e.g. to
+// apply the gRPC limits. Hooks run while the reload lock is held.
+func (r *Reloader) OnReload(hook func(prev, next YAMLConfig)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// Current returns the last applied config.
+func (r *Reloader) Current() YAMLConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads the config file and applies the differences.
+// On error the previous config stays current, so the next reload retries the
+// whole diff; updates already applied are not repeated since they match the live state.
+func (r *Reloader) Reload() (ReloadResult, error) {
+	next, err := (&ConfigImpl{}).LoadYAML(r.path)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("failed to load config: %w", err)
+	}
+	return r.Apply(next)
+}
+
+// Apply applies next as if it had been loaded from the config file.
+func (r *Reloader) Apply(next YAMLConfig) (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev := r.current
+	updates, err := r.target.UpdateCatalog(func(live []types.PoolReward) []types.PoolReward {
+		return DiffCatalog(prev.Pool, next.Pool, live)
+	})
+	result := ReloadResult{Updates: updates, RestartRequired: restartRequired(prev, next)}
+	if err != nil {
+		return result, fmt.Errorf("failed to apply catalog: %w", err)
+	}
+
+	if next.WAL.FlushAfterNDraw != prev.WAL.FlushAfterNDraw {
+		r.target.SetFlushAfterNDraw(next.WAL.FlushAfterNDraw)
+	}
+	for _, hook := range r.hooks {
+		hook(prev, next)
+	}
+
+	r.current = next
+	return result, nil
+}
+
+// Watch polls the config file every interval and reloads it when its
+// modification time or size changes, until ctx is cancelled.
+// Only one Watch may run per Reloader.
+// onReload is called with the outcome of every reload.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(ReloadResult, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			continue
+		}
+		last := r.lastStat
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		r.lastStat = info
+
+		result, err := r.Reload()
+		if onReload != nil {
+			onReload(result, err)
+		}
+	}
+}
+
+// restartRequired returns the settings that changed but cannot be applied live.
+func restartRequired(prev, next YAMLConfig) []string {
+	var fields []string
+	if prev.WorkingDir != next.WorkingDir {
+		fields = append(fields, "working_dir")
+	}
+	if prev.WAL.Formatter != next.WAL.Formatter {
+		fields = append(fields, "wal.formatter")
+	}
+	if prev.WAL.MaxRequestBuffer != next.WAL.MaxRequestBuffer {
+		fields = append(fields, "wal.max_request_buffer_size")
+	}
+	if prev.WAL.StreamOverflowPolicy != next.WAL.StreamOverflowPolicy {
+		fields = append(fields, "wal.stream_overflow_policy")
+	}
+	if prev.WAL.Compaction != next.WAL.Compaction {
+		fields = append(fields, "wal.compaction")
+	}
+	if prev.WAL.Growable != next.WAL.Growable || prev.WAL.GrowChunkKB != next.WAL.GrowChunkKB {
+		fields = append(fields, "wal.growable")
+	}
+	if !reflect.DeepEqual(prev.WAL.Encryption, next.WAL.Encryption) {
+		fields = append(fields, "wal.encryption")
+	}
+	if prev.WAL.Compression != next.WAL.Compression {
+		fields = append(fields, "wal.compression")
+	}
+	if prev.Snapshot.Format != next.Snapshot.Format {
+		fields = append(fields, "snapshot.format")
+	}
+	if prev.GRPC.Enabled != next.GRPC.Enabled || prev.GRPC.ListenAddress != next.GRPC.ListenAddress {
+		fields = append(fields, "grpc.listen_address")
+	}
+	if prev.Metrics != next.Metrics {
+		fields = append(fields, "metrics")
+	}
+	if prev.Tracing != next.Tracing {
+		fields = append(fields, "tracing")
+	}
+	if prev.Replication != next.Replication {
+		fields = append(fields, "replication")
+	}
+	if prev.Election != next.Election {
+		fields = append(fields, "election")
+	}
+	if prev.Sink != next.Sink {
+		fields = append(fields, "sink")
+	}
+	if !reflect.DeepEqual(prev.Webhooks, next.Webhooks) {
+		fields = append(fields, "webhooks")
+	}
+	if prev.ObjectStore != next.ObjectStore {
+		fields = append(fields, "object_store")
+	}
+	return fields
+}
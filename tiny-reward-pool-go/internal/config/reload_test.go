@@ -0,0 +1,140 @@
+package config_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/config"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+func TestDiffCatalog(t *testing.T) {
+	previous := types.ConfigPool{Catalog: []types.PoolReward{
+		{ItemID: "gold", Quantity: 100, Probability: 10},
+		{ItemID: "silver", Quantity: 50, Probability: 20},
+		{ItemID: "rock", Quantity: 10, Probability: 30},
+	}}
+	next := types.ConfigPool{Catalog: []types.PoolReward{
+		{ItemID: "gold", Quantity: 100, Probability: 15},  // probability changed
+		{ItemID: "silver", Quantity: 80, Probability: 20}, // restocked
+		{ItemID: "diamond", Quantity: 5, Probability: 1},  // new
+	}}
+	live := []types.PoolReward{
+		{ItemID: "gold", Quantity: 90, Probability: 10},
+		{ItemID: "silver", Quantity: 40, Probability: 20},
+		{ItemID: "rock", Quantity: 3, Probability: 30},
+	}
+
+	updates := config.DiffCatalog(previous, next, live)
+	assert.Equal(t, []types.PoolReward{
+		{ItemID: "gold", Quantity: 90, Probability: 15},
+		{ItemID: "silver", Quantity: 80, Probability: 20},
+		{ItemID: "diamond", Quantity: 5, Probability: 1},
+		{ItemID: "rock", Quantity: 0, Probability: 0},
+	}, updates)
+
+	// Same config again: nothing to do
+	live = []types.PoolReward{
+		{ItemID: "gold", Quantity: 90, Probability: 15},
+		{ItemID: "silver", Quantity: 80, Probability: 20},
+		{ItemID: "diamond", Quantity: 5, Probability: 1},
+		{ItemID: "rock", Quantity: 0, Probability: 0},
+	}
+	assert.Empty(t, config.DiffCatalog(next, next, live))
+}
+
+// poolTarget applies the diff directly on a pool, like the actor does.
+type poolTarget struct {
+	pool            *rewardpool.Pool
+	flushAfterNDraw int
+}
+
+func (p *poolTarget) UpdateCatalog(diff func(live []types.PoolReward) []types.PoolReward) ([]types.PoolReward, error) {
+	updates := diff(p.pool.State())
+	for _, u := range updates {
+		if err := p.pool.UpdateItem(u.ItemID, u.Quantity, u.Probability); err != nil {
+			return nil, err
+		}
+	}
+	return updates, nil
+}
+
+func (p *poolTarget) SetFlushAfterNDraw(n int) {
+	p.flushAfterNDraw = n
+}
+
+const reloadConfigYAML = `
+working_dir: "tmp"
+pool:
+  catalog:
+    - item_id: "gold"
+      quantity: %d
+      probability: 10
+wal:
+  formatter: "%s"
+  flush_after_n_draw: %d
+`
+
+func writeConfig(t *testing.T, path string, quantity int, formatter string, flushAfter int) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(reloadConfigYAML, quantity, formatter, flushAfter)), 0644))
+}
+
+func TestReloader_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 10, "json", 5)
+	initial, err := (&config.ConfigImpl{}).LoadYAML(path)
+	require.NoError(t, err)
+
+	target := &poolTarget{pool: rewardpool.CreatePoolFromConfig(initial.Pool)}
+	reloader := config.NewReloader(path, initial, target)
+
+	var hookCalls int
+	reloader.OnReload(func(prev, next config.YAMLConfig) { hookCalls++ })
+
+	writeConfig(t, path, 20, "string_line", 50)
+	result, err := reloader.Reload()
+	require.NoError(t, err)
+
+	assert.Equal(t, []types.PoolReward{{ItemID: "gold", Quantity: 20, Probability: 10}}, result.Updates)
+	assert.Equal(t, []string{"wal.formatter"}, result.RestartRequired)
+	assert.Equal(t, 20, target.pool.GetItemRemaining("gold"))
+	assert.Equal(t, 50, target.flushAfterNDraw)
+	assert.Equal(t, 1, hookCalls)
+	assert.Equal(t, 50, reloader.Current().WAL.FlushAfterNDraw)
+}
+
+func TestReloader_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 10, "json", 5)
+	initial, err := (&config.ConfigImpl{}).LoadYAML(path)
+	require.NoError(t, err)
+
+	target := &poolTarget{pool: rewardpool.CreatePoolFromConfig(initial.Pool)}
+	reloader := config.NewReloader(path, initial, target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 1)
+	go reloader.Watch(ctx, 5*time.Millisecond, func(_ config.ReloadResult, err error) {
+		reloaded <- err
+	})
+
+	// Make sure the size changes even if the mtime resolution is coarse.
+	writeConfig(t, path, 1000, "json", 5)
+
+	select {
+	case err := <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("config change was not picked up")
+	}
+	assert.Equal(t, 1000, target.pool.GetItemRemaining("gold"))
+}
@@ -1,13 +1,26 @@
 package config
 
-import "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+import (
+	"fmt"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
 
 // YAMLConfig represents the application's configuration.
 type YAMLConfig struct {
-	WorkingDir string           `yaml:"working_dir"`
-	Pool       types.ConfigPool `yaml:"pool"`
-	WAL        YAMLConfigWAL    `yaml:"wal"`
-	GRPC       YAMLConfigGRPC   `yaml:"grpc"`
+	WorkingDir  string                `yaml:"working_dir"`
+	Pool        types.ConfigPool      `yaml:"pool"`
+	WAL         YAMLConfigWAL         `yaml:"wal"`
+	Snapshot    YAMLConfigSnapshot    `yaml:"snapshot"`
+	GRPC        YAMLConfigGRPC        `yaml:"grpc"`
+	Metrics     YAMLConfigMetrics     `yaml:"metrics"`
+	Tracing     YAMLConfigTracing     `yaml:"tracing"`
+	Reload      YAMLConfigReload      `yaml:"reload"`
+	Replication YAMLConfigReplication `yaml:"replication"`
+	Election    YAMLConfigElection    `yaml:"election"`
+	Sink        YAMLConfigSink        `yaml:"sink"`
+	Webhooks    YAMLConfigWebhooks    `yaml:"webhooks"`
+	ObjectStore YAMLConfigObjectStore `yaml:"object_store"`
 }
 
 // YAMLConfigWAL represents the configuration for the WAL.
@@ -16,10 +29,259 @@ type YAMLConfigWAL struct {
 	MaxRequestBuffer int    `yaml:"max_request_buffer_size"`
 	Formatter        string `yaml:"formatter"`
 	FlushAfterNDraw  int    `yaml:"flush_after_n_draw"`
+	// StreamOverflowPolicy applies when the streamers fall behind the draws:
+	// "block" (default), "drop" or "resume". See actor.StreamOverflowPolicy.
+	StreamOverflowPolicy string `yaml:"stream_overflow_policy"`
+	// Compaction removes or archives the closed WAL files once a newer
+	// snapshot is written. It is used by the headless server.
+	Compaction YAMLConfigCompaction `yaml:"compaction"`
+	// Growable maps the WAL files in chunks of GrowChunkKB instead of
+	// preallocating MaxFileSizeKB, which becomes a soft limit: the file is
+	// rotated after the flush that reaches it.
+	Growable    bool `yaml:"growable"`
+	GrowChunkKB int  `yaml:"grow_chunk_kb"`
+	// Rotation rotates the WAL file before it reaches its size limit.
+	Rotation YAMLConfigRotation `yaml:"rotation"`
+	// Encryption encrypts the WAL batches and the snapshot files.
+	Encryption YAMLConfigEncryption `yaml:"encryption"`
+	// Compression compresses each WAL batch: "none" (default), "zstd" or
+	// "snappy". See compress.Formatter.
+	Compression string `yaml:"compression"`
+}
+
+// YAMLConfigSnapshot represents the configuration of the snapshot files.
+type YAMLConfigSnapshot struct {
+	// Format is "json" (default) or "binary", see snapshot.ParseFormat.
+	// Both are read on recovery.
+	Format string `yaml:"format"`
+	// EveryNDraws and IntervalSec take a snapshot in the background, 0 is
+	// disabled. See actor.SnapshotPolicy.
+	EveryNDraws int `yaml:"every_n_draws"`
+	IntervalSec int `yaml:"interval_sec"`
+}
+
+// YAMLConfigEncryption represents the WAL encryption at rest. See
+// crypt.Keyring.
+type YAMLConfigEncryption struct {
+	Enabled bool `yaml:"enabled"`
+	// ActiveKeyID is the key new batches and snapshots are encrypted with.
+	ActiveKeyID uint32 `yaml:"active_key_id"`
+	// Keys must keep the previous keys while files encrypted with them
+	// are still read.
+	Keys []YAMLConfigEncryptionKey `yaml:"keys"`
+}
+
+// YAMLConfigEncryptionKey is an AES key, hex encoded in KeyFile.
+type YAMLConfigEncryptionKey struct {
+	ID      uint32 `yaml:"id"`
+	KeyFile string `yaml:"key_file"`
+}
+
+// YAMLConfigRotation represents the WAL rotation policy. Zero values are
+// disabled. See actor.RotationPolicy.
+type YAMLConfigRotation struct {
+	MaxEntries int `yaml:"max_entries"`
+	MaxAgeSec  int `yaml:"max_age_sec"`
+}
+
+// YAMLConfigCompaction represents the configuration for the WAL compactor.
+// See compactor.CompactorOptional.
+type YAMLConfigCompaction struct {
+	Enabled bool `yaml:"enabled"`
+	// Action is "delete" (default) or "gzip".
+	Action string `yaml:"action"`
+	// ArchiveDir keeps the gzip files. Defaults to <working_dir>/archive.
+	ArchiveDir string `yaml:"archive_dir"`
+	// AuditDir, when set, gets the entries of the compacted files as
+	// per-day JSON lines files.
+	AuditDir     string `yaml:"audit_dir"`
+	KeepSegments int    `yaml:"keep_segments"`
+	IntervalMs   int    `yaml:"interval_ms"`
 }
 
 // YAMLConfigGRPC represents the configuration for the gRPC service.
 type YAMLConfigGRPC struct {
+	Enabled       bool                `yaml:"enabled"`
+	ListenAddress string              `yaml:"listen_address"`
+	MaxDrawCount  int32               `yaml:"max_draw_count"`
+	RateLimit     YAMLConfigRateLimit `yaml:"rate_limit"`
+	// DrainTimeoutSec bounds how long the server waits for in-flight
+	// streams on shutdown before closing them.
+	DrainTimeoutSec int `yaml:"drain_timeout_sec"`
+}
+
+// Validate checks that a DrawRequest of max_draw_count draws can pass the
+// rate limits: a count larger than a burst is never allowed.
+func (g YAMLConfigGRPC) Validate() error {
+	limits := []struct {
+		name  string
+		rps   float64
+		burst int
+	}{
+		{"global_burst", g.RateLimit.GlobalRPS, g.RateLimit.GlobalBurst},
+		{"per_client_burst", g.RateLimit.PerClientRPS, g.RateLimit.PerClientBurst},
+	}
+	for _, l := range limits {
+		if l.rps <= 0 {
+			continue
+		}
+		burst := max(l.burst, 1)
+		if g.MaxDrawCount <= 0 {
+			return fmt.Errorf("grpc.max_draw_count must be set to at most grpc.rate_limit.%s (%d)", l.name, burst)
+		}
+		if int(g.MaxDrawCount) > burst {
+			return fmt.Errorf("grpc.max_draw_count %d exceeds grpc.rate_limit.%s %d", g.MaxDrawCount, l.name, burst)
+		}
+	}
+	return nil
+}
+
+// YAMLConfigRateLimit represents the token-bucket limits for draw requests.
+// A rate of 0 disables the corresponding limit.
+type YAMLConfigRateLimit struct {
+	GlobalRPS      float64 `yaml:"global_rps"`
+	GlobalBurst    int     `yaml:"global_burst"`
+	PerClientRPS   float64 `yaml:"per_client_rps"`
+	PerClientBurst int     `yaml:"per_client_burst"`
+}
+
+// YAMLConfigMetrics represents the configuration for the Prometheus metrics endpoint.
+type YAMLConfigMetrics struct {
 	Enabled       bool   `yaml:"enabled"`
 	ListenAddress string `yaml:"listen_address"`
 }
+
+// YAMLConfigTracing represents the configuration for OpenTelemetry tracing.
+type YAMLConfigTracing struct {
+	// Exporter is one of "none", "stdout" or "file".
+	Exporter    string  `yaml:"exporter"`
+	FilePath    string  `yaml:"file_path"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// YAMLConfigReload represents the configuration for hot-reloading the config file.
+type YAMLConfigReload struct {
+	// Watch polls the config file and applies it when it changes.
+	Watch      bool `yaml:"watch"`
+	IntervalMs int  `yaml:"interval_ms"`
+}
+
+// Replication roles.
+const (
+	ReplicationRolePrimary = "primary"
+	ReplicationRoleReplica = "replica"
+)
+
+// YAMLConfigReplication represents the configuration for primary/replica replication.
+// It is used by the headless server.
+type YAMLConfigReplication struct {
+	// Role is "primary", "replica" or empty to disable replication.
+	Role string `yaml:"role"`
+	// ListenAddress is where a primary accepts replicas.
+	ListenAddress string `yaml:"listen_address"`
+	// PrimaryAddress is the primary a replica follows.
+	PrimaryAddress string `yaml:"primary_address"`
+	// BacklogSize is the number of entries a primary keeps for reconnecting replicas.
+	BacklogSize int `yaml:"backlog_size"`
+}
+
+// YAMLConfigElection represents the configuration for leader election through
+// a lease file on shared disk. It is used by the headless server and replaces
+// replication.role: the leader streams on replication.listen_address and the
+// other nodes follow it.
+type YAMLConfigElection struct {
+	Enabled bool `yaml:"enabled"`
+	// NodeID must be unique among the nodes sharing the lease file.
+	NodeID     string `yaml:"node_id"`
+	LeasePath  string `yaml:"lease_path"`
+	LeaseTTLMs int    `yaml:"lease_ttl_ms"`
+	// AdvertiseAddress is the gRPC address followers redirect clients to.
+	AdvertiseAddress string `yaml:"advertise_address"`
+	// AdvertiseReplicationAddress is the address followers replicate from.
+	AdvertiseReplicationAddress string `yaml:"advertise_replication_address"`
+}
+
+// Sink kinds.
+const (
+	SinkKindNATS = "nats"
+)
+
+// YAMLConfigSink represents the configuration for publishing every committed
+// WAL entry to a message broker. It is used by the headless server.
+type YAMLConfigSink struct {
+	Enabled bool `yaml:"enabled"`
+	// Kind is the broker protocol, only "nats" for now.
+	Kind    string `yaml:"kind"`
+	Address string `yaml:"address"`
+	Subject string `yaml:"subject"`
+	// SpillDir keeps the entries the broker did not accept yet, and the last
+	// acknowledged request ID.
+	SpillDir        string `yaml:"spill_dir"`
+	BatchSize       int    `yaml:"batch_size"`
+	FlushIntervalMs int    `yaml:"flush_interval_ms"`
+	MaxRetries      int    `yaml:"max_retries"`
+	// MaxBuffered is the number of entries kept in memory before spilling.
+	MaxBuffered int `yaml:"max_buffered"`
+}
+
+// YAMLConfigWebhooks represents the configuration for the partner webhooks.
+// It is used by the headless server.
+type YAMLConfigWebhooks struct {
+	Enabled bool `yaml:"enabled"`
+	// QueueDir keeps the entries not delivered yet and the dead-letter file.
+	QueueDir         string                    `yaml:"queue_dir"`
+	MaxAttempts      int                       `yaml:"max_attempts"`
+	InitialBackoffMs int                       `yaml:"initial_backoff_ms"`
+	MaxBackoffMs     int                       `yaml:"max_backoff_ms"`
+	TimeoutMs        int                       `yaml:"timeout_ms"`
+	Targets          []YAMLConfigWebhookTarget `yaml:"targets"`
+}
+
+// YAMLConfigWebhookTarget is a partner endpoint.
+type YAMLConfigWebhookTarget struct {
+	// Name must be unique, it names the target's queue file.
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// ItemIDs and LogTypes ("draw", "update", "snapshot") filter the
+	// entries. Empty means all.
+	ItemIDs  []string `yaml:"item_ids"`
+	LogTypes []string `yaml:"log_types"`
+}
+
+// YAMLConfigObjectStore represents the configuration for archiving the
+// finalized WAL files, with their snapshots, to an S3-compatible object
+// store. A server starting on an empty working_dir restores from it.
+// It is used by the headless server.
+type YAMLConfigObjectStore struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// Prefix is prepended to every key, so pools can share a bucket.
+	Prefix string `yaml:"prefix"`
+	// MaxPending bounds the queued uploads, see objectstore.ArchiverOptional.
+	// 0 uses the default.
+	MaxPending int `yaml:"max_pending"`
+}
+
+// ParseLogTypes returns the log types of the target.
+func (t YAMLConfigWebhookTarget) ParseLogTypes() ([]types.LogType, error) {
+	logTypes := make([]types.LogType, 0, len(t.LogTypes))
+	for _, name := range t.LogTypes {
+		switch name {
+		case "draw":
+			logTypes = append(logTypes, types.LogTypeDraw)
+		case "update":
+			logTypes = append(logTypes, types.LogTypeUpdate)
+		case "snapshot":
+			logTypes = append(logTypes, types.LogTypeSnapshot)
+		default:
+			return nil, fmt.Errorf("webhook %q: unknown log type %q", t.Name, name)
+		}
+	}
+	return logTypes, nil
+}
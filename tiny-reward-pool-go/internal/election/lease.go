@@ -0,0 +1,252 @@
+package election
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+const (
+	defaultLeaseTTL = 5 * time.Second
+	lockSuffix      = ".lock"
+)
+
+// ErrLeaseBusy is returned when another node is updating the lease file.
+// The caller should retry on its next tick.
+var ErrLeaseBusy = errors.New("lease file is locked by another node")
+
+// Lease is the content of the lease file.
+//
+// Token is the fencing token: it is incremented every time the lease changes
+// hands, so anything written by an older leader can be told apart.
+type Lease struct {
+	Holder             string    `json:"holder"`
+	Token              uint64    `json:"token"`
+	Address            string    `json:"address"`
+	ReplicationAddress string    `json:"replication_address"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+// Candidate identifies a node taking part in the election.
+type Candidate struct {
+	ID string
+	// Address is the gRPC address clients are redirected to.
+	Address string
+	// ReplicationAddress is the walstream address followers replicate from.
+	ReplicationAddress string
+}
+
+// LeaseElector elects a leader through a lease file on a disk shared by all nodes.
+//
+// The lease is held for TTL and must be renewed before it expires. Updates of
+// the lease file are serialized by a lock file created with O_EXCL, and the
+// lease itself is replaced atomically with a rename.
+type LeaseElector struct {
+	path      string
+	candidate Candidate
+	ttl       time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	lease Lease
+	held  bool
+}
+
+// LeaseElectorOptional provides optional settings for the LeaseElector.
+type LeaseElectorOptional struct {
+	TTL time.Duration
+	// Now replaces time.Now, for tests.
+	Now func() time.Time
+}
+
+// NewLeaseElector creates a LeaseElector using the lease file at path.
+func NewLeaseElector(path string, candidate Candidate, opts ...LeaseElectorOptional) *LeaseElector {
+	var opt LeaseElectorOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.TTL <= 0 {
+		opt.TTL = defaultLeaseTTL
+	}
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+	return &LeaseElector{path: path, candidate: candidate, ttl: opt.TTL, now: opt.Now}
+}
+
+// TTL returns the lease duration.
+func (e *LeaseElector) TTL() time.Duration {
+	return e.ttl
+}
+
+// TryAcquire takes the lease if it is free or expired, or renews it if this
+// node holds it. It returns the current lease and whether this node holds it.
+func (e *LeaseElector) TryAcquire() (Lease, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.withLock(func() error {
+		current, err := readLease(e.path)
+		if err != nil {
+			return err
+		}
+
+		now := e.now()
+		switch {
+		case current.Holder == e.candidate.ID && e.held && current.Token == e.lease.Token && now.Before(current.ExpiresAt):
+			// Renew
+		case current.Holder == "" || !now.Before(current.ExpiresAt) || current.Holder == e.candidate.ID:
+			// Take over. An expired lease of this node, or one left before a
+			// restart, is taken over with a new token as well: the fence of the
+			// old token has already failed.
+			current.Token++
+		default:
+			e.lease = current
+			e.held = false
+			return nil
+		}
+
+		current.Holder = e.candidate.ID
+		current.Address = e.candidate.Address
+		current.ReplicationAddress = e.candidate.ReplicationAddress
+		current.ExpiresAt = now.Add(e.ttl)
+		if err := writeLease(e.path, current); err != nil {
+			return err
+		}
+		e.lease = current
+		e.held = true
+		return nil
+	})
+	if err != nil {
+		return e.lease, false, err
+	}
+	return e.lease, e.held, nil
+}
+
+// Release gives up the lease so another node can take it right away.
+func (e *LeaseElector) Release() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.held {
+		return nil
+	}
+
+	return e.withLock(func() error {
+		current, err := readLease(e.path)
+		if err != nil {
+			return err
+		}
+		e.held = false
+		if current.Holder != e.candidate.ID || current.Token != e.lease.Token {
+			return nil
+		}
+		current.ExpiresAt = e.now()
+		e.lease = current
+		return writeLease(e.path, current)
+	})
+}
+
+// Read reads the lease file without taking or renewing the lease.
+func (e *LeaseElector) Read() (Lease, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lease, err := readLease(e.path)
+	if err != nil {
+		return e.lease, err
+	}
+	if !e.held {
+		e.lease = lease
+	}
+	return lease, nil
+}
+
+// Lease returns the lease as last read or written by this node.
+func (e *LeaseElector) Lease() Lease {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lease
+}
+
+// CheckFence returns types.ErrNotLeader unless this node still holds the
+// lease with token and the lease has not expired. It does not touch the disk,
+// so it can be called before every WAL flush.
+func (e *LeaseElector) CheckFence(token uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.held || e.lease.Token != token || !e.now().Before(e.lease.ExpiresAt) {
+		return types.ErrNotLeader
+	}
+	return nil
+}
+
+// withLock runs fn while holding the lock file. A lock file older than the
+// TTL is left by a crashed node and is removed.
+func (e *LeaseElector) withLock(fn func() error) error {
+	lockPath := e.path + lockSuffix
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		info, statErr := os.Stat(lockPath)
+		if statErr != nil || e.now().Sub(info.ModTime()) < e.ttl {
+			return ErrLeaseBusy
+		}
+		os.Remove(lockPath)
+		f, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return ErrLeaseBusy
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(lockPath)
+
+	return fn()
+}
+
+func readLease(path string) (Lease, error) {
+	var lease Lease
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, err
+	}
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return lease, fmt.Errorf("failed to decode lease file: %w", err)
+	}
+	return lease, nil
+}
+
+func writeLease(path string, lease Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
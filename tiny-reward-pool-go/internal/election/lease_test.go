@@ -0,0 +1,136 @@
+package election_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/election"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLeaseElector_Failover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opt := election.LeaseElectorOptional{TTL: 5 * time.Second, Now: clock.Now}
+	a := election.NewLeaseElector(path, election.Candidate{ID: "a", Address: "a:50051"}, opt)
+	b := election.NewLeaseElector(path, election.Candidate{ID: "b", Address: "b:50051"}, opt)
+
+	// a takes the free lease with the first token
+	lease, held, err := a.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, uint64(1), lease.Token)
+	assert.NoError(t, a.CheckFence(1))
+
+	// b sees a as the leader
+	lease, held, err = b.TryAcquire()
+	require.NoError(t, err)
+	assert.False(t, held)
+	assert.Equal(t, "a", lease.Holder)
+	assert.Equal(t, "a:50051", lease.Address)
+	assert.ErrorIs(t, b.CheckFence(1), types.ErrNotLeader)
+
+	// Renewing keeps the token
+	clock.Advance(3 * time.Second)
+	lease, held, err = a.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, uint64(1), lease.Token)
+
+	// a stops renewing: its fence fails once the lease expires and b takes over
+	clock.Advance(5 * time.Second)
+	assert.ErrorIs(t, a.CheckFence(1), types.ErrNotLeader)
+	lease, held, err = b.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, uint64(2), lease.Token)
+
+	// a cannot renew a lease that changed hands
+	lease, held, err = a.TryAcquire()
+	require.NoError(t, err)
+	assert.False(t, held)
+	assert.Equal(t, "b", lease.Holder)
+}
+
+func TestLeaseElector_Release(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	a := election.NewLeaseElector(path, election.Candidate{ID: "a"})
+	b := election.NewLeaseElector(path, election.Candidate{ID: "b"})
+
+	_, held, err := a.TryAcquire()
+	require.NoError(t, err)
+	require.True(t, held)
+	require.NoError(t, a.Release())
+	assert.ErrorIs(t, a.CheckFence(1), types.ErrNotLeader)
+
+	// b does not wait for the TTL
+	lease, held, err := b.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, uint64(2), lease.Token)
+}
+
+func TestLeaseElector_LockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	clock := &fakeClock{now: time.Now()}
+	a := election.NewLeaseElector(path, election.Candidate{ID: "a"}, election.LeaseElectorOptional{TTL: time.Second, Now: clock.Now})
+
+	// Another node is updating the lease
+	require.NoError(t, os.WriteFile(path+".lock", nil, 0644))
+	_, _, err := a.TryAcquire()
+	assert.ErrorIs(t, err, election.ErrLeaseBusy)
+
+	// The lock is left by a crashed node
+	clock.Advance(2 * time.Second)
+	_, held, err := a.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.NoFileExists(t, path+".lock")
+}
+
+func TestLeaseElector_Read(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opt := election.LeaseElectorOptional{TTL: 5 * time.Second, Now: clock.Now}
+	a := election.NewLeaseElector(path, election.Candidate{ID: "a", Address: "a:50051"}, opt)
+	b := election.NewLeaseElector(path, election.Candidate{ID: "b", Address: "b:50051"}, opt)
+
+	_, _, err := a.TryAcquire()
+	require.NoError(t, err)
+	require.NoError(t, a.Release())
+
+	// Reading the released lease does not take it
+	lease, err := b.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "a", lease.Holder)
+	assert.Equal(t, uint64(1), lease.Token)
+	assert.Equal(t, lease, b.Lease())
+	assert.ErrorIs(t, b.CheckFence(1), types.ErrNotLeader)
+
+	lease, held, err := a.TryAcquire()
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, uint64(2), lease.Token)
+}
@@ -0,0 +1,291 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+const namespace = "rewardpool"
+
+// Draw outcomes used as the `outcome` label of the draws counter.
+const (
+	OutcomeSuccess   = "success"
+	OutcomePoolEmpty = "pool_empty"
+	OutcomeError     = "error"
+)
+
+// Metrics holds the Prometheus collectors for the actor system and the WAL.
+// All methods are safe to call on a nil *Metrics, so callers do not need to
+// check whether metrics are enabled.
+//
+// Counters and histograms are lock-free once created. The per-item draw
+// counters are cached in a DrawRecorder so the hot path never
+// goes through the CounterVec label lookup.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	draws            *prometheus.CounterVec
+	updates          prometheus.Counter
+	flushDuration    prometheus.Histogram
+	snapshotDuration prometheus.Histogram
+	walBytesWritten  prometheus.Counter
+	walRotations     prometheus.Counter
+	streamDropped    prometheus.Counter
+	streamReplayed   prometheus.Counter
+
+	pendingLogs atomic.Int64
+}
+
+// NewMetrics creates the collectors and registers them on a fresh registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		draws: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "draws_total",
+			Help:      "Number of draws by item and outcome.",
+		}, []string{"item", "outcome"}),
+		updates: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "updates_total",
+			Help:      "Number of item updates.",
+		}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "flush_duration_seconds",
+			Help:      "Latency of WAL flushes triggered by the actor.",
+			Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+		}),
+		snapshotDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "snapshot_duration_seconds",
+			Help:      "Time spent creating and writing a snapshot.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}),
+		walBytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "wal_bytes_written_total",
+			Help:      "Number of encoded bytes written to the WAL storage.",
+		}),
+		walRotations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "wal_rotations_total",
+			Help:      "Number of WAL file rotations.",
+		}),
+		streamDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_dropped_total",
+			Help:      "Number of committed logs not streamed because the streaming mailbox was full.",
+		}),
+		streamReplayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_replayed_total",
+			Help:      "Number of committed logs streamed from the WAL files after the streaming mailbox overflowed.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.draws,
+		m.updates,
+		m.flushDuration,
+		m.snapshotDuration,
+		m.walBytesWritten,
+		m.walRotations,
+		m.streamDropped,
+		m.streamReplayed,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pending_logs",
+			Help:      "Number of logs staged in the actor and not yet flushed.",
+		}, func() float64 { return float64(m.pendingLogs.Load()) }),
+	)
+
+	return m
+}
+
+// Registry returns the registry that holds all collectors.
+func (m *Metrics) Registry() *prometheus.Registry {
+	if m == nil {
+		return nil
+	}
+	return m.registry
+}
+
+// DrawRecorder caches the per-item draw counters.
+// It is not safe for concurrent use and is meant to be owned by the actor goroutine.
+type DrawRecorder struct {
+	metrics  *Metrics
+	counters map[drawKey]prometheus.Counter
+}
+
+type drawKey struct {
+	itemID  string
+	outcome string
+}
+
+// NewDrawRecorder creates a DrawRecorder backed by the draws counter.
+func (m *Metrics) NewDrawRecorder() *DrawRecorder {
+	if m == nil {
+		return nil
+	}
+	return &DrawRecorder{metrics: m, counters: make(map[drawKey]prometheus.Counter)}
+}
+
+// Inc counts one draw for the item and outcome.
+func (r *DrawRecorder) Inc(itemID, outcome string) {
+	if r == nil {
+		return
+	}
+	key := drawKey{itemID: itemID, outcome: outcome}
+	c, ok := r.counters[key]
+	if !ok {
+		c = r.metrics.draws.WithLabelValues(itemID, outcome)
+		r.counters[key] = c
+	}
+	c.Inc()
+}
+
+// IncUpdates counts an item update.
+func (m *Metrics) IncUpdates() {
+	if m == nil {
+		return
+	}
+	m.updates.Inc()
+}
+
+// ObserveFlush records the latency of a WAL flush.
+func (m *Metrics) ObserveFlush(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.flushDuration.Observe(d.Seconds())
+}
+
+// ObserveSnapshot records the duration of a snapshot.
+func (m *Metrics) ObserveSnapshot(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.snapshotDuration.Observe(d.Seconds())
+}
+
+// AddWALBytes counts bytes written to the WAL storage.
+func (m *Metrics) AddWALBytes(n int) {
+	if m == nil {
+		return
+	}
+	m.walBytesWritten.Add(float64(n))
+}
+
+// IncWALRotations counts a WAL rotation.
+func (m *Metrics) IncWALRotations() {
+	if m == nil {
+		return
+	}
+	m.walRotations.Inc()
+}
+
+// IncStreamDropped counts a log dropped instead of streamed.
+func (m *Metrics) IncStreamDropped() {
+	if m == nil {
+		return
+	}
+	m.streamDropped.Inc()
+}
+
+// AddStreamReplayed counts logs streamed from the WAL files.
+func (m *Metrics) AddStreamReplayed(n int) {
+	if m == nil {
+		return
+	}
+	m.streamReplayed.Add(float64(n))
+}
+
+// SetPendingLogs publishes the actor's pending log count.
+func (m *Metrics) SetPendingLogs(n int) {
+	if m == nil {
+		return
+	}
+	m.pendingLogs.Store(int64(n))
+}
+
+// RegisterMailboxDepth exposes the length of an actor mailbox.
+// depth is called on every scrape and must be safe for concurrent use.
+func (m *Metrics) RegisterMailboxDepth(actorName string, depth func() int) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "mailbox_depth",
+		Help:        "Number of messages waiting in an actor mailbox.",
+		ConstLabels: prometheus.Labels{"actor": actorName},
+	}, func() float64 { return float64(depth()) }))
+}
+
+// RegisterStreamLag exposes how far the WAL streamer is behind.
+// lag returns the request IDs of the last streamed and the last acknowledged
+// draws. It is called on every scrape and must be safe for concurrent use.
+func (m *Metrics) RegisterStreamLag(lag func() (streamed, acked uint64)) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stream_acked_request_id",
+			Help:      "Request ID of the last draw acknowledged by the stream receiver.",
+		}, func() float64 {
+			_, acked := lag()
+			return float64(acked)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stream_lag_request_ids",
+			Help:      "Number of draws streamed but not yet acknowledged by the stream receiver.",
+		}, func() float64 {
+			streamed, acked := lag()
+			if acked > streamed {
+				return 0
+			}
+			return float64(streamed - acked)
+		}),
+	)
+}
+
+// RegisterRemainingQuantity exposes the remaining quantity of every item.
+// state is called on every scrape, so it should go through the actor
+// (e.g. System.State) rather than read the pool directly.
+func (m *Metrics) RegisterRemainingQuantity(state func() []types.PoolReward) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(&remainingCollector{
+		state: state,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "item_remaining_quantity"),
+			"Remaining quantity per item. -1 means unlimited.",
+			[]string{"item"}, nil,
+		),
+	})
+}
+
+// remainingCollector builds the per-item gauges at scrape time so removed
+// items disappear without any bookkeeping on the actor side.
+type remainingCollector struct {
+	state func() []types.PoolReward
+	desc  *prometheus.Desc
+}
+
+func (c *remainingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *remainingCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, item := range c.state() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(item.Quantity), item.ItemID)
+	}
+}
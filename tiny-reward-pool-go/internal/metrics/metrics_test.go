@@ -0,0 +1,108 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+func TestMetrics_NilIsNoOp(t *testing.T) {
+	var m *metrics.Metrics
+
+	assert.NotPanics(t, func() {
+		m.IncUpdates()
+		m.ObserveFlush(time.Millisecond)
+		m.ObserveSnapshot(time.Millisecond)
+		m.AddWALBytes(10)
+		m.IncWALRotations()
+		m.SetPendingLogs(3)
+		m.RegisterMailboxDepth("processor", func() int { return 0 })
+		m.RegisterRemainingQuantity(func() []types.PoolReward { return nil })
+		m.NewDrawRecorder().Inc("gold", metrics.OutcomeSuccess)
+	})
+}
+
+func TestMetrics_Collect(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	rec := m.NewDrawRecorder()
+	rec.Inc("gold", metrics.OutcomeSuccess)
+	rec.Inc("gold", metrics.OutcomeSuccess)
+	rec.Inc("", metrics.OutcomePoolEmpty)
+	m.IncUpdates()
+	m.AddWALBytes(128)
+	m.IncWALRotations()
+	m.SetPendingLogs(7)
+	m.RegisterMailboxDepth("processor", func() int { return 4 })
+	m.RegisterRemainingQuantity(func() []types.PoolReward {
+		return []types.PoolReward{{ItemID: "gold", Quantity: 98}, {ItemID: "mud", Quantity: -1}}
+	})
+
+	expected := `
+# HELP rewardpool_draws_total Number of draws by item and outcome.
+# TYPE rewardpool_draws_total counter
+rewardpool_draws_total{item="",outcome="pool_empty"} 1
+rewardpool_draws_total{item="gold",outcome="success"} 2
+# HELP rewardpool_item_remaining_quantity Remaining quantity per item. -1 means unlimited.
+# TYPE rewardpool_item_remaining_quantity gauge
+rewardpool_item_remaining_quantity{item="gold"} 98
+rewardpool_item_remaining_quantity{item="mud"} -1
+# HELP rewardpool_mailbox_depth Number of messages waiting in an actor mailbox.
+# TYPE rewardpool_mailbox_depth gauge
+rewardpool_mailbox_depth{actor="processor"} 4
+# HELP rewardpool_pending_logs Number of logs staged in the actor and not yet flushed.
+# TYPE rewardpool_pending_logs gauge
+rewardpool_pending_logs 7
+# HELP rewardpool_updates_total Number of item updates.
+# TYPE rewardpool_updates_total counter
+rewardpool_updates_total 1
+# HELP rewardpool_wal_bytes_written_total Number of encoded bytes written to the WAL storage.
+# TYPE rewardpool_wal_bytes_written_total counter
+rewardpool_wal_bytes_written_total 128
+# HELP rewardpool_wal_rotations_total Number of WAL file rotations.
+# TYPE rewardpool_wal_rotations_total counter
+rewardpool_wal_rotations_total 1
+`
+	err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected),
+		"rewardpool_draws_total",
+		"rewardpool_item_remaining_quantity",
+		"rewardpool_mailbox_depth",
+		"rewardpool_pending_logs",
+		"rewardpool_updates_total",
+		"rewardpool_wal_bytes_written_total",
+		"rewardpool_wal_rotations_total",
+	)
+	require.NoError(t, err)
+}
+
+func TestMetrics_Serve(t *testing.T) {
+	m := metrics.NewMetrics()
+	m.IncUpdates()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- metrics.Serve(ctx, m, lis) }()
+
+	resp, err := http.Get("http://" + lis.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "rewardpool_updates_total 1")
+
+	cancel()
+	require.NoError(t, <-done)
+}
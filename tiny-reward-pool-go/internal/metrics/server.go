@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe exposes the metrics on `/metrics` until ctx is cancelled.
+func ListenAndServe(ctx context.Context, m *Metrics, listenAddress string) error {
+	lis, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, m, lis)
+}
+
+// Serve is like ListenAndServe but uses an existing listener.
+func Serve(ctx context.Context, m *Metrics, lis net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
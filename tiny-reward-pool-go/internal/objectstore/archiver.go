@@ -0,0 +1,401 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+const (
+	defaultArchiverRetryBackoff = time.Second
+	defaultArchiverMaxBackoff   = time.Minute
+	defaultArchiverMaxPending   = 128
+
+	// stagedSuffix names the hard links of the queued files.
+	stagedSuffix = ".archive"
+
+	segmentDir  = "wal/"
+	snapshotDir = "snapshot/"
+)
+
+// Archiver uploads finalized WAL segments, with the snapshot each one ends
+// on, to an object store:
+//
+//	<prefix>wal/wal.NNN
+//	<prefix>snapshot/wal.NNN
+//
+// The snapshot is uploaded first, so an archived segment always has one.
+// Restore downloads the latest segment and its snapshot to an empty disk.
+//
+// The queue holds paths, the files are read when they are uploaded. The
+// queued files are hard linked next to them with the .archive suffix, so
+// the compactor and the next snapshot can remove them meanwhile. A link is
+// removed once uploaded, the ones left by a crash are not uploaded.
+type Archiver struct {
+	client       Client
+	prefix       string
+	formatter    types.LogFormatter
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	maxPending   int
+	logger       *slog.Logger
+
+	mu      sync.Mutex
+	pending []upload
+	notify  chan struct{}
+}
+
+// ArchiverOptional provides optional settings for the Archiver.
+type ArchiverOptional struct {
+	// Prefix is prepended to every key, e.g. "pool-a/".
+	Prefix string
+	// Formatter decodes the WAL segments. Defaults to JSON.
+	Formatter    types.LogFormatter
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// MaxPending bounds the queued uploads, a segment takes one or two.
+	// ArchiveSegment fails with ErrQueueFull beyond it. Defaults to 128.
+	MaxPending int
+	Logger     *slog.Logger
+}
+
+// ErrQueueFull is returned by ArchiveSegment when MaxPending uploads are
+// queued: the object store does not keep up.
+var ErrQueueFull = errors.New("archive queue is full")
+
+// upload is a queued file: the first size bytes of the hard link at path,
+// the whole file when size is negative.
+type upload struct {
+	key  string
+	path string
+	size int64
+}
+
+// NewArchiver creates an Archiver. Run uploads the archived segments.
+func NewArchiver(client Client, opts ...ArchiverOptional) *Archiver {
+	var opt ArchiverOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = defaultArchiverRetryBackoff
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = defaultArchiverMaxBackoff
+	}
+	if opt.MaxPending <= 0 {
+		opt.MaxPending = defaultArchiverMaxPending
+	}
+	return &Archiver{
+		client:       client,
+		prefix:       opt.Prefix,
+		formatter:    opt.Formatter,
+		retryBackoff: opt.RetryBackoff,
+		maxBackoff:   opt.MaxBackoff,
+		maxPending:   opt.MaxPending,
+		logger:       opt.Logger,
+		notify:       make(chan struct{}, 1),
+	}
+}
+
+// ArchiveSegment queues the finalized WAL file at walPath and the snapshot
+// file named by its last snapshot entry. Both are hard linked right away:
+// the snapshot file is removed once the next snapshot is logged. It fails
+// with ErrQueueFull when the queue is full, and nothing is queued.
+func (a *Archiver) ArchiveSegment(walPath string) error {
+	entries, hdr, err := wal.ParseWAL(walPath, a.formatter)
+	if err != nil {
+		return err
+	}
+	if hdr == nil {
+		return fmt.Errorf("%s is not a WAL file", walPath)
+	}
+
+	name := filepath.Base(walPath)
+	var uploads []upload
+	// sources are the files the uploads link to.
+	var sources []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		if snapshot, ok := entries[i].(*types.WalLogSnapshotItem); ok {
+			// Named after the segment too, two segments may end on the
+			// same snapshot.
+			uploads = append(uploads, upload{key: a.prefix + snapshotDir + name, path: snapshot.Path + "." + name + stagedSuffix, size: -1})
+			sources = append(sources, snapshot.Path)
+			break
+		}
+	}
+	// A preallocated file is zero-filled after its data.
+	uploads = append(uploads, upload{key: a.prefix + segmentDir + name, path: walPath + stagedSuffix, size: types.WALHeaderSize + int64(hdr.DataLength)})
+	sources = append(sources, walPath)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending)+len(uploads) > a.maxPending {
+		return fmt.Errorf("%w: %d uploads pending, %s not queued", ErrQueueFull, len(a.pending), walPath)
+	}
+	for i, u := range uploads {
+		if err := stage(sources[i], u.path); err != nil {
+			for _, staged := range uploads[:i] {
+				os.Remove(staged.path)
+			}
+			return err
+		}
+	}
+	a.pending = append(a.pending, uploads...)
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// stage hard links the file at path to staged, replacing a link left by an
+// earlier run.
+func stage(path, staged string) error {
+	if err := os.Remove(staged); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(path, staged)
+}
+
+// read returns the content of the queued file.
+func (u upload) read() ([]byte, error) {
+	if u.size < 0 {
+		return os.ReadFile(u.path)
+	}
+	f, err := os.Open(u.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, u.size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// put uploads the queued file. A file that cannot be read is not retried.
+func (a *Archiver) put(ctx context.Context, u upload) (retry bool, err error) {
+	data, err := u.read()
+	if err != nil {
+		return false, err
+	}
+	if err := a.client.Put(ctx, u.key, data); err != nil {
+		return true, err
+	}
+	os.Remove(u.path)
+	return false, nil
+}
+
+// Pending returns the number of uploads not done yet.
+func (a *Archiver) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+// Run uploads the queued files in order until ctx is cancelled, retrying
+// failed uploads with an exponential backoff. A file that cannot be read
+// is logged and dropped.
+func (a *Archiver) Run(ctx context.Context) {
+	backoff := a.retryBackoff
+	for {
+		a.mu.Lock()
+		var next *upload
+		if len(a.pending) > 0 {
+			next = &a.pending[0]
+		}
+		a.mu.Unlock()
+
+		if next == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.notify:
+				continue
+			}
+		}
+
+		if retry, err := a.put(ctx, *next); retry {
+			if ctx.Err() != nil {
+				return
+			}
+			if a.logger != nil {
+				a.logger.Warn("failed to archive, retrying", "key", next.key, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, a.maxBackoff)
+			continue
+		} else if err != nil && a.logger != nil {
+			a.logger.Error("failed to read the file to archive, dropping it", "key", next.key, "path", next.path, "error", err)
+		}
+		backoff = a.retryBackoff
+
+		a.mu.Lock()
+		a.pending = a.pending[1:]
+		a.mu.Unlock()
+	}
+}
+
+// Flush uploads the queued files once, e.g. on shutdown after Run
+// returned. It stops at the first failure, a file that cannot be read is
+// dropped.
+func (a *Archiver) Flush(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if len(a.pending) == 0 {
+			a.mu.Unlock()
+			return nil
+		}
+		next := a.pending[0]
+		a.mu.Unlock()
+
+		retry, err := a.put(ctx, next)
+		if retry {
+			return fmt.Errorf("failed to archive %s: %w", next.key, err)
+		}
+		a.mu.Lock()
+		a.pending = a.pending[1:]
+		a.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", next.key, err)
+		}
+	}
+}
+
+// Restore downloads the latest archived segment to walDir, and its snapshot
+// to walDir under the file name of its last snapshot entry, so recovery can
+// start from them. The path in the entry is the layout of the host that
+// wrote it and is not used. It reports false when nothing is archived.
+func (a *Archiver) Restore(ctx context.Context, walDir string) (bool, error) {
+	keys, err := a.client.List(ctx, a.prefix+segmentDir)
+	if err != nil {
+		return false, err
+	}
+	var latest string
+	var latestSeqNo uint64
+	for _, key := range keys {
+		name := path.Base(key)
+		if !strings.HasPrefix(name, types.WALBaseName+".") {
+			continue
+		}
+		seqNo, err := strconv.ParseUint(strings.TrimPrefix(name, types.WALBaseName+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		if latest == "" || seqNo > latestSeqNo {
+			latest, latestSeqNo = name, seqNo
+		}
+	}
+	if latest == "" {
+		return false, nil
+	}
+
+	segment, err := a.client.Get(ctx, a.prefix+segmentDir+latest)
+	if err != nil {
+		return false, err
+	}
+	snapshot, err := a.client.Get(ctx, a.prefix+snapshotDir+latest)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		return false, err
+	}
+	walPath := filepath.Join(walDir, latest)
+	if err := os.WriteFile(walPath, segment, 0644); err != nil {
+		return false, err
+	}
+	if snapshot == nil {
+		return true, nil
+	}
+
+	entries, _, err := wal.ParseWAL(walPath, a.formatter)
+	if err != nil {
+		return false, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if item, ok := entries[i].(*types.WalLogSnapshotItem); ok {
+			name := filepath.Base(item.Path)
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				return false, fmt.Errorf("invalid snapshot path %q in archived segment %s", item.Path, latest)
+			}
+			return true, os.WriteFile(filepath.Join(walDir, name), snapshot, 0644)
+		}
+	}
+	return true, nil
+}
+
+// Storage is a types.Storage that hands its WAL file to an Archiver once
+// it is finalized.
+type Storage struct {
+	types.Storage
+	path     string
+	archiver *Archiver
+	archived bool
+}
+
+var _ types.Storage = (*Storage)(nil)
+
+// NewStorage wraps the storage of the WAL file at walPath.
+func NewStorage(inner types.Storage, walPath string, archiver *Archiver) *Storage {
+	return &Storage{Storage: inner, path: walPath, archiver: archiver}
+}
+
+// FinalizeAndClose finalizes the file and queues it for upload. A failure
+// to queue it is logged and does not fail the WAL.
+func (s *Storage) FinalizeAndClose() error {
+	if err := s.Storage.FinalizeAndClose(); err != nil {
+		return err
+	}
+	if s.archived {
+		return nil
+	}
+	s.archived = true
+	if err := s.archiver.ArchiveSegment(s.path); err != nil && s.archiver.logger != nil {
+		s.archiver.logger.Error("failed to archive WAL segment", "path", s.path, "error", err)
+	}
+	return nil
+}
+
+// SetFirstRequestID forwards to the wrapped storage, see wal.WAL.
+func (s *Storage) SetFirstRequestID(id uint64) {
+	if inner, ok := s.Storage.(interface{ SetFirstRequestID(id uint64) }); ok {
+		inner.SetFirstRequestID(id)
+	}
+}
+
+// Truncate forwards to the wrapped storage, see wal.WAL.
+func (s *Storage) Truncate(size int64) error {
+	inner, ok := s.Storage.(interface{ Truncate(size int64) error })
+	if !ok {
+		return fmt.Errorf("cannot truncate %T", s.Storage)
+	}
+	return inner.Truncate(size)
+}
+
+func (s *Storage) Close() error {
+	return s.FinalizeAndClose()
+}
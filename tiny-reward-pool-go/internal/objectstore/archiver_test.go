@@ -0,0 +1,205 @@
+package objectstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/objectstore"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+func TestArchiver_RestoreEmptyDisk(t *testing.T) {
+	_, srv := newFakeS3(t, "rewards")
+	client, err := objectstore.NewS3Client(srv.URL, "rewards", testCreds)
+	require.NoError(t, err)
+	archiver := objectstore.NewArchiver(client, objectstore.ArchiverOptional{Prefix: "pool-a/"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		archiver.Run(ctx)
+	}()
+
+	walDir := t.TempDir()
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		// Small files, so the draws cross rotations.
+		store, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4 * 1024})
+		if err != nil {
+			return nil, err
+		}
+		return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), objectstore.NewStorage(store, path, archiver))
+	}
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	w, err := walFactory(path, seqNo)
+	require.NoError(t, err)
+
+	catalog := []types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}}
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, rewardpool.NewPool(catalog), &actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		WALFactory:      walFactory,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	require.NoError(t, sys.Snapshot())
+	state := sys.State()
+	sys.Stop()
+
+	cancel()
+	<-done
+	require.NoError(t, archiver.Flush(context.Background()))
+	assert.Equal(t, 0, archiver.Pending())
+
+	// The disk is lost, the pool is restored on a host with another layout.
+	// The snapshot goes to the new WAL dir, not to the path of the old host.
+	require.NoError(t, os.RemoveAll(walDir))
+	newDir := t.TempDir()
+	newUtils := utils.NewDefaultUtils(newDir, newDir, 0, io.Discard)
+
+	pool, lastRequestID, lastWalPath, err := recovery.RecoverPoolFromArchive(context.Background(), rewardpool.NewPool(catalog), formatter.NewJSONFormatter(), newUtils, archiver, newDir)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), lastRequestID)
+	assert.Equal(t, state, pool.State())
+	assert.Empty(t, lastWalPath)
+	assert.NoDirExists(t, walDir)
+	assert.FileExists(t, filepath.Join(newDir, "snapshot-100.json"))
+}
+
+func TestArchiver_RestoreNothingArchived(t *testing.T) {
+	archiver := objectstore.NewArchiver(objectstore.NewMemoryClient())
+	walDir := t.TempDir()
+
+	restored, err := archiver.Restore(context.Background(), walDir)
+	require.NoError(t, err)
+	assert.False(t, restored)
+	entries, err := os.ReadDir(walDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// flakyClient fails the first puts.
+type flakyClient struct {
+	*objectstore.MemoryClient
+	failures atomic.Int32
+}
+
+func (c *flakyClient) Put(ctx context.Context, key string, data []byte) error {
+	if c.failures.Add(-1) >= 0 {
+		return errors.New("unavailable")
+	}
+	return c.MemoryClient.Put(ctx, key, data)
+}
+
+func TestArchiver_RetryUpload(t *testing.T) {
+	client := &flakyClient{MemoryClient: objectstore.NewMemoryClient()}
+	client.failures.Store(2)
+	archiver := objectstore.NewArchiver(client, objectstore.ArchiverOptional{RetryBackoff: time.Millisecond})
+
+	walDir := t.TempDir()
+	path := walDir + "/wal.000"
+	store, err := storage.NewFileStorage(path, 0)
+	require.NoError(t, err)
+	w, err := wal.NewWAL(path, 0, formatter.NewJSONFormatter(), objectstore.NewStorage(store, path, archiver))
+	require.NoError(t, err)
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 1, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go archiver.Run(ctx)
+	require.Eventually(t, func() bool { return archiver.Pending() == 0 }, 5*time.Second, time.Millisecond)
+
+	keys, err := client.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wal/wal.000"}, keys)
+}
+
+// writeSegment writes a finalized WAL file seqNo in dir, holding a draw and
+// a snapshot entry when snapshotPath is set.
+func writeSegment(t *testing.T, dir string, seqNo uint64, snapshotPath string) string {
+	path := filepath.Join(dir, fmt.Sprintf("%s.%03d", types.WALBaseName, seqNo))
+	store, err := storage.NewFileStorage(path, seqNo)
+	require.NoError(t, err)
+	w, err := wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store)
+	require.NoError(t, err)
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: seqNo + 1, ItemID: "gold", Success: true}))
+	if snapshotPath != "" {
+		require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: snapshotPath}))
+	}
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+	return path
+}
+
+func TestArchiver_ReadsFilesAtUpload(t *testing.T) {
+	client := objectstore.NewMemoryClient()
+	archiver := objectstore.NewArchiver(client)
+	walDir := t.TempDir()
+	snapshotPath := filepath.Join(walDir, "snapshot-1.json")
+	require.NoError(t, os.WriteFile(snapshotPath, []byte(`{"last_request_id":1}`), 0644))
+	walPath := writeSegment(t, walDir, 0, snapshotPath)
+	require.NoError(t, archiver.ArchiveSegment(walPath))
+
+	// Removed by the next snapshot and the compactor before the upload.
+	require.NoError(t, os.Remove(snapshotPath))
+	segment, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(walPath))
+
+	require.NoError(t, archiver.Flush(context.Background()))
+	data, err := client.Get(context.Background(), "snapshot/wal.000")
+	require.NoError(t, err)
+	assert.Equal(t, `{"last_request_id":1}`, string(data))
+	data, err = client.Get(context.Background(), "wal/wal.000")
+	require.NoError(t, err)
+	assert.Equal(t, bytes.TrimRight(segment, "\x00"), data)
+
+	// The links are removed once uploaded.
+	entries, err := os.ReadDir(walDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestArchiver_QueueFull(t *testing.T) {
+	client := objectstore.NewMemoryClient()
+	archiver := objectstore.NewArchiver(client, objectstore.ArchiverOptional{MaxPending: 3})
+	walDir := t.TempDir()
+	snapshotPath := filepath.Join(walDir, "snapshot-1.json")
+	require.NoError(t, os.WriteFile(snapshotPath, []byte(`{}`), 0644))
+
+	require.NoError(t, archiver.ArchiveSegment(writeSegment(t, walDir, 0, snapshotPath)))
+	require.NoError(t, archiver.ArchiveSegment(writeSegment(t, walDir, 1, "")))
+	// Nothing is queued when the segment and its snapshot do not fit.
+	assert.ErrorIs(t, archiver.ArchiveSegment(writeSegment(t, walDir, 2, snapshotPath)), objectstore.ErrQueueFull)
+	assert.Equal(t, 3, archiver.Pending())
+	assert.NoFileExists(t, filepath.Join(walDir, "wal.002.archive"))
+	assert.NoFileExists(t, snapshotPath+".wal.002.archive")
+
+	require.NoError(t, archiver.Flush(context.Background()))
+	require.NoError(t, archiver.ArchiveSegment(filepath.Join(walDir, "wal.002")))
+	require.NoError(t, archiver.Flush(context.Background()))
+	keys, err := client.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snapshot/wal.000", "snapshot/wal.002", "wal/wal.000", "wal/wal.001", "wal/wal.002"}, keys)
+}
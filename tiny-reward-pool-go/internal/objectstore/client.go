@@ -0,0 +1,65 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by Client.Get for a missing key.
+var ErrNotFound = errors.New("object not found")
+
+// Client is the part of an object store API used to archive the WAL.
+type Client interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns ErrNotFound when the key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// MemoryClient is a Client keeping the objects in memory, for tests.
+type MemoryClient struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+var _ Client = (*MemoryClient)(nil)
+
+// NewMemoryClient creates an empty MemoryClient.
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{objects: make(map[string][]byte)}
+}
+
+func (c *MemoryClient) Put(ctx context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[key] = bytes.Clone(data)
+	return nil
+}
+
+func (c *MemoryClient) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(data), nil
+}
+
+func (c *MemoryClient) List(ctx context.Context, prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for key := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,33 @@
+package raft
+
+// MessageType is the type of a Raft Message.
+type MessageType int
+
+const (
+	// MsgVote asks for a vote. LogIndex/LogTerm describe the candidate's last entry.
+	MsgVote MessageType = iota + 1
+	MsgVoteResp
+	// MsgApp carries the entries after LogIndex/LogTerm and the leader's commit index.
+	// With no entries it is a heartbeat.
+	MsgApp
+	// MsgAppResp acknowledges a MsgApp or MsgSnap. Hint is the last index
+	// the follower has, or on Reject the index the leader should retry after.
+	MsgAppResp
+	// MsgSnap carries a Snapshot for a follower that fell behind the compacted log.
+	MsgSnap
+)
+
+// Message is exchanged between Nodes through a Transport.
+type Message struct {
+	Type     MessageType
+	From     string
+	To       string
+	Term     uint64
+	LogIndex uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+	Reject   bool
+	Hint     uint64
+	Snapshot *Snapshot
+}
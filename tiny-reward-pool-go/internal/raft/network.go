@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Network is an in-process Transport between Nodes that can drop and delay
+// messages and isolate nodes. It is used to test the cluster in a single
+// process.
+type Network struct {
+	mu       sync.Mutex
+	nodes    map[string]*Node
+	isolated map[string]bool
+	dropRate float64
+	maxDelay time.Duration
+	rand     *rand.Rand
+}
+
+// NetworkOptional provides optional settings for the Network.
+type NetworkOptional struct {
+	// DropRate is the probability in [0, 1) that a message is lost.
+	DropRate float64
+	// MaxDelay delays each message by a random duration up to MaxDelay,
+	// which also reorders them.
+	MaxDelay time.Duration
+	Seed     uint64
+}
+
+// NewNetwork creates a Network.
+func NewNetwork(opts ...NetworkOptional) *Network {
+	var opt NetworkOptional
+	for _, o := range opts {
+		opt = o
+	}
+	return &Network{
+		nodes:    make(map[string]*Node),
+		isolated: make(map[string]bool),
+		dropRate: opt.DropRate,
+		maxDelay: opt.MaxDelay,
+		rand:     rand.New(rand.NewPCG(opt.Seed, opt.Seed)),
+	}
+}
+
+// Add registers a node so it receives the messages sent to its ID.
+func (nw *Network) Add(node *Node) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[node.cfg.ID] = node
+}
+
+// Isolate drops every message from and to id until Heal is called.
+func (nw *Network) Isolate(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.isolated[id] = true
+}
+
+// Heal reconnects an isolated node.
+func (nw *Network) Heal(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.isolated, id)
+}
+
+// Send implements Transport.
+func (nw *Network) Send(msg Message) {
+	nw.mu.Lock()
+	node := nw.nodes[msg.To]
+	lost := node == nil || nw.isolated[msg.From] || nw.isolated[msg.To] || nw.rand.Float64() < nw.dropRate
+	var delay time.Duration
+	if nw.maxDelay > 0 {
+		delay = time.Duration(nw.rand.Int64N(int64(nw.maxDelay)))
+	}
+	nw.mu.Unlock()
+
+	if lost {
+		return
+	}
+	if delay == 0 {
+		node.Step(msg)
+		return
+	}
+	time.AfterFunc(delay, func() { node.Step(msg) })
+}
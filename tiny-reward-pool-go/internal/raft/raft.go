@@ -0,0 +1,714 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+const (
+	defaultTickInterval         = 10 * time.Millisecond
+	defaultElectionTicks        = 10
+	defaultHeartbeatTicks       = 1
+	defaultSnapshotThreshold    = 10_000
+	defaultMaxEntriesPerMessage = 64
+	defaultMailboxSize          = 4096
+)
+
+// ErrStopped is returned to proposals still waiting when the node stops.
+var ErrStopped = errors.New("raft node stopped")
+
+// Role is the role of a Node in its current term.
+type Role int
+
+const (
+	RoleFollower Role = iota
+	RoleCandidate
+	RoleLeader
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleLeader:
+		return "leader"
+	case RoleCandidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// Entry is a Raft log entry. Entries with nil Data are appended by new
+// leaders and are not passed to the StateMachine.
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Data  []byte
+}
+
+// Snapshot replaces the log up to Index. Pool is the state machine state
+// at that index, so a follower that fell behind the compacted log is
+// restored from it.
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Pool  *types.PoolSnapshot
+}
+
+// StateMachine receives the committed entries in log order.
+type StateMachine interface {
+	Apply(index uint64, data []byte) error
+	Snapshot() (*types.PoolSnapshot, error)
+	Restore(snapshot *types.PoolSnapshot) error
+}
+
+// Transport delivers messages to other nodes. It may drop, delay or
+// reorder them; Send must not block.
+type Transport interface {
+	Send(msg Message)
+}
+
+// Config holds the settings of a Node.
+type Config struct {
+	ID string
+	// Peers lists all the nodes of the cluster, including ID.
+	Peers        []string
+	Transport    Transport
+	StateMachine StateMachine
+	// Storage persists the hard state and the log. Defaults to MemoryStorage.
+	Storage Storage
+
+	// TickInterval is the duration of a tick. Timeouts below are in ticks.
+	TickInterval time.Duration
+	// ElectionTicks is the minimum election timeout. A leader that did not
+	// hear from a quorum for ElectionTicks steps down.
+	ElectionTicks  int
+	HeartbeatTicks int
+	// SnapshotThreshold is the number of applied entries that triggers log compaction.
+	SnapshotThreshold uint64
+	// MaxEntriesPerMessage bounds the entries sent in one append message.
+	MaxEntriesPerMessage int
+	Logger               *slog.Logger
+}
+
+// Status is a point-in-time view of a Node.
+type Status struct {
+	ID      string
+	Term    uint64
+	Role    Role
+	Leader  string
+	Commit  uint64
+	Applied uint64
+}
+
+type proposal struct {
+	data  []byte
+	index chan uint64 // receives the index the proposal was appended at
+	done  chan error
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a member of a Raft cluster.
+//
+// Like the RewardProcessorActor, all the Raft state is owned by a single
+// goroutine fed by a mailbox; Step and Propose only send messages to it.
+// The log and hard state are saved to Config.Storage before any message
+// depending on them is sent. A node that lost them, e.g. with the default
+// MemoryStorage, must rejoin under a new ID. When Storage fails the node
+// stops, and its waiting proposals fail with the error.
+type Node struct {
+	cfg    Config
+	quorum int
+
+	recv    chan Message
+	propc   chan proposal
+	stopc   chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+
+	statusMu sync.RWMutex
+	status   Status
+
+	// Owned by the run goroutine.
+	role             Role
+	term             uint64
+	votedFor         string
+	leader           string
+	log              []Entry // entries after snap.Index
+	snap             Snapshot
+	commit           uint64
+	applied          uint64
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+	votes            map[string]bool
+	next             map[string]uint64
+	match            map[string]uint64
+	active           map[string]bool
+	waiters          map[uint64]waiter
+	storageErr       error
+}
+
+// NewNode creates a Node from the state saved in cfg.Storage. The
+// StateMachine is restored from the saved snapshot, the entries after it
+// are applied again once committed. Call Start to run it.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = defaultTickInterval
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = defaultElectionTicks
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = defaultHeartbeatTicks
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if cfg.MaxEntriesPerMessage <= 0 {
+		cfg.MaxEntriesPerMessage = defaultMaxEntriesPerMessage
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = MemoryStorage{}
+	}
+	hs, snap, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft storage: %w", err)
+	}
+	if snap.Pool != nil {
+		if err := cfg.StateMachine.Restore(snap.Pool); err != nil {
+			return nil, fmt.Errorf("failed to restore raft snapshot: %w", err)
+		}
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		quorum:   len(cfg.Peers)/2 + 1,
+		recv:     make(chan Message, defaultMailboxSize),
+		propc:    make(chan proposal),
+		stopc:    make(chan struct{}),
+		done:     make(chan struct{}),
+		waiters:  make(map[uint64]waiter),
+		term:     hs.Term,
+		votedFor: hs.VotedFor,
+		log:      entries,
+		snap:     snap,
+		commit:   snap.Index,
+		applied:  snap.Index,
+	}
+	n.resetElectionTimeout()
+	n.publishStatus()
+	return n, nil
+}
+
+// Start runs the node in its own goroutine.
+func (n *Node) Start() {
+	go n.run()
+}
+
+// Stop stops the node. Waiting proposals fail with ErrStopped.
+func (n *Node) Stop() {
+	n.stopped.Do(func() {
+		close(n.stopc)
+		<-n.done
+	})
+}
+
+// Step delivers a message from the Transport. Messages are dropped when
+// the mailbox is full, Raft retries them.
+func (n *Node) Step(msg Message) {
+	select {
+	case n.recv <- msg:
+	default:
+	}
+}
+
+// Propose appends data to the log and waits until it is committed and
+// applied. It fails with types.ErrNotLeader when the node is not the
+// leader or loses leadership before the entry is committed. In the latter
+// case the entry may still be committed by the next leader.
+//
+// ctx only bounds the wait for the proposal to be appended: once appended,
+// Propose waits for the outcome so the caller never reverts an entry that
+// is committed later by this leader.
+func (n *Node) Propose(ctx context.Context, data []byte) (uint64, error) {
+	p := proposal{data: data, index: make(chan uint64, 1), done: make(chan error, 1)}
+	select {
+	case n.propc <- p:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-n.done:
+		return 0, ErrStopped
+	}
+	err := <-p.done
+	select {
+	case index := <-p.index:
+		return index, err
+	default:
+		return 0, err
+	}
+}
+
+// Status returns the current status of the node.
+func (n *Node) Status() Status {
+	n.statusMu.RLock()
+	defer n.statusMu.RUnlock()
+	return n.status
+}
+
+// IsLeader reports whether the node is the leader of its current term.
+func (n *Node) IsLeader() bool {
+	return n.Status().Role == RoleLeader
+}
+
+func (n *Node) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.cfg.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case m := <-n.recv:
+			n.step(m)
+		case p := <-n.propc:
+			n.propose(p)
+		case <-n.stopc:
+			n.failWaiters(ErrStopped)
+			return
+		}
+		n.publishStatus()
+		if n.storageErr != nil {
+			n.failWaiters(n.storageErr)
+			return
+		}
+	}
+}
+
+func (n *Node) publishStatus() {
+	n.statusMu.Lock()
+	defer n.statusMu.Unlock()
+	n.status = Status{
+		ID:      n.cfg.ID,
+		Term:    n.term,
+		Role:    n.role,
+		Leader:  n.leader,
+		Commit:  n.commit,
+		Applied: n.applied,
+	}
+}
+
+// Log helpers
+
+func (n *Node) firstIndex() uint64 { return n.snap.Index + 1 }
+
+func (n *Node) lastIndex() uint64 { return n.snap.Index + uint64(len(n.log)) }
+
+// termAt returns the term of the entry at index, false when it was
+// compacted or does not exist.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snap.Index {
+		return n.snap.Term, true
+	}
+	if index < n.firstIndex() || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.firstIndex()].Term, true
+}
+
+func (n *Node) lastTerm() uint64 {
+	t, _ := n.termAt(n.lastIndex())
+	return t
+}
+
+// Role transitions
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.cfg.ElectionTicks + rand.IntN(n.cfg.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if n.role == RoleLeader {
+		n.failWaiters(types.ErrNotLeader)
+	}
+	if term != n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveHardState()
+	}
+	n.role = RoleFollower
+	n.leader = leader
+	n.resetElectionTimeout()
+}
+
+func (n *Node) campaign() {
+	n.term++
+	n.role = RoleCandidate
+	n.votedFor = n.cfg.ID
+	n.saveHardState()
+	n.leader = ""
+	n.votes = map[string]bool{n.cfg.ID: true}
+	n.resetElectionTimeout()
+	if n.quorum == 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		n.send(Message{Type: MsgVote, To: peer, LogIndex: n.lastIndex(), LogTerm: n.lastTerm()})
+	}
+}
+
+func (n *Node) becomeLeader() {
+	if n.cfg.Logger != nil {
+		n.cfg.Logger.Info("raft: elected leader", "id", n.cfg.ID, "term", n.term)
+	}
+	n.role = RoleLeader
+	n.leader = n.cfg.ID
+	n.heartbeatElapsed = 0
+	n.electionElapsed = 0
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.active = make(map[string]bool)
+	for _, peer := range n.cfg.Peers {
+		n.next[peer] = n.lastIndex() + 1
+	}
+	// Entries of previous terms are only committed through an entry of this term.
+	n.appendEntry(nil)
+	n.maybeCommit()
+	n.broadcastAppend()
+}
+
+// Events
+
+func (n *Node) tick() {
+	if n.role == RoleLeader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.cfg.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+		n.electionElapsed++
+		if n.electionElapsed >= n.cfg.ElectionTicks {
+			n.electionElapsed = 0
+			// Check quorum: a partitioned leader steps down so its proposals fail.
+			if len(n.active)+1 < n.quorum {
+				if n.cfg.Logger != nil {
+					n.cfg.Logger.Warn("raft: lost quorum, stepping down", "id", n.cfg.ID, "term", n.term)
+				}
+				n.becomeFollower(n.term, "")
+			}
+			n.active = make(map[string]bool)
+		}
+		return
+	}
+
+	n.electionElapsed++
+	if n.electionElapsed >= n.electionTimeout {
+		n.campaign()
+	}
+}
+
+func (n *Node) propose(p proposal) {
+	if n.role != RoleLeader {
+		p.done <- types.ErrNotLeader
+		return
+	}
+	index := n.appendEntry(p.data)
+	p.index <- index
+	n.waiters[index] = waiter{term: n.term, done: p.done}
+	n.maybeCommit()
+	n.broadcastAppend()
+}
+
+func (n *Node) appendEntry(data []byte) uint64 {
+	index := n.lastIndex() + 1
+	e := Entry{Term: n.term, Index: index, Data: data}
+	n.log = append(n.log, e)
+	n.save(n.cfg.Storage.Append([]Entry{e}))
+	n.match[n.cfg.ID] = index
+	n.next[n.cfg.ID] = index + 1
+	return index
+}
+
+func (n *Node) step(m Message) {
+	switch {
+	case m.Term > n.term:
+		leader := ""
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	case m.Term < n.term:
+		// Tell a stale leader or candidate about the new term.
+		switch m.Type {
+		case MsgApp, MsgSnap:
+			n.send(Message{Type: MsgAppResp, To: m.From, Reject: true})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgVote:
+		canVote := n.votedFor == "" || n.votedFor == m.From
+		upToDate := m.LogTerm > n.lastTerm() || (m.LogTerm == n.lastTerm() && m.LogIndex >= n.lastIndex())
+		if canVote && upToDate && n.role != RoleLeader {
+			if n.votedFor != m.From {
+				n.votedFor = m.From
+				n.saveHardState()
+			}
+			n.resetElectionTimeout()
+			n.send(Message{Type: MsgVoteResp, To: m.From})
+		} else {
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+
+	case MsgVoteResp:
+		if n.role != RoleCandidate {
+			return
+		}
+		n.votes[m.From] = !m.Reject
+		granted, rejected := 0, 0
+		for _, v := range n.votes {
+			if v {
+				granted++
+			} else {
+				rejected++
+			}
+		}
+		if granted >= n.quorum {
+			n.becomeLeader()
+		} else if rejected >= n.quorum {
+			n.becomeFollower(n.term, "")
+		}
+
+	case MsgApp:
+		if n.role != RoleFollower || n.leader != m.From {
+			n.becomeFollower(n.term, m.From)
+		}
+		n.electionElapsed = 0
+		n.handleAppend(m)
+
+	case MsgSnap:
+		if n.role != RoleFollower || n.leader != m.From {
+			n.becomeFollower(n.term, m.From)
+		}
+		n.electionElapsed = 0
+		n.handleSnapshot(m)
+
+	case MsgAppResp:
+		if n.role != RoleLeader {
+			return
+		}
+		n.active[m.From] = true
+		if m.Reject {
+			if m.Hint+1 < n.next[m.From] {
+				n.next[m.From] = m.Hint + 1
+			}
+			n.sendAppend(m.From)
+			return
+		}
+		if m.Hint > n.match[m.From] {
+			n.match[m.From] = m.Hint
+			n.next[m.From] = m.Hint + 1
+			n.maybeCommit()
+		}
+		if n.next[m.From] <= n.lastIndex() {
+			n.sendAppend(m.From)
+		}
+	}
+}
+
+func (n *Node) handleAppend(m Message) {
+	if m.LogIndex < n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Hint: n.commit})
+		return
+	}
+	if t, ok := n.termAt(m.LogIndex); !ok || t != m.LogTerm {
+		hint := n.lastIndex()
+		if m.LogIndex <= hint {
+			hint = m.LogIndex - 1
+		}
+		n.send(Message{Type: MsgAppResp, To: m.From, Reject: true, Hint: hint})
+		return
+	}
+
+	var appended []Entry
+	for _, e := range m.Entries {
+		if t, ok := n.termAt(e.Index); ok {
+			if t == e.Term {
+				continue
+			}
+			// Conflict: drop this entry and everything after it.
+			n.log = n.log[:e.Index-n.firstIndex()]
+		}
+		n.log = append(n.log, e)
+		appended = append(appended, e)
+	}
+	n.save(n.cfg.Storage.Append(appended))
+
+	lastNew := m.LogIndex + uint64(len(m.Entries))
+	if commit := min(m.Commit, lastNew); commit > n.commit {
+		n.commit = commit
+		n.apply()
+	}
+	n.send(Message{Type: MsgAppResp, To: m.From, Hint: lastNew})
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	s := m.Snapshot
+	if s.Index <= n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Hint: n.commit})
+		return
+	}
+	if err := n.cfg.StateMachine.Restore(s.Pool); err != nil {
+		if n.cfg.Logger != nil {
+			n.cfg.Logger.Error("raft: failed to restore snapshot", "id", n.cfg.ID, "index", s.Index, "error", err)
+		}
+		return
+	}
+	if n.cfg.Logger != nil {
+		n.cfg.Logger.Info("raft: restored snapshot", "id", n.cfg.ID, "index", s.Index)
+	}
+	n.snap = *s
+	n.log = nil
+	n.commit = s.Index
+	n.applied = s.Index
+	n.save(n.cfg.Storage.SaveSnapshot(n.snap, nil))
+	n.send(Message{Type: MsgAppResp, To: m.From, Hint: s.Index})
+}
+
+// maybeCommit advances the commit index to the highest entry of the
+// current term stored on a quorum.
+func (n *Node) maybeCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if t, _ := n.termAt(index); t != n.term {
+			return
+		}
+		count := 0
+		for _, peer := range n.cfg.Peers {
+			if n.match[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum {
+			n.commit = index
+			n.apply()
+			return
+		}
+	}
+}
+
+func (n *Node) apply() {
+	for n.applied < n.commit {
+		n.applied++
+		e := n.log[n.applied-n.firstIndex()]
+		if e.Data != nil {
+			if err := n.cfg.StateMachine.Apply(e.Index, e.Data); err != nil && n.cfg.Logger != nil {
+				n.cfg.Logger.Error("raft: failed to apply entry", "id", n.cfg.ID, "index", e.Index, "error", err)
+			}
+		}
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.done <- nil
+			} else {
+				w.done <- types.ErrNotLeader
+			}
+		}
+	}
+	n.maybeCompact()
+}
+
+func (n *Node) maybeCompact() {
+	if n.applied-n.snap.Index < n.cfg.SnapshotThreshold {
+		return
+	}
+	pool, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		if n.cfg.Logger != nil {
+			n.cfg.Logger.Error("raft: failed to snapshot", "id", n.cfg.ID, "error", err)
+		}
+		return
+	}
+	term, _ := n.termAt(n.applied)
+	n.log = append([]Entry(nil), n.log[n.applied-n.firstIndex()+1:]...)
+	n.snap = Snapshot{Index: n.applied, Term: term, Pool: pool}
+	n.save(n.cfg.Storage.SaveSnapshot(n.snap, n.log))
+}
+
+func (n *Node) saveHardState() {
+	n.save(n.cfg.Storage.SaveHardState(HardState{Term: n.term, VotedFor: n.votedFor}))
+}
+
+// save records the first Storage error. No message is sent after it, and
+// the node stops once the current event is handled.
+func (n *Node) save(err error) {
+	if err == nil || n.storageErr != nil {
+		return
+	}
+	if n.cfg.Logger != nil {
+		n.cfg.Logger.Error("raft: failed to save state, stopping", "id", n.cfg.ID, "error", err)
+	}
+	n.storageErr = err
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		delete(n.waiters, index)
+		w.done <- err
+	}
+}
+
+// Sending
+
+func (n *Node) send(m Message) {
+	if n.storageErr != nil {
+		return
+	}
+	m.From = n.cfg.ID
+	m.Term = n.term
+	n.cfg.Transport.Send(m)
+}
+
+func (n *Node) broadcastAppend() {
+	for _, peer := range n.cfg.Peers {
+		if peer != n.cfg.ID {
+			n.sendAppend(peer)
+		}
+	}
+}
+
+// sendAppend sends the entries the peer is missing, or the snapshot when
+// they were compacted.
+func (n *Node) sendAppend(to string) {
+	prev := n.next[to] - 1
+	prevTerm, ok := n.termAt(prev)
+	if !ok {
+		snap := n.snap
+		n.send(Message{Type: MsgSnap, To: to, Snapshot: &snap})
+		return
+	}
+
+	start := prev + 1 - n.firstIndex()
+	end := min(uint64(len(n.log)), start+uint64(n.cfg.MaxEntriesPerMessage))
+	// Copy: the log is modified after the message is handed to the transport.
+	entries := append([]Entry(nil), n.log[start:end]...)
+	n.send(Message{Type: MsgApp, To: to, LogIndex: prev, LogTerm: prevTerm, Entries: entries, Commit: n.commit})
+}
@@ -0,0 +1,327 @@
+package raft_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/raft"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// chainStateMachine hashes the applied entries in order, so two nodes have
+// the same hash only if they applied the same entries in the same order.
+// The snapshot carries the count in LastRequestID and the hash in SHA256.
+type chainStateMachine struct {
+	mu       sync.Mutex
+	count    uint64
+	hash     string
+	restored int
+}
+
+func (s *chainStateMachine) Apply(index uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := sha256.Sum256(append([]byte(s.hash), data...))
+	s.hash = hex.EncodeToString(sum[:])
+	s.count++
+	return nil
+}
+
+func (s *chainStateMachine) Snapshot() (*types.PoolSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &types.PoolSnapshot{LastRequestID: s.count, SHA256: s.hash}, nil
+}
+
+func (s *chainStateMachine) Restore(snapshot *types.PoolSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count, s.hash = snapshot.LastRequestID, snapshot.SHA256
+	s.restored++
+	return nil
+}
+
+func (s *chainStateMachine) get() (uint64, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.hash, s.restored
+}
+
+type cluster struct {
+	network *raft.Network
+	nodes   map[string]*raft.Node
+	sms     map[string]*chainStateMachine
+}
+
+func newCluster(t *testing.T, snapshotThreshold uint64, opt raft.NetworkOptional) *cluster {
+	t.Helper()
+	peers := []string{"n1", "n2", "n3"}
+	c := &cluster{
+		network: raft.NewNetwork(opt),
+		nodes:   make(map[string]*raft.Node),
+		sms:     make(map[string]*chainStateMachine),
+	}
+	for _, id := range peers {
+		sm := &chainStateMachine{}
+		node, err := raft.NewNode(raft.Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         c.network,
+			StateMachine:      sm,
+			TickInterval:      5 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		})
+		require.NoError(t, err)
+		c.network.Add(node)
+		c.nodes[id] = node
+		c.sms[id] = sm
+	}
+	for _, node := range c.nodes {
+		node.Start()
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// leader waits for a single leader among the nodes not in except.
+func (c *cluster) leader(t *testing.T, except ...string) *raft.Node {
+	t.Helper()
+	var leader *raft.Node
+	require.Eventually(t, func() bool {
+		leader = nil
+		for id, node := range c.nodes {
+			if node.IsLeader() && !contains(except, id) {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		return leader != nil
+	}, 10*time.Second, 5*time.Millisecond)
+	return leader
+}
+
+// propose retries until a leader accepts the entry.
+func (c *cluster) propose(t *testing.T, data string, except ...string) {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		leader := c.leader(t, except...)
+		if _, err := leader.Propose(context.Background(), []byte(data)); err == nil {
+			return
+		}
+	}
+	t.Fatalf("failed to commit %q", data)
+}
+
+func (c *cluster) assertConverged(t *testing.T, ids ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		count, hash, _ := c.sms[ids[0]].get()
+		for _, id := range ids[1:] {
+			if n, h, _ := c.sms[id].get(); n != count || h != hash {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 5*time.Millisecond)
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRaft_ReplicatesOverLossyNetwork(t *testing.T) {
+	c := newCluster(t, 0, raft.NetworkOptional{DropRate: 0.2, MaxDelay: 5 * time.Millisecond, Seed: 1})
+
+	for i := 0; i < 50; i++ {
+		c.propose(t, fmt.Sprintf("entry-%d", i))
+	}
+	c.assertConverged(t, "n1", "n2", "n3")
+	count, _, _ := c.sms["n1"].get()
+	assert.GreaterOrEqual(t, count, uint64(50))
+}
+
+func TestRaft_IsolatedLeaderStepsDown(t *testing.T) {
+	c := newCluster(t, 0, raft.NetworkOptional{})
+	c.propose(t, "before")
+
+	old := c.leader(t)
+	oldID := old.Status().ID
+	c.network.Isolate(oldID)
+
+	// The isolated leader cannot commit and steps down
+	_, err := old.Propose(context.Background(), []byte("lost"))
+	assert.ErrorIs(t, err, types.ErrNotLeader)
+	require.Eventually(t, func() bool { return !old.IsLeader() }, 5*time.Second, 5*time.Millisecond)
+
+	// The others elect a new leader and keep every committed entry
+	c.propose(t, "after", oldID)
+	c.network.Heal(oldID)
+	c.assertConverged(t, "n1", "n2", "n3")
+}
+
+func TestRaft_SnapshotTransfer(t *testing.T) {
+	c := newCluster(t, 10, raft.NetworkOptional{})
+	c.propose(t, "first")
+	leader := c.leader(t)
+
+	var lagging string
+	for id := range c.nodes {
+		if id != leader.Status().ID {
+			lagging = id
+			break
+		}
+	}
+	c.network.Isolate(lagging)
+
+	// The log is compacted past the entries the lagging node is missing
+	for i := 0; i < 35; i++ {
+		c.propose(t, fmt.Sprintf("entry-%d", i), lagging)
+	}
+
+	c.network.Heal(lagging)
+	c.assertConverged(t, "n1", "n2", "n3")
+	_, _, restored := c.sms[lagging].get()
+	assert.Equal(t, 1, restored)
+}
+
+// captureTransport records the messages a node sends.
+type captureTransport struct {
+	mu   sync.Mutex
+	msgs []raft.Message
+}
+
+func (c *captureTransport) Send(msg raft.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+}
+
+func (c *captureTransport) voteResp(from string) (raft.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.msgs {
+		if m.Type == raft.MsgVoteResp && m.To == from {
+			return m, true
+		}
+	}
+	return raft.Message{}, false
+}
+
+func TestRaft_RestartedNodeDoesNotVoteTwice(t *testing.T) {
+	dir := t.TempDir()
+	start := func(transport raft.Transport) *raft.Node {
+		storage, err := raft.NewFileStorage(dir)
+		require.NoError(t, err)
+		t.Cleanup(func() { storage.Close() })
+		node, err := raft.NewNode(raft.Config{
+			ID:           "n1",
+			Peers:        []string{"n1", "n2", "n3"},
+			Transport:    transport,
+			StateMachine: &chainStateMachine{},
+			Storage:      storage,
+			// Never campaign
+			TickInterval: time.Hour,
+		})
+		require.NoError(t, err)
+		node.Start()
+		return node
+	}
+
+	first := &captureTransport{}
+	node := start(first)
+	node.Step(raft.Message{Type: raft.MsgVote, From: "n2", To: "n1", Term: 5})
+	var resp raft.Message
+	require.Eventually(t, func() bool {
+		var ok bool
+		resp, ok = first.voteResp("n2")
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.False(t, resp.Reject)
+	node.Stop()
+
+	// The vote of term 5 went to n2
+	second := &captureTransport{}
+	node = start(second)
+	defer node.Stop()
+	assert.Equal(t, uint64(5), node.Status().Term)
+	node.Step(raft.Message{Type: raft.MsgVote, From: "n3", To: "n1", Term: 5})
+	require.Eventually(t, func() bool {
+		var ok bool
+		resp, ok = second.voteResp("n3")
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, resp.Reject)
+}
+
+func TestRaft_RestartKeepsLog(t *testing.T) {
+	peers := []string{"n1", "n2", "n3"}
+	network := raft.NewNetwork(raft.NetworkOptional{})
+	dirs := make(map[string]string)
+	nodes := make(map[string]*raft.Node)
+	sms := make(map[string]*chainStateMachine)
+	start := func(id string) {
+		storage, err := raft.NewFileStorage(dirs[id])
+		require.NoError(t, err)
+		t.Cleanup(func() { storage.Close() })
+		sm := &chainStateMachine{}
+		node, err := raft.NewNode(raft.Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         network,
+			StateMachine:      sm,
+			Storage:           storage,
+			TickInterval:      5 * time.Millisecond,
+			SnapshotThreshold: 10,
+		})
+		require.NoError(t, err)
+		network.Add(node)
+		nodes[id], sms[id] = node, sm
+		node.Start()
+	}
+	for _, id := range peers {
+		dirs[id] = t.TempDir()
+		start(id)
+	}
+	c := &cluster{network: network, nodes: nodes, sms: sms}
+	defer func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	}()
+
+	// Past the snapshot threshold, so the restart loads a snapshot and a log
+	for i := 0; i < 25; i++ {
+		c.propose(t, fmt.Sprintf("entry-%d", i))
+	}
+	c.assertConverged(t, "n1", "n2", "n3")
+
+	// Every node restarts from its storage with a fresh state machine
+	for _, id := range peers {
+		c.nodes[id].Stop()
+	}
+	for _, id := range peers {
+		start(id)
+	}
+	c.propose(t, "after")
+	c.assertConverged(t, "n1", "n2", "n3")
+	count, _, _ := c.sms["n1"].get()
+	assert.Equal(t, uint64(26), count)
+}
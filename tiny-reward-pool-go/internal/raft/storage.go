@@ -0,0 +1,262 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	hardStateFileName = "hardstate.json"
+	snapshotFileName  = "snapshot.json"
+	logFileName       = "log.jsonl"
+)
+
+// HardState is the state a Node must not forget across restarts: the
+// current term and the vote cast in it, so it never votes twice in a term.
+type HardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Storage persists the HardState, the log and the snapshot of a Node.
+// Every call returns once the data is durable: the Node sends the messages
+// that depend on it afterwards.
+type Storage interface {
+	// Load returns what was saved, or zero values and no entries for a new node.
+	// The entries follow the snapshot index.
+	Load() (HardState, Snapshot, []Entry, error)
+	SaveHardState(hs HardState) error
+	// Append saves entries, which follow each other. Saved entries from the
+	// index of the first one on are replaced.
+	Append(entries []Entry) error
+	// SaveSnapshot replaces the saved snapshot and log.
+	SaveSnapshot(snap Snapshot, log []Entry) error
+}
+
+// MemoryStorage is a Storage that keeps nothing. A node using it that
+// restarts must rejoin under a new ID.
+type MemoryStorage struct{}
+
+var _ Storage = MemoryStorage{}
+
+func (MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	return HardState{}, Snapshot{}, nil, nil
+}
+
+func (MemoryStorage) SaveHardState(hs HardState) error { return nil }
+
+func (MemoryStorage) Append(entries []Entry) error { return nil }
+
+func (MemoryStorage) SaveSnapshot(snap Snapshot, log []Entry) error { return nil }
+
+// FileStorage is a Storage in a directory: the HardState and the snapshot
+// in JSON files replaced atomically, and the log as one JSON entry per line,
+// appended and synced on every call.
+type FileStorage struct {
+	dir     string
+	log     *os.File
+	first   uint64  // index of the first entry in the log file
+	offsets []int64 // offset of each entry in the log file
+	size    int64
+}
+
+var _ Storage = (*FileStorage)(nil)
+
+// NewFileStorage creates a FileStorage in dir, creating dir if needed.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+// Load implements Storage. A torn last line of the log, left by a crash
+// during Append, is dropped.
+func (s *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	var hs HardState
+	var snap Snapshot
+	if err := readJSON(filepath.Join(s.dir, hardStateFileName), &hs); err != nil {
+		return hs, snap, nil, err
+	}
+	if err := readJSON(filepath.Join(s.dir, snapshotFileName), &snap); err != nil {
+		return hs, snap, nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, logFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hs, snap, nil, err
+	}
+	// A crash during SaveSnapshot may leave entries up to the snapshot index.
+	var entries []Entry
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		var e Entry
+		if err := json.Unmarshal(data[:end], &e); err != nil {
+			break
+		}
+		if e.Index > snap.Index {
+			if e.Index != snap.Index+uint64(len(entries))+1 {
+				return hs, snap, nil, fmt.Errorf("raft log has entry %d after %d", e.Index, snap.Index+uint64(len(entries)))
+			}
+			entries = append(entries, e)
+		}
+		data = data[end+1:]
+	}
+
+	if err := s.writeLog(entries); err != nil {
+		return hs, snap, nil, err
+	}
+	return hs, snap, entries, nil
+}
+
+// SaveHardState implements Storage.
+func (s *FileStorage) SaveHardState(hs HardState) error {
+	return writeJSON(filepath.Join(s.dir, hardStateFileName), hs)
+}
+
+// Append implements Storage.
+func (s *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if s.log == nil {
+		return errors.New("raft storage is not loaded")
+	}
+	if i := entries[0].Index; i < s.first+uint64(len(s.offsets)) {
+		// Replace the conflicting entries.
+		if i < s.first {
+			return fmt.Errorf("raft log entry %d is before the first saved entry %d", i, s.first)
+		}
+		s.size = s.offsets[i-s.first]
+		s.offsets = s.offsets[:i-s.first]
+		if err := s.log.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+	if len(s.offsets) == 0 {
+		s.first = entries[0].Index
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		s.offsets = append(s.offsets, s.size+int64(buf.Len()))
+		if err := json.NewEncoder(&buf).Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := s.log.WriteAt(buf.Bytes(), s.size); err != nil {
+		return err
+	}
+	s.size += int64(buf.Len())
+	return s.log.Sync()
+}
+
+// SaveSnapshot implements Storage. The snapshot is written before the log,
+// so a crash in between leaves entries Load skips.
+func (s *FileStorage) SaveSnapshot(snap Snapshot, log []Entry) error {
+	if err := writeJSON(filepath.Join(s.dir, snapshotFileName), snap); err != nil {
+		return err
+	}
+	return s.writeLog(log)
+}
+
+// Close closes the log file.
+func (s *FileStorage) Close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+// writeLog replaces the log file with entries and opens it for Append.
+func (s *FileStorage) writeLog(entries []Entry) error {
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		offsets = append(offsets, int64(buf.Len()))
+		if err := json.NewEncoder(&buf).Encode(e); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(s.dir, logFileName)
+	if err := writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if s.log != nil {
+		s.log.Close()
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		s.log = nil
+		return err
+	}
+	s.log = f
+	s.offsets = offsets
+	s.size = int64(buf.Len())
+	s.first = 0
+	if len(entries) > 0 {
+		s.first = entries[0].Index
+	}
+	return nil
+}
+
+func readJSON(path string, v any) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces path with data atomically.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
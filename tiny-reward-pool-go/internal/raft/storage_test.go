@@ -0,0 +1,68 @@
+package raft_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/raft"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+func loadStorage(t *testing.T, dir string) (*raft.FileStorage, raft.HardState, raft.Snapshot, []raft.Entry) {
+	t.Helper()
+	s, err := raft.NewFileStorage(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	hs, snap, entries, err := s.Load()
+	require.NoError(t, err)
+	return s, hs, snap, entries
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, hs, snap, entries := loadStorage(t, dir)
+	assert.Zero(t, hs)
+	assert.Zero(t, snap)
+	assert.Empty(t, entries)
+
+	require.NoError(t, s.SaveHardState(raft.HardState{Term: 2, VotedFor: "n2"}))
+	require.NoError(t, s.Append([]raft.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Data: []byte("a")}, {Term: 1, Index: 3, Data: []byte("b")}}))
+	// A new leader replaces the entries from index 3 on
+	require.NoError(t, s.Append([]raft.Entry{{Term: 2, Index: 3, Data: []byte("c")}, {Term: 2, Index: 4, Data: []byte("d")}}))
+	require.NoError(t, s.Close())
+
+	s, hs, _, entries = loadStorage(t, dir)
+	assert.Equal(t, raft.HardState{Term: 2, VotedFor: "n2"}, hs)
+	assert.Equal(t, []raft.Entry{
+		{Term: 1, Index: 1},
+		{Term: 1, Index: 2, Data: []byte("a")},
+		{Term: 2, Index: 3, Data: []byte("c")},
+		{Term: 2, Index: 4, Data: []byte("d")},
+	}, entries)
+
+	// Compaction keeps the entries after the snapshot
+	pool := &types.PoolSnapshot{LastRequestID: 7}
+	require.NoError(t, s.SaveSnapshot(raft.Snapshot{Index: 3, Term: 2, Pool: pool}, entries[3:]))
+	require.NoError(t, s.Append([]raft.Entry{{Term: 2, Index: 5, Data: []byte("e")}}))
+	require.NoError(t, s.Close())
+
+	// A crash in the middle of an append leaves a torn line
+	f, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Term":2,"Ind`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, _, snap, entries = loadStorage(t, dir)
+	assert.Equal(t, uint64(3), snap.Index)
+	assert.Equal(t, uint64(7), snap.Pool.LastRequestID)
+	assert.Equal(t, []raft.Entry{{Term: 2, Index: 4, Data: []byte("d")}, {Term: 2, Index: 5, Data: []byte("e")}}, entries)
+	require.NoError(t, s.Append([]raft.Entry{{Term: 3, Index: 6}}))
+	require.NoError(t, s.Close())
+
+	_, _, _, entries = loadStorage(t, dir)
+	assert.Len(t, entries, 3)
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// KeyedLimiter keeps one TokenBucket per key (e.g. per client).
+// Buckets that have refilled completely are dropped periodically so the
+// map does not grow with every client ever seen.
+type KeyedLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewKeyedLimiter creates a limiter where every key gets its own bucket.
+// A rate <= 0 means keys are never limited.
+func NewKeyedLimiter(rate float64, burst int) *KeyedLimiter {
+	return newKeyedLimiter(rate, burst, time.Now)
+}
+
+func newKeyedLimiter(rate float64, burst int, now func() time.Time) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*TokenBucket),
+		lastSweep: now(),
+		now:       now,
+	}
+}
+
+// AllowN reports whether key may consume n tokens and consumes them.
+func (l *KeyedLimiter) AllowN(key string, n int) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	return l.bucket(key).AllowN(n)
+}
+
+// Refund gives back n tokens to key's bucket.
+func (l *KeyedLimiter) Refund(key string, n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.bucket(key).Refund(n)
+}
+
+// Len returns the number of tracked keys.
+func (l *KeyedLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (l *KeyedLimiter) bucket(key string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := l.now(); now.Sub(l.lastSweep) >= defaultSweepInterval {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			if b.full() {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst, l.now)
+		l.buckets[key] = b
+	}
+	return b
+}
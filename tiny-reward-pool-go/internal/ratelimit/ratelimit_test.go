@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestTokenBucket_AllowAndRefill(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := newTokenBucket(10, 5, clock.Now)
+
+	// Starts full
+	assert.True(t, b.AllowN(5))
+	assert.False(t, b.Allow())
+
+	// 100ms at 10 tokens/s -> 1 token
+	clock.Advance(100 * time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// Refill never exceeds burst
+	clock.Advance(10 * time.Second)
+	assert.False(t, b.AllowN(6))
+	assert.True(t, b.AllowN(5))
+}
+
+func TestTokenBucket_RejectDoesNotConsume(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := newTokenBucket(1, 3, clock.Now)
+
+	assert.False(t, b.AllowN(4))
+	assert.True(t, b.AllowN(3))
+
+	b.Refund(2)
+	assert.True(t, b.AllowN(2))
+	assert.False(t, b.Allow())
+}
+
+func TestTokenBucket_Unlimited(t *testing.T) {
+	b := NewTokenBucket(0, 0)
+	for i := 0; i < 1000; i++ {
+		assert.True(t, b.AllowN(1000))
+	}
+}
+
+func TestKeyedLimiter_PerKey(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := newKeyedLimiter(1, 2, clock.Now)
+
+	assert.True(t, l.AllowN("a", 2))
+	assert.False(t, l.AllowN("a", 1))
+
+	// Another key has its own bucket
+	assert.True(t, l.AllowN("b", 2))
+	assert.Equal(t, 2, l.Len())
+}
+
+func TestKeyedLimiter_SweepsIdleKeys(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := newKeyedLimiter(1, 2, clock.Now)
+
+	l.AllowN("a", 1)
+	l.AllowN("b", 1)
+	assert.Equal(t, 2, l.Len())
+
+	// After the sweep interval both buckets are full again and get dropped.
+	clock.Advance(defaultSweepInterval)
+	l.AllowN("c", 1)
+	assert.Equal(t, 1, l.Len())
+}
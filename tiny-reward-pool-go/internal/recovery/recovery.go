@@ -1,14 +1,17 @@
 package recovery
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
 )
 
 // RecoverPool loads the pool state from a snapshot and replays any subsequent WAL entries.
@@ -18,7 +21,7 @@ func RecoverPool(configPath string, formatter types.LogFormatter, utils types.Ut
 	var lastRequestID uint64
 
 	// 1. Get all WAL files, sorted by sequence number.
-	walFiles, err := utils.GetWALFiles()
+	walFiles, err := listWALFiles(utils)
 	if err != nil {
 		return nil, 0, "", fmt.Errorf("failed to get WAL files: %w", err)
 	}
@@ -28,25 +31,22 @@ func RecoverPool(configPath string, formatter types.LogFormatter, utils types.Ut
 	var snapshotToLoad string // Initialize to empty
 
 	if len(walFiles) > 0 {
-		lastWalPath = walFiles[len(walFiles)-1]
-
-		// Parse only the latest WAL file
-		entries, _, err := wal.ParseWAL(lastWalPath, formatter)
+		var entries []types.WalLogEntry
+		var walPath string
+		entries, walPath, lastWalPath, err = readLatestWAL(walFiles, formatter)
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("error parsing latest WAL file %s: %w", lastWalPath, err)
+			return nil, 0, "", err
 		}
 
-		if len(entries) == 0 {
-			// Latest WAL is empty or only contains header, indicate no WAL to continue from
-			lastWalPath = ""
-		} else {
-			// The first entry must be a snapshot
-			snapshotLog, ok := entries[0].(*types.WalLogSnapshotItem)
-			if !ok {
-				return nil, 0, "", fmt.Errorf("first entry in WAL %s is not a snapshot", lastWalPath)
+		if len(entries) > 0 {
+			// A later snapshot (e.g. taken on shutdown) supersedes the initial one.
+			snapshotIdx := lastSnapshotIndex(entries)
+			snapshotToLoad = entries[snapshotIdx].(*types.WalLogSnapshotItem).Path
+			// Replay logs after the latest snapshot
+			logsToReplay, err = logsAfterSnapshot(entries, snapshotIdx)
+			if err != nil {
+				return nil, 0, "", fmt.Errorf("invalid snapshot entry in WAL %s: %w", walPath, err)
 			}
-			snapshotToLoad = snapshotLog.Path
-			logsToReplay = entries[1:] // Replay logs after the initial snapshot
 		}
 	}
 
@@ -56,19 +56,13 @@ func RecoverPool(configPath string, formatter types.LogFormatter, utils types.Ut
 	// Attempt to load from the determined snapshot path.
 	if snapshotToLoad != "" {
 		if _, err := os.Stat(snapshotToLoad); err == nil {
-			file, err := os.Open(snapshotToLoad)
+			snap, err := readSnapshot(snapshotToLoad, formatter)
 			if err != nil {
-				return nil, 0, "", fmt.Errorf("failed to open snapshot file %s: %w", snapshotToLoad, err)
-			}
-			defer file.Close()
-
-			var snap types.PoolSnapshot
-			if err := json.NewDecoder(file).Decode(&snap); err != nil {
-				return nil, 0, "", fmt.Errorf("failed to decode snapshot %s: %w", snapshotToLoad, err)
+				return nil, 0, "", err
 			}
 
 			// Load the pool state and the last request ID from the snapshot.
-			pool.LoadSnapshot(&snap)
+			pool.LoadSnapshot(snap)
 			lastRequestID = snap.LastRequestID
 
 		} else if !os.IsNotExist(err) {
@@ -117,11 +111,18 @@ func RecoverPool(configPath string, formatter types.LogFormatter, utils types.Ut
 // RecoverPoolFromConfig loads the pool state from a snapshot and replays any subsequent WAL entries.
 // It returns the recovered pool, the last used request ID, the path of the last WAL file, and any error that occurred.
 func RecoverPoolFromConfig(initialPool *rewardpool.Pool, formatter types.LogFormatter, utils types.Utils) (*rewardpool.Pool, uint64, string, error) {
+	return recoverPool(initialPool, formatter, utils, "")
+}
+
+// recoverPool is RecoverPoolFromConfig. When snapshotDir is set, the
+// snapshot is read from it under the file name of the snapshot entry
+// instead of the path in the entry.
+func recoverPool(initialPool *rewardpool.Pool, formatter types.LogFormatter, utils types.Utils, snapshotDir string) (*rewardpool.Pool, uint64, string, error) {
 	var pool *rewardpool.Pool
 	var lastRequestID uint64
 
 	// 1. Get all WAL files, sorted by sequence number.
-	walFiles, err := utils.GetWALFiles()
+	walFiles, err := listWALFiles(utils)
 	if err != nil {
 		return nil, 0, "", fmt.Errorf("failed to get WAL files: %w", err)
 	}
@@ -131,25 +132,25 @@ func RecoverPoolFromConfig(initialPool *rewardpool.Pool, formatter types.LogForm
 	var snapshotToLoad string // Initialize to empty
 
 	if len(walFiles) > 0 {
-		lastWalPath = walFiles[len(walFiles)-1]
-
-		// Parse only the latest WAL file
-		entries, _, err := wal.ParseWAL(lastWalPath, formatter)
+		var entries []types.WalLogEntry
+		var walPath string
+		entries, walPath, lastWalPath, err = readLatestWAL(walFiles, formatter)
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("error parsing latest WAL file %s: %w", lastWalPath, err)
+			return nil, 0, "", err
 		}
 
-		if len(entries) == 0 {
-			// Latest WAL is empty or only contains header, indicate no WAL to continue from
-			lastWalPath = ""
-		} else {
-			// The first entry must be a snapshot
-			snapshotLog, ok := entries[0].(*types.WalLogSnapshotItem)
-			if !ok {
-				return nil, 0, "", fmt.Errorf("first entry in WAL %s is not a snapshot", lastWalPath)
+		if len(entries) > 0 {
+			// A later snapshot (e.g. taken on shutdown) supersedes the initial one.
+			snapshotIdx := lastSnapshotIndex(entries)
+			snapshotToLoad = entries[snapshotIdx].(*types.WalLogSnapshotItem).Path
+			if snapshotDir != "" {
+				snapshotToLoad = filepath.Join(snapshotDir, filepath.Base(snapshotToLoad))
+			}
+			// Replay logs after the latest snapshot
+			logsToReplay, err = logsAfterSnapshot(entries, snapshotIdx)
+			if err != nil {
+				return nil, 0, "", fmt.Errorf("invalid snapshot entry in WAL %s: %w", walPath, err)
 			}
-			snapshotToLoad = snapshotLog.Path
-			logsToReplay = entries[1:] // Replay logs after the initial snapshot
 		}
 	}
 
@@ -159,19 +160,13 @@ func RecoverPoolFromConfig(initialPool *rewardpool.Pool, formatter types.LogForm
 	// Attempt to load from the determined snapshot path.
 	if snapshotToLoad != "" {
 		if _, err := os.Stat(snapshotToLoad); err == nil {
-			file, err := os.Open(snapshotToLoad)
+			snap, err := readSnapshot(snapshotToLoad, formatter)
 			if err != nil {
-				return nil, 0, "", fmt.Errorf("failed to open snapshot file %s: %w", snapshotToLoad, err)
-			}
-			defer file.Close()
-
-			var snap types.PoolSnapshot
-			if err := json.NewDecoder(file).Decode(&snap); err != nil {
-				return nil, 0, "", fmt.Errorf("failed to decode snapshot %s: %w", snapshotToLoad, err)
+				return nil, 0, "", err
 			}
 
 			// Load the pool state and the last request ID from the snapshot.
-			pool.LoadSnapshot(&snap)
+			pool.LoadSnapshot(snap)
 			lastRequestID = snap.LastRequestID
 
 		} else if !os.IsNotExist(err) {
@@ -208,3 +203,144 @@ func RecoverPoolFromConfig(initialPool *rewardpool.Pool, formatter types.LogForm
 
 	return pool, lastRequestID, lastWalPath, nil
 }
+
+// Restorer downloads the latest archived WAL file, and the snapshot it
+// refers to, into walDir. It reports false when nothing is archived.
+type Restorer interface {
+	Restore(ctx context.Context, walDir string) (bool, error)
+}
+
+// RecoverPoolFromArchive restores the archived WAL state with restorer when
+// walDir holds no WAL file, e.g. on a new disk, then recovers like
+// RecoverPoolFromConfig. The entries written after the last archived WAL
+// file are lost.
+//
+// The snapshot entry of a restored file has the path of the host that wrote
+// it: the snapshot is read from walDir instead. No last WAL path is returned
+// then, so the next file starts with a snapshot entry of this host.
+func RecoverPoolFromArchive(ctx context.Context, initialPool *rewardpool.Pool, formatter types.LogFormatter, utils types.Utils, restorer Restorer, walDir string) (*rewardpool.Pool, uint64, string, error) {
+	walFiles, err := utils.GetWALFiles()
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to get WAL files: %w", err)
+	}
+	if len(walFiles) > 0 {
+		return RecoverPoolFromConfig(initialPool, formatter, utils)
+	}
+
+	restored, err := restorer.Restore(ctx, walDir)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to restore from archive: %w", err)
+	}
+	if !restored {
+		return RecoverPoolFromConfig(initialPool, formatter, utils)
+	}
+	if logger := utils.GetLogger(); logger != nil {
+		logger.Info("Restored the latest WAL file from the archive.")
+	}
+	pool, lastRequestID, _, err := recoverPool(initialPool, formatter, utils, walDir)
+	return pool, lastRequestID, "", err
+}
+
+// snapshotOpener is implemented by the formatters that decrypt the
+// snapshot files, see crypt.Formatter.
+// walVerifier is implemented by Utils that check the WAL files against
+// their checksums, e.g. utils.DefaultUtils.
+type walVerifier interface {
+	VerifyWALFiles() error
+}
+
+// listWALFiles returns the WAL files to recover from, once verified when
+// utils can.
+func listWALFiles(utils types.Utils) ([]string, error) {
+	walFiles, err := utils.GetWALFiles()
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := utils.(walVerifier); ok {
+		if err := v.VerifyWALFiles(); err != nil {
+			return nil, err
+		}
+	}
+	return walFiles, nil
+}
+
+type snapshotOpener interface {
+	OpenSnapshot(data []byte) ([]byte, error)
+}
+
+// readSnapshot reads a snapshot file, decrypting it with formatter when it
+// is encrypted.
+func readSnapshot(path string, formatter types.LogFormatter) (*types.PoolSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot file %s: %w", path, err)
+	}
+	if crypt.IsEncrypted(data) {
+		opener, ok := formatter.(snapshotOpener)
+		if !ok {
+			return nil, fmt.Errorf("%w: snapshot %s is encrypted", types.ErrEncryptionKeyMissing, path)
+		}
+		if data, err = opener.OpenSnapshot(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt snapshot %s: %w", path, err)
+		}
+	}
+	snap, err := snapshot.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+	}
+	return snap, nil
+}
+
+// readLatestWAL reads the latest WAL file with entries, its first entry
+// must be a snapshot. A crash right after a rotation leaves a newer file
+// without any: its snapshot entry was not flushed.
+//
+// lastWalPath is the file to continue, only set when it is the latest file
+// and it was finalized. A file left open by a crash is read up to its last
+// complete entry, and the next one is started after it.
+func readLatestWAL(walFiles []string, formatter types.LogFormatter) (entries []types.WalLogEntry, walPath, lastWalPath string, err error) {
+	for i := len(walFiles) - 1; i >= 0; i-- {
+		walPath = walFiles[i]
+		entries, hdr, err := wal.ReadWAL(walPath, formatter)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("error parsing latest WAL file %s: %w", walPath, err)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if _, ok := entries[0].(*types.WalLogSnapshotItem); !ok {
+			return nil, "", "", fmt.Errorf("first entry in WAL %s is not a snapshot", walPath)
+		}
+		if i == len(walFiles)-1 && hdr.Status == types.WALStatusClosed {
+			lastWalPath = walPath
+		}
+		return entries, walPath, lastWalPath, nil
+	}
+	return nil, "", "", nil
+}
+
+// logsAfterSnapshot returns the entries not in the snapshot of the entry at
+// idx: the ones after it, and the ones before it it is Behind, see
+// types.WalLogSnapshotItem.
+func logsAfterSnapshot(entries []types.WalLogEntry, idx int) ([]types.WalLogEntry, error) {
+	behind := entries[idx].(*types.WalLogSnapshotItem).Behind
+	if behind == 0 {
+		return entries[idx+1:], nil
+	}
+	if behind < 0 || behind > idx {
+		return nil, fmt.Errorf("snapshot is %d entries behind at entry %d", behind, idx)
+	}
+	logs := make([]types.WalLogEntry, 0, behind+len(entries)-idx-1)
+	logs = append(logs, entries[idx-behind:idx]...)
+	return append(logs, entries[idx+1:]...), nil
+}
+
+// lastSnapshotIndex returns the index of the last snapshot entry in entries, or -1.
+func lastSnapshotIndex(entries []types.WalLogEntry) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, ok := entries[i].(*types.WalLogSnapshotItem); ok {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,6 +1,8 @@
 package recovery_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -8,11 +10,14 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/objectstore"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
 )
@@ -105,4 +110,204 @@ func TestRecoverPool_MMap(t *testing.T) {
 
 	assert.Equal(t, uint64(22), lastRequestID)
 	assert.Equal(t, 98, recoveredPool.GetItemRemaining("gold"))
-}
\ No newline at end of file
+}
+func TestRecoverPool_LatestSnapshotInWAL(t *testing.T) {
+	snapshotPath, walPath, configPath, walDir := setupTestPaths(t)
+
+	w, err := wal.NewWAL(walPath, 0, formatter.NewJSONFormatter(), nil)
+	require.NoError(t, err)
+
+	writeSnapshot := func(path string, remaining int, lastRequestID uint64) {
+		pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: remaining, Probability: 50}})
+		snap, err := pool.CreateSnapshot()
+		require.NoError(t, err)
+		snap.LastRequestID = lastRequestID
+		sf, err := os.Create(path)
+		require.NoError(t, err)
+		require.NoError(t, json.NewEncoder(sf).Encode(snap))
+		sf.Close()
+	}
+
+	// Initial snapshot, two draws, then a snapshot taken on shutdown, then one more draw.
+	// Both snapshots use the same path, so the file holds the state of the second one.
+	writeSnapshot(snapshotPath, 98, 2)
+	snapshotLog := func(path string) types.WalLogSnapshotItem {
+		return types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: path}
+	}
+	drawLog := func(id uint64) types.WalLogDrawItem {
+		return types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: id, ItemID: "gold", Success: true}
+	}
+	require.NoError(t, w.LogSnapshot(snapshotLog(snapshotPath)))
+	require.NoError(t, w.LogDraw(drawLog(1)))
+	require.NoError(t, w.LogDraw(drawLog(2)))
+	require.NoError(t, w.LogSnapshot(snapshotLog(snapshotPath)))
+	require.NoError(t, w.LogDraw(drawLog(3)))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+
+	recoveredPool, lastRequestID, _, err := recovery.RecoverPool(configPath, formatter.NewJSONFormatter(), utils.NewDefaultUtils(walDir, "", 0, nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(3), lastRequestID)
+	assert.Equal(t, 97, recoveredPool.GetItemRemaining("gold"))
+}
+
+func TestRecoverPoolFromArchive_EmptyDisk(t *testing.T) {
+	snapshotPath, walPath, configPath, walDir := setupTestPaths(t)
+	jsonFormatter := formatter.NewJSONFormatter()
+	client := objectstore.NewMemoryClient()
+	archiver := objectstore.NewArchiver(client)
+
+	mmapStorage, err := storage.NewFileMMapStorage(walPath, 0)
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 0, jsonFormatter, objectstore.NewStorage(mmapStorage, walPath, archiver))
+	require.NoError(t, err)
+
+	pool, err := rewardpool.CreatePoolFromConfigPath(configPath)
+	require.NoError(t, err)
+	snap, err := pool.CreateSnapshot()
+	require.NoError(t, err)
+	snap.LastRequestID = 30
+	sf, err := os.Create(snapshotPath)
+	require.NoError(t, err)
+	require.NoError(t, json.NewEncoder(sf).Encode(snap))
+	sf.Close()
+
+	require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: snapshotPath}))
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 31, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+	require.NoError(t, archiver.Flush(context.Background()))
+
+	// The disk is lost.
+	require.NoError(t, os.Remove(walPath))
+	require.NoError(t, os.Remove(snapshotPath))
+
+	recoveredPool, lastRequestID, lastWalPath, err := recovery.RecoverPoolFromArchive(context.Background(), rewardpool.NewPool(nil), jsonFormatter, utils.NewDefaultUtils(walDir, "", 0, nil), archiver, walDir)
+	require.NoError(t, err)
+
+	// The restored file is not continued: its snapshot entry names the old path.
+	assert.Empty(t, lastWalPath)
+	assert.FileExists(t, walPath)
+	assert.Equal(t, uint64(31), lastRequestID)
+	assert.Equal(t, 99, recoveredPool.GetItemRemaining("gold"))
+	// The snapshot was restored to walDir
+	assert.FileExists(t, filepath.Join(walDir, filepath.Base(snapshotPath)))
+	assert.NoFileExists(t, snapshotPath)
+}
+
+func TestRecoverPool_Encrypted(t *testing.T) {
+	snapshotPath, walPath, configPath, walDir := setupTestPaths(t)
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	encrypted := crypt.NewFormatter(formatter.NewJSONFormatter(), ring)
+
+	pool, err := rewardpool.CreatePoolFromConfigPath(configPath)
+	require.NoError(t, err)
+	snap, err := pool.CreateSnapshot()
+	require.NoError(t, err)
+	snap.LastRequestID = 10
+	data, err := json.Marshal(snap)
+	require.NoError(t, err)
+	sealed, err := ring.Seal(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(snapshotPath, sealed, 0644))
+
+	fileStorage, err := storage.NewFileMMapStorage(walPath, 0, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4096, KeyID: ring.Active()})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 0, encrypted, fileStorage)
+	require.NoError(t, err)
+	require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: snapshotPath}))
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 11, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+
+	for _, path := range []string{walPath, snapshotPath} {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "gold", path)
+	}
+
+	u := utils.NewDefaultUtils(walDir, "", 0, nil)
+	recoveredPool, lastRequestID, _, err := recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), encrypted, u)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), lastRequestID)
+	assert.Equal(t, 99, recoveredPool.GetItemRemaining("gold"))
+
+	// Without the key, recovery fails instead of starting from the config.
+	_, _, _, err = recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), formatter.NewJSONFormatter(), u)
+	assert.ErrorIs(t, err, types.ErrEncryptionKeyMissing)
+
+	other, err := crypt.NewKeyring(2, map[uint32][]byte{2: bytes.Repeat([]byte{2}, 32)})
+	require.NoError(t, err)
+	_, _, _, err = recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), crypt.NewFormatter(formatter.NewJSONFormatter(), other), u)
+	assert.ErrorIs(t, err, types.ErrEncryptionKeyMissing)
+}
+
+func TestRecoverPool_BinarySnapshot(t *testing.T) {
+	_, walPath, configPath, walDir := setupTestPaths(t)
+	snapshotPath := filepath.Join(walDir, snapshot.FileName(snapshot.FormatBinary))
+
+	pool, err := rewardpool.CreatePoolFromConfigPath(configPath)
+	require.NoError(t, err)
+	view, err := snapshot.Capture(pool, 10)
+	require.NoError(t, err)
+	require.NoError(t, snapshot.Persist(view, snapshotPath, snapshot.PersistOptional{Format: snapshot.FormatBinary}))
+
+	w, err := wal.NewWAL(walPath, 0, formatter.NewJSONFormatter(), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: snapshotPath}))
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 11, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+
+	recoveredPool, lastRequestID, _, err := recovery.RecoverPool(configPath, formatter.NewJSONFormatter(), utils.NewDefaultUtils(walDir, "", 0, nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), lastRequestID)
+	assert.Equal(t, 99, recoveredPool.GetItemRemaining("gold"))
+
+	// A corrupted binary snapshot fails the recovery.
+	data, err := os.ReadFile(snapshotPath)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(snapshotPath, data, 0644))
+	_, _, _, err = recovery.RecoverPool(configPath, formatter.NewJSONFormatter(), utils.NewDefaultUtils(walDir, "", 0, nil))
+	assert.ErrorIs(t, err, types.ErrSnapshotChecksum)
+}
+
+func TestRecoverPool_SnapshotBehind(t *testing.T) {
+	for _, format := range []types.LogFormatter{formatter.NewJSONFormatter(), formatter.NewStringLineFormatter()} {
+		_, walPath, configPath, walDir := setupTestPaths(t)
+		initialPath := filepath.Join(walDir, "snapshot.json")
+		backgroundPath := filepath.Join(walDir, "snapshot-1.json")
+
+		pool, err := rewardpool.CreatePoolFromConfigPath(configPath)
+		require.NoError(t, err)
+		view, err := snapshot.Capture(pool, 0)
+		require.NoError(t, err)
+		require.NoError(t, snapshot.Persist(view, initialPath))
+		// Captured after the first draw, logged after the third.
+		catalog := view.Catalog.Items()
+		catalog[0].Quantity = 99
+		require.NoError(t, snapshot.Persist(&snapshot.View{LastRequestID: 1, Catalog: types.CatalogViewOf(catalog)}, backgroundPath))
+
+		drawLog := func(id uint64) types.WalLogDrawItem {
+			return types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: id, ItemID: "gold", Success: true}
+		}
+		w, err := wal.NewWAL(walPath, 0, format, nil)
+		require.NoError(t, err)
+		require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: initialPath}))
+		for id := uint64(1); id <= 3; id++ {
+			require.NoError(t, w.LogDraw(drawLog(id)))
+		}
+		require.NoError(t, w.LogSnapshot(types.WalLogSnapshotItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeSnapshot}, Path: backgroundPath, Behind: 2}))
+		require.NoError(t, w.LogDraw(drawLog(4)))
+		require.NoError(t, w.Flush())
+		require.NoError(t, w.Close())
+
+		recoveredPool, lastRequestID, _, err := recovery.RecoverPool(configPath, format, utils.NewDefaultUtils(walDir, "", 0, nil))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(4), lastRequestID)
+		assert.Equal(t, 96, recoveredPool.GetItemRemaining("gold"))
+	}
+}
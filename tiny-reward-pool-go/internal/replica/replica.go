@@ -0,0 +1,251 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+const defaultRetryInterval = time.Second
+
+// Replica follows a primary's walstream.TCPStreamer and keeps a read-only
+// copy of its pool.
+//
+// It is bootstrapped with a snapshot shipped by the primary, then applies the
+// committed entries with replay.ApplyLog. After a disconnect it reconnects
+// with the walstream.Position of the last applied entry and only receives
+// what it missed, also from a restarted primary.
+//
+// Replica implements the reads of the gRPC ActorSystem; draws and updates
+// fail with types.ErrReadOnlyReplica.
+type Replica struct {
+	primaryAddress string
+	retryInterval  time.Duration
+	logger         *slog.Logger
+	formatter      types.LogFormatter
+
+	mu       sync.RWMutex
+	pool     *rewardpool.Pool
+	position walstream.Position
+	ready    chan struct{}
+}
+
+// ReplicaOptional provides optional settings for the Replica.
+type ReplicaOptional struct {
+	// RetryInterval is the delay before reconnecting to the primary.
+	RetryInterval time.Duration
+	Logger        *slog.Logger
+}
+
+// NewReplica creates a Replica following the primary at primaryAddress.
+func NewReplica(primaryAddress string, opts ...ReplicaOptional) *Replica {
+	var opt ReplicaOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.RetryInterval <= 0 {
+		opt.RetryInterval = defaultRetryInterval
+	}
+
+	return &Replica{
+		primaryAddress: primaryAddress,
+		retryInterval:  opt.RetryInterval,
+		logger:         opt.Logger,
+		formatter:      walformatter.NewJSONFormatter(),
+		ready:          make(chan struct{}),
+	}
+}
+
+// Run follows the primary until ctx is cancelled, reconnecting after errors.
+func (r *Replica) Run(ctx context.Context) error {
+	for {
+		err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if r.logger != nil {
+			r.logger.Warn("replication stream lost, reconnecting", "primary", r.primaryAddress, "error", err)
+		}
+
+		select {
+		case <-time.After(r.retryInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// WaitReady blocks until the first snapshot from the primary is applied.
+func (r *Replica) WaitReady(ctx context.Context) error {
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// follow runs one replication session.
+func (r *Replica) follow(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.primaryAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	r.mu.RLock()
+	var hello walstream.ReplicationHello
+	if r.pool != nil {
+		position := r.position
+		hello.Position = &position
+	}
+	r.mu.RUnlock()
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var frame walstream.ReplicationFrame
+		if err := dec.Decode(&frame); err != nil {
+			return err
+		}
+		if err := r.apply(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Replica) apply(frame walstream.ReplicationFrame) error {
+	var entries []types.WalLogEntry
+	if frame.Snapshot == nil {
+		var err error
+		entries, err = r.formatter.Decode(frame.Entry)
+		if err != nil {
+			return fmt.Errorf("failed to decode entry at %+v: %w", frame.Position, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if frame.Snapshot != nil {
+		r.pool = rewardpool.NewPool(frame.Snapshot.Catalog)
+		if r.logger != nil {
+			r.logger.Info("replica bootstrapped from snapshot", "position", frame.Position)
+		}
+		select {
+		case <-r.ready:
+		default:
+			close(r.ready)
+		}
+	} else {
+		next := r.position
+		for _, entry := range entries {
+			next.Advance(entry)
+		}
+		if r.pool == nil || next != frame.Position {
+			return fmt.Errorf("unexpected entry at %+v, replica at %+v", frame.Position, r.position)
+		}
+		replay.ReplayLogs(r.pool, entries)
+	}
+
+	r.position = frame.Position
+	return nil
+}
+
+// Bootstrapped reports whether a snapshot from the primary was applied.
+func (r *Replica) Bootstrapped() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool != nil
+}
+
+// Position returns the position of the last applied frame.
+func (r *Replica) Position() walstream.Position {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.position
+}
+
+// State returns the replicated state of the reward pool.
+// It is empty until the replica is bootstrapped.
+func (r *Replica) State() []types.PoolReward {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.pool == nil {
+		return nil
+	}
+	return r.pool.State()
+}
+
+// StateCtx is like State. The replicated state is read without waiting.
+func (r *Replica) StateCtx(ctx context.Context) ([]types.PoolReward, error) {
+	return r.State(), nil
+}
+
+// Snapshot returns the replicated pool and request ID, or nil until the
+// replica is bootstrapped. It is used to promote the replica to a leader.
+func (r *Replica) Snapshot() (*types.PoolSnapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.pool == nil {
+		return nil, nil
+	}
+	snapshot, err := r.pool.CreateSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.LastRequestID = r.position.RequestID
+	return snapshot, nil
+}
+
+// GetRequestID returns the last request ID applied on the replica.
+func (r *Replica) GetRequestID() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.position.RequestID
+}
+
+// Draw is rejected on a replica.
+func (r *Replica) Draw() <-chan actor.DrawResponse {
+	respChan := make(chan actor.DrawResponse, 1)
+	respChan <- actor.DrawResponse{Err: types.ErrReadOnlyReplica}
+	return respChan
+}
+
+// TryDrawCtx is rejected on a replica.
+func (r *Replica) TryDrawCtx(ctx context.Context) (<-chan actor.DrawResponse, error) {
+	return nil, types.ErrReadOnlyReplica
+}
+
+// UpdateItem is rejected on a replica.
+func (r *Replica) UpdateItem(id string, quantity int, weight int64) error {
+	return types.ErrReadOnlyReplica
+}
+
+// SetRequestID does nothing: request IDs come from the primary.
+func (r *Replica) SetRequestID(id uint64) {}
+
+// Stop does nothing: cancel the context passed to Run instead.
+func (r *Replica) Stop() {}
@@ -0,0 +1,255 @@
+package replica_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replica"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	walformatter "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	walstorage "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+type primary struct {
+	sys      *actor.System
+	streamer *walstream.TCPStreamer
+	addr     string
+	stop     func()
+}
+
+// startPrimary runs an actor system streaming to a TCPStreamer on a local port.
+func startPrimary(t *testing.T, addr string, backlog int) *primary {
+	t.Helper()
+	pool := rewardpool.NewPool([]types.PoolReward{
+		{ItemID: "gold", Quantity: 1000, Probability: 10},
+		{ItemID: "silver", Quantity: 1000, Probability: 10},
+	})
+	return startPrimaryIn(t, t.TempDir(), "wal.000", addr, backlog, pool, 0)
+}
+
+// startPrimaryIn is like startPrimary but writes walName in dir, starting
+// from pool and lastRequestID as recovered from the WAL files already there.
+func startPrimaryIn(t *testing.T, dir, walName, addr string, backlog int, pool *rewardpool.Pool, lastRequestID uint64) *primary {
+	t.Helper()
+	walPath := filepath.Join(dir, walName)
+	storage, err := walstorage.NewFileStorage(walPath, 0)
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 0, walformatter.NewJSONFormatter(), storage)
+	require.NoError(t, err)
+
+	u := utils.NewDefaultUtils(dir, dir, slog.LevelError, io.Discard)
+	streamer := walstream.NewTCPStreamer(pool.State(), lastRequestID, walstream.TCPStreamerOptional{BacklogSize: backlog, Utils: u})
+
+	ctx := &types.Context{
+		WAL:   w,
+		Utils: u,
+	}
+	sys, err := actor.NewSystem(ctx, pool, &actor.SystemOptional{FlushAfterNDraw: 5, LastRequestID: lastRequestID, WALStreamer: streamer})
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	serveCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamer.Serve(serveCtx, lis)
+	}()
+
+	return &primary{
+		sys:      sys,
+		streamer: streamer,
+		addr:     lis.Addr().String(),
+		stop: func() {
+			cancel()
+			<-done
+		},
+	}
+}
+
+func (p *primary) draw(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		<-p.sys.Draw()
+	}
+	require.NoError(t, p.sys.Flush())
+}
+
+func startReplica(t *testing.T, addr string, logger ...*slog.Logger) (*replica.Replica, func()) {
+	t.Helper()
+	opt := replica.ReplicaOptional{RetryInterval: 10 * time.Millisecond}
+	for _, l := range logger {
+		opt.Logger = l
+	}
+	r := replica.NewReplica(addr, opt)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer waitCancel()
+	require.NoError(t, r.WaitReady(waitCtx))
+	return r, func() {
+		cancel()
+		<-done
+	}
+}
+
+// assertInSync waits until the replica has the primary's state.
+func assertInSync(t *testing.T, p *primary, r *replica.Replica) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return r.GetRequestID() == p.sys.GetRequestID() && assert.ObjectsAreEqual(sorted(p.sys.State()), sorted(r.State()))
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func sorted(items []types.PoolReward) []types.PoolReward {
+	slices.SortFunc(items, func(a, b types.PoolReward) int { return strings.Compare(a.ItemID, b.ItemID) })
+	return items
+}
+
+func TestReplica_BootstrapAndFollow(t *testing.T) {
+	p := startPrimary(t, "127.0.0.1:0", 100)
+	defer p.sys.Stop()
+	defer p.stop()
+
+	// Draws before the replica connects are shipped as a snapshot
+	p.draw(t, 20)
+
+	r, stopReplica := startReplica(t, p.addr)
+	defer stopReplica()
+	assertInSync(t, p, r)
+
+	// Then committed entries are streamed
+	p.draw(t, 30)
+	require.NoError(t, p.sys.UpdateItem("diamond", 5, 1))
+	require.NoError(t, p.sys.Flush())
+	assertInSync(t, p, r)
+	assert.Equal(t, uint64(50), r.GetRequestID())
+
+	// Replicas are read-only
+	assert.ErrorIs(t, r.UpdateItem("gold", 1, 1), types.ErrReadOnlyReplica)
+	_, err := r.TryDrawCtx(context.Background())
+	assert.ErrorIs(t, err, types.ErrReadOnlyReplica)
+}
+
+func TestReplica_CatchUpAfterDisconnect(t *testing.T) {
+	p := startPrimary(t, "127.0.0.1:0", 100)
+	defer p.sys.Stop()
+
+	r, stopReplica := startReplica(t, p.addr)
+	defer stopReplica()
+	p.draw(t, 10)
+	assertInSync(t, p, r)
+	position := r.Position()
+
+	// Drop the connection, keep drawing, then serve again on the same address
+	p.stop()
+	p.draw(t, 15)
+	lis, err := net.Listen("tcp", p.addr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.streamer.Serve(ctx, lis)
+
+	assertInSync(t, p, r)
+	// Resumed from the backlog
+	assert.Equal(t, walstream.Position{RequestID: position.RequestID + 15}, r.Position())
+}
+
+// bootstrapCount counts the snapshots a replica logs it was bootstrapped with.
+type bootstrapCount struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *bootstrapCount) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += strings.Count(string(p), "replica bootstrapped from snapshot")
+	return len(p), nil
+}
+
+func (c *bootstrapCount) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestReplica_ResumeAfterPrimaryRestart(t *testing.T) {
+	dir := t.TempDir()
+	pool := rewardpool.NewPool([]types.PoolReward{
+		{ItemID: "gold", Quantity: 1000, Probability: 10},
+		{ItemID: "silver", Quantity: 1000, Probability: 10},
+	})
+	p := startPrimaryIn(t, dir, "wal.000", "127.0.0.1:0", 100, pool, 0)
+
+	var bootstraps bootstrapCount
+	r, stopReplica := startReplica(t, p.addr, slog.New(slog.NewTextHandler(&bootstraps, nil)))
+	defer stopReplica()
+	p.draw(t, 10)
+	require.NoError(t, p.sys.UpdateItem("gold", 500, 10))
+	require.NoError(t, p.sys.Flush())
+	assertInSync(t, p, r)
+	assert.Equal(t, walstream.Position{RequestID: 10, Skip: 1}, r.Position())
+
+	// The replica is disconnected while the primary commits more entries
+	p.stop()
+	p.draw(t, 5)
+	require.NoError(t, p.sys.UpdateItem("silver", 500, 10))
+	require.NoError(t, p.sys.Flush())
+	state, lastRequestID := p.sys.State(), p.sys.GetRequestID()
+	p.sys.Stop()
+
+	// The restarted primary has an empty backlog and reads the missed
+	// entries back from the WAL files
+	restarted := startPrimaryIn(t, dir, "wal.001", p.addr, 100, rewardpool.NewPool(state), lastRequestID)
+	defer restarted.sys.Stop()
+	defer restarted.stop()
+	assert.Equal(t, walstream.Position{RequestID: 15, Skip: 1}, restarted.streamer.Position())
+
+	assertInSync(t, restarted, r)
+	restarted.draw(t, 5)
+	assertInSync(t, restarted, r)
+	assert.Equal(t, walstream.Position{RequestID: 20}, r.Position())
+	assert.Equal(t, 1, bootstraps.get())
+}
+
+func TestReplica_BootstrapWhenBehindBacklog(t *testing.T) {
+	p := startPrimary(t, "127.0.0.1:0", 5)
+	defer p.sys.Stop()
+
+	r, stopReplica := startReplica(t, p.addr)
+	defer stopReplica()
+	assertInSync(t, p, r)
+
+	p.stop()
+	// More entries than the backlog keeps
+	p.draw(t, 40)
+	lis, err := net.Listen("tcp", p.addr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.streamer.Serve(ctx, lis)
+
+	assertInSync(t, p, r)
+	assert.Equal(t, uint64(40), r.GetRequestID())
+}
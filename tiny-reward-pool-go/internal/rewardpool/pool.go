@@ -1,13 +1,11 @@
 package rewardpool
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"os"
-	"sort"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/selector"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 )
 
@@ -51,29 +49,17 @@ func (p *Pool) Load(config types.ConfigPool) error {
 }
 
 func (p *Pool) CreateSnapshot() (*types.PoolSnapshot, error) {
+	// Reflect item remaining
 	if len(p.pendingDraws) > 0 {
 		return nil, types.ErrPendingDrawsNotEmpty
 	}
-
-	// Reflect item remaining
 	snapshot_catalog := p.selector.SnapshotCatalog()
 
-	// Create a sorted copy of the catalog for deterministic hashing
-	sortedCatalog := make([]types.PoolReward, len(snapshot_catalog))
-	copy(sortedCatalog, snapshot_catalog)
-	sort.Slice(sortedCatalog, func(i, j int) bool {
-		return sortedCatalog[i].ItemID < sortedCatalog[j].ItemID
-	})
-
-	// Calculate SHA256 hash for integrity checking
-	hash := sha256.New()
-	// Hash the sorted catalog data by converting to JSON for consistent hashing
-	catalogJSON, err := json.Marshal(sortedCatalog)
+	// Hash the catalog sorted by ItemID for integrity checking
+	sha256Hash, err := snapshot.CatalogSHA256(snapshot_catalog)
 	if err != nil {
 		return nil, err
 	}
-	hash.Write(catalogJSON)
-	sha256Hash := hex.EncodeToString(hash.Sum(nil))
 
 	snap := &types.PoolSnapshot{
 		Catalog: snapshot_catalog,
@@ -82,6 +68,16 @@ func (p *Pool) CreateSnapshot() (*types.PoolSnapshot, error) {
 	return snap, nil
 }
 
+// CaptureCatalog returns the catalog with the remaining quantities,
+// copy-on-write: the items are only copied by the next writes, a chunk at
+// a time. See snapshot.Capture.
+func (p *Pool) CaptureCatalog() (types.CatalogView, error) {
+	if len(p.pendingDraws) > 0 {
+		return types.CatalogView{}, types.ErrPendingDrawsNotEmpty
+	}
+	return p.selector.CaptureCatalog(), nil
+}
+
 func (p *Pool) LoadSnapshot(snapshot *types.PoolSnapshot) error {
 	p.pendingDraws = make(map[string]int)
 	p.selector.Reset(snapshot.Catalog)
@@ -131,14 +127,24 @@ func (p *Pool) ApplyDrawLog(itemID string) {
 }
 
 func (p *Pool) ApplyUpdateLog(itemID string, quantity int, probability int64) {
-	p.selector.UpdateItem(itemID, quantity, probability)
+	p.upsertItem(itemID, quantity, probability)
 }
 
 func (p *Pool) UpdateItem(itemID string, quantity int, probability int64) error {
-	p.selector.UpdateItem(itemID, quantity, probability)
+	p.upsertItem(itemID, quantity, probability)
 	return nil
 }
 
+// upsertItem updates an item, or appends it to the catalog when it is unknown
+// (e.g. added by a config reload). Remaining quantities of the other items are kept.
+func (p *Pool) upsertItem(itemID string, quantity int, probability int64) {
+	if !p.selector.HasItem(itemID) {
+		// Add it empty first, then let the selector apply the values as for any update.
+		p.selector.Reset(append(p.selector.SnapshotCatalog(), types.PoolReward{ItemID: itemID}))
+	}
+	p.selector.UpdateItem(itemID, quantity, probability)
+}
+
 func (p *Pool) State() []types.PoolReward {
 	catalog := p.selector.SnapshotCatalog()
 	return catalog
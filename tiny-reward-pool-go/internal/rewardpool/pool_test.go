@@ -8,6 +8,7 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/selector"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 func TestTransactionalDraw(t *testing.T) {
@@ -18,7 +19,7 @@ func TestTransactionalDraw(t *testing.T) {
 	pool := NewPool(initialCatalog)
 
 	ctx := &types.Context{
-		WAL:   &utils.MockWAL{},
+		WAL:   wal.NewMemoryWAL(),
 		Utils: &utils.MockUtils{},
 	}
 
@@ -133,7 +134,7 @@ func TestTransactionalDrawWithUnlimitedQuantity(t *testing.T) {
 	pool := NewPool(initialCatalog)
 
 	ctx := &types.Context{
-		WAL:   &utils.MockWAL{},
+		WAL:   wal.NewMemoryWAL(),
 		Utils: &utils.MockUtils{},
 	}
 
@@ -270,7 +271,7 @@ func TestPool_CreateSnapshot_WithPendingDraws(t *testing.T) {
 	pool := NewPool(catalog)
 
 	ctx := &types.Context{
-		WAL:   &utils.MockWAL{},
+		WAL:   wal.NewMemoryWAL(),
 		Utils: &utils.MockUtils{},
 	}
 
@@ -289,3 +290,19 @@ func TestPool_CreateSnapshot_WithPendingDraws(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, snapshot.SHA256)
 }
+
+func TestPool_UpdateItem_AddsUnknownItem(t *testing.T) {
+	pool := NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 2, Probability: 10}})
+	_, err := pool.SelectItem(&types.Context{})
+	require.NoError(t, err)
+	pool.CommitDraw()
+
+	require.NoError(t, pool.UpdateItem("silver", 5, 20))
+	assert.Equal(t, 5, pool.GetItemRemaining("silver"))
+	// Existing items keep their remaining quantity
+	assert.Equal(t, 1, pool.GetItemRemaining("gold"))
+
+	pool.ApplyUpdateLog("bronze", 3, 30)
+	assert.Equal(t, 3, pool.GetItemRemaining("bronze"))
+	assert.Len(t, pool.State(), 3)
+}
@@ -0,0 +1,63 @@
+package selector
+
+import (
+	"slices"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// catalogChunkSize is the number of items copied by the first write to a
+// chunk shared with a capture.
+const catalogChunkSize = 256
+
+// catalog holds the items of a selector in chunks. A capture shares the
+// chunks, and the first write to a shared chunk copies it, so a capture
+// only copies the list of chunks.
+type catalog struct {
+	chunks [][]types.PoolReward
+	// shared marks the chunks referenced by a capture.
+	shared []bool
+	size   int
+}
+
+func newCatalog(items []types.PoolReward) catalog {
+	c := catalog{size: len(items)}
+	for start := 0; start < len(items); start += catalogChunkSize {
+		c.chunks = append(c.chunks, slices.Clone(items[start:min(start+catalogChunkSize, len(items))]))
+	}
+	c.shared = make([]bool, len(c.chunks))
+	return c
+}
+
+// at returns the item at i. It must not be written to, see mut.
+func (c *catalog) at(i int) *types.PoolReward {
+	return &c.chunks[i/catalogChunkSize][i%catalogChunkSize]
+}
+
+// mut returns the item at i to be written to, copying its chunk first when
+// a capture shares it.
+func (c *catalog) mut(i int) *types.PoolReward {
+	n := i / catalogChunkSize
+	if c.shared[n] {
+		c.chunks[n] = slices.Clone(c.chunks[n])
+		c.shared[n] = false
+	}
+	return &c.chunks[n][i%catalogChunkSize]
+}
+
+// capture shares the chunks with a view.
+func (c *catalog) capture() types.CatalogView {
+	for n := range c.shared {
+		c.shared[n] = true
+	}
+	return types.CatalogView{Chunks: slices.Clone(c.chunks)}
+}
+
+// items returns a copy of the items.
+func (c *catalog) items() []types.PoolReward {
+	items := make([]types.PoolReward, 0, c.size)
+	for _, chunk := range c.chunks {
+		items = append(items, chunk...)
+	}
+	return items
+}
@@ -14,8 +14,8 @@ type FenwickTreeSelector struct {
 	// tree stores the cumulative probabilities of items.
 	tree *utils.FenwickTree
 
-	// items stores the original reward data.
-	items []types.PoolReward
+	// items stores the reward data with the remaining quantities.
+	items catalog
 
 	// itemIDs maps the index in the Fenwick tree back to the actual ItemID.
 	itemIDs []string
@@ -23,9 +23,6 @@ type FenwickTreeSelector struct {
 	// itemIndex maps ItemID to its index in the Fenwick tree and itemIDs slice.
 	itemIndex map[string]int
 
-	// itemInfo tracks the current state (quantity) of each item.
-	itemInfo map[string]*types.PoolReward
-
 	// totalWeight stores the sum of all probabilities in the tree.
 	totalWeight int64
 
@@ -39,28 +36,28 @@ var _ types.ItemSelector = (*FenwickTreeSelector)(nil)
 func NewFenwickTreeSelector() *FenwickTreeSelector {
 	return &FenwickTreeSelector{
 		itemIndex: make(map[string]int),
-		itemInfo:  make(map[string]*types.PoolReward),
 		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
+// SetRand sets the random number generator of the selection, e.g. a
+// seeded one to replay the same draws.
+func (fts *FenwickTreeSelector) SetRand(r *rand.Rand) {
+	fts.rand = r
+}
+
 // Reset initializes or re-initializes the selector with a new catalog.
 func (fts *FenwickTreeSelector) Reset(catalog []types.PoolReward) {
-	fts.items = make([]types.PoolReward, len(catalog))
+	fts.items = newCatalog(catalog)
 	fts.itemIDs = make([]string, len(catalog))
 	fts.itemIndex = make(map[string]int)
-	fts.itemInfo = make(map[string]*types.PoolReward, len(catalog))
 	fts.totalWeight = 0
 
 	fts.tree = utils.NewFenwickTree(len(catalog))
 
 	for i, item := range catalog {
-		// Create a copy to avoid modifying the original catalog
-		itemCopy := item
-		fts.items[i] = itemCopy
 		fts.itemIDs[i] = item.ItemID
 		fts.itemIndex[item.ItemID] = i
-		fts.itemInfo[item.ItemID] = &fts.items[i]
 
 		if item.Quantity > 0 || item.Quantity == types.UnlimitedQuantity {
 			fts.tree.Add(i, item.Probability)
@@ -84,7 +81,7 @@ func (fts *FenwickTreeSelector) Select(ctx *types.Context) (string, error) {
 	}
 
 	selectedItemID := fts.itemIDs[idx]
-	if fts.itemInfo[selectedItemID].Quantity <= 0 && fts.itemInfo[selectedItemID].Quantity != types.UnlimitedQuantity {
+	if item := fts.items.at(idx); item.Quantity <= 0 && item.Quantity != types.UnlimitedQuantity {
 		return "", fmt.Errorf("internal error: selected item %s has zero quantity", selectedItemID)
 	}
 
@@ -98,10 +95,10 @@ func (fts *FenwickTreeSelector) Update(itemID string, delta int64) {
 		return
 	}
 
-	item := fts.itemInfo[itemID]
-	if item.Quantity == types.UnlimitedQuantity {
+	if fts.items.at(idx).Quantity == types.UnlimitedQuantity {
 		return // Do not update quantity for unlimited items
 	}
+	item := fts.items.mut(idx)
 
 	oldQuantity := item.Quantity
 	newQuantity := oldQuantity + int(delta)
@@ -125,7 +122,7 @@ func (fts *FenwickTreeSelector) UpdateItem(itemID string, quantity int, probabil
 		return // Item not found
 	}
 
-	item := fts.itemInfo[itemID]
+	item := fts.items.mut(idx)
 
 	// If the item was in the tree, remove its old probability.
 	if item.Quantity > 0 || item.Quantity == types.UnlimitedQuantity {
@@ -151,21 +148,26 @@ func (fts *FenwickTreeSelector) TotalAvailable() int64 {
 
 // GetItemRemaining returns the remaining quantity of a specific item.
 func (fts *FenwickTreeSelector) GetItemRemaining(itemID string) int {
-	if item, ok := fts.itemInfo[itemID]; ok {
-		return item.Quantity
+	if idx, ok := fts.itemIndex[itemID]; ok {
+		return fts.items.at(idx).Quantity
 	}
 	return -1 // Item not found
 }
 
-// Return PoolReward[] for Snapshot
+// HasItem reports whether the item is in the catalog.
+func (fts *FenwickTreeSelector) HasItem(itemID string) bool {
+	_, ok := fts.itemIndex[itemID]
+	return ok
+}
+
+// Return PoolReward[] for Snapshot. items holds the remaining quantities,
+// so it is a single copy of the items.
 func (fts *FenwickTreeSelector) SnapshotCatalog() []types.PoolReward {
-	snapshot_catalog := make([]types.PoolReward, len(fts.items))
-	for i, val := range fts.items {
-		snapshot_catalog[i] = types.PoolReward{
-			Quantity:    fts.GetItemRemaining(val.ItemID),
-			ItemID:      val.ItemID,
-			Probability: val.Probability,
-		}
-	}
-	return snapshot_catalog
+	return fts.items.items()
+}
+
+// CaptureCatalog returns the catalog, copied on the next write, see
+// types.ItemSelector.
+func (fts *FenwickTreeSelector) CaptureCatalog() types.CatalogView {
+	return fts.items.capture()
 }
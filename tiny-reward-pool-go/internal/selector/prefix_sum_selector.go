@@ -13,8 +13,8 @@ type PrefixSumSelector struct {
 	// prefixSums stores the cumulative sums of item probabilities.
 	prefixSums []int64
 
-	// items stores the original reward data.
-	items []types.PoolReward
+	// items stores the reward data with the remaining quantities.
+	items catalog
 
 	// itemIDs maps the index in the prefixSums array back to the actual ItemID.
 	itemIDs []string
@@ -22,9 +22,6 @@ type PrefixSumSelector struct {
 	// itemIndex maps ItemID to its index in the prefixSums and itemIDs slices.
 	itemIndex map[string]int
 
-	// itemInfo tracks the current state (quantity) of each item.
-	itemInfo map[string]*types.PoolReward
-
 	// totalWeight stores the sum of all probabilities in the selector.
 	totalWeight int64
 
@@ -38,27 +35,22 @@ var _ types.ItemSelector = (*PrefixSumSelector)(nil)
 func NewPrefixSumSelector() *PrefixSumSelector {
 	return &PrefixSumSelector{
 		itemIndex: make(map[string]int),
-		itemInfo:  make(map[string]*types.PoolReward),
 		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 // Reset initializes or re-initializes the selector with a new catalog.
 func (pss *PrefixSumSelector) Reset(catalog []types.PoolReward) {
-	pss.items = make([]types.PoolReward, len(catalog))
+	pss.items = newCatalog(catalog)
 	pss.itemIDs = make([]string, len(catalog))
 	pss.itemIndex = make(map[string]int)
-	pss.itemInfo = make(map[string]*types.PoolReward, len(catalog))
 	pss.prefixSums = make([]int64, len(catalog))
 	pss.totalWeight = 0
 
 	var currentWeight int64
 	for i, item := range catalog {
-		itemCopy := item
-		pss.items[i] = itemCopy
 		pss.itemIDs[i] = item.ItemID
 		pss.itemIndex[item.ItemID] = i
-		pss.itemInfo[item.ItemID] = &pss.items[i]
 
 		if item.Quantity > 0 || item.Quantity == types.UnlimitedQuantity {
 			currentWeight += item.Probability
@@ -83,7 +75,7 @@ func (pss *PrefixSumSelector) Select(ctx *types.Context) (string, error) {
 	}
 
 	selectedItemID := pss.itemIDs[idx]
-	if pss.itemInfo[selectedItemID].Quantity <= 0 && pss.itemInfo[selectedItemID].Quantity != types.UnlimitedQuantity {
+	if item := pss.items.at(idx); item.Quantity <= 0 && item.Quantity != types.UnlimitedQuantity {
 		return "", fmt.Errorf("internal error: selected item %s has zero quantity", selectedItemID)
 	}
 
@@ -115,10 +107,10 @@ func (pss *PrefixSumSelector) Update(itemID string, delta int64) {
 		return
 	}
 
-	item := pss.itemInfo[itemID]
-	if item.Quantity == types.UnlimitedQuantity {
+	if pss.items.at(idx).Quantity == types.UnlimitedQuantity {
 		return // Do not update quantity for unlimited items
 	}
+	item := pss.items.mut(idx)
 
 	oldQuantity := item.Quantity
 	newQuantity := oldQuantity + int(delta)
@@ -146,7 +138,7 @@ func (pss *PrefixSumSelector) UpdateItem(itemID string, quantity int, probabilit
 		return // Item not found
 	}
 
-	item := pss.itemInfo[itemID]
+	item := pss.items.mut(idx)
 	var oldProbability int64
 	if item.Quantity > 0 || item.Quantity == types.UnlimitedQuantity {
 		oldProbability = item.Probability
@@ -177,21 +169,26 @@ func (pss *PrefixSumSelector) TotalAvailable() int64 {
 
 // GetItemRemaining returns the remaining quantity of a specific item.
 func (pss *PrefixSumSelector) GetItemRemaining(itemID string) int {
-	if item, ok := pss.itemInfo[itemID]; ok {
-		return item.Quantity
+	if idx, ok := pss.itemIndex[itemID]; ok {
+		return pss.items.at(idx).Quantity
 	}
 	return -1 // Item not found
 }
 
-// Return PoolReward[] for Snapshot
+// HasItem reports whether the item is in the catalog.
+func (pss *PrefixSumSelector) HasItem(itemID string) bool {
+	_, ok := pss.itemIndex[itemID]
+	return ok
+}
+
+// Return PoolReward[] for Snapshot. items holds the remaining quantities,
+// so it is a single copy of the items.
 func (pss *PrefixSumSelector) SnapshotCatalog() []types.PoolReward {
-	snapshot_catalog := make([]types.PoolReward, len(pss.items))
-	for i, val := range pss.items {
-		snapshot_catalog[i] = types.PoolReward{
-			Quantity:    pss.GetItemRemaining(val.ItemID),
-			ItemID:      val.ItemID,
-			Probability: val.Probability,
-		}
-	}
-	return snapshot_catalog
+	return pss.items.items()
+}
+
+// CaptureCatalog returns the catalog, copied on the next write, see
+// types.ItemSelector.
+func (pss *PrefixSumSelector) CaptureCatalog() types.CatalogView {
+	return pss.items.capture()
 }
@@ -1,6 +1,7 @@
 package selector_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -71,3 +72,43 @@ func TestItemSelector_UpdateItem(t *testing.T) {
 		})
 	}
 }
+
+func TestItemSelector_HasItem(t *testing.T) {
+	catalog := []types.PoolReward{
+		{ItemID: "limited", Quantity: 0, Probability: 20},
+		{ItemID: "unlimited", Quantity: types.UnlimitedQuantity, Probability: 30},
+	}
+
+	for _, s := range []types.ItemSelector{selector.NewFenwickTreeSelector(), selector.NewPrefixSumSelector()} {
+		s.Reset(catalog)
+		assert.True(t, s.HasItem("limited"))
+		assert.True(t, s.HasItem("unlimited"))
+		assert.False(t, s.HasItem("missing"))
+	}
+}
+
+func TestItemSelector_CaptureCatalog(t *testing.T) {
+	catalog := make([]types.PoolReward, 1000)
+	for i := range catalog {
+		catalog[i] = types.PoolReward{ItemID: fmt.Sprintf("item%d", i), Quantity: 10, Probability: 1}
+	}
+
+	for _, sel := range []types.ItemSelector{selector.NewFenwickTreeSelector(), selector.NewPrefixSumSelector()} {
+		sel.Reset(catalog)
+		view := sel.CaptureCatalog()
+		sel.Update("item0", -1)
+		sel.UpdateItem("item999", 5, 2)
+
+		// The view keeps the captured items.
+		assert.Equal(t, catalog, view.Items())
+		assert.Equal(t, 9, sel.GetItemRemaining("item0"))
+		assert.Equal(t, 5, sel.GetItemRemaining("item999"))
+
+		// Only the chunks written to were copied.
+		next := sel.CaptureCatalog()
+		assert.Equal(t, len(view.Chunks), len(next.Chunks))
+		assert.NotSame(t, &view.Chunks[0][0], &next.Chunks[0][0])
+		assert.Same(t, &view.Chunks[1][0], &next.Chunks[1][0])
+		assert.NotSame(t, &view.Chunks[len(view.Chunks)-1][0], &next.Chunks[len(next.Chunks)-1][0])
+	}
+}
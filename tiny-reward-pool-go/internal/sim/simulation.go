@@ -0,0 +1,703 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/selector"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+const (
+	// simMailboxSize bounds the requests the Simulation queues.
+	simMailboxSize = 16
+	// simBufferSize is the size of the mailboxes of the System. It leaves
+	// room for a flush when the stream mailbox is drained at half of it:
+	// the processor must never block on it.
+	simBufferSize = 256
+	// simAnswerTimeout bounds the wait for the client goroutine of a
+	// request handled by the actor.
+	simAnswerTimeout = 5 * time.Second
+)
+
+// SimulationOptional provides optional settings for a Simulation.
+type SimulationOptional struct {
+	// Catalog is the initial pool. Defaults to a few limited items and an
+	// unlimited one.
+	Catalog []types.PoolReward
+	// NoFaults disables the storage faults and power losses.
+	NoFaults bool
+}
+
+// Simulation runs an actor.System with a WALStreamer under an
+// actor.Scheduler, on the calling goroutine. A scheduler seeded with the
+// seed of the run picks every event: a System call, the delivery of its
+// request or its cancellation, the background snapshot worker, whose
+// result is delivered from the mailbox too, the ticks of the snapshot
+// ticker on the Clock, the streamer, the clock moving, a stop or a crash
+// followed by a recovery.
+//
+// The calls waiting for their response are made on a client goroutine,
+// the next event is picked once their request is in the mailbox.
+//
+// Time is a Clock. The WAL files are kept in memory and fail at random,
+// see storage.FaultStorage, and a crash keeps what was flushed. They are
+// written to dir to be recovered by the recovery package, next to the
+// snapshot files. A run is replayed from its seed.
+//
+// Step checks after each event that the streamed logs match the draw
+// responses, that the pool matches the streamed logs once they are all
+// streamed, and that a recovered pool matches them too.
+type Simulation struct {
+	seed    int64
+	rng     *rand.Rand
+	dir     string
+	catalog []types.PoolReward
+	faults  bool
+	clock   *Clock
+	utils   *simUtils
+
+	flushAfterNDraw int
+	rotation        actor.RotationPolicy
+	snapshotPolicy  actor.SnapshotPolicy
+	snapshotFormat  string
+	walSize         int
+
+	sys   *actor.System
+	sched *actor.Scheduler
+	files []*simWALFile
+	// started is the index in files of the first file of the System.
+	started int
+	// requests read the responses of the requests in the mailbox, in
+	// order, once they were handled. They fail when a request that must
+	// be answered was not.
+	requests []func() error
+	// cancels cancel the contexts of the draws and updates sent.
+	cancels []context.CancelFunc
+
+	// model is the initial pool with the streamed logs applied.
+	model *rewardpool.Pool
+	// responses are the draw responses by request ID, until their draw
+	// is streamed.
+	responses    map[uint64]actor.DrawResponse
+	lastStreamed uint64
+	// violation is the first invariant the streamer found broken.
+	violation error
+
+	step  int
+	trace []string
+}
+
+// simWALFile is a WAL file of the Simulation. inner holds what survives a
+// crash.
+type simWALFile struct {
+	path  string
+	store *storage.FaultStorage
+	inner *storage.MemoryStorage
+}
+
+// NewSimulation starts a simulation run with seed, keeping its files in
+// dir. The policies of the System are picked from the seed.
+func NewSimulation(seed int64, dir string, opts ...SimulationOptional) (*Simulation, error) {
+	var opt SimulationOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Catalog == nil {
+		opt.Catalog = []types.PoolReward{
+			{ItemID: "gold", Quantity: 20, Probability: 1},
+			{ItemID: "silver", Quantity: 50, Probability: 2},
+			{ItemID: "bronze", Quantity: 100, Probability: 3},
+			{ItemID: "rock", Quantity: types.UnlimitedQuantity, Probability: 2},
+		}
+	}
+
+	walDir := filepath.Join(dir, "wal")
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(seed))
+	s := &Simulation{
+		seed:      seed,
+		rng:       rng,
+		dir:       dir,
+		catalog:   opt.Catalog,
+		faults:    !opt.NoFaults,
+		clock:     NewClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)),
+		utils:     &simUtils{walDir: walDir, snapshotDir: dir},
+		model:     rewardpool.NewPool(opt.Catalog),
+		responses: map[uint64]actor.DrawResponse{},
+
+		flushAfterNDraw: 1 + rng.Intn(20),
+		snapshotFormat:  []string{snapshot.FormatJSON, snapshot.FormatBinary}[rng.Intn(2)],
+		walSize:         types.WALHeaderSize + 2048 + rng.Intn(4096),
+	}
+	if rng.Intn(2) == 0 {
+		s.rotation.MaxEntries = 10 + rng.Intn(50)
+	}
+	if rng.Intn(2) == 0 {
+		s.rotation.MaxAge = time.Duration(5+rng.Intn(25)) * time.Second
+	}
+	if rng.Intn(2) == 0 {
+		s.snapshotPolicy.EveryNDraws = 1 + rng.Intn(30)
+	}
+	if rng.Intn(2) == 0 {
+		s.snapshotPolicy.Interval = time.Duration(1+rng.Intn(5)) * time.Second
+	}
+
+	if err := s.start(s.newPool(), 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run runs steps events, and stops at the first broken invariant.
+func (s *Simulation) Run(steps int) error {
+	for i := 0; i < steps; i++ {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trace returns the events run so far, the same for every run of a seed.
+func (s *Simulation) Trace() []string {
+	return s.trace
+}
+
+// Close stops the System. The files in dir are left to the caller.
+func (s *Simulation) Close() {
+	s.sys.Stop()
+}
+
+// simEvent is an event the scheduler can pick, when ready.
+type simEvent struct {
+	name   string
+	weight int
+	ready  func(s *Simulation) bool
+	run    func(s *Simulation) error
+}
+
+var simEvents = []simEvent{
+	{name: "draw", weight: 30, ready: (*Simulation).mailboxFree, run: (*Simulation).draw},
+	{name: "update", weight: 2, ready: (*Simulation).mailboxFree, run: (*Simulation).update},
+	{name: "flush", weight: 3, ready: (*Simulation).mailboxFree, run: (*Simulation).flush},
+	{name: "snapshot", weight: 2, ready: (*Simulation).mailboxFree, run: (*Simulation).snapshot},
+	{name: "flush-after", weight: 1, ready: (*Simulation).mailboxFree, run: (*Simulation).setFlushAfterNDraw},
+	{name: "cancel", weight: 2, ready: func(s *Simulation) bool { return len(s.cancels) > 0 }, run: (*Simulation).cancel},
+	{name: "deliver", weight: 30, ready: func(s *Simulation) bool { return s.sched.Pending() > 0 }, run: (*Simulation).deliver},
+	{name: "stream", weight: 8, ready: func(s *Simulation) bool { return s.sched.PendingStream() > 0 }, run: (*Simulation).stream},
+	{name: "worker", weight: 4, ready: func(s *Simulation) bool { return s.sched.Workers() > 0 }, run: (*Simulation).runWorker},
+	{name: "tick", weight: 4, ready: func(s *Simulation) bool { return s.sched.PendingTicks() > 0 }, run: (*Simulation).tick},
+	{name: "clock", weight: 5, run: (*Simulation).advanceClock},
+	{name: "stop", weight: 1, run: (*Simulation).stop},
+	{name: "crash", weight: 1, ready: func(s *Simulation) bool { return s.faults }, run: (*Simulation).crash},
+}
+
+// Step runs the next event picked by the scheduler and checks the
+// invariants after it.
+func (s *Simulation) Step() error {
+	s.step++
+	// The processor never blocks on a full stream mailbox.
+	if s.sched.PendingStream() > simBufferSize/2 {
+		s.drainStream()
+	}
+
+	var ready []simEvent
+	total := 0
+	for _, e := range simEvents {
+		if e.ready == nil || e.ready(s) {
+			ready = append(ready, e)
+			total += e.weight
+		}
+	}
+	n := s.rng.Intn(total)
+	var event simEvent
+	for _, event = range ready {
+		if n < event.weight {
+			break
+		}
+		n -= event.weight
+	}
+
+	err := event.run(s)
+	if err == nil && s.powerLost() {
+		// The process died with the storage.
+		err = s.crash()
+	}
+	if err == nil {
+		err = s.violation
+	}
+	if err == nil {
+		err = s.checkPool()
+	}
+	if err != nil {
+		return fmt.Errorf("simulation seed %d, step %d (%s): %w", s.seed, s.step, event.name, err)
+	}
+	return nil
+}
+
+func (s *Simulation) logf(format string, args ...any) {
+	s.trace = append(s.trace, fmt.Sprintf(format, args...))
+}
+
+func (s *Simulation) mailboxFree() bool {
+	return s.sched.Pending() < simMailboxSize
+}
+
+// call makes a System call waiting for its response on a client
+// goroutine, and returns once its request is in the mailbox. done gets
+// the result of the call once the request was handled.
+func (s *Simulation) call(fn func() error, done func(err error)) error {
+	queued := s.sched.Pending()
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	for s.sched.Pending() == queued {
+		select {
+		case err := <-result:
+			return fmt.Errorf("request not sent: %w", err)
+		default:
+			runtime.Gosched()
+		}
+	}
+	s.requests = append(s.requests, func() error {
+		select {
+		case err := <-result:
+			done(err)
+		case <-time.After(simAnswerTimeout):
+			return fmt.Errorf("request not answered")
+		}
+		return nil
+	})
+	return nil
+}
+
+func (s *Simulation) draw() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels = append(s.cancels, cancel)
+	s.logf("draw sent")
+	// The mailbox has room, DrawCtx does not wait.
+	respChan := s.sys.DrawCtx(ctx)
+	s.requests = append(s.requests, func() error {
+		select {
+		case resp := <-respChan:
+			s.logf("draw %d: %q, error %v", resp.RequestID, resp.Item, resp.Err != nil)
+			if errors.Is(resp.Err, context.Canceled) && resp.RequestID != 0 {
+				return fmt.Errorf("cancelled draw used request ID %d", resp.RequestID)
+			}
+			if resp.RequestID != 0 {
+				s.responses[resp.RequestID] = resp
+			}
+		default:
+			return fmt.Errorf("draw not answered")
+		}
+		return nil
+	})
+	return nil
+}
+
+func (s *Simulation) update() error {
+	index := s.rng.Intn(8)
+	quantity := s.rng.Intn(50)
+	if s.rng.Intn(10) == 0 {
+		quantity = types.UnlimitedQuantity
+	}
+	probability := int64(1 + s.rng.Intn(5))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels = append(s.cancels, cancel)
+	s.logf("update sent")
+	var applied int
+	return s.call(func() error {
+		updates, err := s.sys.UpdateCatalogCtx(ctx, func(live []types.PoolReward) []types.PoolReward {
+			return []types.PoolReward{{ItemID: live[index%len(live)].ItemID, Quantity: quantity, Probability: probability}}
+		})
+		applied = len(updates)
+		return err
+	}, func(err error) {
+		s.logf("update: %d applied, error %v", applied, err != nil)
+	})
+}
+
+func (s *Simulation) flush() error {
+	s.logf("flush sent")
+	return s.call(s.sys.Flush, func(err error) {
+		s.logf("flush: error %v", err != nil)
+	})
+}
+
+func (s *Simulation) snapshot() error {
+	s.logf("snapshot sent")
+	return s.call(s.sys.Snapshot, func(err error) {
+		s.logf("snapshot: error %v", err != nil)
+	})
+}
+
+func (s *Simulation) setFlushAfterNDraw() error {
+	n := 1 + s.rng.Intn(20)
+	s.logf("flush after %d draws sent", n)
+	return s.call(func() error {
+		return s.sys.SetFlushAfterNDrawCtx(context.Background(), n)
+	}, func(err error) {
+		if err != nil {
+			// Setters are left unanswered by the shutdown.
+			s.logf("flush after not answered")
+			return
+		}
+		s.flushAfterNDraw = n
+	})
+}
+
+// cancel cancels the context of a draw or update, which is dropped if it is
+// still in the mailbox.
+func (s *Simulation) cancel() error {
+	i := s.rng.Intn(len(s.cancels))
+	s.logf("cancel")
+	s.cancels[i]()
+	s.cancels = slices.Delete(s.cancels, i, i+1)
+	return nil
+}
+
+// deliver hands the next message of the mailbox to the actor: a request,
+// or the result of the background snapshot worker.
+func (s *Simulation) deliver() error {
+	if !s.sched.Deliver() {
+		s.logf("snapshot done")
+		return nil
+	}
+	done := s.requests[0]
+	s.requests = s.requests[1:]
+	return done()
+}
+
+// stream streams some of the committed logs.
+func (s *Simulation) stream() error {
+	n := 1 + s.rng.Intn(s.sched.PendingStream())
+	s.logf("stream %d", n)
+	for i := 0; i < n; i++ {
+		s.sched.Stream()
+	}
+	return nil
+}
+
+func (s *Simulation) drainStream() {
+	for s.sched.PendingStream() > 0 {
+		s.sched.Stream()
+	}
+}
+
+func (s *Simulation) runWorker() error {
+	s.logf("snapshot worker")
+	s.sched.RunWorker()
+	return nil
+}
+
+func (s *Simulation) tick() error {
+	s.logf("tick")
+	s.sched.Tick()
+	return nil
+}
+
+func (s *Simulation) advanceClock() error {
+	d := time.Duration(s.rng.Int63n(int64(2 * time.Second)))
+	s.logf("clock +%v", d)
+	s.clock.Advance(d)
+	return nil
+}
+
+// stop stops the System, then restarts it from the recovered state.
+func (s *Simulation) stop() error {
+	s.logf("stop")
+	s.sys.Stop()
+	// The requests left in the mailbox were drained by the shutdown.
+	for _, done := range s.requests {
+		if err := done(); err != nil {
+			return err
+		}
+	}
+	s.requests = nil
+	s.cancels = nil
+	// A draw is only reverted by a failed flush.
+	if !s.faults {
+		for _, id := range slices.Sorted(maps.Keys(s.responses)) {
+			if s.responses[id].Err == nil {
+				return fmt.Errorf("draw %d was answered but not streamed", id)
+			}
+		}
+	}
+	return s.recover()
+}
+
+// crash kills the System: the requests in the mailbox are not answered,
+// and what was not flushed to the WAL is lost. Then it is restarted from
+// the recovered state.
+func (s *Simulation) crash() error {
+	s.logf("crash")
+	// Handed to the streamer after their flush, so they are in the WAL.
+	s.drainStream()
+	for _, f := range s.files {
+		f.store.PowerLoss()
+	}
+	// Nothing the shutdown writes reaches the WAL files any more.
+	s.sys.Stop()
+	s.requests = nil
+	s.cancels = nil
+	return s.recover()
+}
+
+// powerLost reports whether a WAL file of the System lost its power, so
+// the process died with it.
+func (s *Simulation) powerLost() bool {
+	for _, f := range s.files[s.started:] {
+		if f.store.Lost() {
+			return true
+		}
+	}
+	return false
+}
+
+// recover writes the WAL files to disk and recovers the pool from them,
+// then starts a new System from it.
+func (s *Simulation) recover() error {
+	for _, f := range s.files {
+		if err := os.WriteFile(f.path, f.inner.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	u := utils.NewDefaultUtils(s.utils.walDir, s.utils.snapshotDir, slog.LevelError, io.Discard)
+	pool, lastRequestID, _, err := recovery.RecoverPoolFromConfig(s.newPool(), formatter.NewJSONFormatter(), u)
+	if err != nil {
+		return fmt.Errorf("recovery failed: %w", err)
+	}
+	s.logf("recovered up to request %d", lastRequestID)
+
+	if lastRequestID < s.lastStreamed {
+		return fmt.Errorf("recovered up to request %d, draw %d was streamed", lastRequestID, s.lastStreamed)
+	}
+	if diff := diffPools(pool.State(), s.model.State()); diff != "" {
+		return fmt.Errorf("recovered pool differs from the streamed logs: %s", diff)
+	}
+	// The draws not streamed were lost, their request IDs are used again.
+	clear(s.responses)
+	return s.start(pool, lastRequestID)
+}
+
+// start creates a System on a new WAL file.
+func (s *Simulation) start(pool *rewardpool.Pool, lastRequestID uint64) error {
+	s.started = len(s.files)
+	path, seqNo, err := s.utils.GenNextWALPath()
+	if err != nil {
+		return err
+	}
+	// The first flush of the file is spared, NewSystem fails without it.
+	w, err := s.openWAL(path, seqNo, true)
+	if err != nil {
+		return err
+	}
+
+	sched := actor.NewScheduler()
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: s.utils}, pool, &actor.SystemOptional{
+		FlushAfterNDraw:   s.flushAfterNDraw,
+		RequestBufferSize: simBufferSize,
+		LastRequestID:     lastRequestID,
+		WALStreamer:       simStreamer{s},
+		WALFactory: func(path string, seqNo uint64) (types.WAL, error) {
+			return s.openWAL(path, seqNo, false)
+		},
+		RotationPolicy: s.rotation,
+		SnapshotFormat: s.snapshotFormat,
+		SnapshotPolicy: s.snapshotPolicy,
+		Clock:          s.clock,
+		Scheduler:      sched,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sys = sys
+	s.sched = sched
+	return nil
+}
+
+// openWAL opens a WAL file in memory. Its writes and flushes fail at
+// random, and it may lose its power at a flush.
+func (s *Simulation) openWAL(path string, seqNo uint64, spareFirst bool) (types.WAL, error) {
+	if s.powerLost() {
+		return nil, types.ErrPowerLost
+	}
+	inner := storage.NewMemoryStorage(seqNo, storage.MemoryStorageOpt{SizeInBytes: s.walSize, FormatterID: types.WALFormatterJSON})
+	var opt storage.FaultStorageOpt
+	if s.faults {
+		from := 1
+		if spareFirst {
+			from = 2
+		}
+		for n := from; n <= 200; n++ {
+			switch s.rng.Intn(60) {
+			case 0:
+				opt.FailWrites = append(opt.FailWrites, n)
+			case 1:
+				opt.PartialWrites = append(opt.PartialWrites, n)
+			case 2:
+				opt.FailFlushes = append(opt.FailFlushes, n)
+			}
+		}
+		if s.rng.Intn(10) == 0 {
+			opt.PowerLossAtFlush = from + s.rng.Intn(50)
+		}
+	}
+	store := storage.NewFaultStorage(inner, opt)
+	s.files = append(s.files, &simWALFile{path: path, store: store, inner: inner})
+	s.logf("open %s", filepath.Base(path))
+	return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store)
+}
+
+// newPool returns the initial pool, drawing with a seeded selector.
+func (s *Simulation) newPool() *rewardpool.Pool {
+	sel := selector.NewFenwickTreeSelector()
+	sel.SetRand(rand.New(rand.NewSource(s.rng.Int63())))
+	return rewardpool.NewPool(s.catalog, rewardpool.PoolOptional{Selector: sel})
+}
+
+// checkPool compares the pool with the streamed logs, once all the
+// committed logs are streamed.
+func (s *Simulation) checkPool() error {
+	if !s.sched.Idle() {
+		return nil
+	}
+	if diff := diffPools(s.sched.State(), s.model.State()); diff != "" {
+		return fmt.Errorf("pool differs from the streamed logs: %s", diff)
+	}
+	return nil
+}
+
+// streamed checks a log handed to the streamer, and applies it to the
+// model.
+func (s *Simulation) streamed(entry types.WalLogEntry) error {
+	switch v := entry.(type) {
+	case *types.WalLogDrawItem:
+		if v.RequestID <= s.lastStreamed {
+			return fmt.Errorf("draw %d streamed after draw %d", v.RequestID, s.lastStreamed)
+		}
+		s.lastStreamed = v.RequestID
+		resp, ok := s.responses[v.RequestID]
+		switch {
+		case !ok:
+			return fmt.Errorf("draw %d streamed without a response", v.RequestID)
+		case v.Success && (resp.Err != nil || resp.Item != v.ItemID):
+			return fmt.Errorf("draw %d of %s streamed, the response was %q, error %v", v.RequestID, v.ItemID, resp.Item, resp.Err)
+		case !v.Success && resp.Err != types.ErrEmptyRewardPool:
+			return fmt.Errorf("failed draw %d streamed, the response error was %v", v.RequestID, resp.Err)
+		}
+		delete(s.responses, v.RequestID)
+	case *types.WalLogUpdateItem, types.WalLogSnapshotItem:
+	default:
+		return fmt.Errorf("unexpected log %T streamed", entry)
+	}
+	replay.ApplyLog(s.model, entry)
+	return nil
+}
+
+// diffPools describes the items that differ between two states, "" when
+// they are the same.
+func diffPools(got, want []types.PoolReward) string {
+	byID := func(items []types.PoolReward) map[string]types.PoolReward {
+		m := make(map[string]types.PoolReward, len(items))
+		for _, item := range items {
+			m[item.ItemID] = item
+		}
+		return m
+	}
+	g, w := byID(got), byID(want)
+	var ids []string
+	for id := range g {
+		ids = append(ids, id)
+	}
+	for id := range w {
+		if _, ok := g[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	var diffs []string
+	for _, id := range ids {
+		gi, gok := g[id]
+		wi, wok := w[id]
+		if gok != wok || gi.Quantity != wi.Quantity || gi.Probability != wi.Probability {
+			diffs = append(diffs, fmt.Sprintf("%s: %d/%d, want %d/%d", id, gi.Quantity, gi.Probability, wi.Quantity, wi.Probability))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// simStreamer is the walstream.WALStreamer of a Simulation.
+type simStreamer struct {
+	s *Simulation
+}
+
+func (st simStreamer) Stream(entry types.WalLogEntry) {
+	if err := st.s.streamed(entry); err != nil && st.s.violation == nil {
+		st.s.violation = err
+	}
+}
+
+// simUtils names the files of a Simulation. The WAL files are only
+// written to walDir on recovery.
+type simUtils struct {
+	walDir      string
+	snapshotDir string
+	nextSeqNo   uint64
+}
+
+var _ types.Utils = (*simUtils)(nil)
+
+func (u *simUtils) GetLogger() *slog.Logger {
+	return nil
+}
+
+func (u *simUtils) GenSnapshotPath() *string {
+	path := filepath.Join(u.snapshotDir, "snapshot.json")
+	return &path
+}
+
+func (u *simUtils) GetWALFiles() ([]string, error) {
+	var paths []string
+	for seqNo := uint64(0); seqNo < u.nextSeqNo; seqNo++ {
+		paths = append(paths, u.walPath(seqNo))
+	}
+	return paths, nil
+}
+
+func (u *simUtils) GenNextWALPath() (string, uint64, error) {
+	seqNo := u.nextSeqNo
+	u.nextSeqNo++
+	return u.walPath(seqNo), seqNo, nil
+}
+
+func (u *simUtils) walPath(seqNo uint64) string {
+	return filepath.Join(u.walDir, fmt.Sprintf("%s.%03d", types.WALBaseName, seqNo))
+}
@@ -0,0 +1,51 @@
+package sim_test
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/sim"
+)
+
+func simulate(t *testing.T, seed int64, steps int) []string {
+	s, err := sim.NewSimulation(seed, t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Run(steps))
+	return s.Trace()
+}
+
+func TestSimulation_Reproducible(t *testing.T) {
+	first := simulate(t, 42, 2000)
+	assert.Equal(t, first, simulate(t, 42, 2000))
+}
+
+// firstSeed is the first of the seeds of the simulation tests. The seeds
+// are fixed, set it to run others, e.g. -seed $RANDOM.
+var firstSeed = flag.Int64("seed", 1, "first seed of the simulations")
+
+func TestSimulation_Seeds(t *testing.T) {
+	for run := int64(0); run < 20; run++ {
+		seed := *firstSeed + run
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			// A failure is replayed with simulate(t, <seed>, 1000), or
+			// go run ./cmd/sim -seed <seed> -runs 1.
+			simulate(t, seed, 1000)
+		})
+	}
+}
+
+func TestSimulation_NoFaults(t *testing.T) {
+	for run := int64(0); run < 5; run++ {
+		seed := *firstSeed + run
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			s, err := sim.NewSimulation(seed, t.TempDir(), sim.SimulationOptional{NoFaults: true})
+			require.NoError(t, err)
+			defer s.Close()
+			require.NoError(t, s.Run(1000))
+		})
+	}
+}
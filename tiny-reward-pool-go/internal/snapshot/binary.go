@@ -0,0 +1,152 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// The binary format, integers as varints:
+//
+//	magic "TNSB" | version | last request ID | item count
+//	per item: ItemID length | ItemID | Quantity (signed) | Probability (signed)
+//	SHA256 of all the bytes above
+const (
+	binaryMagic   = "TNSB"
+	binaryVersion = 1
+)
+
+// IsBinary reports whether data is a FormatBinary snapshot.
+func IsBinary(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(binaryMagic))
+}
+
+// encodeBinary writes v through a buffer, hashing the bytes as they are
+// written, and appends the hash.
+func encodeBinary(w io.Writer, v *View) error {
+	hash := sha256.New()
+	bw := bufio.NewWriterSize(io.MultiWriter(w, hash), 64*1024)
+	var scratch [binary.MaxVarintLen64]byte
+
+	bw.WriteString(binaryMagic)
+	bw.WriteByte(binaryVersion)
+	bw.Write(binary.AppendUvarint(scratch[:0], v.LastRequestID))
+	bw.Write(binary.AppendUvarint(scratch[:0], uint64(v.Catalog.Len())))
+	for _, chunk := range v.Catalog.Chunks {
+		for _, item := range chunk {
+			bw.Write(binary.AppendUvarint(scratch[:0], uint64(len(item.ItemID))))
+			bw.WriteString(item.ItemID)
+			bw.Write(binary.AppendVarint(scratch[:0], int64(item.Quantity)))
+			bw.Write(binary.AppendVarint(scratch[:0], item.Probability))
+		}
+	}
+	// bufio keeps the first error, Flush returns it.
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(hash.Sum(nil))
+	return err
+}
+
+func decodeBinary(data []byte) (*types.PoolSnapshot, error) {
+	if len(data) < len(binaryMagic)+1+sha256.Size {
+		return nil, fmt.Errorf("binary snapshot is truncated")
+	}
+	body, trailer := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:], trailer) {
+		return nil, types.ErrSnapshotChecksum
+	}
+
+	r := binaryReader{data: body[len(binaryMagic):]}
+	if version := r.byte(); version != binaryVersion {
+		return nil, fmt.Errorf("unsupported binary snapshot version %d", version)
+	}
+	snap := &types.PoolSnapshot{SHA256: hex.EncodeToString(trailer)}
+	snap.LastRequestID = r.uvarint()
+	count := r.uvarint()
+	// Every item takes at least 3 bytes.
+	if r.err == nil && count > uint64(len(r.data))/3 {
+		return nil, fmt.Errorf("invalid binary snapshot: %d items in %d bytes", count, len(r.data))
+	}
+	snap.Catalog = make([]types.PoolReward, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		var item types.PoolReward
+		item.ItemID = string(r.bytes(r.uvarint()))
+		item.Quantity = int(r.varint())
+		item.Probability = r.varint()
+		snap.Catalog = append(snap.Catalog, item)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid binary snapshot: %w", r.err)
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("invalid binary snapshot: %d trailing bytes", len(r.data))
+	}
+	return snap, nil
+}
+
+// binaryReader reads the fields of a binary snapshot. After the first
+// error, it returns zero values and keeps the error.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
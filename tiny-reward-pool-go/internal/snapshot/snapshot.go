@@ -0,0 +1,213 @@
+// Package snapshot writes and reads the snapshot files of the reward pool.
+//
+// A snapshot is taken in two steps: Capture takes a copy-on-write view of
+// the catalog on the actor goroutine, and Persist encodes, hashes and writes
+// it, which can be done on another goroutine while the actor keeps drawing.
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// The snapshot file formats.
+const (
+	// FormatJSON is a types.PoolSnapshot as JSON, easy to read when
+	// debugging. It is the default.
+	FormatJSON = "json"
+	// FormatBinary is a compact encoding written in one pass with a
+	// streaming hash, for large catalogs. See Encode.
+	FormatBinary = "binary"
+)
+
+// ParseFormat validates a snapshot format name. "" is FormatJSON.
+func ParseFormat(name string) (string, error) {
+	switch name {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatBinary:
+		return FormatBinary, nil
+	default:
+		return "", fmt.Errorf("unknown snapshot format: %q", name)
+	}
+}
+
+// FileName returns the snapshot file name for format.
+func FileName(format string) string {
+	if format == FormatBinary {
+		return "snapshot.bin"
+	}
+	return "snapshot.json"
+}
+
+// Sealer encrypts the snapshot files, e.g. a crypt.Keyring.
+type Sealer interface {
+	Seal(plain []byte) ([]byte, error)
+}
+
+// catalogCapturer is implemented by the pools that can capture their
+// catalog copy-on-write, e.g. rewardpool.Pool.
+type catalogCapturer interface {
+	CaptureCatalog() (types.CatalogView, error)
+}
+
+// View is the state of the pool at a request ID. Its catalog is immutable:
+// the pool copies the items it shares with it before writing to them, so it
+// can be persisted from another goroutine.
+type View struct {
+	LastRequestID uint64
+	Catalog       types.CatalogView
+}
+
+// Capture takes a copy-on-write view of the catalog of pool. It is the only
+// step run on the actor goroutine: the items are neither copied, sorted,
+// encoded nor hashed. The next draws and updates copy the chunks of items
+// they write to instead. A pool without CaptureCatalog is copied.
+func Capture(pool types.RewardPool, lastRequestID uint64) (*View, error) {
+	if c, ok := pool.(catalogCapturer); ok {
+		catalog, err := c.CaptureCatalog()
+		if err != nil {
+			return nil, err
+		}
+		return &View{LastRequestID: lastRequestID, Catalog: catalog}, nil
+	}
+	snap, err := pool.CreateSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &View{LastRequestID: lastRequestID, Catalog: types.CatalogViewOf(snap.Catalog)}, nil
+}
+
+// Encode writes v to w in format. The JSON format is a types.PoolSnapshot
+// followed by a newline.
+func (v *View) Encode(w io.Writer, format string) error {
+	if format == FormatBinary {
+		return encodeBinary(w, v)
+	}
+	catalog := v.Catalog.Items()
+	sum, err := CatalogSHA256(catalog)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(types.PoolSnapshot{
+		LastRequestID: v.LastRequestID,
+		Catalog:       catalog,
+		SHA256:        sum,
+	})
+}
+
+// PersistOptional provides optional settings for Persist.
+type PersistOptional struct {
+	// Format defaults to FormatJSON.
+	Format string
+	// Sealer encrypts the file. Nil writes it in clear.
+	Sealer Sealer
+}
+
+// Persist writes v to path: the file is written next to it, synced and
+// renamed, so path always holds a complete snapshot. It does not touch the
+// pool and can run on any goroutine.
+func Persist(v *View, path string, opts ...PersistOptional) error {
+	var opt PersistOptional
+	for _, o := range opts {
+		opt = o
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(file, v, opt); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func write(w io.Writer, v *View, opt PersistOptional) error {
+	if opt.Sealer == nil {
+		return v.Encode(w, opt.Format)
+	}
+	// A frame is sealed as a whole.
+	var buf bytes.Buffer
+	if err := v.Encode(&buf, opt.Format); err != nil {
+		return err
+	}
+	sealed, err := opt.Sealer.Seal(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt snapshot: %w", err)
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Decode reads a snapshot file content in either format, once decrypted.
+// The SHA256 of a binary snapshot is the checksum of the file, verified
+// here, not the catalog hash of the JSON format.
+func Decode(data []byte) (*types.PoolSnapshot, error) {
+	if IsBinary(data) {
+		return decodeBinary(data)
+	}
+	var snap types.PoolSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// CatalogSHA256 returns the hash of the JSON snapshots: the SHA256 of the
+// JSON array of the items sorted by ItemID. The items are hashed one at a
+// time instead of marshaling the whole array.
+func CatalogSHA256(catalog []types.PoolReward) (string, error) {
+	sorted := make([]types.PoolReward, len(catalog))
+	copy(sorted, catalog)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ItemID < sorted[j].ItemID
+	})
+
+	hash := sha256.New()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	hash.Write([]byte{'['})
+	for i, item := range sorted {
+		if i > 0 {
+			hash.Write([]byte{','})
+		}
+		buf.Reset()
+		if err := enc.Encode(item); err != nil {
+			return "", err
+		}
+		// Without the newline Encode appends.
+		hash.Write(buf.Bytes()[:buf.Len()-1])
+	}
+	hash.Write([]byte{']'})
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
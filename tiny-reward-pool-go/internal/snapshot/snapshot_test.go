@@ -0,0 +1,138 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/snapshot"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+)
+
+func testCatalog(n int) []types.PoolReward {
+	catalog := make([]types.PoolReward, n)
+	for i := range catalog {
+		catalog[i] = types.PoolReward{ItemID: fmt.Sprintf("item-%05d", n-i), Quantity: i * 7, Probability: int64(i%10 + 1)}
+	}
+	catalog[0].Quantity = types.UnlimitedQuantity
+	return catalog
+}
+
+func TestCatalogSHA256_MatchesJSON(t *testing.T) {
+	catalog := append(testCatalog(100), types.PoolReward{ItemID: "<html> & \"quotes\"", Quantity: 1, Probability: 1})
+
+	sorted := append([]types.PoolReward(nil), catalog...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ItemID < sorted[j].ItemID })
+	data, err := json.Marshal(sorted)
+	require.NoError(t, err)
+	want := sha256.Sum256(data)
+
+	got, err := snapshot.CatalogSHA256(catalog)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(want[:]), got)
+}
+
+func TestPersist_Formats(t *testing.T) {
+	view := &snapshot.View{LastRequestID: 42, Catalog: types.CatalogViewOf(testCatalog(1000))}
+	sizes := map[string]int64{}
+
+	for _, format := range []string{snapshot.FormatJSON, snapshot.FormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), snapshot.FileName(format))
+			require.NoError(t, snapshot.Persist(view, path, snapshot.PersistOptional{Format: format}))
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			sizes[format] = int64(len(data))
+			assert.Equal(t, format == snapshot.FormatBinary, snapshot.IsBinary(data))
+
+			snap, err := snapshot.Decode(data)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(42), snap.LastRequestID)
+			assert.Equal(t, view.Catalog.Items(), snap.Catalog)
+			assert.NotEmpty(t, snap.SHA256)
+
+			_, err = os.Stat(path + ".tmp")
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+	assert.Less(t, sizes[snapshot.FormatBinary], sizes[snapshot.FormatJSON]/2)
+}
+
+func TestDecode_BinaryCorrupted(t *testing.T) {
+	var buf bytes.Buffer
+	view := &snapshot.View{LastRequestID: 7, Catalog: types.CatalogViewOf(testCatalog(10))}
+	require.NoError(t, view.Encode(&buf, snapshot.FormatBinary))
+	data := buf.Bytes()
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+	_, err := snapshot.Decode(flipped)
+	assert.ErrorIs(t, err, types.ErrSnapshotChecksum)
+
+	_, err = snapshot.Decode(data[:len(data)-1])
+	assert.Error(t, err)
+	_, err = snapshot.Decode(data[:6])
+	assert.Error(t, err)
+}
+
+func TestPersist_Sealed(t *testing.T) {
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	view := &snapshot.View{LastRequestID: 3, Catalog: types.CatalogViewOf(testCatalog(10))}
+	path := filepath.Join(t.TempDir(), "snapshot.bin")
+	require.NoError(t, snapshot.Persist(view, path, snapshot.PersistOptional{Format: snapshot.FormatBinary, Sealer: ring}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, crypt.IsEncrypted(data))
+	plain, err := ring.Open(data)
+	require.NoError(t, err)
+	snap, err := snapshot.Decode(plain)
+	require.NoError(t, err)
+	assert.Equal(t, view.Catalog.Items(), snap.Catalog)
+}
+
+func TestCapture_PersistedWhileDrawing(t *testing.T) {
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 100, Probability: 1}})
+	view, err := snapshot.Capture(pool, 5)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "snapshot.bin")
+	done := make(chan error)
+	go func() {
+		done <- snapshot.Persist(view, path, snapshot.PersistOptional{Format: snapshot.FormatBinary})
+	}()
+	for i := 0; i < 10; i++ {
+		_, err := pool.SelectItem(&types.Context{})
+		require.NoError(t, err)
+		pool.CommitDraw()
+	}
+	require.NoError(t, <-done)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	snap, err := snapshot.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), snap.LastRequestID)
+	assert.Equal(t, 100, snap.Catalog[0].Quantity)
+	assert.Equal(t, 90, pool.GetItemRemaining("gold"))
+}
+
+func TestCapture_PendingDraws(t *testing.T) {
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 100, Probability: 1}})
+	_, err := pool.SelectItem(&types.Context{})
+	require.NoError(t, err)
+	_, err = snapshot.Capture(pool, 1)
+	assert.ErrorIs(t, err, types.ErrPendingDrawsNotEmpty)
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// InstrumentationName is the tracer name used by every span of the reward pool.
+const InstrumentationName = "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go"
+
+// Supported exporter kinds.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Propagator is the W3C trace-context propagator used on the gRPC boundary.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Tracer returns the tracer that owns the span in ctx.
+// Inner layers (actor, WAL) use it so they only record spans when the caller
+// started a trace, and never need their own TracerProvider.
+func Tracer(ctx context.Context) trace.Tracer {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(InstrumentationName)
+}
+
+// Provider wraps an SDK TracerProvider together with the resources it owns.
+type Provider struct {
+	*sdktrace.TracerProvider
+	closer io.Closer
+}
+
+// NewProvider creates a TracerProvider exporting spans in batches to exporter.
+func NewProvider(exporter sdktrace.SpanExporter, opts ...sdktrace.TracerProviderOption) *Provider {
+	opts = append([]sdktrace.TracerProviderOption{sdktrace.WithBatcher(exporter)}, opts...)
+	return &Provider{TracerProvider: sdktrace.NewTracerProvider(opts...)}
+}
+
+// NewProviderFromConfig builds a Provider for an exporter kind.
+// For ExporterNone it returns a no-op trace.TracerProvider.
+func NewProviderFromConfig(kind, filePath string, sampleRatio float64) (trace.TracerProvider, func(context.Context) error, error) {
+	var w io.Writer
+	var closer io.Closer
+
+	switch kind {
+	case "", ExporterNone:
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		w = os.Stdout
+	case ExporterFile:
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		w, closer = f, f
+	default:
+		return nil, nil, fmt.Errorf("unsupported trace exporter: %s", kind)
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, err
+	}
+
+	var opts []sdktrace.TracerProviderOption
+	if sampleRatio > 0 && sampleRatio < 1 {
+		opts = append(opts, sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))))
+	}
+	p := NewProvider(exporter, opts...)
+	p.closer = closer
+	return p, p.Shutdown, nil
+}
+
+// Shutdown flushes the remaining spans and releases the exporter.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	err := p.TracerProvider.Shutdown(ctx)
+	if p.closer != nil {
+		if cerr := p.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package tracing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewProviderFromConfig_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	tp, shutdown, err := tracing.NewProviderFromConfig(tracing.ExporterFile, path, 0)
+	require.NoError(t, err)
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "root")
+	_, child := tracing.Tracer(ctx).Start(ctx, "child")
+	child.End()
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"root"`)
+	assert.Contains(t, string(data), `"Name":"child"`)
+}
+
+func TestNewProviderFromConfig_None(t *testing.T) {
+	tp, shutdown, err := tracing.NewProviderFromConfig(tracing.ExporterNone, "", 0)
+	require.NoError(t, err)
+	defer shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "root")
+	assert.False(t, span.IsRecording())
+}
+
+func TestNewProviderFromConfig_Unsupported(t *testing.T) {
+	_, _, err := tracing.NewProviderFromConfig("jaeger", "", 0)
+	assert.Error(t, err)
+}
+
+func TestTracer_WithoutSpanIsNoop(t *testing.T) {
+	_, span := tracing.Tracer(context.Background()).Start(context.Background(), "orphan")
+	assert.False(t, span.IsRecording())
+	assert.Equal(t, trace.SpanContext{}, span.SpanContext())
+}
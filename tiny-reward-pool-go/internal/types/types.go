@@ -18,19 +18,56 @@ type WALHeader struct {
 	Status     uint32
 	SeqNo      uint64
 	DataLength uint64
-	Padding    [228]byte // To make the total size 256 bytes
+	// FencingToken is the leader lease token of the node that created the file.
+	// 0 when leader election is not used.
+	FencingToken uint64
+	// KeyID is the encryption key the file was created with, 0 when its
+	// batches are not encrypted.
+	KeyID uint32
+	// Codec compresses the batches of the file, one of the WALCodec
+	// constants.
+	Codec uint32
+
+	// The fields below are 0 in version 1 files.
+
+	// FormatterID is the formatter of the batches, one of the WALFormatter
+	// constants.
+	FormatterID uint32
+	// FirstRequestID is the request ID of the first draw of the file, set
+	// when the file is closed. 0 when it has none.
+	FirstRequestID uint64
+	// CreatedAt is the creation time of the file, in Unix nanoseconds.
+	CreatedAt int64
+	// Checksum is the CRC32 (IEEE) of the header with Checksum set to 0.
+	Checksum uint32
+	Padding  [188]byte // To make the total size 256 bytes
 }
 
 // WAL file constants
 const (
 	WALMagic        uint32 = 0x746E776C // "tnwl" in little-endian
 	WALVersion1     uint32 = 1
+	WALVersion2     uint32 = 2
 	WALHeaderSize          = 256
 	WALStatusOpen   uint32 = 0
 	WALStatusClosed uint32 = 1
 	WALBaseName            = "wal"
 )
 
+// WAL batch formatters, see WALHeader.FormatterID.
+const (
+	WALFormatterUnknown    uint32 = 0
+	WALFormatterJSON       uint32 = 1
+	WALFormatterStringLine uint32 = 2
+)
+
+// WAL batch compression codecs, see WALHeader.Codec.
+const (
+	WALCodecNone   uint32 = 0
+	WALCodecZstd   uint32 = 1
+	WALCodecSnappy uint32 = 2
+)
+
 // LogError defines the type of a WAL log error.
 type LogError byte
 
@@ -58,12 +95,45 @@ type PoolReward struct {
 	Probability int64  `json:"probability" yaml:"probability"`
 }
 
+// CatalogView is a catalog captured copy-on-write, see ItemSelector.CaptureCatalog.
+// Its chunks may be shared with the selector, which copies a chunk before
+// writing to it again: the view must not be written to, and can be read from
+// another goroutine.
+type CatalogView struct {
+	Chunks [][]PoolReward
+}
+
+// CatalogViewOf returns a view of items, which must not be written to anymore.
+func CatalogViewOf(items []PoolReward) CatalogView {
+	return CatalogView{Chunks: [][]PoolReward{items}}
+}
+
+// Len returns the number of items.
+func (v CatalogView) Len() int {
+	n := 0
+	for _, chunk := range v.Chunks {
+		n += len(chunk)
+	}
+	return n
+}
+
+// Items returns a copy of the items.
+func (v CatalogView) Items() []PoolReward {
+	items := make([]PoolReward, 0, v.Len())
+	for _, chunk := range v.Chunks {
+		items = append(items, chunk...)
+	}
+	return items
+}
+
 // PoolSnapshot represents the data structure for a snapshot of the reward pool.
 // The SHA256 field contains a hash of the catalog data for integrity checking.
 // The hash is calculated from the JSON representation of the catalog after sorting
 // all items by ItemID (alphabetically) to ensure deterministic hashing.
 // This means the same catalog data will always produce the same hash regardless
 // of the original order of items in the catalog.
+// In a binary snapshot file, SHA256 is the checksum of the file instead, see
+// snapshot.FormatBinary.
 type PoolSnapshot struct {
 	LastRequestID uint64       `json:"last_request_id"`
 	Catalog       []PoolReward `json:"catalog"`
@@ -105,6 +175,10 @@ type WalLogUpdateItem struct {
 type WalLogSnapshotItem struct {
 	WalLogEntryBase
 	Path string `json:"path"`
+	// Behind is the number of entries before this one that are not in the
+	// snapshot: they were logged while it was written in the background.
+	// Recovery replays them with the entries after it.
+	Behind int `json:"behind,omitempty"`
 }
 
 
@@ -209,8 +283,15 @@ type ItemSelector interface {
 	// GetItemRemaining returns the remaining quantity of a specific item.
 	GetItemRemaining(itemID string) int
 
+	// HasItem reports whether the item is in the catalog.
+	HasItem(itemID string) bool
+
 	// Return PoolReward[] for Snapshot
 	SnapshotCatalog() []PoolReward
+
+	// CaptureCatalog returns the catalog without copying its items. They are
+	// copied on the next write instead, a chunk at a time.
+	CaptureCatalog() CatalogView
 }
 
 // Error
@@ -225,3 +306,16 @@ const ErrWALFull = errString("WAL is full, rotation is required")
 const ErrEmptyRewardPool = errString("reward pool is empty")
 const ErrPendingDrawsNotEmpty = errString("PendingDraws remaining. Please CommitDraw or RevertDraw before")
 const ErrShutingDown = errString("request cancelled: processor shutting down")
+const ErrSystemBusy = errString("system busy: mailbox is full")
+const ErrReadOnlyReplica = errString("read-only replica: draws and updates go to the primary")
+const ErrNotLeader = errString("not the leader: draws and updates go to the leader")
+const ErrStaleFencingToken = errString("WAL was written with a fencing token not older than the lease")
+const ErrManifestGap = errString("WAL manifest has a gap in the segment sequence")
+const ErrManifestMissingSegment = errString("WAL segment listed in the manifest is missing")
+const ErrManifestChecksum = errString("WAL segment does not match its checksum in the manifest")
+const ErrTailerBehind = errString("WAL tailer is behind: a WAL file was removed before it was read")
+const ErrEncryptionKeyMissing = errString("encryption key is missing")
+const ErrWALHeaderChecksum = errString("WAL header checksum mismatch")
+const ErrSnapshotChecksum = errString("snapshot checksum mismatch")
+const ErrInjectedFault = errString("injected storage fault")
+const ErrPowerLost = errString("storage lost power")
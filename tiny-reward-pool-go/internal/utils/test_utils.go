@@ -28,19 +28,6 @@ func (m *MockRandSource) Seed(seed int64) {
 
 var _ rand.Source = (*MockRandSource)(nil)
 
-type MockWAL struct{}
-
-var _ types.WAL = (*MockWAL)(nil)
-
-func (w *MockWAL) Size() (int64, error)                            { return 0, nil }
-func (m *MockWAL) LogDraw(item types.WalLogDrawItem) error         { return nil }
-func (m *MockWAL) LogUpdate(item types.WalLogUpdateItem) error     { return nil }
-func (m *MockWAL) LogSnapshot(item types.WalLogSnapshotItem) error { return nil }
-
-func (m *MockWAL) Close() error { return nil }
-func (m *MockWAL) Flush() error { return nil }
-func (m *MockWAL) Reset()       {}
-
 // MockUtils is a mock implementation of the types.Utils interface for testing.
 type MockUtils struct{}
 
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
 )
 
 // DefaultUtils provides a default implementation for the types.Utils interface.
@@ -19,8 +20,9 @@ import (
 
 type DefaultUtils struct {
 	logger      *slog.Logger
-	walDir      string
-	snapshotDir string
+	walDir       string
+	snapshotDir  string
+	snapshotName string
 }
 
 var _ types.Utils = (*DefaultUtils)(nil)
@@ -44,22 +46,41 @@ func (u *DefaultUtils) GetLogger() *slog.Logger {
 }
 
 // GenSnapshotPath generates a new path for a snapshot file.
-// The path is fixed "snapshot.json".
+// The path is fixed "snapshot.json", or the name set with SetSnapshotName.
 // It returns a pointer to the path, or nil if path generation is disabled.
 func (u *DefaultUtils) GenSnapshotPath() *string {
 	if u.snapshotDir == "" {
 		return nil
 	}
-	path := filepath.Join(u.snapshotDir, "snapshot.json")
+	name := u.snapshotName
+	if name == "" {
+		name = "snapshot.json"
+	}
+	path := filepath.Join(u.snapshotDir, name)
 	return &path
 }
 
+// SetSnapshotName sets the snapshot file name, e.g. snapshot.FileName.
+func (u *DefaultUtils) SetSnapshotName(name string) {
+	u.snapshotName = name
+}
+
 // GetWALFiles scans the WAL directory, finds all WAL files, and returns their paths sorted by sequence number.
+// When the directory has a wal.Manifest, the files are the ones it lists, compacted ones excepted, and a
+// gap or a missing file is an error. The checksums are checked by VerifyWALFiles.
 func (u *DefaultUtils) GetWALFiles() ([]string, error) {
 	if u.walDir == "" {
 		return []string{}, nil
 	}
 
+	segments, found, err := wal.ReadManifest(u.walDir)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return u.manifestWALFiles(segments)
+	}
+
 	files, err := os.ReadDir(u.walDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
@@ -70,9 +91,14 @@ func (u *DefaultUtils) GetWALFiles() ([]string, error) {
 		if file.IsDir() {
 			continue
 		}
-		if strings.HasPrefix(file.Name(), types.WALBaseName+".") {
-			walFiles = append(walFiles, file.Name())
+		if !strings.HasPrefix(file.Name(), types.WALBaseName+".") {
+			continue
+		}
+		// Skip stray files such as wal.tmp.
+		if _, err := strconv.ParseUint(strings.TrimPrefix(file.Name(), types.WALBaseName+"."), 10, 64); err != nil {
+			continue
 		}
+		walFiles = append(walFiles, file.Name())
 	}
 
 	sort.Slice(walFiles, func(i, j int) bool {
@@ -90,8 +116,64 @@ func (u *DefaultUtils) GetWALFiles() ([]string, error) {
 	return walFiles, nil
 }
 
+// VerifyWALFiles checks the closed files listed by the wal.Manifest of the WAL directory against their
+// checksums, e.g. before recovery. A file not matching is a types.ErrManifestChecksum error. Without a
+// manifest there is nothing to check.
+func (u *DefaultUtils) VerifyWALFiles() error {
+	if u.walDir == "" {
+		return nil
+	}
+	segments, found, err := wal.ReadManifest(u.walDir)
+	if err != nil || !found {
+		return err
+	}
+	for _, s := range segments {
+		if s.Status == wal.SegmentCompacted {
+			continue
+		}
+		if err := s.Verify(filepath.Join(u.walDir, s.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestWALFiles returns the paths of the segments that were not compacted.
+func (u *DefaultUtils) manifestWALFiles(segments []wal.ManifestSegment) ([]string, error) {
+	walFiles := []string{}
+	for _, s := range segments {
+		if s.Status == wal.SegmentCompacted {
+			continue
+		}
+		path := filepath.Join(u.walDir, s.Name)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("%w: %s", types.ErrManifestMissingSegment, path)
+			}
+			return nil, err
+		}
+		walFiles = append(walFiles, path)
+	}
+	return walFiles, nil
+}
+
 // GenNextWALPath determines the next available WAL sequence number and returns the corresponding path.
+// With a wal.Manifest, it follows the last segment it lists, compacted or not.
 func (u *DefaultUtils) GenNextWALPath() (string, uint64, error) {
+	if u.walDir != "" {
+		segments, found, err := wal.ReadManifest(u.walDir)
+		if err != nil {
+			return "", 0, err
+		}
+		if found {
+			var nextSeq uint64
+			if len(segments) > 0 {
+				nextSeq = segments[len(segments)-1].SeqNo + 1
+			}
+			return filepath.Join(u.walDir, fmt.Sprintf("%s.%03d", types.WALBaseName, nextSeq)), nextSeq, nil
+		}
+	}
+
 	walFiles, err := u.GetWALFiles()
 	if err != nil {
 		return "", 0, err
@@ -0,0 +1,403 @@
+package compactor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+// Action is what the Compactor does with a closed WAL segment.
+type Action string
+
+const (
+	// ActionDelete removes the segment.
+	ActionDelete Action = "delete"
+	// ActionGzip moves the segment to the archive directory as wal.NNN.gz.
+	ActionGzip Action = "gzip"
+)
+
+const (
+	defaultInterval   = time.Minute
+	defaultArchiveDir = "archive"
+	auditDateFormat   = "2006-01-02"
+)
+
+// ParseAction parses an action name. Empty means ActionDelete.
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case "", ActionDelete:
+		return ActionDelete, nil
+	case ActionGzip:
+		return ActionGzip, nil
+	default:
+		return "", fmt.Errorf("unknown compaction action: %s", s)
+	}
+}
+
+// Compactor removes or archives the closed WAL segments that a newer
+// snapshot made unnecessary for recovery. Optionally, their entries are
+// merged into a per-day audit file, as JSON lines.
+//
+// A segment is compacted once a newer segment holds a snapshot entry whose
+// file exists, and the segment is not one of the KeepSegments newest closed
+// ones. The open segment is never touched.
+//
+// What was done with each segment is recorded in the wal.Manifest of the
+// WAL directory, see wal.SegmentCompaction.
+type Compactor struct {
+	walDir       string
+	archiveDir   string
+	auditDir     string
+	action       Action
+	keepSegments int
+	interval     time.Duration
+	formatter    types.LogFormatter
+	logger       *slog.Logger
+	now          func() time.Time
+	manifest     *wal.Manifest
+}
+
+// CompactorOptional provides optional settings for the Compactor.
+type CompactorOptional struct {
+	// Action defaults to ActionDelete.
+	Action Action
+	// ArchiveDir keeps the gzip files. Defaults to <walDir>/archive.
+	ArchiveDir string
+	// AuditDir enables the per-day audit files, named YYYY-MM-DD.jsonl
+	// after the day the segment was closed.
+	AuditDir string
+	// KeepSegments is the number of compactable segments to leave in
+	// walDir, e.g. for a WAL tailer or the resume stream overflow policy.
+	KeepSegments int
+	// Interval between two passes of Run. Defaults to 1 minute.
+	Interval time.Duration
+	// Formatter decodes the WAL segments. Defaults to JSON.
+	Formatter types.LogFormatter
+	Logger    *slog.Logger
+	// Now is used for CompactedAt. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewCompactor creates a Compactor for the WAL files registered in manifest.
+func NewCompactor(manifest *wal.Manifest, opts ...CompactorOptional) (*Compactor, error) {
+	var opt CompactorOptional
+	for _, o := range opts {
+		opt = o
+	}
+	action, err := ParseAction(string(opt.Action))
+	if err != nil {
+		return nil, err
+	}
+	walDir := manifest.Dir()
+	if opt.ArchiveDir == "" {
+		opt.ArchiveDir = filepath.Join(walDir, defaultArchiveDir)
+	}
+	if filepath.Clean(opt.ArchiveDir) == filepath.Clean(walDir) {
+		return nil, fmt.Errorf("compaction archive dir must differ from the WAL dir")
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = defaultInterval
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+
+	return &Compactor{
+		walDir:       walDir,
+		archiveDir:   opt.ArchiveDir,
+		auditDir:     opt.AuditDir,
+		action:       action,
+		keepSegments: opt.KeepSegments,
+		interval:     opt.Interval,
+		formatter:    opt.Formatter,
+		logger:       opt.Logger,
+		now:          opt.Now,
+		manifest:     manifest,
+	}, nil
+}
+
+// Run compacts every Interval until ctx is cancelled. Errors are logged.
+func (c *Compactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Compact(); err != nil && c.logger != nil {
+			c.logger.Error("WAL compaction failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compact runs one pass and returns the number of segments compacted.
+func (c *Compactor) Compact() (int, error) {
+	files, err := listWALFiles(c.walDir)
+	if err != nil {
+		return 0, err
+	}
+	boundary, ok := c.snapshotBoundary(files)
+	if !ok {
+		return 0, nil
+	}
+
+	var candidates []walFile
+	for _, f := range files {
+		if f.seqNo >= boundary {
+			break
+		}
+		candidates = append(candidates, f)
+	}
+	if len(candidates) <= c.keepSegments {
+		return 0, nil
+	}
+	candidates = candidates[:len(candidates)-c.keepSegments]
+
+	compacted := 0
+	for _, f := range candidates {
+		done, err := c.compactSegment(f)
+		if err != nil {
+			return compacted, fmt.Errorf("failed to compact %s: %w", f.path, err)
+		}
+		if done {
+			compacted++
+		}
+	}
+	if compacted > 0 && c.logger != nil {
+		c.logger.Info("WAL segments compacted", "count", compacted, "action", string(c.action))
+	}
+	return compacted, nil
+}
+
+// snapshotBoundary returns the sequence number of the newest segment
+// holding a snapshot entry whose file exists.
+func (c *Compactor) snapshotBoundary(files []walFile) (uint64, bool) {
+	for i := len(files) - 1; i > 0; i-- {
+		entries, _, err := wal.ReadWAL(files[i].path, c.formatter)
+		if err != nil {
+			continue
+		}
+		for j := len(entries) - 1; j >= 0; j-- {
+			snapshot, ok := entries[j].(*types.WalLogSnapshotItem)
+			if !ok {
+				continue
+			}
+			if _, err := os.Stat(snapshot.Path); err == nil {
+				return files[i].seqNo, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// compactSegment archives, merges and records f, then removes it. Closed
+// segments only. Each step can be redone after a crash.
+func (c *Compactor) compactSegment(f walFile) (bool, error) {
+	if c.compacted(f.seqNo) {
+		// Recorded before a crash, only the removal is left.
+		return true, removeIfExists(f.path)
+	}
+
+	entries, hdr, err := wal.ParseWAL(f.path, c.formatter)
+	if err != nil {
+		return false, err
+	}
+	if hdr == nil || hdr.Status != types.WALStatusClosed {
+		return false, nil
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	content = content[:types.WALHeaderSize+hdr.DataLength]
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	compaction := wal.SegmentCompaction{
+		Entries:     len(entries),
+		Size:        int64(len(content)),
+		Action:      string(c.action),
+		CompactedAt: c.now().UTC(),
+	}
+	if err := os.MkdirAll(c.archiveDir, 0755); err != nil {
+		return false, err
+	}
+	if c.action == ActionGzip {
+		compaction.ArchivePath = filepath.Join(c.archiveDir, filepath.Base(f.path)+".gz")
+		if err := writeGzip(compaction.ArchivePath, content); err != nil {
+			return false, err
+		}
+	}
+	if c.auditDir != "" {
+		compaction.AuditPath = filepath.Join(c.auditDir, info.ModTime().UTC().Format(auditDateFormat)+".jsonl")
+		if compaction.AuditSize, err = c.appendAudit(compaction.AuditPath, entries); err != nil {
+			return false, err
+		}
+	}
+
+	if err := c.manifest.MarkCompacted(f.seqNo, compaction); err != nil {
+		return false, err
+	}
+	return true, removeIfExists(f.path)
+}
+
+func (c *Compactor) compacted(seqNo uint64) bool {
+	for _, s := range c.manifest.Segments() {
+		if s.SeqNo == seqNo {
+			return s.Status == wal.SegmentCompacted
+		}
+	}
+	return false
+}
+
+// auditSize returns the size of the audit file at path after its last
+// recorded merge.
+func (c *Compactor) auditSize(path string) int64 {
+	var size int64
+	for _, s := range c.manifest.Segments() {
+		if s.Compaction != nil && s.Compaction.AuditPath == path {
+			size = s.Compaction.AuditSize
+		}
+	}
+	return size
+}
+
+// appendAudit appends entries to the audit file at path, as JSON lines,
+// after truncating what a crashed merge may have left past its recorded
+// size. It returns the new size.
+func (c *Compactor) appendAudit(path string, entries []types.WalLogEntry) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size := c.auditSize(path)
+	if err := file.Truncate(size); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(buf.Bytes(), size); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return size + int64(buf.Len()), nil
+}
+
+// ReadArchive returns the segment stored in a gzip file written by the
+// Compactor, in the WAL file layout.
+func ReadArchive(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeGzip(path string, content []byte) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// writeFileAtomic replaces path with data, synced before the rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type walFile struct {
+	seqNo uint64
+	path  string
+}
+
+// listWALFiles returns the wal.NNN files of dir, by sequence number.
+func listWALFiles(dir string) ([]walFile, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []walFile
+	for _, e := range dirEntries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, types.WALBaseName+".") {
+			continue
+		}
+		seqNo, err := strconv.ParseUint(strings.TrimPrefix(name, types.WALBaseName+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, walFile{seqNo: seqNo, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seqNo < files[j].seqNo })
+	return files, nil
+}
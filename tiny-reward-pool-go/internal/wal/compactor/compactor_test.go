@@ -0,0 +1,178 @@
+package compactor_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compactor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+var catalog = []types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}}
+
+// drawWithRotations draws n times with small WAL files and returns the
+// state of the stopped system.
+func drawWithRotations(t *testing.T, u *utils.DefaultUtils, n int) []types.PoolReward {
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		store, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4 * 1024})
+		if err != nil {
+			return nil, err
+		}
+		return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store)
+	}
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	w, err := walFactory(path, seqNo)
+	require.NoError(t, err)
+
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, rewardpool.NewPool(catalog), &actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		WALFactory:      walFactory,
+	})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	state := sys.State()
+	sys.Stop()
+	return state
+}
+
+func TestCompactor_GzipAndAudit(t *testing.T) {
+	walDir := t.TempDir()
+	auditDir := filepath.Join(t.TempDir(), "audit")
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	state := drawWithRotations(t, u, 200)
+
+	before, err := u.GetWALFiles()
+	require.NoError(t, err)
+	require.Greater(t, len(before), 2)
+	var removed []types.WalLogEntry
+	for _, path := range before[:len(before)-1] {
+		entries, _, err := wal.ParseWAL(path, formatter.NewJSONFormatter())
+		require.NoError(t, err)
+		removed = append(removed, entries...)
+	}
+
+	walManifest, err := wal.OpenManifest(walDir)
+	require.NoError(t, err)
+	c, err := compactor.NewCompactor(walManifest, compactor.CompactorOptional{Action: compactor.ActionGzip, AuditDir: auditDir})
+	require.NoError(t, err)
+	n, err := c.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, len(before)-1, n)
+
+	// Only the segment holding the latest snapshot is left.
+	after, err := u.GetWALFiles()
+	require.NoError(t, err)
+	assert.Equal(t, before[len(before)-1:], after)
+
+	segments := walManifest.Segments()
+	require.Len(t, segments, len(before))
+	var auditPath string
+	var lastRequestID uint64
+	for i, segment := range segments[:n] {
+		assert.Equal(t, uint64(i), segment.SeqNo)
+		assert.Equal(t, wal.SegmentCompacted, segment.Status)
+		assert.Greater(t, segment.FirstRequestID, lastRequestID)
+		assert.GreaterOrEqual(t, segment.LastRequestID, segment.FirstRequestID)
+		lastRequestID = segment.LastRequestID
+
+		require.NotNil(t, segment.Compaction)
+		content, err := compactor.ReadArchive(segment.Compaction.ArchivePath)
+		require.NoError(t, err)
+		assert.Equal(t, segment.Compaction.Size, int64(len(content)))
+		sum := sha256.Sum256(content)
+		assert.Equal(t, segment.SHA256, hex.EncodeToString(sum[:]))
+		auditPath = segment.Compaction.AuditPath
+	}
+	assert.Nil(t, segments[n].Compaction)
+
+	// Every entry of the removed segments is in the audit file.
+	file, err := os.Open(auditPath)
+	require.NoError(t, err)
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	assert.Equal(t, len(removed), lines)
+	info, err := os.Stat(auditPath)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), segments[n-1].Compaction.AuditSize)
+
+	// The manifest survives a restart, and there is nothing left to do.
+	walManifest, err = wal.OpenManifest(walDir)
+	require.NoError(t, err)
+	assert.Equal(t, segments, walManifest.Segments())
+	c, err = compactor.NewCompactor(walManifest, compactor.CompactorOptional{Action: compactor.ActionGzip, AuditDir: auditDir})
+	require.NoError(t, err)
+	n, err = c.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Recovery only needs the segment left.
+	pool, lastID, _, err := recovery.RecoverPoolFromConfig(rewardpool.NewPool(catalog), formatter.NewJSONFormatter(), u)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), lastID)
+	assert.Equal(t, state, pool.State())
+}
+
+func TestCompactor_KeepSegments(t *testing.T) {
+	walDir := t.TempDir()
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	drawWithRotations(t, u, 200)
+	before, err := u.GetWALFiles()
+	require.NoError(t, err)
+	require.Greater(t, len(before), 3)
+
+	walManifest, err := wal.OpenManifest(walDir)
+	require.NoError(t, err)
+
+	c, err := compactor.NewCompactor(walManifest, compactor.CompactorOptional{KeepSegments: 2})
+	require.NoError(t, err)
+	n, err := c.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, len(before)-3, n)
+
+	// The removed files are marked in the WAL manifest, so they are not missing.
+	after, err := u.GetWALFiles()
+	require.NoError(t, err)
+	assert.Equal(t, before[len(before)-3:], after)
+	for i, segment := range walManifest.Segments() {
+		if i < n {
+			assert.Equal(t, wal.SegmentCompacted, segment.Status)
+			require.NotNil(t, segment.Compaction)
+			assert.Equal(t, string(compactor.ActionDelete), segment.Compaction.Action)
+			assert.Empty(t, segment.Compaction.ArchivePath)
+		} else {
+			assert.Equal(t, wal.SegmentClosed, segment.Status)
+			assert.Nil(t, segment.Compaction)
+		}
+	}
+}
+
+func TestNewCompactor_Invalid(t *testing.T) {
+	walDir := t.TempDir()
+	walManifest, err := wal.OpenManifest(walDir)
+	require.NoError(t, err)
+	_, err = compactor.NewCompactor(walManifest, compactor.CompactorOptional{Action: "zip"})
+	assert.Error(t, err)
+	_, err = compactor.NewCompactor(walManifest, compactor.CompactorOptional{ArchiveDir: walDir})
+	assert.Error(t, err)
+}
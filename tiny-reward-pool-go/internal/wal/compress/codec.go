@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// framePrefix starts every compressed frame:
+//
+//	tnwz <codec> <base64(compressed batch)>\n
+//
+// A frame is a single line, so a file being written still ends at the last
+// newline before its zero-filled space, like a plain WAL file.
+const framePrefix = "tnwz "
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, and costly to create.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+// ParseCodec returns the codec named by wal.compression: "none" (or
+// empty), "zstd" or "snappy".
+func ParseCodec(name string) (uint32, error) {
+	switch name {
+	case "", "none":
+		return types.WALCodecNone, nil
+	case "zstd":
+		return types.WALCodecZstd, nil
+	case "snappy":
+		return types.WALCodecSnappy, nil
+	default:
+		return 0, fmt.Errorf("unsupported WAL compression: %s", name)
+	}
+}
+
+// CodecName returns the name of codec, as accepted by ParseCodec.
+func CodecName(codec uint32) string {
+	switch codec {
+	case types.WALCodecNone:
+		return "none"
+	case types.WALCodecZstd:
+		return "zstd"
+	case types.WALCodecSnappy:
+		return "snappy"
+	default:
+		return "codec " + strconv.FormatUint(uint64(codec), 10)
+	}
+}
+
+// Compress encodes plain into a frame with codec, which must not be
+// types.WALCodecNone.
+func Compress(codec uint32, plain []byte) ([]byte, error) {
+	var compressed []byte
+	switch codec {
+	case types.WALCodecZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		compressed = enc.EncodeAll(plain, nil)
+	case types.WALCodecSnappy:
+		compressed = snappy.Encode(nil, plain)
+	default:
+		return nil, fmt.Errorf("unsupported WAL compression: %s", CodecName(codec))
+	}
+
+	prefix := framePrefix + strconv.FormatUint(uint64(codec), 10) + " "
+	frame := make([]byte, 0, len(prefix)+base64.StdEncoding.EncodedLen(len(compressed))+1)
+	frame = append(frame, prefix...)
+	frame = base64.StdEncoding.AppendEncode(frame, compressed)
+	return append(frame, '\n'), nil
+}
+
+// Decompress returns data with its frames decompressed, in order. The
+// lines that are not frames are kept as they are, so the batches written
+// before compression was enabled are read too.
+func Decompress(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(framePrefix)) {
+		return data, nil
+	}
+	var plain []byte
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			data = nil
+		}
+		if !IsCompressed(line) {
+			plain = append(plain, line...)
+			continue
+		}
+		p, err := decompressFrame(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, p...)
+	}
+	return plain, nil
+}
+
+func decompressFrame(line []byte) ([]byte, error) {
+	rest := line[len(framePrefix):]
+	sep := bytes.IndexByte(rest, ' ')
+	if sep < 0 {
+		return nil, fmt.Errorf("invalid compressed frame")
+	}
+	codec, err := strconv.ParseUint(string(rest[:sep]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed frame codec: %w", err)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(string(rest[sep+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed frame: %w", err)
+	}
+
+	var plain []byte
+	switch uint32(codec) {
+	case types.WALCodecZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		plain, err = dec.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd frame: %w", err)
+		}
+	case types.WALCodecSnappy:
+		plain, err = snappy.Decode(nil, compressed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress snappy frame: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported WAL compression: %s", CodecName(uint32(codec)))
+	}
+	return plain, nil
+}
+
+// IsCompressed reports whether data starts with a compressed frame.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(framePrefix))
+}
@@ -0,0 +1,52 @@
+package compress
+
+import (
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// Formatter is a types.LogFormatter that compresses the batches of another
+// formatter: each flush is written as one frame compressed with its codec.
+// A frame is decoded on its own, so a file is still read batch by batch,
+// and a torn last batch is left out like a torn plain line.
+//
+// Decode reads the frames of any codec and the plain lines, so the WAL
+// files written before compression was enabled or changed are still read.
+// With types.WALCodecNone, the batches are written as they are.
+//
+// Wrap it in a crypt.Formatter, not the other way around: encrypted data
+// does not compress.
+type Formatter struct {
+	inner types.LogFormatter
+	codec uint32
+}
+
+var _ types.LogFormatter = (*Formatter)(nil)
+
+// NewFormatter wraps inner. See ParseCodec for the codecs.
+func NewFormatter(inner types.LogFormatter, codec uint32) *Formatter {
+	return &Formatter{inner: inner, codec: codec}
+}
+
+func (f *Formatter) Encode(items []types.WalLogEntry) ([]byte, error) {
+	plain, err := f.inner.Encode(items)
+	if err != nil || f.codec == types.WALCodecNone {
+		return plain, err
+	}
+	return Compress(f.codec, plain)
+}
+
+func (f *Formatter) Decode(data []byte) ([]types.WalLogEntry, error) {
+	plain, err := Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 {
+		return []types.WalLogEntry{}, nil
+	}
+	return f.inner.Decode(plain)
+}
+
+// Codec returns the codec new batches are compressed with.
+func (f *Formatter) Codec() uint32 {
+	return f.codec
+}
@@ -0,0 +1,85 @@
+package compress_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+func drawItems(from, n int) []types.WalLogEntry {
+	items := make([]types.WalLogEntry, 0, n)
+	for i := range n {
+		items = append(items, &types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: uint64(from + i), ItemID: "gold", Success: true})
+	}
+	return items
+}
+
+func TestFormatter_Codecs(t *testing.T) {
+	plain, err := formatter.NewJSONFormatter().Encode(drawItems(1, 200))
+	require.NoError(t, err)
+
+	for _, name := range []string{"zstd", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := compress.ParseCodec(name)
+			require.NoError(t, err)
+			assert.Equal(t, name, compress.CodecName(codec))
+			f := compress.NewFormatter(formatter.NewJSONFormatter(), codec)
+
+			data, err := f.Encode(drawItems(1, 200))
+			require.NoError(t, err)
+			assert.True(t, compress.IsCompressed(data))
+			assert.Less(t, len(data), len(plain)/2)
+			assert.Equal(t, 1, bytes.Count(data, []byte("\n")))
+
+			// Frames of any codec and plain lines are read together.
+			more, err := compress.NewFormatter(formatter.NewJSONFormatter(), types.WALCodecNone).Encode(drawItems(201, 2))
+			require.NoError(t, err)
+			assert.False(t, compress.IsCompressed(more))
+			entries, err := f.Decode(append(data, more...))
+			require.NoError(t, err)
+			require.Len(t, entries, 202)
+			assert.Equal(t, uint64(202), entries[201].(*types.WalLogDrawItem).RequestID)
+		})
+	}
+
+	_, err = compress.ParseCodec("lz4")
+	assert.Error(t, err)
+}
+
+func TestFormatter_WALFile(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.001")
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	format := crypt.NewFormatter(compress.NewFormatter(formatter.NewStringLineFormatter(), types.WALCodecZstd), ring)
+
+	fileStorage, err := storage.NewFileMMapStorage(walPath, 1, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4096, KeyID: ring.Active(), Codec: types.WALCodecZstd})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 1, format, fileStorage)
+	require.NoError(t, err)
+	for _, item := range drawItems(1, 30) {
+		require.NoError(t, w.LogDraw(*item.(*types.WalLogDrawItem)))
+		require.NoError(t, w.Flush())
+	}
+
+	// An open file is read up to its last batch.
+	entries, hdr, err := wal.ReadWAL(walPath, format)
+	require.NoError(t, err)
+	assert.Len(t, entries, 30)
+	assert.Equal(t, types.WALCodecZstd, hdr.Codec)
+	require.NoError(t, w.Close())
+
+	entries, hdr, err = wal.ParseWAL(walPath, format)
+	require.NoError(t, err)
+	require.Len(t, entries, 30)
+	assert.Equal(t, uint64(30), entries[29].(*types.WalLogDrawItem).RequestID)
+	assert.Equal(t, types.WALCodecZstd, hdr.Codec)
+}
@@ -0,0 +1,56 @@
+package crypt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+// DecryptFile returns the plaintext of an encrypted WAL or snapshot file.
+// A WAL file keeps its header with KeyID 0, and is marked closed with the
+// length of its decrypted data, so it reads with the plain formatter. The
+// batches of a file still being written are decrypted up to the last
+// complete one.
+func DecryptFile(content []byte, ring *Keyring) ([]byte, error) {
+	if IsEncrypted(content) {
+		return ring.Open(content)
+	}
+	if len(content) < types.WALHeaderSize {
+		return nil, fmt.Errorf("neither a WAL file nor an encrypted snapshot")
+	}
+
+	hdr, err := storage.DecodeHeader(content)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Magic != types.WALMagic {
+		return nil, fmt.Errorf("neither a WAL file nor an encrypted snapshot")
+	}
+	if hdr.KeyID == 0 {
+		return nil, fmt.Errorf("WAL file %d is not encrypted", hdr.SeqNo)
+	}
+
+	data := content[types.WALHeaderSize:]
+	if hdr.Status == types.WALStatusClosed {
+		if uint64(len(data)) < hdr.DataLength {
+			return nil, fmt.Errorf("WAL file %d is shorter than its data length", hdr.SeqNo)
+		}
+		data = data[:hdr.DataLength]
+	} else {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+	plain, err := ring.Open(data)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.KeyID = 0
+	hdr.Status = types.WALStatusClosed
+	hdr.DataLength = uint64(len(plain))
+	return append(storage.EncodeHeader(hdr), plain...), nil
+}
@@ -0,0 +1,68 @@
+package crypt
+
+import (
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// Formatter is a types.LogFormatter that encrypts the batches of another
+// formatter: each flush is written as one frame sealed with the active key
+// of its Keyring.
+//
+// Every reader of the WAL files (recovery, tailer, compactor, archiver)
+// decrypts them when given this formatter. The files whose header has no
+// key ID are read with the wrapped formatter, see wal.FormatterFor.
+type Formatter struct {
+	inner types.LogFormatter
+	ring  *Keyring
+}
+
+var _ types.LogFormatter = (*Formatter)(nil)
+
+// NewFormatter wraps inner.
+func NewFormatter(inner types.LogFormatter, ring *Keyring) *Formatter {
+	return &Formatter{inner: inner, ring: ring}
+}
+
+func (f *Formatter) Encode(items []types.WalLogEntry) ([]byte, error) {
+	plain, err := f.inner.Encode(items)
+	if err != nil {
+		return nil, err
+	}
+	return f.ring.Seal(plain)
+}
+
+func (f *Formatter) Decode(data []byte) ([]types.WalLogEntry, error) {
+	plain, err := f.ring.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 {
+		return []types.WalLogEntry{}, nil
+	}
+	return f.inner.Decode(plain)
+}
+
+// Keyring returns the keys of the formatter.
+func (f *Formatter) Keyring() *Keyring {
+	return f.ring
+}
+
+// Plain returns the wrapped formatter, which decodes the WAL files
+// written before encryption was enabled.
+func (f *Formatter) Plain() types.LogFormatter {
+	return f.inner
+}
+
+// HasKey reports whether the key id is in the keyring.
+func (f *Formatter) HasKey(id uint32) bool {
+	return f.ring.HasKey(id)
+}
+
+// OpenSnapshot decrypts a snapshot file written with the keyring. A
+// snapshot that is not encrypted is returned as is.
+func (f *Formatter) OpenSnapshot(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	return f.ring.Open(data)
+}
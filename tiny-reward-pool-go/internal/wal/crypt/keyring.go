@@ -0,0 +1,166 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// framePrefix starts every encrypted frame:
+//
+//	tnwe <key id> <base64(nonce | ciphertext)>\n
+//
+// A frame is a single line, so a file being written still ends at the last
+// newline before its zero-filled space, like a plain WAL file.
+const framePrefix = "tnwe "
+
+// Keyring holds the AES-GCM keys by ID. New frames are sealed with the
+// active key, frames sealed with any key of the ring can be opened.
+//
+// To rotate keys, add the new key, make it active and keep the old one
+// until no WAL or snapshot file sealed with it is left.
+type Keyring struct {
+	active uint32
+	keys   map[uint32]cipher.AEAD
+}
+
+// NewKeyring creates a Keyring. Keys are 16, 24 or 32 bytes long (AES-128,
+// AES-192 or AES-256). ID 0 means not encrypted and cannot be used.
+func NewKeyring(active uint32, keys map[uint32][]byte) (*Keyring, error) {
+	r := &Keyring{active: active, keys: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, fmt.Errorf("encryption key ID 0 is reserved")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		r.keys[id] = aead
+	}
+	if !r.HasKey(active) {
+		return nil, fmt.Errorf("%w: active key %d", types.ErrEncryptionKeyMissing, active)
+	}
+	return r, nil
+}
+
+// LoadKeyring creates a Keyring from key files holding a hex encoded key.
+func LoadKeyring(active uint32, keyFiles map[uint32]string) (*Keyring, error) {
+	keys := make(map[uint32][]byte, len(keyFiles))
+	for id, path := range keyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key %d: %w", id, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d in %s is not hex encoded: %w", id, path, err)
+		}
+		keys[id] = key
+	}
+	return NewKeyring(active, keys)
+}
+
+// Active returns the ID of the key new frames are sealed with.
+func (r *Keyring) Active() uint32 {
+	return r.active
+}
+
+// HasKey reports whether the key id is in the ring.
+func (r *Keyring) HasKey(id uint32) bool {
+	_, ok := r.keys[id]
+	return ok
+}
+
+// Seal encrypts plain into a frame with the active key.
+func (r *Keyring) Seal(plain []byte) ([]byte, error) {
+	aead := r.keys[r.active]
+	prefix := framePrefix + strconv.FormatUint(uint64(r.active), 10) + " "
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The prefix is authenticated, so a frame cannot be moved to another key.
+	sealed := aead.Seal(nonce, nonce, plain, []byte(prefix))
+
+	frame := make([]byte, 0, len(prefix)+base64.StdEncoding.EncodedLen(len(sealed))+1)
+	frame = append(frame, prefix...)
+	frame = base64.StdEncoding.AppendEncode(frame, sealed)
+	return append(frame, '\n'), nil
+}
+
+// Open decrypts a sequence of frames and returns their plaintexts, in order.
+// A frame sealed with a key that is not in the ring fails with
+// types.ErrEncryptionKeyMissing.
+func (r *Keyring) Open(data []byte) ([]byte, error) {
+	var plain []byte
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if len(line) == 0 {
+			continue
+		}
+		p, err := r.open(line)
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, p...)
+	}
+	return plain, nil
+}
+
+func (r *Keyring) open(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(framePrefix)) {
+		return nil, fmt.Errorf("not an encrypted frame")
+	}
+	rest := line[len(framePrefix):]
+	sep := bytes.IndexByte(rest, ' ')
+	if sep < 0 {
+		return nil, fmt.Errorf("invalid encrypted frame")
+	}
+	id, err := strconv.ParseUint(string(rest[:sep]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted frame key ID: %w", err)
+	}
+	aead, ok := r.keys[uint32(id)]
+	if !ok {
+		return nil, fmt.Errorf("%w: key %d", types.ErrEncryptionKeyMissing, id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(rest[sep+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted frame: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted frame: too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, line[:len(framePrefix)+sep+1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt frame with key %d: %w", id, err)
+	}
+	return plain, nil
+}
+
+// IsEncrypted reports whether data starts with an encrypted frame, e.g. a
+// snapshot file written with a Keyring.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(framePrefix))
+}
@@ -0,0 +1,139 @@
+package crypt_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestKeyring_Rotation(t *testing.T) {
+	old, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	frame1, err := old.Seal([]byte("first"))
+	require.NoError(t, err)
+	assert.True(t, crypt.IsEncrypted(frame1))
+
+	// Key 2 is added and made active, key 1 still opens the older frames.
+	rotated, err := crypt.NewKeyring(2, map[uint32][]byte{1: key1, 2: key2})
+	require.NoError(t, err)
+	frame2, err := rotated.Seal([]byte("second"))
+	require.NoError(t, err)
+
+	plain, err := rotated.Open(append(frame1, frame2...))
+	require.NoError(t, err)
+	assert.Equal(t, "firstsecond", string(plain))
+
+	_, err = old.Open(frame2)
+	assert.ErrorIs(t, err, types.ErrEncryptionKeyMissing)
+}
+
+func TestKeyring_Invalid(t *testing.T) {
+	_, err := crypt.NewKeyring(2, map[uint32][]byte{1: key1})
+	assert.ErrorIs(t, err, types.ErrEncryptionKeyMissing)
+	_, err = crypt.NewKeyring(0, map[uint32][]byte{0: key1})
+	assert.Error(t, err)
+	_, err = crypt.NewKeyring(1, map[uint32][]byte{1: []byte("short")})
+	assert.Error(t, err)
+
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	frame, err := ring.Seal([]byte("data"))
+	require.NoError(t, err)
+	// The key ID is authenticated with the frame.
+	tampered := bytes.Replace(frame, []byte("tnwe 1 "), []byte("tnwe 2 "), 1)
+	both, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1, 2: key1})
+	require.NoError(t, err)
+	_, err = both.Open(tampered)
+	assert.Error(t, err)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.hex")
+	require.NoError(t, os.WriteFile(path, []byte("0101010101010101010101010101010101010101010101010101010101010101\n"), 0600))
+
+	ring, err := crypt.LoadKeyring(1, map[uint32]string{1: path})
+	require.NoError(t, err)
+	frame, err := ring.Seal([]byte("data"))
+	require.NoError(t, err)
+
+	other, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	plain, err := other.Open(frame)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(plain))
+}
+
+func TestFormatter_WALFile(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.003")
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	encrypted := crypt.NewFormatter(formatter.NewStringLineFormatter(), ring)
+
+	fileStorage, err := storage.NewFileMMapStorage(walPath, 3, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4096, KeyID: ring.Active()})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 3, encrypted, fileStorage)
+	require.NoError(t, err)
+	for i := range 3 {
+		require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: uint64(i + 1), ItemID: "gold", Success: true}))
+		require.NoError(t, w.Flush())
+	}
+
+	// An open file is read up to its last batch.
+	entries, hdr, err := wal.ReadWAL(walPath, encrypted)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, uint32(1), hdr.KeyID)
+	require.NoError(t, w.Close())
+
+	entries, _, err = wal.ParseWAL(walPath, encrypted)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[2].(*types.WalLogDrawItem).RequestID)
+
+	_, _, err = wal.ParseWAL(walPath, formatter.NewStringLineFormatter())
+	assert.ErrorIs(t, err, types.ErrEncryptionKeyMissing)
+
+	// Decrypted, the file reads with the plain formatter.
+	content, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "gold")
+	plain, err := crypt.DecryptFile(content, ring)
+	require.NoError(t, err)
+	plainPath := filepath.Join(t.TempDir(), "wal.003")
+	require.NoError(t, os.WriteFile(plainPath, plain, 0600))
+	decrypted, hdr, err := wal.ParseWAL(plainPath, formatter.NewStringLineFormatter())
+	require.NoError(t, err)
+	assert.Equal(t, entries, decrypted)
+	assert.Equal(t, uint32(0), hdr.KeyID)
+	assert.Equal(t, uint64(3), hdr.SeqNo)
+}
+
+func TestFormatter_PlainFile(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.000")
+	w, err := wal.NewWAL(walPath, 0, formatter.NewJSONFormatter(), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 1, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close())
+
+	// Written before encryption was enabled, the file has no key ID.
+	ring, err := crypt.NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	entries, _, err := wal.ParseWAL(walPath, crypt.NewFormatter(formatter.NewJSONFormatter(), ring))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,32 @@
+package formatter
+
+import (
+	"fmt"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// ByName returns the formatter named by wal.formatter, "json" or
+// "string_line", and its ID for types.WALHeader.FormatterID.
+func ByName(name string) (types.LogFormatter, uint32, error) {
+	switch name {
+	case "json":
+		return NewJSONFormatter(), types.WALFormatterJSON, nil
+	case "string_line":
+		return NewStringLineFormatter(), types.WALFormatterStringLine, nil
+	default:
+		return nil, types.WALFormatterUnknown, fmt.Errorf("unsupported WAL formatter: %s", name)
+	}
+}
+
+// ByID returns the formatter of a types.WALHeader.FormatterID.
+func ByID(id uint32) (types.LogFormatter, error) {
+	switch id {
+	case types.WALFormatterJSON:
+		return NewJSONFormatter(), nil
+	case types.WALFormatterStringLine:
+		return NewStringLineFormatter(), nil
+	default:
+		return nil, fmt.Errorf("unsupported WAL formatter ID: %d", id)
+	}
+}
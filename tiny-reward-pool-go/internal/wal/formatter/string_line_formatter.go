@@ -26,7 +26,11 @@ func (f *StringLineFormatter) Encode(items []types.WalLogEntry) ([]byte, error)
 		case *types.WalLogUpdateItem:
 			sb.WriteString(fmt.Sprintf("%d,%s,%d,%d\n", item.GetType(), v.ItemID, v.Quantity, v.Probability))
 		case *types.WalLogSnapshotItem:
-			sb.WriteString(fmt.Sprintf("%d,%s\n", item.GetType(), v.Path))
+			if v.Behind > 0 {
+				sb.WriteString(fmt.Sprintf("%d,%s,%d\n", item.GetType(), v.Path, v.Behind))
+			} else {
+				sb.WriteString(fmt.Sprintf("%d,%s\n", item.GetType(), v.Path))
+			}
 		}
 	}
 	return []byte(sb.String()), nil
@@ -101,14 +105,21 @@ func (f *StringLineFormatter) Decode(data []byte) ([]types.WalLogEntry, error) {
 				Probability: probability,
 			})
 		case types.LogTypeSnapshot:
-			if len(parts) != 2 {
+			if len(parts) != 2 && len(parts) != 3 {
 				return nil, fmt.Errorf("invalid WAL log format for snapshot: %s", line)
 			}
+			var behind int
+			if len(parts) == 3 {
+				if behind, err = strconv.Atoi(parts[2]); err != nil {
+					return nil, fmt.Errorf("invalid behind count in WAL log: %s", parts[2])
+				}
+			}
 			items = append(items, &types.WalLogSnapshotItem{
 				WalLogEntryBase: types.WalLogEntryBase{
 					Type: logType,
 				},
-				Path: parts[1],
+				Path:   parts[1],
+				Behind: behind,
 			})
 		}
 	}
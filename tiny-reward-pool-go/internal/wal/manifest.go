@@ -0,0 +1,394 @@
+package wal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+// ManifestName is the name of the manifest file in the WAL directory.
+const ManifestName = "MANIFEST"
+
+// SegmentStatus is the state of a WAL file in the manifest.
+type SegmentStatus string
+
+const (
+	SegmentOpen   SegmentStatus = "open"
+	SegmentClosed SegmentStatus = "closed"
+	// SegmentCompacted is a file removed or archived by the compactor.
+	SegmentCompacted SegmentStatus = "compacted"
+)
+
+// ManifestSegment is the manifest record of a WAL file.
+type ManifestSegment struct {
+	SeqNo uint64 `json:"seq_no"`
+	// Name is the file name in the WAL directory.
+	Name string `json:"name"`
+	// FirstRequestID and LastRequestID are the range of the draws, both 0
+	// when there is none yet.
+	FirstRequestID uint64 `json:"first_request_id"`
+	LastRequestID  uint64 `json:"last_request_id"`
+	// SnapshotPath is the path of the last snapshot entry.
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	// SHA256 is the checksum of the closed file, header included, without
+	// the preallocated zeroes after its data.
+	SHA256 string        `json:"sha256,omitempty"`
+	Status SegmentStatus `json:"status"`
+	// Compaction is set when the compactor removed or archived the file.
+	Compaction *SegmentCompaction `json:"compaction,omitempty"`
+}
+
+// SegmentCompaction records what the compactor did with a WAL file.
+type SegmentCompaction struct {
+	Entries int `json:"entries"`
+	// Size is that of the file, header included, without the preallocated
+	// zeroes after its data.
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	// ArchivePath is the gzip file, for the gzip action.
+	ArchivePath string `json:"archive_path,omitempty"`
+	// AuditPath is the audit file the entries were merged into, and
+	// AuditSize its size after the merge. A later merge interrupted by a
+	// crash is truncated back to it.
+	AuditPath   string    `json:"audit_path,omitempty"`
+	AuditSize   int64     `json:"audit_size,omitempty"`
+	CompactedAt time.Time `json:"compacted_at"`
+}
+
+// Verify checks the file at path against the checksum of a closed segment.
+// Segments without a checksum are not checked.
+func (s ManifestSegment) Verify(path string) error {
+	if s.Status != SegmentClosed || s.SHA256 == "" {
+		return nil
+	}
+	sum, err := segmentChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != s.SHA256 {
+		return fmt.Errorf("%w: %s", types.ErrManifestChecksum, path)
+	}
+	return nil
+}
+
+type manifestFile struct {
+	Segments []ManifestSegment `json:"segments"`
+}
+
+// Manifest is the registry of the WAL files of a directory, kept in its
+// MANIFEST file. A WAL created with WALOptional.Manifest registers itself
+// when it is created, records its snapshots and draw range on flush, and
+// its checksum when it is closed. The file is replaced atomically when a
+// WAL file is created or closed, and when a snapshot is flushed.
+//
+// Once the file exists, DefaultUtils lists the WAL files from it instead
+// of the directory. The compactor records the files it removes in it too.
+type Manifest struct {
+	dir    string
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	segments []ManifestSegment
+}
+
+// ManifestOptional provides optional settings for the Manifest.
+type ManifestOptional struct {
+	// Formatter decodes the existing WAL files when the manifest is
+	// created. Defaults to JSON.
+	Formatter types.LogFormatter
+	Logger    *slog.Logger
+}
+
+// OpenManifest loads the manifest of dir. When there is none yet, it is
+// built from the wal.NNN files in dir.
+func OpenManifest(dir string, opts ...ManifestOptional) (*Manifest, error) {
+	var opt ManifestOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{dir: dir, logger: opt.Logger}
+	segments, found, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		m.segments = segments
+		return m, nil
+	}
+
+	segments, err = scanSegments(dir, opt.Formatter)
+	if err != nil {
+		return nil, err
+	}
+	m.segments = segments
+	if len(segments) == 0 {
+		// Written with the first WAL file, so files restored to an empty
+		// directory before it are still listed from the directory.
+		return m, nil
+	}
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	if m.logger != nil {
+		m.logger.Info("WAL manifest created from the WAL directory.", "segments", len(segments))
+	}
+	return m, nil
+}
+
+// ReadManifest reads the manifest of dir and checks that the sequence
+// numbers have no gap. found is false when there is no manifest.
+func ReadManifest(dir string) (segments []ManifestSegment, found bool, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var file manifestFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, true, fmt.Errorf("invalid WAL manifest in %s: %w", dir, err)
+	}
+	for i := 1; i < len(file.Segments); i++ {
+		if file.Segments[i].SeqNo != file.Segments[i-1].SeqNo+1 {
+			return nil, true, fmt.Errorf("%w: %d after %d", types.ErrManifestGap, file.Segments[i].SeqNo, file.Segments[i-1].SeqNo)
+		}
+	}
+	return file.Segments, true, nil
+}
+
+// Segments returns a copy of the segments, by sequence number.
+func (m *Manifest) Segments() []ManifestSegment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ManifestSegment(nil), m.segments...)
+}
+
+// Dir returns the WAL directory.
+func (m *Manifest) Dir() string {
+	return m.dir
+}
+
+// MarkCompacted records that the file seqNo is about to be removed, and
+// what the compactor did with it.
+func (m *Manifest) MarkCompacted(seqNo uint64, compaction SegmentCompaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(seqNo)
+	if s == nil {
+		return fmt.Errorf("WAL segment %d is not in the manifest", seqNo)
+	}
+	s.Status = SegmentCompacted
+	s.Compaction = &compaction
+	return m.save()
+}
+
+// opened registers a new or reopened WAL file. A new file must follow the
+// last one.
+func (m *Manifest) opened(path string, seqNo uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.find(seqNo); s != nil {
+		s.Status = SegmentOpen
+		s.SHA256 = ""
+		return m.save()
+	}
+	if n := len(m.segments); n > 0 && m.segments[n-1].SeqNo+1 != seqNo {
+		return fmt.Errorf("%w: %d after %d", types.ErrManifestGap, seqNo, m.segments[n-1].SeqNo)
+	}
+	m.segments = append(m.segments, ManifestSegment{SeqNo: seqNo, Name: filepath.Base(path), Status: SegmentOpen})
+	return m.save()
+}
+
+// flushed records the entries written to the file seqNo. The manifest is
+// only saved when they hold a snapshot. A failed save is logged, the
+// entries are already in the WAL.
+func (m *Manifest) flushed(seqNo uint64, entries []types.WalLogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(seqNo)
+	if s == nil {
+		return
+	}
+	snapshot := updateSegment(s, entries)
+	if !snapshot {
+		return
+	}
+	if err := m.save(); err != nil && m.logger != nil {
+		m.logger.Error("Failed to save the WAL manifest.", "error", err)
+	}
+}
+
+// closed records the checksum of the finalized file seqNo.
+func (m *Manifest) closed(path string, seqNo uint64) error {
+	sum, err := segmentChecksum(path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.find(seqNo)
+	if s == nil {
+		return nil
+	}
+	s.Status = SegmentClosed
+	s.SHA256 = sum
+	return m.save()
+}
+
+func (m *Manifest) find(seqNo uint64) *ManifestSegment {
+	for i := range m.segments {
+		if m.segments[i].SeqNo == seqNo {
+			return &m.segments[i]
+		}
+	}
+	return nil
+}
+
+// save replaces the manifest file: write, sync, rename, sync the dir.
+func (m *Manifest) save() error {
+	data, err := json.MarshalIndent(manifestFile{Segments: m.segments}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.dir, ManifestName)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(m.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// updateSegment applies entries to s and reports whether they hold a
+// snapshot.
+func updateSegment(s *ManifestSegment, entries []types.WalLogEntry) bool {
+	snapshot := false
+	for _, entry := range entries {
+		switch v := entry.(type) {
+		case *types.WalLogDrawItem:
+			if s.FirstRequestID == 0 {
+				s.FirstRequestID = v.RequestID
+			}
+			s.LastRequestID = v.RequestID
+		case *types.WalLogSnapshotItem:
+			s.SnapshotPath = v.Path
+			snapshot = true
+		}
+	}
+	return snapshot
+}
+
+// segmentChecksum returns the SHA256 of a finalized WAL file, up to its
+// DataLength.
+func segmentChecksum(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(content) < types.WALHeaderSize {
+		return "", fmt.Errorf("%s is not a WAL file", path)
+	}
+	hdr, err := storage.DecodeHeader(content)
+	if err != nil {
+		return "", err
+	}
+	end := types.WALHeaderSize + int(hdr.DataLength)
+	if end > len(content) {
+		return "", fmt.Errorf("%s is shorter than its data length", path)
+	}
+	sum := sha256.Sum256(content[:end])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// scanSegments builds the manifest records of the wal.NNN files in dir.
+func scanSegments(dir string, format types.LogFormatter) ([]ManifestSegment, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []ManifestSegment
+	for _, e := range dirEntries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		seqNo, err := ParseSeqNo(name)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		entries, hdr, err := ReadWAL(path, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		s := ManifestSegment{SeqNo: seqNo, Name: name, Status: SegmentOpen}
+		updateSegment(&s, entries)
+		if hdr != nil && hdr.Status == types.WALStatusClosed {
+			s.Status = SegmentClosed
+			if s.SHA256, err = segmentChecksum(path); err != nil {
+				return nil, err
+			}
+		}
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].SeqNo < segments[j].SeqNo })
+	for i := 1; i < len(segments); i++ {
+		if segments[i].SeqNo != segments[i-1].SeqNo+1 {
+			return nil, fmt.Errorf("%w: %d after %d", types.ErrManifestGap, segments[i].SeqNo, segments[i-1].SeqNo)
+		}
+	}
+	return segments, nil
+}
+
+// ParseSeqNo returns the sequence number of a wal.NNN file path.
+func ParseSeqNo(path string) (uint64, error) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, types.WALBaseName+".") {
+		return 0, fmt.Errorf("invalid WAL file name format: %s", path)
+	}
+	seqNo, err := strconv.ParseUint(strings.TrimPrefix(name, types.WALBaseName+"."), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL file name format: %s", path)
+	}
+	return seqNo, nil
+}
@@ -0,0 +1,165 @@
+package wal_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/recovery"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+// drawWithManifest draws n times with small WAL files registered in the
+// manifest of walDir.
+func drawWithManifest(t *testing.T, walDir string, n int) {
+	manifest, err := wal.OpenManifest(walDir)
+	require.NoError(t, err)
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	walFactory := func(path string, seqNo uint64) (types.WAL, error) {
+		store, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4 * 1024})
+		if err != nil {
+			return nil, err
+		}
+		return wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), store, wal.WALOptional{Manifest: manifest})
+	}
+	path, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	w, err := walFactory(path, seqNo)
+	require.NoError(t, err)
+
+	pool := rewardpool.NewPool([]types.PoolReward{{ItemID: "gold", Quantity: 1000, Probability: 1}})
+	sys, err := actor.NewSystem(&types.Context{WAL: w, Utils: u}, pool, &actor.SystemOptional{
+		FlushAfterNDraw: 1,
+		WALFactory:      walFactory,
+	})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, (<-sys.Draw()).Err)
+	}
+	sys.Stop()
+}
+
+func TestManifest_Rotations(t *testing.T) {
+	walDir := t.TempDir()
+	drawWithManifest(t, walDir, 200)
+
+	segments, found, err := wal.ReadManifest(walDir)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Greater(t, len(segments), 1)
+
+	var lastRequestID uint64
+	for i, s := range segments {
+		assert.Equal(t, uint64(i), s.SeqNo)
+		assert.Equal(t, wal.SegmentClosed, s.Status)
+		assert.Equal(t, lastRequestID+1, s.FirstRequestID)
+		lastRequestID = s.LastRequestID
+
+		content, err := os.ReadFile(filepath.Join(walDir, s.Name))
+		require.NoError(t, err)
+		entries, hdr, err := wal.ParseWAL(filepath.Join(walDir, s.Name), formatter.NewJSONFormatter())
+		require.NoError(t, err)
+		// Each file starts with the snapshot it is replayed on.
+		assert.Equal(t, entries[0].(*types.WalLogSnapshotItem).Path, s.SnapshotPath)
+		sum := sha256.Sum256(content[:types.WALHeaderSize+hdr.DataLength])
+		assert.Equal(t, hex.EncodeToString(sum[:]), s.SHA256)
+	}
+	assert.Equal(t, uint64(200), lastRequestID)
+
+	// A stray file is not a WAL file, the manifest is the source of truth.
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, "wal.999"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, "wal.tmp"), nil, 0644))
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	files, err := u.GetWALFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, len(segments))
+	_, seqNo, err := u.GenNextWALPath()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(segments)), seqNo)
+
+	// The next run registers its file after them.
+	require.NoError(t, os.Remove(filepath.Join(walDir, "wal.999")))
+	drawWithManifest(t, walDir, 10)
+	next, _, err := wal.ReadManifest(walDir)
+	require.NoError(t, err)
+	require.Len(t, next, len(segments)+1)
+	assert.Equal(t, wal.SegmentClosed, next[len(segments)].Status)
+	assert.Equal(t, uint64(10), next[len(segments)].LastRequestID)
+}
+
+func TestManifest_MissingSegment(t *testing.T) {
+	walDir := t.TempDir()
+	drawWithManifest(t, walDir, 100)
+	require.NoError(t, os.Remove(filepath.Join(walDir, "wal.001")))
+
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	_, err := u.GetWALFiles()
+	assert.ErrorIs(t, err, types.ErrManifestMissingSegment)
+}
+
+func TestManifest_ChecksumMismatch(t *testing.T) {
+	walDir := t.TempDir()
+	drawWithManifest(t, walDir, 100)
+
+	// Flip a byte in the data of a closed file
+	path := filepath.Join(walDir, "wal.001")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content[types.WALHeaderSize] ^= 0xff
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	// Listing the files does not read them, recovery checks them.
+	u := utils.NewDefaultUtils(walDir, walDir, 0, io.Discard)
+	_, err = u.GetWALFiles()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, u.VerifyWALFiles(), types.ErrManifestChecksum)
+	_, _, _, err = recovery.RecoverPoolFromConfig(rewardpool.NewPool(nil), formatter.NewJSONFormatter(), u)
+	assert.ErrorIs(t, err, types.ErrManifestChecksum)
+}
+
+func TestOpenManifest_FromDirectory(t *testing.T) {
+	walDir := t.TempDir()
+	for seqNo := uint64(3); seqNo <= 4; seqNo++ {
+		path := filepath.Join(walDir, "wal.00"+string(rune('0'+seqNo)))
+		w, err := wal.NewWAL(path, seqNo, formatter.NewJSONFormatter(), nil)
+		require.NoError(t, err)
+		require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: seqNo * 10, ItemID: "gold", Success: true}))
+		require.NoError(t, w.Flush())
+		if seqNo == 3 {
+			require.NoError(t, w.Close())
+		}
+	}
+
+	manifest, err := wal.OpenManifest(walDir)
+	require.NoError(t, err)
+	segments := manifest.Segments()
+	require.Len(t, segments, 2)
+	assert.Equal(t, wal.ManifestSegment{SeqNo: 3, Name: "wal.003", FirstRequestID: 30, LastRequestID: 30, SHA256: segments[0].SHA256, Status: wal.SegmentClosed}, segments[0])
+	assert.NotEmpty(t, segments[0].SHA256)
+	assert.Equal(t, wal.ManifestSegment{SeqNo: 4, Name: "wal.004", FirstRequestID: 40, LastRequestID: 40, Status: wal.SegmentOpen}, segments[1])
+
+	// A new file must follow the last one.
+	_, err = wal.NewWAL(filepath.Join(walDir, "wal.006"), 6, formatter.NewJSONFormatter(), nil, wal.WALOptional{Manifest: manifest})
+	assert.ErrorIs(t, err, types.ErrManifestGap)
+}
+
+func TestReadManifest_Gap(t *testing.T) {
+	walDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, wal.ManifestName), []byte(`{"segments":[{"seq_no":0,"name":"wal.000"},{"seq_no":2,"name":"wal.002"}]}`), 0644))
+
+	_, _, err := wal.ReadManifest(walDir)
+	assert.ErrorIs(t, err, types.ErrManifestGap)
+	_, _, err = utils.NewDefaultUtils(walDir, walDir, 0, io.Discard).GenNextWALPath()
+	assert.ErrorIs(t, err, types.ErrManifestGap)
+}
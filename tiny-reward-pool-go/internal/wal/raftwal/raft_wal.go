@@ -0,0 +1,117 @@
+package raftwal
+
+import (
+	"context"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/raft"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+// WAL is a types.WAL that commits each flushed batch through a Raft log.
+//
+// Flush returns only once the batch is stored on a quorum of nodes, so the
+// actor commits a draw only when it survives the loss of the leader. A
+// failed flush is ambiguous: the batch may still be committed by the next
+// leader. The WAL then fails every later call and Fence fails, so the actor
+// stops drawing; a new actor must be started from the StateMachine of the
+// new leader.
+type WAL struct {
+	node      *raft.Node
+	formatter types.LogFormatter
+	buffer    []types.WalLogEntry
+	size      int64
+	err       error
+}
+
+var _ types.WAL = (*WAL)(nil)
+
+// NewWAL creates a WAL proposing to node, which must be the leader.
+// Batches are encoded with the JSON formatter read by the StateMachine.
+func NewWAL(node *raft.Node) *WAL {
+	return &WAL{node: node, formatter: formatter.NewJSONFormatter()}
+}
+
+func (w *WAL) LogDraw(item types.WalLogDrawItem) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buffer = append(w.buffer, &item)
+	return nil
+}
+
+func (w *WAL) LogUpdate(item types.WalLogUpdateItem) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buffer = append(w.buffer, &item)
+	return nil
+}
+
+func (w *WAL) LogSnapshot(item types.WalLogSnapshotItem) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buffer = append(w.buffer, &item)
+	return nil
+}
+
+func (w *WAL) Flush() error {
+	return w.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but records the Raft commit as a span when ctx
+// carries a trace. Cancelling ctx does not abort the commit.
+func (w *WAL) FlushContext(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	data, err := w.formatter.Encode(w.buffer)
+	if err != nil {
+		return err
+	}
+	w.buffer = w.buffer[:0]
+
+	_, span := tracing.Tracer(ctx).Start(ctx, "raft.commit")
+	_, err = w.node.Propose(context.WithoutCancel(ctx), data)
+	span.End()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.size += int64(len(data))
+	return nil
+}
+
+// Fence fails once the node is no longer the leader or a flush failed.
+// Pass it to actor.SystemOptional.Fence.
+func (w *WAL) Fence() error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.node.IsLeader() {
+		return types.ErrNotLeader
+	}
+	return nil
+}
+
+// Reset drops the buffered entries.
+func (w *WAL) Reset() {
+	w.buffer = w.buffer[:0]
+}
+
+// Close does nothing: the Raft node outlives the WAL.
+func (w *WAL) Close() error {
+	return nil
+}
+
+// Size returns the bytes committed through this WAL. It never reports
+// ErrWALFull, the Raft log is compacted instead.
+func (w *WAL) Size() (int64, error) {
+	return w.size, nil
+}
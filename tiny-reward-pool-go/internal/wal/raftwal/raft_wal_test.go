@@ -0,0 +1,154 @@
+package raftwal_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/raft"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/utils"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/raftwal"
+)
+
+var catalog = []types.PoolReward{
+	{ItemID: "gold", Quantity: 100, Probability: 10},
+	{ItemID: "silver", Quantity: 100, Probability: 30},
+}
+
+type cluster struct {
+	network *raft.Network
+	nodes   map[string]*raft.Node
+	sms     map[string]*raftwal.StateMachine
+}
+
+func newCluster(t *testing.T) *cluster {
+	t.Helper()
+	peers := []string{"n1", "n2", "n3"}
+	c := &cluster{
+		network: raft.NewNetwork(raft.NetworkOptional{DropRate: 0.1, MaxDelay: 3 * time.Millisecond, Seed: 7}),
+		nodes:   make(map[string]*raft.Node),
+		sms:     make(map[string]*raftwal.StateMachine),
+	}
+	for _, id := range peers {
+		sm := raftwal.NewStateMachine(catalog, 0)
+		node, err := raft.NewNode(raft.Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         c.network,
+			StateMachine:      sm,
+			TickInterval:      5 * time.Millisecond,
+			SnapshotThreshold: 8,
+		})
+		require.NoError(t, err)
+		c.network.Add(node)
+		c.nodes[id] = node
+		c.sms[id] = sm
+	}
+	for _, node := range c.nodes {
+		node.Start()
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// promote waits for a leader other than except, and starts an actor on it
+// from its state machine once everything committed before is applied.
+func (c *cluster) promote(t *testing.T, except string) (string, *actor.System, uint64) {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		for id, node := range c.nodes {
+			if id == except || !node.IsLeader() {
+				continue
+			}
+			if _, err := node.Propose(context.Background(), nil); err != nil {
+				continue
+			}
+			snapshot, err := c.sms[id].Snapshot()
+			require.NoError(t, err)
+
+			w := raftwal.NewWAL(node)
+			sys, err := actor.NewSystem(
+				&types.Context{WAL: w, Utils: &utils.MockUtils{}},
+				rewardpool.NewPool(snapshot.Catalog),
+				&actor.SystemOptional{FlushAfterNDraw: 1, LastRequestID: snapshot.LastRequestID, Fence: w.Fence},
+			)
+			require.NoError(t, err)
+			t.Cleanup(sys.Stop)
+			return id, sys, snapshot.LastRequestID
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return "", nil, 0
+}
+
+func (c *cluster) assertApplied(t *testing.T, state []types.PoolReward, requestID uint64, ids ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for _, id := range ids {
+			if c.sms[id].GetRequestID() != requestID {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 5*time.Millisecond)
+	for _, id := range ids {
+		assert.ElementsMatch(t, state, c.sms[id].State(), id)
+	}
+}
+
+func TestRaftWAL_Failover(t *testing.T) {
+	c := newCluster(t)
+	leaderID, sys, startID := c.promote(t, "")
+	require.Equal(t, uint64(0), startID)
+
+	var lastAcked uint64
+	for i := 0; i < 30; i++ {
+		resp := <-sys.Draw()
+		require.NoError(t, resp.Err)
+		lastAcked = resp.RequestID
+	}
+	// Every acknowledged draw is applied on every node, including the
+	// followers' compacted logs.
+	c.assertApplied(t, sys.State(), lastAcked, "n1", "n2", "n3")
+
+	// The isolated leader cannot commit, the draw is reverted and the actor
+	// stops drawing.
+	c.network.Isolate(leaderID)
+	resp := <-sys.Draw()
+	assert.ErrorIs(t, resp.Err, types.ErrNotLeader)
+	resp = <-sys.Draw()
+	assert.ErrorIs(t, resp.Err, types.ErrNotLeader)
+
+	// The new leader continues from the last acknowledged draw. The failed
+	// draw may have been committed, in which case its ID is not reused.
+	_, next, startID := c.promote(t, leaderID)
+	assert.GreaterOrEqual(t, startID, lastAcked)
+	assert.LessOrEqual(t, startID, lastAcked+1)
+	resp = <-next.Draw()
+	require.NoError(t, resp.Err)
+	assert.Equal(t, startID+1, resp.RequestID)
+
+	c.network.Heal(leaderID)
+	c.assertApplied(t, next.State(), resp.RequestID, "n1", "n2", "n3")
+}
+
+func TestRaftWAL_UpdateItem(t *testing.T) {
+	c := newCluster(t)
+	_, sys, _ := c.promote(t, "")
+
+	require.NoError(t, sys.UpdateItem("gold", 5, 10))
+	resp := <-sys.Draw()
+	require.NoError(t, resp.Err)
+
+	c.assertApplied(t, sys.State(), resp.RequestID, "n1", "n2", "n3")
+}
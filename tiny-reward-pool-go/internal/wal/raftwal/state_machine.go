@@ -0,0 +1,92 @@
+package raftwal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/raft"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+// StateMachine is the raft.StateMachine of the reward pool. It applies the
+// committed batches of the WAL to a pool with replay.ApplyLog, and is
+// snapshotted as a types.PoolSnapshot when the Raft log is compacted.
+//
+// Every node runs one. A node elected leader starts its actor from Snapshot
+// after a barrier (raft.Node.Propose with nil data), so it continues the
+// request ID sequence of the previous leader.
+type StateMachine struct {
+	formatter types.LogFormatter
+
+	mu        sync.RWMutex
+	pool      *rewardpool.Pool
+	requestID uint64
+}
+
+var _ raft.StateMachine = (*StateMachine)(nil)
+
+// NewStateMachine creates a StateMachine. All the nodes must start from the
+// same catalog and lastRequestID.
+func NewStateMachine(catalog []types.PoolReward, lastRequestID uint64) *StateMachine {
+	return &StateMachine{
+		formatter: formatter.NewJSONFormatter(),
+		pool:      rewardpool.NewPool(catalog),
+		requestID: lastRequestID,
+	}
+}
+
+// Apply implements raft.StateMachine.
+func (s *StateMachine) Apply(index uint64, data []byte) error {
+	entries, err := s.formatter.Decode(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode entry %d: %w", index, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		replay.ApplyLog(s.pool, e)
+		if draw, ok := e.(*types.WalLogDrawItem); ok {
+			s.requestID = draw.RequestID
+		}
+	}
+	return nil
+}
+
+// Snapshot implements raft.StateMachine. The snapshot carries the last request ID.
+func (s *StateMachine) Snapshot() (*types.PoolSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, err := s.pool.CreateSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.LastRequestID = s.requestID
+	return snapshot, nil
+}
+
+// Restore implements raft.StateMachine.
+func (s *StateMachine) Restore(snapshot *types.PoolSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pool = rewardpool.NewPool(snapshot.Catalog)
+	s.requestID = snapshot.LastRequestID
+	return nil
+}
+
+// State returns the committed state of the pool.
+func (s *StateMachine) State() []types.PoolReward {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool.State()
+}
+
+// GetRequestID returns the last committed request ID.
+func (s *StateMachine) GetRequestID() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.requestID
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// FaultStorage wraps a storage to inject failures, for tests. The data
+// written is only handed to the wrapped storage by Flush, so PowerLoss can
+// drop what was not flushed, like a machine losing power.
+type FaultStorage struct {
+	mu      sync.Mutex
+	inner   types.Storage
+	pending []byte
+	writes  int
+	flushes int
+	lost    bool
+
+	failWrites    map[int]bool
+	partialWrites map[int]bool
+	failFlushes   map[int]bool
+	powerLossAt   int
+}
+
+var _ types.Storage = (*FaultStorage)(nil)
+
+// FaultStorageOpt chooses the failing calls. Calls are counted from 1.
+type FaultStorageOpt struct {
+	// FailWrites are the calls of Write that fail without writing anything.
+	FailWrites []int
+	// PartialWrites are the calls of Write that write the first half of the
+	// data, then fail.
+	PartialWrites []int
+	// FailFlushes are the calls of Flush that fail. The data written since
+	// the last flush is left pending, as after a failed fsync.
+	FailFlushes []int
+	// PowerLossAtFlush loses power during that call of Flush, before any
+	// of its data is durable. Zero disables it.
+	PowerLossAtFlush int
+}
+
+func NewFaultStorage(inner types.Storage, ops ...FaultStorageOpt) *FaultStorage {
+	s := &FaultStorage{inner: inner}
+	for _, v := range ops {
+		s.failWrites = callSet(v.FailWrites)
+		s.partialWrites = callSet(v.PartialWrites)
+		s.failFlushes = callSet(v.FailFlushes)
+		s.powerLossAt = v.PowerLossAtFlush
+	}
+	return s
+}
+
+func callSet(calls []int) map[int]bool {
+	set := make(map[int]bool, len(calls))
+	for _, n := range calls {
+		set[n] = true
+	}
+	return set
+}
+
+func (s *FaultStorage) Write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return types.ErrPowerLost
+	}
+	s.writes++
+	if s.failWrites[s.writes] {
+		return types.ErrInjectedFault
+	}
+	if s.partialWrites[s.writes] {
+		s.pending = append(s.pending, data[:len(data)/2]...)
+		return types.ErrInjectedFault
+	}
+	s.pending = append(s.pending, data...)
+	return nil
+}
+
+func (s *FaultStorage) CanWrite(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.CanWrite(len(s.pending) + size)
+}
+
+func (s *FaultStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size, err := s.inner.Size()
+	return size + int64(len(s.pending)), err
+}
+
+func (s *FaultStorage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return types.ErrPowerLost
+	}
+	s.flushes++
+	if s.flushes == s.powerLossAt {
+		s.powerLoss()
+		return types.ErrPowerLost
+	}
+	if s.failFlushes[s.flushes] {
+		return types.ErrInjectedFault
+	}
+	return s.flushPending()
+}
+
+// flushPending hands the pending data to the wrapped storage.
+func (s *FaultStorage) flushPending() error {
+	if len(s.pending) > 0 {
+		if err := s.inner.Write(s.pending); err != nil {
+			return err
+		}
+		s.pending = s.pending[:0]
+	}
+	return s.inner.Flush()
+}
+
+// Truncate drops the data after size, see the wal package.
+func (s *FaultStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return types.ErrPowerLost
+	}
+	flushed, err := s.inner.Size()
+	if err != nil {
+		return err
+	}
+	if size >= flushed {
+		if keep := size - flushed; keep < int64(len(s.pending)) {
+			s.pending = s.pending[:keep]
+		}
+		return nil
+	}
+	t, ok := s.inner.(interface{ Truncate(size int64) error })
+	if !ok {
+		return fmt.Errorf("cannot truncate %T", s.inner)
+	}
+	s.pending = s.pending[:0]
+	return t.Truncate(size)
+}
+
+// PowerLoss drops the data that was not flushed. The wrapped storage is
+// left as it is, not finalized, and every later call fails with
+// types.ErrPowerLost.
+func (s *FaultStorage) PowerLoss() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.powerLoss()
+}
+
+func (s *FaultStorage) powerLoss() {
+	s.lost = true
+	s.pending = nil
+}
+
+// Lost reports whether the storage lost power.
+func (s *FaultStorage) Lost() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lost
+}
+
+// Calls returns the number of calls of Write and Flush so far.
+func (s *FaultStorage) Calls() (writes, flushes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes, s.flushes
+}
+
+func (s *FaultStorage) FinalizeAndClose() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost {
+		return types.ErrPowerLost
+	}
+	if err := s.flushPending(); err != nil {
+		return err
+	}
+	return s.inner.FinalizeAndClose()
+}
+
+// SetFirstRequestID is passed to the wrapped storage, see WALHeader.
+func (s *FaultStorage) SetFirstRequestID(id uint64) {
+	if inner, ok := s.inner.(interface{ SetFirstRequestID(id uint64) }); ok {
+		inner.SetFirstRequestID(id)
+	}
+}
+
+func (s *FaultStorage) Close() error {
+	return s.FinalizeAndClose()
+}
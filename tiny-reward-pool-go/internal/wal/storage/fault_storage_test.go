@@ -0,0 +1,89 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+func TestFaultStorage_Faults(t *testing.T) {
+	inner := storage.NewMemoryStorage(1)
+	fs := storage.NewFaultStorage(inner, storage.FaultStorageOpt{
+		FailWrites:    []int{2},
+		PartialWrites: []int{3},
+		FailFlushes:   []int{1},
+	})
+
+	require.NoError(t, fs.Write([]byte("aa")))
+	assert.ErrorIs(t, fs.Flush(), types.ErrInjectedFault)
+	// Only flushed data reaches the wrapped storage.
+	assert.Len(t, inner.Bytes(), types.WALHeaderSize)
+
+	assert.ErrorIs(t, fs.Write([]byte("bb")), types.ErrInjectedFault)
+	assert.ErrorIs(t, fs.Write([]byte("cccc")), types.ErrInjectedFault)
+	size, err := fs.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(types.WALHeaderSize+4), size)
+
+	require.NoError(t, fs.Flush())
+	assert.Equal(t, []byte("aacc"), inner.Bytes()[types.WALHeaderSize:])
+	writes, flushes := fs.Calls()
+	assert.Equal(t, 3, writes)
+	assert.Equal(t, 2, flushes)
+}
+
+func TestFaultStorage_PowerLoss(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.000")
+	inner, err := storage.NewFileStorage(path, 0)
+	require.NoError(t, err)
+	fs := storage.NewFaultStorage(inner, storage.FaultStorageOpt{PowerLossAtFlush: 2})
+	w, err := wal.NewWAL(path, 0, formatter.NewJSONFormatter(), fs)
+	require.NoError(t, err)
+
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 1, ItemID: "gold", Success: true}))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 2, ItemID: "gold", Success: true}))
+	assert.ErrorIs(t, w.Flush(), types.ErrPowerLost)
+	assert.True(t, fs.Lost())
+	assert.ErrorIs(t, w.Close(), types.ErrPowerLost)
+
+	// The file is not finalized, only the first flush is durable.
+	entries, hdr, err := wal.ReadWAL(path, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	assert.Equal(t, types.WALStatusOpen, hdr.Status)
+	require.Len(t, entries, 1)
+	assert.Equal(t, uint64(1), entries[0].(*types.WalLogDrawItem).RequestID)
+}
+
+func TestFaultStorage_WALRewindsFailedWrites(t *testing.T) {
+	inner := storage.NewMemoryStorage(1)
+	fs := storage.NewFaultStorage(inner, storage.FaultStorageOpt{
+		PartialWrites: []int{2},
+		FailFlushes:   []int{2},
+	})
+	w, err := wal.NewWAL("", 1, formatter.NewJSONFormatter(), fs)
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= 4; i++ {
+		require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: i, ItemID: "gold", Success: true}))
+		if err := w.Flush(); err != nil {
+			assert.ErrorIs(t, err, types.ErrInjectedFault)
+			w.Reset()
+		}
+	}
+	require.NoError(t, w.Close())
+
+	// The torn entry of the partial write and the batch of the failed
+	// flush were dropped.
+	entries, err := formatter.NewJSONFormatter().Decode(inner.Bytes()[types.WALHeaderSize:])
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(1), entries[0].(*types.WalLogDrawItem).RequestID)
+	assert.Equal(t, uint64(4), entries[1].(*types.WalLogDrawItem).RequestID)
+}
@@ -1,17 +1,17 @@
 package storage
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 )
 
 const ( // Constants for mmap file operations
-	defaultMmapFileSize int64 = 1024 * 1024 * 10 // 10 MB
+	defaultMmapFileSize  int64 = 1024 * 1024 * 10 // 10 MB
+	defaultMmapGrowChunk int64 = 1024 * 1024      // 1 MB
 )
 
 type FileMMapStorage struct {
@@ -21,20 +21,54 @@ type FileMMapStorage struct {
 	offset int64
 
 	sizeMapInBytes int64
+	growable       bool
+	growChunk      int64
+	firstRequestID uint64
 }
 
 var _ types.Storage = (*FileMMapStorage)(nil)
 
 type FileMMapStorageOps struct {
 	MMapFileSizeInBytes int64
+	// FencingToken is written to the header of a new file.
+	FencingToken uint64
+	// KeyID is written to the header of a new file, see types.WALHeader.
+	KeyID uint32
+	// Codec is written to the header of a new file, see types.WALHeader.
+	Codec uint32
+	// FormatterID is written to the header of a new file, see
+	// types.WALHeader.
+	FormatterID uint32
+	// Growable maps the file in chunks of GrowChunkInBytes instead of
+	// preallocating MMapFileSizeInBytes. MMapFileSizeInBytes becomes a soft
+	// limit: a write is accepted while the file is below it, and the map
+	// grows to fit it, so a batch is never rejected because it is a little
+	// larger than the space left.
+	Growable bool
+	// GrowChunkInBytes defaults to 1 MB.
+	GrowChunkInBytes int64
 }
 
 func NewFileMMapStorage(path string, seqNo uint64, opts ...FileMMapStorageOps) (*FileMMapStorage, error) {
 	sizeMapInBytes := defaultMmapFileSize
+	var fencingToken uint64
+	var keyID uint32
+	var codec uint32
+	var formatterID uint32
+	var growable bool
+	growChunk := defaultMmapGrowChunk
 	for _, val := range opts {
 		if val.MMapFileSizeInBytes > 0 {
 			sizeMapInBytes = val.MMapFileSizeInBytes
 		}
+		fencingToken = val.FencingToken
+		keyID = val.KeyID
+		codec = val.Codec
+		formatterID = val.FormatterID
+		growable = val.Growable
+		if val.GrowChunkInBytes > 0 {
+			growChunk = val.GrowChunkInBytes
+		}
 	}
 
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
@@ -51,14 +85,16 @@ func NewFileMMapStorage(path string, seqNo uint64, opts ...FileMMapStorageOps) (
 	currentSize := info.Size()
 	isNewFile := currentSize == 0
 
-	if isNewFile {
-		if err := f.Truncate(sizeMapInBytes); err != nil {
+	initialSize := sizeMapInBytes
+	if growable {
+		initialSize = max(min(growChunk, sizeMapInBytes), int64(types.WALHeaderSize))
+	}
+	if currentSize < initialSize {
+		// A new file, or a closed one truncated to its data.
+		if err := f.Truncate(initialSize); err != nil {
 			f.Close()
 			return nil, fmt.Errorf("failed to truncate file: %w", err)
 		}
-	} else {
-		// If the file exists, use its size for the mapping
-		sizeMapInBytes = currentSize
 	}
 
 	m, err := mmap.Map(f, mmap.RDWR, 0)
@@ -72,26 +108,28 @@ func NewFileMMapStorage(path string, seqNo uint64, opts ...FileMMapStorageOps) (
 		mmap:           m,
 		path:           path,
 		sizeMapInBytes: sizeMapInBytes,
+		growable:       growable,
+		growChunk:      growChunk,
 	}
 
 	if isNewFile {
 		hdr := types.WALHeader{
-			Magic:   types.WALMagic,
-			Version: types.WALVersion1,
-			Status:  types.WALStatusOpen,
-			SeqNo:   seqNo,
+			Magic:        types.WALMagic,
+			Version:      types.WALVersion2,
+			Status:       types.WALStatusOpen,
+			SeqNo:        seqNo,
+			FencingToken: fencingToken,
+			KeyID:        keyID,
+			Codec:        codec,
+			FormatterID:  formatterID,
+			CreatedAt:    time.Now().UnixNano(),
 		}
-		var buf bytes.Buffer
-		if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
-			s.Close()
-			return nil, err
-		}
-		copy(s.mmap, buf.Bytes())
+		copy(s.mmap, EncodeHeader(&hdr))
 		s.offset = int64(types.WALHeaderSize)
 	} else {
 		// Existing file, read header to restore offset
-		var hdr types.WALHeader
-		if err := binary.Read(bytes.NewReader(m[:types.WALHeaderSize]), binary.LittleEndian, &hdr); err != nil {
+		hdr, err := DecodeHeader(m[:types.WALHeaderSize])
+		if err != nil {
 			s.Close()
 			return nil, fmt.Errorf("failed to read WAL header from existing file: %w", err)
 		}
@@ -102,16 +140,50 @@ func NewFileMMapStorage(path string, seqNo uint64, opts ...FileMMapStorageOps) (
 }
 
 func (s *FileMMapStorage) Write(data []byte) error {
+	if end := s.offset + int64(len(data)); end > int64(len(s.mmap)) {
+		if !s.growable {
+			return types.ErrWALFull
+		}
+		// Round up to a whole number of chunks.
+		if err := s.remap((end + s.growChunk - 1) / s.growChunk * s.growChunk); err != nil {
+			return err
+		}
+	}
 	copy(s.mmap[s.offset:], data)
 	s.offset += int64(len(data))
 	return nil
 }
 
 func (s *FileMMapStorage) CanWrite(size int) bool {
+	if s.growable {
+		// Soft limit: the last batch may end past it.
+		return s.offset < s.sizeMapInBytes
+	}
 	// For mmap, the capacity is the total length of the map.
 	return s.offset+int64(size) <= int64(len(s.mmap))
 }
 
+// remap grows the file to size and maps it again.
+func (s *FileMMapStorage) remap(size int64) error {
+	if s.mmap != nil {
+		if err := s.mmap.Flush(); err != nil {
+			return err
+		}
+		if err := s.mmap.Unmap(); err != nil {
+			return err
+		}
+	}
+	if err := s.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to grow file: %w", err)
+	}
+	m, err := mmap.Map(s.file, mmap.RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to mmap file: %w", err)
+	}
+	s.mmap = m
+	return nil
+}
+
 func (s *FileMMapStorage) Size() (int64, error) {
 	return s.offset, nil
 }
@@ -120,6 +192,17 @@ func (s *FileMMapStorage) Flush() error {
 	return s.mmap.Flush()
 }
 
+// Truncate drops the data after size, see the wal package. The dropped
+// bytes are zeroed, an open file is read up to the first zero byte.
+func (s *FileMMapStorage) Truncate(size int64) error {
+	if size < types.WALHeaderSize || size > s.offset {
+		return fmt.Errorf("cannot truncate WAL file of %d bytes to %d", s.offset, size)
+	}
+	clear(s.mmap[size:s.offset])
+	s.offset = size
+	return nil
+}
+
 func (s *FileMMapStorage) FinalizeAndClose() error {
 	if s.mmap == nil {
 		return nil
@@ -130,23 +213,20 @@ func (s *FileMMapStorage) FinalizeAndClose() error {
 	}
 
 	hdr := types.WALHeader{
-		Magic:      types.WALMagic,
-		Version:    types.WALVersion1,
-		Status:     types.WALStatusClosed,
-		DataLength: uint64(s.offset - types.WALHeaderSize),
+		Magic:   types.WALMagic,
+		Version: types.WALVersion1,
 	}
 
-	// Read the original SeqNo from the header before overwriting
-	var originalHdr types.WALHeader
-	if err := binary.Read(bytes.NewReader(s.mmap[:types.WALHeaderSize]), binary.LittleEndian, &originalHdr); err == nil {
-		hdr.SeqNo = originalHdr.SeqNo
+	// Keep the original header fields (SeqNo, FencingToken) before overwriting
+	if originalHdr, err := DecodeHeader(s.mmap[:types.WALHeaderSize]); err == nil {
+		hdr = *originalHdr
 	}
-
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
-		return err
+	hdr.Status = types.WALStatusClosed
+	hdr.DataLength = uint64(s.offset - types.WALHeaderSize)
+	if hdr.FirstRequestID == 0 {
+		hdr.FirstRequestID = s.firstRequestID
 	}
-	copy(s.mmap, buf.Bytes())
+	copy(s.mmap, EncodeHeader(&hdr))
 
 	if err := s.mmap.Flush(); err != nil {
 		return err
@@ -157,9 +237,22 @@ func (s *FileMMapStorage) FinalizeAndClose() error {
 		return err
 	}
 
+	// Drop the zeroes after the data, readers stop at DataLength.
+	if err := s.file.Truncate(s.offset); err != nil {
+		s.file.Close()
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+
 	return s.file.Close()
 }
 
+// SetFirstRequestID records the request ID of the first draw written to
+// the file. It is written to the header when the file is finalized, unless
+// the header already has one.
+func (s *FileMMapStorage) SetFirstRequestID(id uint64) {
+	s.firstRequestID = id
+}
+
 func (s *FileMMapStorage) Close() error {
 	return s.FinalizeAndClose()
 }
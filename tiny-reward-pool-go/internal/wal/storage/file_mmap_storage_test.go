@@ -1,7 +1,10 @@
 package storage_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,3 +70,83 @@ func TestFileMMapStorage_Reopen(t *testing.T) {
 	expectedContent := append(initialData, secondData...)
 	assert.Contains(t, string(finalContent[types.WALHeaderSize:]), string(expectedContent))
 }
+
+func TestFileMMapStorage_FencingToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.000")
+
+	fs, err := storage.NewFileMMapStorage(path, 3, storage.FileMMapStorageOps{MMapFileSizeInBytes: 1024, FencingToken: 7})
+	require.NoError(t, err)
+	require.NoError(t, fs.Write([]byte("data")))
+	require.NoError(t, fs.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var hdr types.WALHeader
+	require.NoError(t, binary.Read(bytes.NewReader(content[:types.WALHeaderSize]), binary.LittleEndian, &hdr))
+
+	// The header is rewritten on close but keeps SeqNo and FencingToken
+	assert.Equal(t, types.WALStatusClosed, hdr.Status)
+	assert.Equal(t, uint64(3), hdr.SeqNo)
+	assert.Equal(t, uint64(7), hdr.FencingToken)
+	assert.Equal(t, uint64(4), hdr.DataLength)
+}
+
+func TestFileMMapStorage_TruncatedOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.000")
+
+	fs, err := storage.NewFileMMapStorage(path, 0, storage.FileMMapStorageOps{MMapFileSizeInBytes: 1024})
+	require.NoError(t, err)
+	require.NoError(t, fs.Write([]byte("data")))
+	require.NoError(t, fs.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(types.WALHeaderSize+4), info.Size())
+
+	// Reopened, the file gets its free space back.
+	fs, err = storage.NewFileMMapStorage(path, 0, storage.FileMMapStorageOps{MMapFileSizeInBytes: 1024})
+	require.NoError(t, err)
+	assert.True(t, fs.CanWrite(1024-types.WALHeaderSize-4))
+	assert.False(t, fs.CanWrite(1024-types.WALHeaderSize-3))
+	require.NoError(t, fs.Close())
+}
+
+func TestFileMMapStorage_Growable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.000")
+	opt := storage.FileMMapStorageOps{MMapFileSizeInBytes: 2048, Growable: true, GrowChunkInBytes: 512}
+
+	fs, err := storage.NewFileMMapStorage(path, 0, opt)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(512), info.Size(), "mapped one chunk at a time")
+
+	// A batch larger than the space left is accepted below the soft limit.
+	batch := bytes.Repeat([]byte("a"), 1500)
+	require.True(t, fs.CanWrite(len(batch)))
+	require.NoError(t, fs.Write(batch))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2048), info.Size())
+
+	// Past the soft limit after the next batch.
+	require.True(t, fs.CanWrite(len(batch)))
+	require.NoError(t, fs.Write(batch))
+	assert.False(t, fs.CanWrite(1))
+	require.NoError(t, fs.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, content, types.WALHeaderSize+2*len(batch))
+	assert.Equal(t, append(batch, batch...), content[types.WALHeaderSize:])
+
+	// Reopened, it grows from its data again.
+	fs, err = storage.NewFileMMapStorage(path, 0, storage.FileMMapStorageOps{MMapFileSizeInBytes: 4096, Growable: true, GrowChunkInBytes: 512})
+	require.NoError(t, err)
+	require.NoError(t, fs.Write([]byte("b")))
+	require.NoError(t, fs.Close())
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, byte('b'), content[len(content)-1])
+	assert.Len(t, content, types.WALHeaderSize+2*len(batch)+1)
+}
@@ -1,11 +1,11 @@
 package storage
 
 import (
-	"bytes"
-	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
 	"os"
+	"time"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 )
@@ -14,20 +14,39 @@ type FileStorage struct {
 	file     *os.File
 	capacity int
 	usage    int
+
+	firstRequestID uint64
 }
 
 var _ types.Storage = (*FileStorage)(nil)
 
 type FileStorageOpt struct {
 	SizeFileInBytes int
+	// FencingToken is written to the header of a new file.
+	FencingToken uint64
+	// KeyID is written to the header of a new file, see types.WALHeader.
+	KeyID uint32
+	// Codec is written to the header of a new file, see types.WALHeader.
+	Codec uint32
+	// FormatterID is written to the header of a new file, see
+	// types.WALHeader.
+	FormatterID uint32
 }
 
 func NewFileStorage(path string, seqNo uint64, ops ...FileStorageOpt) (*FileStorage, error) {
 	maxSize := math.MaxInt
+	var fencingToken uint64
+	var keyID uint32
+	var codec uint32
+	var formatterID uint32
 	for _, v := range ops {
 		if v.SizeFileInBytes > 0 {
 			maxSize = v.SizeFileInBytes
 		}
+		fencingToken = v.FencingToken
+		keyID = v.KeyID
+		codec = v.Codec
+		formatterID = v.FormatterID
 	}
 
 	// Use O_RDWR instead of O_APPEND and O_WRONLY to allow seeking back to write the header
@@ -47,12 +66,17 @@ func NewFileStorage(path string, seqNo uint64, ops ...FileStorageOpt) (*FileStor
 	if info.Size() == 0 {
 		// New file, write header
 		hdr := types.WALHeader{
-			Magic:   types.WALMagic,
-			Version: types.WALVersion1,
-			Status:  types.WALStatusOpen,
-			SeqNo:   seqNo,
+			Magic:        types.WALMagic,
+			Version:      types.WALVersion2,
+			Status:       types.WALStatusOpen,
+			SeqNo:        seqNo,
+			FencingToken: fencingToken,
+			KeyID:        keyID,
+			Codec:        codec,
+			FormatterID:  formatterID,
+			CreatedAt:    time.Now().UnixNano(),
 		}
-		if err := binary.Write(f, binary.LittleEndian, &hdr); err != nil {
+		if _, err := f.Write(EncodeHeader(&hdr)); err != nil {
 			f.Close()
 			return nil, err
 		}
@@ -92,6 +116,21 @@ func (s *FileStorage) Flush() error {
 	return s.file.Sync()
 }
 
+// Truncate drops the data after size, see the wal package.
+func (s *FileStorage) Truncate(size int64) error {
+	if size < types.WALHeaderSize || size > int64(s.usage) {
+		return fmt.Errorf("cannot truncate WAL file of %d bytes to %d", s.usage, size)
+	}
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	s.usage = int(size)
+	return nil
+}
+
 func (s *FileStorage) FinalizeAndClose() error {
 	if err := s.file.Sync(); err != nil {
 		return err
@@ -102,26 +141,25 @@ func (s *FileStorage) FinalizeAndClose() error {
 		return err
 	}
 
-	// Read the original header to preserve SeqNo
+	// Read the original header to preserve SeqNo and FencingToken
 	originalHdrBytes := make([]byte, types.WALHeaderSize)
 	_, err := s.file.ReadAt(originalHdrBytes, 0)
 	if err != nil {
 		return err
 	}
-	var originalHdr types.WALHeader
-	if err := binary.Read(bytes.NewReader(originalHdrBytes), binary.LittleEndian, &originalHdr); err != nil {
+	originalHdr, err := DecodeHeader(originalHdrBytes)
+	if err != nil {
 		return err
 	}
 
-	hdr := types.WALHeader{
-		Magic:      types.WALMagic,
-		Version:    types.WALVersion1,
-		Status:     types.WALStatusClosed,
-		SeqNo:      originalHdr.SeqNo,
-		DataLength: uint64(s.usage - types.WALHeaderSize),
+	hdr := *originalHdr
+	hdr.Status = types.WALStatusClosed
+	hdr.DataLength = uint64(s.usage - types.WALHeaderSize)
+	if hdr.FirstRequestID == 0 {
+		hdr.FirstRequestID = s.firstRequestID
 	}
 
-	if err := binary.Write(s.file, binary.LittleEndian, &hdr); err != nil {
+	if _, err := s.file.Write(EncodeHeader(&hdr)); err != nil {
 		return err
 	}
 
@@ -132,6 +170,13 @@ func (s *FileStorage) FinalizeAndClose() error {
 	return s.file.Close()
 }
 
+// SetFirstRequestID records the request ID of the first draw written to
+// the file. It is written to the header when the file is finalized, unless
+// the header already has one.
+func (s *FileStorage) SetFirstRequestID(id uint64) {
+	s.firstRequestID = id
+}
+
 func (s *FileStorage) Close() error {
 	return s.FinalizeAndClose()
 }
\ No newline at end of file
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// EncodeHeader returns the bytes of hdr. From version 2, its Checksum is
+// set first.
+func EncodeHeader(hdr *types.WALHeader) []byte {
+	if hdr.Version >= types.WALVersion2 {
+		hdr.Checksum = 0
+		hdr.Checksum = crc32.ChecksumIEEE(encodeHeader(hdr))
+	}
+	return encodeHeader(hdr)
+}
+
+func encodeHeader(hdr *types.WALHeader) []byte {
+	var buf bytes.Buffer
+	buf.Grow(types.WALHeaderSize)
+	// Writing a fixed size struct to a bytes.Buffer does not fail.
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	return buf.Bytes()
+}
+
+// DecodeHeader decodes the header at the start of data. The magic number
+// is left to the caller. From version 2, a header that does not match its
+// checksum fails with types.ErrWALHeaderChecksum.
+func DecodeHeader(data []byte) (*types.WALHeader, error) {
+	if len(data) < types.WALHeaderSize {
+		return nil, fmt.Errorf("failed to decode WAL header: %d bytes", len(data))
+	}
+	var hdr types.WALHeader
+	if err := binary.Read(bytes.NewReader(data[:types.WALHeaderSize]), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to decode WAL header: %w", err)
+	}
+	if hdr.Magic != types.WALMagic || hdr.Version < types.WALVersion2 {
+		return &hdr, nil
+	}
+	check := hdr
+	check.Checksum = 0
+	if crc32.ChecksumIEEE(encodeHeader(&check)) != hdr.Checksum {
+		return &hdr, fmt.Errorf("%w in WAL file %d", types.ErrWALHeaderChecksum, hdr.SeqNo)
+	}
+	return &hdr, nil
+}
@@ -0,0 +1,58 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+func TestHeader_Checksum(t *testing.T) {
+	hdr := types.WALHeader{
+		Magic:          types.WALMagic,
+		Version:        types.WALVersion2,
+		SeqNo:          4,
+		FormatterID:    types.WALFormatterStringLine,
+		Codec:          types.WALCodecSnappy,
+		FirstRequestID: 101,
+		CreatedAt:      1700000000000000000,
+	}
+	data := storage.EncodeHeader(&hdr)
+	require.Len(t, data, types.WALHeaderSize)
+	assert.NotZero(t, hdr.Checksum)
+
+	decoded, err := storage.DecodeHeader(data)
+	require.NoError(t, err)
+	assert.Equal(t, hdr, *decoded)
+
+	data[20] ^= 0xff
+	_, err = storage.DecodeHeader(data)
+	assert.ErrorIs(t, err, types.ErrWALHeaderChecksum)
+
+	// A version 1 header has no checksum.
+	v1 := types.WALHeader{Magic: types.WALMagic, Version: types.WALVersion1, SeqNo: 4}
+	data = storage.EncodeHeader(&v1)
+	assert.Zero(t, v1.Checksum)
+	data[20] ^= 0xff
+	decoded, err = storage.DecodeHeader(data)
+	require.NoError(t, err)
+	assert.Equal(t, types.WALVersion1, decoded.Version)
+}
+
+func TestMemoryStorage_HeaderV2(t *testing.T) {
+	ms := storage.NewMemoryStorage(2, storage.MemoryStorageOpt{FormatterID: types.WALFormatterJSON, Codec: types.WALCodecZstd})
+	require.NoError(t, ms.Write([]byte("x\n")))
+	ms.SetFirstRequestID(42)
+	require.NoError(t, ms.FinalizeAndClose())
+
+	hdr, err := storage.DecodeHeader(ms.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, types.WALVersion2, hdr.Version)
+	assert.Equal(t, types.WALFormatterJSON, hdr.FormatterID)
+	assert.Equal(t, types.WALCodecZstd, hdr.Codec)
+	assert.Equal(t, uint64(42), hdr.FirstRequestID)
+	assert.NotZero(t, hdr.CreatedAt)
+	assert.Equal(t, types.WALStatusClosed, hdr.Status)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// MemoryStorage keeps a WAL file in memory, for tests and benchmarks.
+// Bytes returns the same layout as a finalized WAL file.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	data     []byte
+	capacity int
+	closed   bool
+
+	firstRequestID uint64
+}
+
+var _ types.Storage = (*MemoryStorage)(nil)
+
+type MemoryStorageOpt struct {
+	// SizeInBytes is the capacity, header included. Zero means unlimited.
+	SizeInBytes int
+	// FencingToken is written to the header.
+	FencingToken uint64
+	// KeyID is written to the header, see types.WALHeader.
+	KeyID uint32
+	// Codec is written to the header, see types.WALHeader.
+	Codec uint32
+	// FormatterID is written to the header, see types.WALHeader.
+	FormatterID uint32
+}
+
+func NewMemoryStorage(seqNo uint64, ops ...MemoryStorageOpt) *MemoryStorage {
+	capacity := math.MaxInt
+	var fencingToken uint64
+	var keyID uint32
+	var codec uint32
+	var formatterID uint32
+	for _, v := range ops {
+		if v.SizeInBytes > 0 {
+			capacity = v.SizeInBytes
+		}
+		fencingToken = v.FencingToken
+		keyID = v.KeyID
+		codec = v.Codec
+		formatterID = v.FormatterID
+	}
+
+	hdr := types.WALHeader{
+		Magic:        types.WALMagic,
+		Version:      types.WALVersion2,
+		Status:       types.WALStatusOpen,
+		SeqNo:        seqNo,
+		FencingToken: fencingToken,
+		KeyID:        keyID,
+		Codec:        codec,
+		FormatterID:  formatterID,
+		CreatedAt:    time.Now().UnixNano(),
+	}
+	return &MemoryStorage{data: EncodeHeader(&hdr), capacity: capacity}
+}
+
+func (s *MemoryStorage) Write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, data...)
+	return nil
+}
+
+func (s *MemoryStorage) CanWrite(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)+size <= s.capacity
+}
+
+func (s *MemoryStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	return nil
+}
+
+// Truncate drops the data after size, see the wal package.
+func (s *MemoryStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < types.WALHeaderSize || size > int64(len(s.data)) {
+		return fmt.Errorf("cannot truncate WAL file of %d bytes to %d", len(s.data), size)
+	}
+	s.data = s.data[:size]
+	return nil
+}
+
+func (s *MemoryStorage) FinalizeAndClose() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	hdr, err := DecodeHeader(s.data[:types.WALHeaderSize])
+	if err != nil {
+		return err
+	}
+	hdr.Status = types.WALStatusClosed
+	hdr.DataLength = uint64(len(s.data) - types.WALHeaderSize)
+	if hdr.FirstRequestID == 0 {
+		hdr.FirstRequestID = s.firstRequestID
+	}
+	copy(s.data, EncodeHeader(hdr))
+	s.closed = true
+	return nil
+}
+
+// SetFirstRequestID records the request ID of the first draw written to
+// the storage. It is written to the header when it is finalized.
+func (s *MemoryStorage) SetFirstRequestID(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firstRequestID = id
+}
+
+func (s *MemoryStorage) Close() error {
+	return s.FinalizeAndClose()
+}
+
+// Bytes returns a copy of the file content, header included.
+func (s *MemoryStorage) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.data)
+}
@@ -0,0 +1,35 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ms := storage.NewMemoryStorage(7, storage.MemoryStorageOpt{SizeInBytes: types.WALHeaderSize + 16, FencingToken: 3})
+
+	data := []byte("hello world")
+	require.True(t, ms.CanWrite(len(data)))
+	require.NoError(t, ms.Write(data))
+	require.NoError(t, ms.Flush())
+	assert.False(t, ms.CanWrite(len(data)))
+	size, err := ms.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(types.WALHeaderSize+len(data)), size)
+
+	require.NoError(t, ms.Close())
+	content := ms.Bytes()
+	var hdr types.WALHeader
+	require.NoError(t, binary.Read(bytes.NewReader(content), binary.LittleEndian, &hdr))
+	assert.Equal(t, types.WALStatusClosed, hdr.Status)
+	assert.Equal(t, uint64(len(data)), hdr.DataLength)
+	assert.Equal(t, uint64(7), hdr.SeqNo)
+	assert.Equal(t, uint64(3), hdr.FencingToken)
+	assert.Equal(t, data, content[types.WALHeaderSize:])
+}
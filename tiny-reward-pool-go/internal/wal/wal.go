@@ -2,12 +2,17 @@ package wal
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/crypt"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
 )
@@ -16,10 +21,36 @@ type WAL struct {
 	formatter types.LogFormatter
 	storage   types.Storage
 	buffer    []types.WalLogEntry
+	metrics   *metrics.Metrics
+	path      string
+	seqNo     uint64
+	manifest  *Manifest
+	// firstRequestID is the first draw written to the file, 0 until then.
+	firstRequestID uint64
+}
+
+// WALOptional provides optional parameters for creating a new WAL.
+type WALOptional struct {
+	// Metrics counts the bytes written to storage. Nil disables it.
+	Metrics *metrics.Metrics
+	// Manifest registers the file, see Manifest. Nil disables it.
+	Manifest *Manifest
 }
 
 var _ types.WAL = (*WAL)(nil)
 
+// firstRequestIDSetter is implemented by the storages that record the
+// first draw of the file in its header, see types.WALHeader.
+type firstRequestIDSetter interface {
+	SetFirstRequestID(id uint64)
+}
+
+// truncater is implemented by the storages that can drop the data left by
+// a failed write or flush, see FlushContext.
+type truncater interface {
+	Truncate(size int64) error
+}
+
 // Size returns the current size of the WAL content.
 func (w *WAL) Size() (int64, error) {
 	val, err := w.storage.Size()
@@ -30,11 +61,20 @@ func (w *WAL) Size() (int64, error) {
 }
 
 func (w *WAL) Flush() error {
+	return w.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but records the encode, write and storage
+// flush steps as spans when ctx carries a trace.
+func (w *WAL) FlushContext(ctx context.Context) error {
 	if len(w.buffer) == 0 {
 		return nil
 	}
+	tracer := tracing.Tracer(ctx)
 
+	_, span := tracer.Start(ctx, "wal.encode")
 	data, err := w.formatter.Encode(w.buffer)
+	span.End()
 	if err != nil {
 		return err
 	}
@@ -43,16 +83,62 @@ func (w *WAL) Flush() error {
 		return types.ErrWALFull
 	}
 
-	err = w.storage.Write(data)
+	size, err := w.storage.Size()
 	if err != nil {
 		return err
 	}
 
+	_, span = tracer.Start(ctx, "storage.write")
+	err = w.storage.Write(data)
+	span.End()
+	if err != nil {
+		return w.rewind(size, err)
+	}
+	w.metrics.AddWALBytes(len(data))
+
+	_, span = tracer.Start(ctx, "storage.flush")
+	err = w.storage.Flush()
+	span.End()
+	if err != nil {
+		w.buffer = w.buffer[:0]
+		return w.rewind(size, err)
+	}
+	if w.firstRequestID == 0 {
+		w.setFirstRequestID()
+	}
+	if w.manifest != nil {
+		w.manifest.flushed(w.seqNo, w.buffer)
+	}
 	w.buffer = w.buffer[:0]
-	return w.storage.Flush()
+	return nil
 }
 
-func NewWAL(path string, seqNo uint64, format types.LogFormatter, store types.Storage) (*WAL, error) {
+// rewind drops what a failed write or flush of the batch left in the
+// storage, back to size. The caller reverts the batch, so it must not be
+// recovered, and a torn entry would corrupt the ones written after it.
+//
+// The data of a FileMMapStorage is visible to other readers of the file
+// as soon as it is written, so the batch may have been read already. The
+// next batch is written over it. walstream.Tailer detects it and reads the
+// file again. The StreamingActor only replays the batches the processor
+// flushed.
+func (w *WAL) rewind(size int64, err error) error {
+	t, ok := w.storage.(truncater)
+	if !ok {
+		return err
+	}
+	if terr := t.Truncate(size); terr != nil {
+		return errors.Join(err, fmt.Errorf("failed to rewind WAL: %w", terr))
+	}
+	return err
+}
+
+func NewWAL(path string, seqNo uint64, format types.LogFormatter, store types.Storage, opts ...WALOptional) (*WAL, error) {
+	var opt WALOptional
+	for _, o := range opts {
+		opt = o
+	}
+
 	if format == nil {
 		format = formatter.NewJSONFormatter()
 	}
@@ -64,8 +150,23 @@ func NewWAL(path string, seqNo uint64, format types.LogFormatter, store types.St
 		}
 	}
 
+	if opt.Manifest != nil {
+		if err := opt.Manifest.opened(path, seqNo); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("failed to register WAL file in the manifest: %w", err)
+		}
+	}
+
 	// Preallocate buffer for performance (e.g., 4096 entries)
-	return &WAL{formatter: format, storage: store, buffer: make([]types.WalLogEntry, 0, 4096)}, nil
+	return &WAL{formatter: format, storage: store, buffer: make([]types.WalLogEntry, 0, 4096), metrics: opt.Metrics, path: path, seqNo: seqNo, manifest: opt.Manifest}, nil
+}
+
+// NewMemoryWAL creates a JSON WAL kept in a storage.MemoryStorage, for
+// tests and benchmarks.
+func NewMemoryWAL(opts ...storage.MemoryStorageOpt) *WAL {
+	// NewWAL only fails when it creates the storage.
+	w, _ := NewWAL("", 0, formatter.NewJSONFormatter(), storage.NewMemoryStorage(0, opts...))
+	return w
 }
 
 func (w *WAL) LogDraw(item types.WalLogDrawItem) error {
@@ -84,13 +185,90 @@ func (w *WAL) LogSnapshot(item types.WalLogSnapshotItem) error {
 }
 
 func (w *WAL) Close() error {
-	return w.storage.FinalizeAndClose()
+	if err := w.storage.FinalizeAndClose(); err != nil {
+		return err
+	}
+	if w.manifest != nil {
+		return w.manifest.closed(w.path, w.seqNo)
+	}
+	return nil
+}
+
+// setFirstRequestID records the first draw of the buffer, if any.
+func (w *WAL) setFirstRequestID() {
+	for _, entry := range w.buffer {
+		if v, ok := entry.(*types.WalLogDrawItem); ok {
+			w.firstRequestID = v.RequestID
+			if s, ok := w.storage.(firstRequestIDSetter); ok {
+				s.SetFirstRequestID(v.RequestID)
+			}
+			return
+		}
+	}
 }
 
 func (w *WAL) Reset() {
 	w.buffer = w.buffer[:0]
 }
 
+// FormatterFor returns the formatter decoding the data of the file with
+// header hdr.
+//
+// A version 2 header names the formatter and the codec of the file, so
+// only the keys are taken from format: the file is read whatever
+// wal.formatter and wal.compression are set to now. Other files are
+// decoded with format, without its encryption when they have no key ID.
+//
+// A file encrypted with a key that format does not have fails with
+// types.ErrEncryptionKeyMissing rather than a decoding error.
+func FormatterFor(hdr *types.WALHeader, format types.LogFormatter) (types.LogFormatter, error) {
+	encrypted, _ := format.(*crypt.Formatter)
+	if hdr.KeyID != 0 && (encrypted == nil || !encrypted.HasKey(hdr.KeyID)) {
+		return nil, fmt.Errorf("%w: WAL file %d needs key %d", types.ErrEncryptionKeyMissing, hdr.SeqNo, hdr.KeyID)
+	}
+
+	if hdr.Version < types.WALVersion2 || hdr.FormatterID == types.WALFormatterUnknown {
+		if hdr.KeyID == 0 && encrypted != nil {
+			return encrypted.Plain(), nil
+		}
+		return format, nil
+	}
+
+	decoder, err := formatter.ByID(hdr.FormatterID)
+	if err != nil {
+		return nil, fmt.Errorf("WAL file %d: %w", hdr.SeqNo, err)
+	}
+	if hdr.Codec != types.WALCodecNone {
+		decoder = compress.NewFormatter(decoder, hdr.Codec)
+	}
+	if hdr.KeyID != 0 {
+		decoder = crypt.NewFormatter(decoder, encrypted.Keyring())
+	}
+	return decoder, nil
+}
+
+// ReadHeader reads the header of the WAL file at path.
+func ReadHeader(path string) (*types.WALHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdrBytes := make([]byte, types.WALHeaderSize)
+	if _, err := io.ReadFull(f, hdrBytes); err != nil {
+		return nil, fmt.Errorf("failed to read WAL header: %w", err)
+	}
+	hdr, err := storage.DecodeHeader(hdrBytes)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Magic != types.WALMagic {
+		return nil, fmt.Errorf("invalid WAL magic number")
+	}
+	return hdr, nil
+}
+
 // ParseWAL reads the WAL log file, decodes its content, and returns the log entries and the header.
 func ParseWAL(path string, format types.LogFormatter) ([]types.WalLogEntry, *types.WALHeader, error) {
 	f, err := os.Open(path)
@@ -115,31 +293,87 @@ func ParseWAL(path string, format types.LogFormatter) ([]types.WalLogEntry, *typ
 		return nil, nil, fmt.Errorf("failed to read WAL header (read %d bytes): %w", n, err)
 	}
 
-	var hdr types.WALHeader
-	if err := binary.Read(bytes.NewReader(hdrBytes), binary.LittleEndian, &hdr); err != nil {
-		return nil, nil, fmt.Errorf("failed to decode WAL header: %w", err)
+	hdr, err := storage.DecodeHeader(hdrBytes)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Basic validation
 	if hdr.Magic != types.WALMagic {
 		return nil, nil, fmt.Errorf("invalid WAL magic number")
 	}
+	format, err = FormatterFor(hdr, format)
+	if err != nil {
+		return nil, hdr, err
+	}
 
 	// Read data
 	data := make([]byte, hdr.DataLength)
 	_, err = io.ReadFull(f, data)
 	if err != nil {
-		return nil, &hdr, fmt.Errorf("failed to read WAL data: %w", err)
+		return nil, hdr, fmt.Errorf("failed to read WAL data: %w", err)
 	}
 
 	if len(data) == 0 {
-		return []types.WalLogEntry{}, &hdr, nil
+		return []types.WalLogEntry{}, hdr, nil
 	}
 
 	entries, err := format.Decode(data)
 	if err != nil {
-		return nil, &hdr, err
+		return nil, hdr, err
 	}
 
-	return entries, &hdr, nil
-}
\ No newline at end of file
+	return entries, hdr, nil
+}
+
+// ReadWAL is like ParseWAL but also reads a file that is still being
+// written. Its DataLength is only set when the file is finalized, so the
+// data runs up to the first zero byte of the preallocated file. A last
+// entry that is only partially written is left out.
+func ReadWAL(path string, format types.LogFormatter) ([]types.WalLogEntry, *types.WALHeader, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if len(content) < types.WALHeaderSize {
+		return nil, nil, nil
+	}
+
+	hdr, err := storage.DecodeHeader(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Magic != types.WALMagic {
+		return nil, nil, fmt.Errorf("invalid WAL magic number")
+	}
+	format, err = FormatterFor(hdr, format)
+	if err != nil {
+		return nil, hdr, err
+	}
+
+	data := content[types.WALHeaderSize:]
+	if hdr.Status == types.WALStatusClosed {
+		if uint64(len(data)) < hdr.DataLength {
+			return nil, hdr, fmt.Errorf("failed to read WAL data: %w", io.ErrUnexpectedEOF)
+		}
+		data = data[:hdr.DataLength]
+	} else {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		// Every entry ends with a newline.
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+
+	if len(data) == 0 {
+		return []types.WalLogEntry{}, hdr, nil
+	}
+	entries, err := format.Decode(data)
+	if err != nil {
+		return nil, hdr, err
+	}
+	return entries, hdr, nil
+}
@@ -1,13 +1,19 @@
 package wal_test
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/metrics"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/compress"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
 )
@@ -123,4 +129,106 @@ func TestWAL_Full(t *testing.T) {
 	// Flush should return ErrWALFull
 	err = w.Flush()
 	assert.Equal(t, types.ErrWALFull, err)
-}
\ No newline at end of file
+}
+func TestWAL_MetricsBytesWritten(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	m := metrics.NewMetrics()
+
+	w, err := wal.NewWAL(walPath, 0, formatter.NewStringLineFormatter(), nil, wal.WALOptional{Metrics: m})
+	require.NoError(t, err)
+	defer w.Close()
+
+	item := types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 1, ItemID: "gold", Success: true}
+	require.NoError(t, w.LogDraw(item))
+	require.NoError(t, w.Flush())
+
+	encoded, err := formatter.NewStringLineFormatter().Encode([]types.WalLogEntry{&item})
+	require.NoError(t, err)
+	size, err := w.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(encoded)), size)
+
+	expected := fmt.Sprintf(`
+# HELP rewardpool_wal_bytes_written_total Number of encoded bytes written to the WAL storage.
+# TYPE rewardpool_wal_bytes_written_total counter
+rewardpool_wal_bytes_written_total %d
+`, len(encoded))
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "rewardpool_wal_bytes_written_total"))
+}
+
+func TestReadWAL_OpenFile(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.001")
+	store, err := storage.NewFileMMapStorage(walPath, 1, storage.FileMMapStorageOps{MMapFileSizeInBytes: 64 * 1024})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 1, formatter.NewJSONFormatter(), store)
+	require.NoError(t, err)
+
+	for id := uint64(1); id <= 3; id++ {
+		require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: id, ItemID: "gold", Success: true}))
+	}
+	require.NoError(t, w.Flush())
+
+	// ParseWAL only reads finalized files.
+	entries, _, err := wal.ParseWAL(walPath, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	entries, hdr, err := wal.ReadWAL(walPath, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	assert.Equal(t, types.WALStatusOpen, hdr.Status)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[2].(*types.WalLogDrawItem).RequestID)
+
+	require.NoError(t, w.Close())
+	entries, hdr, err = wal.ReadWAL(walPath, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	assert.Equal(t, types.WALStatusClosed, hdr.Status)
+	assert.Len(t, entries, 3)
+}
+
+func TestParseWAL_FormatterFromHeader(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.002")
+	store, err := storage.NewFileMMapStorage(walPath, 2, storage.FileMMapStorageOps{
+		MMapFileSizeInBytes: 64 * 1024,
+		FormatterID:         types.WALFormatterStringLine,
+		Codec:               types.WALCodecSnappy,
+	})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(walPath, 2, compress.NewFormatter(formatter.NewStringLineFormatter(), types.WALCodecSnappy), store)
+	require.NoError(t, err)
+	for id := uint64(7); id <= 9; id++ {
+		require.NoError(t, w.LogDraw(types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: id, ItemID: "gold", Success: true}))
+		require.NoError(t, w.Flush())
+	}
+	require.NoError(t, w.Close())
+
+	// The formatter setting changed since the file was written.
+	entries, hdr, err := wal.ParseWAL(walPath, formatter.NewJSONFormatter())
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(9), entries[2].(*types.WalLogDrawItem).RequestID)
+	assert.Equal(t, types.WALVersion2, hdr.Version)
+	assert.Equal(t, uint64(7), hdr.FirstRequestID)
+	assert.NotZero(t, hdr.CreatedAt)
+
+	// A corrupted header is not trusted.
+	content, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	content[8] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, content, 0644))
+	_, _, err = wal.ParseWAL(walPath, formatter.NewJSONFormatter())
+	assert.ErrorIs(t, err, types.ErrWALHeaderChecksum)
+}
+
+func TestParseWAL_Version1(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.000")
+	data := []byte("1,1,gold,0,true\n")
+	hdr := types.WALHeader{Magic: types.WALMagic, Version: types.WALVersion1, Status: types.WALStatusClosed, DataLength: uint64(len(data))}
+	require.NoError(t, os.WriteFile(walPath, append(storage.EncodeHeader(&hdr), data...), 0644))
+
+	// A version 1 file is decoded with the formatter given.
+	entries, _, err := wal.ParseWAL(walPath, formatter.NewStringLineFormatter())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "gold", entries[0].(*types.WalLogDrawItem).ItemID)
+}
@@ -0,0 +1,157 @@
+package walstream
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileQueueCompactSize is the number of consumed bytes after which the
+// queue file is rewritten without them.
+const fileQueueCompactSize = 1 << 20
+
+// fileQueue is a durable FIFO of newline-terminated records in one file.
+// The offset of the first unacknowledged record is kept in a file next to
+// it, so records survive restarts until popped. A crash may deliver the
+// records popped since the last offset write again.
+type fileQueue struct {
+	path       string
+	offsetPath string
+
+	mu     sync.Mutex
+	file   *os.File
+	offset int64
+	size   int64
+	notify chan struct{}
+}
+
+func openFileQueue(path string) (*fileQueue, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	q := &fileQueue{
+		path:       path,
+		offsetPath: path + ".offset",
+		file:       file,
+		size:       info.Size(),
+		notify:     make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(q.offsetPath)
+	if err == nil {
+		q.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// The file may have been truncated after the offset was written, by a
+	// pop that crashed before writing the reset offset. The clamped offset
+	// is written before anything is pushed past the stale one.
+	if q.offset > q.size {
+		q.offset = q.size
+		if err := q.writeOffsetLocked(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// push appends a record, which must not contain a newline.
+func (q *fileQueue) push(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n, err := q.file.Write(append(record[:len(record):len(record)], '\n'))
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the first record and its size in the file, or nil when the
+// queue is empty.
+func (q *fileQueue) peek() ([]byte, int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.offset == q.size {
+		return nil, 0, nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(q.file, q.offset, q.size-q.offset)).ReadBytes('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	return line[:len(line)-1], int64(len(line)), nil
+}
+
+// pop removes the record returned by peek.
+func (q *fileQueue) pop(consumed int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.offset += consumed
+
+	switch {
+	case q.offset == q.size:
+		if err := q.file.Truncate(0); err != nil {
+			return q.writeOffsetLocked()
+		}
+		q.offset, q.size = 0, 0
+		// A stale offset would skip the records pushed after the truncate.
+		return q.writeOffsetLocked()
+	case q.offset >= fileQueueCompactSize:
+		rest := make([]byte, q.size-q.offset)
+		if _, err := q.file.ReadAt(rest, q.offset); err != nil {
+			return err
+		}
+		// Written first: a crash before the rename delivers the consumed
+		// records again instead of skipping unconsumed ones.
+		q.offset = 0
+		if err := q.writeOffsetLocked(); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(q.path, rest); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(q.path, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		q.file.Close()
+		q.file, q.size = file, int64(len(rest))
+		return nil
+	}
+	return q.writeOffsetLocked()
+}
+
+// wait returns a channel that receives after a push.
+func (q *fileQueue) wait() <-chan struct{} {
+	return q.notify
+}
+
+func (q *fileQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+func (q *fileQueue) writeOffsetLocked() error {
+	return writeFileAtomic(q.offsetPath, []byte(strconv.FormatInt(q.offset, 10)))
+}
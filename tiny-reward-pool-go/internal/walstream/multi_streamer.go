@@ -0,0 +1,42 @@
+package walstream
+
+import (
+	"sync/atomic"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// MultiStreamer streams every entry to several WALStreamers in order.
+type MultiStreamer struct {
+	streamers []WALStreamer
+	streamed  atomic.Uint64
+}
+
+var _ AckedStreamer = (*MultiStreamer)(nil)
+
+// NewMultiStreamer creates a MultiStreamer.
+func NewMultiStreamer(streamers ...WALStreamer) *MultiStreamer {
+	return &MultiStreamer{streamers: streamers}
+}
+
+// Stream implements WALStreamer.
+func (s *MultiStreamer) Stream(log types.WalLogEntry) {
+	for _, streamer := range s.streamers {
+		streamer.Stream(log)
+	}
+	if draw, ok := log.(*types.WalLogDrawItem); ok {
+		s.streamed.Store(draw.RequestID)
+	}
+}
+
+// LastAckedRequestID returns the lowest value of the AckedStreamers. The
+// others count as acknowledging every entry they were streamed.
+func (s *MultiStreamer) LastAckedRequestID() uint64 {
+	acked := s.streamed.Load()
+	for _, streamer := range s.streamers {
+		if a, ok := streamer.(AckedStreamer); ok {
+			acked = min(acked, a.LastAckedRequestID())
+		}
+	}
+	return acked
+}
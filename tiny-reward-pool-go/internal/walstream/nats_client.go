@@ -0,0 +1,142 @@
+package walstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultNATSTimeout = 5 * time.Second
+
+// NATSClient is a BrokerClient speaking the NATS client protocol over TCP.
+//
+// A batch is written as PUB commands followed by a PING. The server handles
+// the commands of a connection in order, so the PONG acknowledges every
+// message of the batch. It is not safe for concurrent use.
+type NATSClient struct {
+	address string
+	timeout time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+var _ BrokerClient = (*NATSClient)(nil)
+
+// NATSClientOptional provides optional settings for the NATSClient.
+type NATSClientOptional struct {
+	// Timeout bounds connecting and every Publish. Defaults to 5s.
+	Timeout time.Duration
+}
+
+// NewNATSClient creates a NATSClient. It connects on the first Publish and
+// reconnects after any error.
+func NewNATSClient(address string, opts ...NATSClientOptional) *NATSClient {
+	var opt NATSClientOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultNATSTimeout
+	}
+	return &NATSClient{address: address, timeout: opt.Timeout}
+}
+
+// Publish implements BrokerClient.
+func (c *NATSClient) Publish(ctx context.Context, subject string, messages [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if err := c.publish(ctx, subject, messages); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (c *NATSClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.reader = nil, nil
+	return err
+}
+
+func (c *NATSClient) publish(ctx context.Context, subject string, messages [][]byte) error {
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// Unblock reads and writes when ctx is cancelled before the deadline.
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	w := bufio.NewWriter(c.conn)
+	for _, msg := range messages {
+		fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(msg))
+		w.Write(msg)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case bytes.Equal(line, []byte("PONG")):
+			return nil
+		case bytes.Equal(line, []byte("PING")):
+			if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case bytes.HasPrefix(line, []byte("-ERR")):
+			return fmt.Errorf("nats: %s", bytes.TrimSpace(line[4:]))
+		}
+		// +OK and INFO updates need no answer.
+	}
+}
+
+// connect dials the server, reads its INFO and sends CONNECT.
+func (c *NATSClient) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(line, []byte("INFO")) {
+		return fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+	_, err = conn.Write([]byte(`CONNECT {"verbose":false,"pedantic":false,"name":"rewardpool-sink"}` + "\r\n"))
+	return err
+}
+
+func (c *NATSClient) readLine() ([]byte, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,68 @@
+package walstream
+
+import (
+	"cmp"
+	"encoding/json"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+// Replication protocol: newline-delimited JSON over a TCP connection.
+//
+// The replica sends a single ReplicationHello, then the primary sends
+// ReplicationFrames until either side closes the connection.
+// A frame carries either a snapshot (bootstrap) or one committed WAL entry.
+
+// Position is a point in the committed log: after the draw with RequestID,
+// then Skip more entries. It is read back from the WAL files, so it outlives
+// the primary process and is the same on every primary of the log.
+//
+// Snapshot entries are not streamed to replicas and not counted.
+type Position struct {
+	RequestID uint64 `json:"request_id"`
+	Skip      int    `json:"skip"`
+}
+
+// Advance moves p past entry.
+func (p *Position) Advance(entry types.WalLogEntry) {
+	if draw, ok := entry.(*types.WalLogDrawItem); ok {
+		p.RequestID, p.Skip = draw.RequestID, 0
+		return
+	}
+	p.Skip++
+}
+
+// Compare returns -1, 0 or +1 when p is before, at or after q.
+func (p Position) Compare(q Position) int {
+	if c := cmp.Compare(p.RequestID, q.RequestID); c != 0 {
+		return c
+	}
+	return cmp.Compare(p.Skip, q.Skip)
+}
+
+// ReplicationHello is sent by the replica when it connects.
+// Position is the position of the last frame it applied, nil for a fresh
+// replica.
+type ReplicationHello struct {
+	Position *Position `json:"position,omitempty"`
+}
+
+// ReplicationFrame is sent by the primary.
+//
+// Position is the position after the entry, or the position of the last
+// entry included in a snapshot.
+type ReplicationFrame struct {
+	Position Position            `json:"position"`
+	Snapshot *types.PoolSnapshot `json:"snapshot,omitempty"`
+	// Entry is the JSON encoded WAL entry (see formatter.JSONFormatter).
+	Entry json.RawMessage `json:"entry,omitempty"`
+}
+
+// streamed reports whether entry is shipped to the replicas.
+func streamed(entry types.WalLogEntry) bool {
+	switch entry.(type) {
+	case types.WalLogSnapshotItem, *types.WalLogSnapshotItem:
+		return false
+	}
+	return true
+}
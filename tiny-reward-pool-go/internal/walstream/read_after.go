@@ -0,0 +1,43 @@
+package walstream
+
+import (
+	"slices"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+)
+
+// ReadAfter returns the entries of the WAL files at paths after the last
+// draw with a request ID up to requestID. The files are read back from the
+// last one, down to the file holding that draw only. found reports whether
+// it is the draw with requestID. Without such a draw, the entries of every
+// file are returned.
+func ReadAfter(paths []string, formatter types.LogFormatter, requestID uint64) (entries []types.WalLogEntry, found bool, err error) {
+	isBefore := func(e types.WalLogEntry) bool {
+		draw, ok := e.(*types.WalLogDrawItem)
+		return ok && draw.RequestID <= requestID
+	}
+
+	var files [][]types.WalLogEntry
+	for i := len(paths) - 1; i >= 0; i-- {
+		fileEntries, _, err := wal.ReadWAL(paths[i], formatter)
+		if err != nil {
+			return nil, false, err
+		}
+		files = append(files, fileEntries)
+		if slices.ContainsFunc(fileEntries, isBefore) {
+			break
+		}
+	}
+	slices.Reverse(files)
+	entries = slices.Concat(files...)
+
+	start := 0
+	for i, entry := range entries {
+		if isBefore(entry) {
+			start = i + 1
+			found = entry.(*types.WalLogDrawItem).RequestID == requestID
+		}
+	}
+	return entries[start:], found, nil
+}
@@ -0,0 +1,485 @@
+package walstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+const (
+	defaultSinkBatchSize     = 100
+	defaultSinkFlushInterval = 100 * time.Millisecond
+	defaultSinkMaxRetries    = 3
+	defaultSinkRetryBackoff  = 100 * time.Millisecond
+	defaultSinkMaxBuffered   = 10_000
+	maxSinkRetryBackoff      = 5 * time.Second
+
+	sinkSpillFileName = "spill.jsonl"
+	sinkStateFileName = "sink.state"
+)
+
+// BrokerClient publishes messages to a message broker, e.g. a Kafka producer
+// or a NATS connection.
+type BrokerClient interface {
+	// Publish returns nil once the broker accepted every message, in order.
+	// The SinkStreamer calls it from a single goroutine.
+	Publish(ctx context.Context, subject string, messages [][]byte) error
+}
+
+// AckedStreamer is a WALStreamer that knows which entries its receiver
+// acknowledged.
+type AckedStreamer interface {
+	WALStreamer
+	// LastAckedRequestID returns the request ID of the last draw acknowledged
+	// by the receiver.
+	LastAckedRequestID() uint64
+}
+
+// SinkStreamer is a WALStreamer that publishes every committed entry to a
+// message broker for analytics. Each message is one entry in the JSON WAL
+// format (see formatter.JSONFormatter).
+//
+// Entries are published in batches by Run. A batch is retried with an
+// exponential backoff until the broker accepts it, so delivery is at least
+// once: a consumer may see an entry twice and should deduplicate draws by
+// request ID. When the broker stays unavailable for MaxRetries attempts, or
+// more than MaxBuffered entries are waiting, the waiting entries are moved
+// to a spill file and published from there once the broker is back. The
+// spill file and the last acknowledged request ID survive restarts.
+type SinkStreamer struct {
+	client        BrokerClient
+	subject       string
+	logger        *slog.Logger
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+	maxBuffered   int
+	statePath     string
+
+	mu          sync.Mutex
+	queue       []sinkEvent
+	spill       *os.File
+	spillOffset int64 // bytes of the spill file already published
+	spillSize   int64
+	spilling    bool // the spill file has entries, so new entries go there too
+	stopped     bool
+
+	acked atomic.Uint64
+	wake  chan struct{}
+}
+
+var _ AckedStreamer = (*SinkStreamer)(nil)
+
+// SinkStreamerOptional provides optional settings for the SinkStreamer.
+type SinkStreamerOptional struct {
+	// BatchSize is the maximum number of entries per Publish.
+	BatchSize int
+	// FlushInterval is how long an entry waits for a batch to fill.
+	FlushInterval time.Duration
+	// MaxRetries is the number of failed attempts after which the waiting
+	// entries are spilled to disk. The batch itself is retried forever.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// MaxBuffered is the number of entries kept in memory before spilling.
+	MaxBuffered int
+	Logger      *slog.Logger
+}
+
+// sinkEvent is a marshalled entry. requestID is set for draws only.
+type sinkEvent struct {
+	requestID uint64
+	data      []byte
+}
+
+// sinkState is persisted after every acknowledged batch.
+type sinkState struct {
+	AckedRequestID uint64 `json:"acked_request_id"`
+	SpillOffset    int64  `json:"spill_offset"`
+}
+
+// NewSinkStreamer creates a SinkStreamer publishing to subject. The spill
+// file and the delivery state are kept in dir, which is created if needed.
+// Entries spilled by a previous run are published first.
+func NewSinkStreamer(client BrokerClient, subject, dir string, opts ...SinkStreamerOptional) (*SinkStreamer, error) {
+	var opt SinkStreamerOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultSinkBatchSize
+	}
+	if opt.FlushInterval <= 0 {
+		opt.FlushInterval = defaultSinkFlushInterval
+	}
+	if opt.MaxRetries <= 0 {
+		opt.MaxRetries = defaultSinkMaxRetries
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = defaultSinkRetryBackoff
+	}
+	if opt.MaxBuffered <= 0 {
+		opt.MaxBuffered = defaultSinkMaxBuffered
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	spill, err := os.OpenFile(filepath.Join(dir, sinkSpillFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := spill.Stat()
+	if err != nil {
+		spill.Close()
+		return nil, err
+	}
+
+	s := &SinkStreamer{
+		client:        client,
+		subject:       subject,
+		logger:        opt.Logger,
+		batchSize:     opt.BatchSize,
+		flushInterval: opt.FlushInterval,
+		maxRetries:    opt.MaxRetries,
+		retryBackoff:  opt.RetryBackoff,
+		maxBuffered:   opt.MaxBuffered,
+		statePath:     filepath.Join(dir, sinkStateFileName),
+		spill:         spill,
+		spillSize:     info.Size(),
+		wake:          make(chan struct{}, 1),
+	}
+
+	var state sinkState
+	if data, err := os.ReadFile(s.statePath); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			spill.Close()
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		spill.Close()
+		return nil, err
+	}
+	s.acked.Store(state.AckedRequestID)
+	// The spill file may have been truncated after the state was written.
+	s.spillOffset = min(state.SpillOffset, s.spillSize)
+	s.spilling = s.spillOffset < s.spillSize
+	return s, nil
+}
+
+// Stream queues the entry for the next batch. It never waits on the broker.
+func (s *SinkStreamer) Stream(log types.WalLogEntry) {
+	data, err := json.Marshal(log)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to marshal log entry", "error", err)
+		}
+		return
+	}
+	ev := sinkEvent{data: data}
+	if draw, ok := log.(*types.WalLogDrawItem); ok {
+		ev.requestID = draw.RequestID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spilling || s.stopped {
+		s.appendSpillLocked([]sinkEvent{ev})
+	} else {
+		s.queue = append(s.queue, ev)
+		if len(s.queue) > s.maxBuffered {
+			s.spillQueueLocked()
+		}
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// LastAckedRequestID implements AckedStreamer.
+func (s *SinkStreamer) LastAckedRequestID() uint64 {
+	return s.acked.Load()
+}
+
+// Run publishes the streamed entries until ctx is cancelled. The entries
+// not yet acknowledged are then written to the spill file, and so are the
+// entries streamed after Run returned.
+func (s *SinkStreamer) Run(ctx context.Context) {
+	for {
+		if !s.waitForBatch(ctx) {
+			s.stop(nil)
+			return
+		}
+		batch, consumed, err := s.nextBatch()
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Error("failed to read the sink spill file", "error", err)
+			}
+			s.stop(nil)
+			return
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.publish(ctx, batch); err != nil {
+			// Entries read from the spill file are still in it.
+			if consumed == 0 {
+				s.stop(batch)
+			} else {
+				s.stop(nil)
+			}
+			return
+		}
+		s.ack(batch, consumed)
+	}
+}
+
+// Close closes the spill file. Call it after Run returned.
+func (s *SinkStreamer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spill.Close()
+}
+
+// waitForBatch waits until a full batch is queued, or a partial one has
+// waited FlushInterval. It returns false when ctx is cancelled.
+func (s *SinkStreamer) waitForBatch(ctx context.Context) bool {
+	var timeout <-chan time.Time
+	for {
+		s.mu.Lock()
+		queued, spilled := len(s.queue), s.spillOffset < s.spillSize
+		s.mu.Unlock()
+		if spilled || queued >= s.batchSize {
+			return true
+		}
+		if queued > 0 && timeout == nil {
+			timer := time.NewTimer(s.flushInterval)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timeout:
+			return true
+		case <-s.wake:
+		}
+	}
+}
+
+// nextBatch takes the oldest waiting entries. The queue is always older
+// than the spill file: entries go to the spill file only once the queue was
+// moved there. consumed is the number of spill file bytes the batch covers.
+func (s *SinkStreamer) nextBatch() ([]sinkEvent, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) > 0 {
+		n := min(len(s.queue), s.batchSize)
+		batch := append([]sinkEvent(nil), s.queue[:n]...)
+		s.queue = s.queue[n:]
+		return batch, 0, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(s.spill, s.spillOffset, s.spillSize-s.spillOffset))
+	var batch []sinkEvent
+	var consumed int64
+	for len(batch) < s.batchSize {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		consumed += int64(len(line))
+		ev, err := decodeSinkEvent(line[:len(line)-1])
+		if err != nil {
+			return nil, 0, err
+		}
+		batch = append(batch, ev)
+	}
+	return batch, consumed, nil
+}
+
+// publish retries the batch until the broker accepts it or ctx is cancelled.
+func (s *SinkStreamer) publish(ctx context.Context, batch []sinkEvent) error {
+	messages := make([][]byte, len(batch))
+	for i, ev := range batch {
+		messages[i] = ev.data
+	}
+
+	backoff := s.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.client.Publish(ctx, s.subject, messages)
+		if err == nil {
+			return nil
+		}
+		if s.logger != nil {
+			s.logger.Warn("failed to publish to the broker", "attempt", attempt, "error", err)
+		}
+		if attempt == s.maxRetries {
+			s.mu.Lock()
+			s.spillQueueLocked()
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxSinkRetryBackoff)
+	}
+}
+
+// ack records a published batch.
+func (s *SinkStreamer) ack(batch []sinkEvent, consumed int64) {
+	for _, ev := range batch {
+		if ev.requestID > 0 {
+			s.acked.Store(ev.requestID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if consumed > 0 {
+		s.spillOffset += consumed
+		if s.spillOffset == s.spillSize {
+			if err := s.spill.Truncate(0); err == nil {
+				s.spillOffset, s.spillSize = 0, 0
+				s.spilling = false
+			} else if s.logger != nil {
+				s.logger.Error("failed to truncate the sink spill file", "error", err)
+			}
+		}
+	}
+	s.writeStateLocked()
+}
+
+// stop writes inflight and the queue to the spill file, ahead of the
+// entries already in it.
+func (s *SinkStreamer) stop(inflight []sinkEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+
+	pending := append(inflight, s.queue...)
+	s.queue = nil
+	if len(pending) == 0 {
+		return
+	}
+	if s.spillOffset == s.spillSize {
+		s.appendSpillLocked(pending)
+		return
+	}
+
+	// Rewrite the spill file with the older entries first.
+	rest := make([]byte, s.spillSize-s.spillOffset)
+	if _, err := s.spill.ReadAt(rest, s.spillOffset); err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to read the sink spill file, entries lost", "count", len(pending), "error", err)
+		}
+		return
+	}
+	var buf []byte
+	for _, ev := range pending {
+		buf = append(append(buf, ev.data...), '\n')
+	}
+	buf = append(buf, rest...)
+
+	path := s.spill.Name()
+	if err := writeFileAtomic(path, buf); err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to rewrite the sink spill file, entries lost", "count", len(pending), "error", err)
+		}
+		return
+	}
+	spill, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to reopen the sink spill file", "error", err)
+		}
+		return
+	}
+	s.spill.Close()
+	s.spill = spill
+	s.spillOffset, s.spillSize = 0, int64(len(buf))
+	s.spilling = true
+	s.writeStateLocked()
+}
+
+// spillQueueLocked moves the queue to the spill file.
+func (s *SinkStreamer) spillQueueLocked() {
+	if len(s.queue) == 0 {
+		return
+	}
+	if s.logger != nil && !s.spilling {
+		s.logger.Warn("spilling sink entries to disk", "count", len(s.queue))
+	}
+	s.appendSpillLocked(s.queue)
+	s.queue = nil
+}
+
+func (s *SinkStreamer) appendSpillLocked(events []sinkEvent) {
+	var buf []byte
+	for _, ev := range events {
+		buf = append(append(buf, ev.data...), '\n')
+	}
+	n, err := s.spill.Write(buf)
+	s.spillSize += int64(n)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to write the sink spill file, entries lost", "count", len(events), "error", err)
+		}
+		return
+	}
+	s.spilling = true
+}
+
+func (s *SinkStreamer) writeStateLocked() {
+	data, err := json.Marshal(sinkState{AckedRequestID: s.acked.Load(), SpillOffset: s.spillOffset})
+	if err == nil {
+		err = writeFileAtomic(s.statePath, data)
+	}
+	if err != nil && s.logger != nil {
+		s.logger.Error("failed to write the sink state", "error", err)
+	}
+}
+
+func decodeSinkEvent(data []byte) (sinkEvent, error) {
+	var entry struct {
+		Type      types.LogType `json:"type"`
+		RequestID uint64        `json:"request_id"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return sinkEvent{}, err
+	}
+	ev := sinkEvent{data: data}
+	if entry.Type == types.LogTypeDraw {
+		ev.requestID = entry.RequestID
+	}
+	return ev, nil
+}
+
+// writeFileAtomic replaces path with data through a rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
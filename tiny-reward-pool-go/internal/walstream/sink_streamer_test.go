@@ -0,0 +1,254 @@
+package walstream_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// fakeBroker is an in-process NATS server that records the published
+// payloads. It can be stopped and restarted on the same address.
+type fakeBroker struct {
+	addr string
+
+	mu       sync.Mutex
+	lis      net.Listener
+	conns    []net.Conn
+	messages [][]byte
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{addr: lis.Addr().String(), lis: lis}
+	go b.serve(lis)
+	t.Cleanup(b.stop)
+	return b
+}
+
+func (b *fakeBroker) start(t *testing.T) {
+	t.Helper()
+	lis, err := net.Listen("tcp", b.addr)
+	require.NoError(t, err)
+	b.mu.Lock()
+	b.lis = lis
+	b.mu.Unlock()
+	go b.serve(lis)
+}
+
+func (b *fakeBroker) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lis != nil {
+		b.lis.Close()
+		b.lis = nil
+	}
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *fakeBroker) serve(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, conn)
+		b.mu.Unlock()
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("INFO {}\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		args := bytes.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch string(args[0]) {
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "PUB":
+			n, err := strconv.Atoi(string(args[len(args)-1]))
+			if err != nil {
+				return
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, payload[:n])
+			b.mu.Unlock()
+		}
+	}
+}
+
+// requestIDs returns the request IDs of the received draws.
+func (b *fakeBroker) requestIDs(t *testing.T) []uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]uint64, 0, len(b.messages))
+	for _, msg := range b.messages {
+		var draw types.WalLogDrawItem
+		require.NoError(t, json.Unmarshal(msg, &draw))
+		ids = append(ids, draw.RequestID)
+	}
+	return ids
+}
+
+func drawEntry(id uint64) *types.WalLogDrawItem {
+	return &types.WalLogDrawItem{
+		WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw},
+		RequestID:       id,
+		ItemID:          "gold",
+		Success:         true,
+	}
+}
+
+func sequence(from, to uint64) []uint64 {
+	var ids []uint64
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+var sinkOpt = walstream.SinkStreamerOptional{
+	BatchSize:     16,
+	FlushInterval: 5 * time.Millisecond,
+	MaxRetries:    2,
+	RetryBackoff:  5 * time.Millisecond,
+	MaxBuffered:   32,
+}
+
+func runSink(t *testing.T, sink *walstream.SinkStreamer) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sink.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSinkStreamer_Publish(t *testing.T) {
+	broker := newFakeBroker(t)
+	client := walstream.NewNATSClient(broker.addr)
+	defer client.Close()
+	sink, err := walstream.NewSinkStreamer(client, "rewardpool.events", t.TempDir(), sinkOpt)
+	require.NoError(t, err)
+	defer sink.Close()
+	stop := runSink(t, sink)
+	defer stop()
+
+	for id := uint64(1); id <= 100; id++ {
+		sink.Stream(drawEntry(id))
+	}
+
+	require.Eventually(t, func() bool { return sink.LastAckedRequestID() == 100 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, sequence(1, 100), broker.requestIDs(t))
+}
+
+func TestSinkStreamer_SpillWhileBrokerDown(t *testing.T) {
+	broker := newFakeBroker(t)
+	dir := t.TempDir()
+	client := walstream.NewNATSClient(broker.addr, walstream.NATSClientOptional{Timeout: 100 * time.Millisecond})
+	defer client.Close()
+	sink, err := walstream.NewSinkStreamer(client, "rewardpool.events", dir, sinkOpt)
+	require.NoError(t, err)
+	defer sink.Close()
+	stop := runSink(t, sink)
+	defer stop()
+
+	sink.Stream(drawEntry(1))
+	require.Eventually(t, func() bool { return sink.LastAckedRequestID() == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	broker.stop()
+	for id := uint64(2); id <= 200; id++ {
+		sink.Stream(drawEntry(id))
+	}
+	// More than MaxBuffered entries are waiting, they are on disk.
+	info, err := os.Stat(filepath.Join(dir, "spill.jsonl"))
+	require.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(0))
+
+	broker.start(t)
+	require.Eventually(t, func() bool { return sink.LastAckedRequestID() == 200 }, 10*time.Second, 5*time.Millisecond)
+	assert.Equal(t, sequence(1, 200), broker.requestIDs(t))
+
+	// The spill file is emptied once delivered.
+	info, err = os.Stat(filepath.Join(dir, "spill.jsonl"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestSinkStreamer_ResumeAfterRestart(t *testing.T) {
+	broker := newFakeBroker(t)
+	dir := t.TempDir()
+	broker.stop()
+
+	// The broker is down for the whole first run.
+	client := walstream.NewNATSClient(broker.addr, walstream.NATSClientOptional{Timeout: 100 * time.Millisecond})
+	sink, err := walstream.NewSinkStreamer(client, "rewardpool.events", dir, sinkOpt)
+	require.NoError(t, err)
+	stop := runSink(t, sink)
+	for id := uint64(1); id <= 50; id++ {
+		sink.Stream(drawEntry(id))
+	}
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	// Streamed after Run returned, e.g. by the final flush.
+	sink.Stream(drawEntry(51))
+	require.NoError(t, sink.Close())
+	assert.Equal(t, uint64(0), sink.LastAckedRequestID())
+
+	broker.start(t)
+	client = walstream.NewNATSClient(broker.addr)
+	defer client.Close()
+	sink, err = walstream.NewSinkStreamer(client, "rewardpool.events", dir, sinkOpt)
+	require.NoError(t, err)
+	defer sink.Close()
+	stop = runSink(t, sink)
+	defer stop()
+
+	require.Eventually(t, func() bool { return sink.LastAckedRequestID() == 51 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, sequence(1, 51), broker.requestIDs(t))
+
+	// The acknowledged request ID is kept across restarts.
+	stop()
+	require.NoError(t, sink.Close())
+	sink, err = walstream.NewSinkStreamer(client, "rewardpool.events", dir, sinkOpt)
+	require.NoError(t, err)
+	defer sink.Close()
+	assert.Equal(t, uint64(51), sink.LastAckedRequestID())
+}
@@ -0,0 +1,394 @@
+package walstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+)
+
+const (
+	defaultTailerPollInterval = 100 * time.Millisecond
+	// tailerReadSize bounds the data read from a WAL file per poll.
+	tailerReadSize = 1 << 20
+)
+
+// TailerCheckpoint is the position of a Tailer: Offset bytes into the data
+// of the WAL file with sequence number SeqNo.
+type TailerCheckpoint struct {
+	SeqNo  uint64 `json:"seq_no"`
+	Offset uint64 `json:"offset"`
+}
+
+// Tailer follows the WAL files written by another process and streams the
+// decoded entries, for change data capture.
+//
+// The file being written has a zero DataLength in its header, so the tailer
+// reads its preallocated data up to the first zero byte, complete entries
+// only. A finalized file is read up to DataLength, then the tailer moves to
+// the next sequence number. The position is saved to the checkpoint file
+// after every batch. Delivery is at least once: a batch streamed just
+// before the process stops is streamed again after a restart.
+//
+// The writer drops a batch whose flush failed (see wal.WAL), which the
+// tailer may have read already. Before reading on, it checks that the file
+// still holds the last entry it read at the same offset, or an entry end
+// after a restart. When it does not, the file is streamed again from its
+// start. The dropped entries were already streamed: the writer reverted
+// them, and later entries may reuse their request IDs.
+//
+// When the directory has a wal.Manifest, the files are listed from it. A
+// file removed before the tailer read it to its end is a
+// types.ErrTailerBehind error: its entries can only be streamed again from
+// a snapshot, so the caller has to start over. A file the manifest lists
+// but that is not compacted and missing is a types.ErrManifestMissingSegment
+// error.
+type Tailer struct {
+	dir            string
+	formatter      types.LogFormatter
+	checkpointPath string
+	pollInterval   time.Duration
+	logger         *slog.Logger
+
+	mu      sync.Mutex
+	pos     TailerCheckpoint
+	started bool
+	// last is the last entry read from the current file, empty after a
+	// restart.
+	last []byte
+}
+
+// TailerOptional provides optional settings for the Tailer.
+type TailerOptional struct {
+	// Formatter decodes the WAL files. Defaults to JSON.
+	Formatter types.LogFormatter
+	// CheckpointPath keeps the position across restarts. Empty starts from
+	// the oldest WAL file every time.
+	CheckpointPath string
+	// PollInterval is how often the directory is checked when there is
+	// nothing new. Defaults to 100ms.
+	PollInterval time.Duration
+	Logger       *slog.Logger
+}
+
+// NewTailer creates a Tailer for the WAL files in dir, resuming from the
+// checkpoint file when there is one.
+func NewTailer(dir string, opts ...TailerOptional) (*Tailer, error) {
+	var opt TailerOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
+	if opt.PollInterval <= 0 {
+		opt.PollInterval = defaultTailerPollInterval
+	}
+
+	t := &Tailer{
+		dir:            dir,
+		formatter:      opt.Formatter,
+		checkpointPath: opt.CheckpointPath,
+		pollInterval:   opt.PollInterval,
+		logger:         opt.Logger,
+	}
+	if t.checkpointPath == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(t.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.pos); err != nil {
+		return nil, fmt.Errorf("invalid tailer checkpoint: %w", err)
+	}
+	t.started = true
+	return t, nil
+}
+
+// Checkpoint returns the current position.
+func (t *Tailer) Checkpoint() TailerCheckpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pos
+}
+
+// Run streams the entries to streamer until ctx is cancelled. It returns
+// an error when a WAL file cannot be read or decoded, or was removed before
+// it was read (see types.ErrTailerBehind).
+func (t *Tailer) Run(ctx context.Context, streamer WALStreamer) error {
+	for {
+		progressed, err := t.poll(streamer)
+		if err != nil {
+			return err
+		}
+		if progressed && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// walFile is a WAL file of the directory.
+type walFile struct {
+	seqNo uint64
+	path  string
+	// segment is its record in the wal.Manifest, nil without a manifest.
+	segment *wal.ManifestSegment
+}
+
+func (f walFile) compacted() bool {
+	return f.segment != nil && f.segment.Status == wal.SegmentCompacted
+}
+
+// poll streams the entries written since the last call, or moves to the
+// next file. It reports whether the position changed.
+func (t *Tailer) poll(streamer WALStreamer) (bool, error) {
+	files, err := listWALFiles(t.dir)
+	if err != nil || len(files) == 0 {
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		// The compacted files are not followed.
+		first := slices.IndexFunc(files, func(f walFile) bool { return !f.compacted() })
+		if first < 0 {
+			return false, nil
+		}
+		t.pos = TailerCheckpoint{SeqNo: files[first].seqNo}
+		t.started = true
+	}
+
+	cur := sort.Search(len(files), func(i int) bool { return files[i].seqNo >= t.pos.SeqNo })
+	if cur == len(files) {
+		return false, nil
+	}
+	if files[cur].seqNo != t.pos.SeqNo {
+		return false, fmt.Errorf("%w: WAL file %d is missing", types.ErrTailerBehind, t.pos.SeqNo)
+	}
+
+	var entries []types.WalLogEntry
+	var consumed uint64
+	if files[cur].compacted() {
+		err = t.checkCompacted(files[cur])
+	} else {
+		entries, consumed, err = t.read(files[cur].path, t.pos.Offset)
+		if errors.Is(err, os.ErrNotExist) {
+			err = t.checkRemoved(files[cur])
+		}
+	}
+	if errors.Is(err, errRewound) {
+		if t.logger != nil {
+			t.logger.Warn("WAL file was rewound after it was read, streaming it again", "path", files[cur].path, "offset", t.pos.Offset)
+		}
+		t.pos.Offset = 0
+		t.last = nil
+		return true, t.saveLocked()
+	}
+	if errors.Is(err, types.ErrWALHeaderChecksum) {
+		// Read while the writer rewrites the header to finalize the file.
+		if t.logger != nil {
+			t.logger.Warn("WAL header checksum mismatch, retrying", "path", files[cur].path)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", files[cur].path, err)
+	}
+	if consumed > 0 {
+		for _, entry := range entries {
+			streamer.Stream(entry)
+		}
+		t.pos.Offset += consumed
+		return true, t.saveLocked()
+	}
+
+	// Nothing new. The writer finalizes a file before creating the next
+	// one, so a newer file means this one is complete.
+	if cur+1 < len(files) {
+		t.pos = TailerCheckpoint{SeqNo: files[cur+1].seqNo}
+		t.last = nil
+		return true, t.saveLocked()
+	}
+	return false, nil
+}
+
+// errRewound is returned by read when the data before the offset is not the
+// last entry read.
+var errRewound = errors.New("WAL file rewound")
+
+// read decodes the complete entries after offset in the data of the WAL
+// file and returns them with the number of bytes they take. It checks that
+// the data before offset ends with the last entry read, and records the new
+// last one.
+func (t *Tailer) read(path string, offset uint64) ([]types.WalLogEntry, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	hdrBytes := make([]byte, types.WALHeaderSize)
+	if _, err := io.ReadFull(f, hdrBytes); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The header is not written yet.
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	hdr, err := storage.DecodeHeader(hdrBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hdr.Magic != types.WALMagic {
+		return nil, 0, nil
+	}
+	format, err := wal.FormatterFor(hdr, t.formatter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Read from the start of the last entry, or its newline after a restart.
+	last := t.last
+	if len(last) == 0 && offset > 0 {
+		last = []byte{'\n'}
+	}
+	if uint64(len(last)) > offset {
+		return nil, 0, errRewound
+	}
+	start := offset - uint64(len(last))
+
+	size := uint64(tailerReadSize) + uint64(len(last))
+	if hdr.Status == types.WALStatusClosed {
+		if offset > hdr.DataLength {
+			return nil, 0, errRewound
+		}
+		size = min(size, hdr.DataLength-start)
+	}
+	data := make([]byte, size)
+	n, err := f.ReadAt(data, int64(types.WALHeaderSize+start))
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	data = data[:n]
+	if hdr.Status != types.WALStatusClosed {
+		// The rest of the preallocated file is zeroed.
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+	}
+	if !bytes.HasPrefix(data, last) {
+		return nil, 0, errRewound
+	}
+	data = data[len(last):]
+	// Every entry ends with a newline, the last one may be partially written.
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+
+	entries, err := format.Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	t.last = append(t.last[:0], data[bytes.LastIndexByte(data[:len(data)-1], '\n')+1:]...)
+	return entries, uint64(len(data)), nil
+}
+
+// checkCompacted returns nil when the compacted file was read to its end,
+// types.ErrTailerBehind otherwise.
+func (t *Tailer) checkCompacted(file walFile) error {
+	c := file.segment.Compaction
+	if c == nil || t.pos.Offset < uint64(max(c.Size-types.WALHeaderSize, 0)) {
+		return fmt.Errorf("%w: WAL file %d was compacted at offset %d", types.ErrTailerBehind, file.seqNo, t.pos.Offset)
+	}
+	return nil
+}
+
+// checkRemoved is called when the listed file is not found. It was
+// compacted since it was listed, or lost.
+func (t *Tailer) checkRemoved(file walFile) error {
+	if file.segment == nil {
+		return fmt.Errorf("%w: WAL file %d is missing", types.ErrTailerBehind, file.seqNo)
+	}
+	files, err := listWALFiles(t.dir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(files, func(f walFile) bool { return f.seqNo == file.seqNo })
+	if i < 0 || !files[i].compacted() {
+		return fmt.Errorf("%w: %s", types.ErrManifestMissingSegment, file.path)
+	}
+	return t.checkCompacted(files[i])
+}
+
+func (t *Tailer) saveLocked() error {
+	if t.checkpointPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(t.pos)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.checkpointPath, data)
+}
+
+// listWALFiles returns the WAL files of dir sorted by sequence number, from
+// its wal.Manifest when it has one.
+func listWALFiles(dir string) ([]walFile, error) {
+	segments, found, err := wal.ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		files := make([]walFile, len(segments))
+		for i := range segments {
+			files[i] = walFile{seqNo: segments[i].SeqNo, path: filepath.Join(dir, segments[i].Name), segment: &segments[i]}
+		}
+		return files, nil
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []walFile
+	for _, e := range dirEntries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, types.WALBaseName+".") {
+			continue
+		}
+		seqNo, err := strconv.ParseUint(strings.TrimPrefix(name, types.WALBaseName+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, walFile{seqNo: seqNo, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seqNo < files[j].seqNo })
+	return files, nil
+}
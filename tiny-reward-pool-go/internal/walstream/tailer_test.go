@@ -0,0 +1,267 @@
+package walstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/storage"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// recordStreamer keeps the request IDs of the streamed draws.
+type recordStreamer struct {
+	mu  sync.Mutex
+	ids []uint64
+}
+
+func (s *recordStreamer) Stream(log types.WalLogEntry) {
+	if draw, ok := log.(*types.WalLogDrawItem); ok {
+		s.mu.Lock()
+		s.ids = append(s.ids, draw.RequestID)
+		s.mu.Unlock()
+	}
+}
+
+func (s *recordStreamer) requestIDs() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.ids...)
+}
+
+func openTestWAL(t *testing.T, dir string, seqNo uint64, opts ...wal.WALOptional) *wal.WAL {
+	path := filepath.Join(dir, fmt.Sprintf("%s.%03d", types.WALBaseName, seqNo))
+	store, err := storage.NewFileMMapStorage(path, seqNo, storage.FileMMapStorageOps{MMapFileSizeInBytes: 64 * 1024})
+	require.NoError(t, err)
+	w, err := wal.NewWAL(path, seqNo, formatter.NewStringLineFormatter(), store, opts...)
+	require.NoError(t, err)
+	return w
+}
+
+func logDraws(t *testing.T, w *wal.WAL, from, to uint64) {
+	for id := from; id <= to; id++ {
+		require.NoError(t, w.LogDraw(*drawEntry(id)))
+	}
+	require.NoError(t, w.Flush())
+}
+
+func runTailer(t *testing.T, tailer *walstream.Tailer, streamer walstream.WALStreamer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tailer.Run(ctx, streamer) }()
+	return func() {
+		cancel()
+		require.NoError(t, <-done)
+	}
+}
+
+func TestTailer_FollowAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := filepath.Join(t.TempDir(), "tailer.checkpoint")
+	opt := walstream.TailerOptional{
+		Formatter:      formatter.NewStringLineFormatter(),
+		CheckpointPath: checkpoint,
+		PollInterval:   time.Millisecond,
+	}
+
+	w := openTestWAL(t, dir, 0)
+	logDraws(t, w, 1, 3)
+
+	tailer, err := walstream.NewTailer(dir, opt)
+	require.NoError(t, err)
+	streamer := &recordStreamer{}
+	stop := runTailer(t, tailer, streamer)
+
+	// Entries appended to the open file are followed.
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 3 }, 5*time.Second, time.Millisecond)
+	logDraws(t, w, 4, 5)
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 5 }, 5*time.Second, time.Millisecond)
+
+	// Rotation: the finalized file is read to its end, then the next one.
+	logDraws(t, w, 6, 6)
+	require.NoError(t, w.Close())
+	w = openTestWAL(t, dir, 1)
+	defer w.Close()
+	logDraws(t, w, 7, 8)
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 8 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, sequence(1, 8), streamer.requestIDs())
+	assert.Equal(t, uint64(1), tailer.Checkpoint().SeqNo)
+	stop()
+
+	// A restarted tailer continues from the checkpoint.
+	logDraws(t, w, 9, 10)
+	tailer, err = walstream.NewTailer(dir, opt)
+	require.NoError(t, err)
+	streamer = &recordStreamer{}
+	stop = runTailer(t, tailer, streamer)
+	defer stop()
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 2 }, 5*time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, sequence(9, 10), streamer.requestIDs())
+}
+
+// heldFlushStorage fails a flush once armed, after the batch was written
+// to the mapped file, and holds it until release is closed.
+type heldFlushStorage struct {
+	*storage.FileMMapStorage
+	armed   bool
+	release chan struct{}
+}
+
+func (s *heldFlushStorage) Flush() error {
+	if s.armed {
+		s.armed = false
+		<-s.release
+		return types.ErrInjectedFault
+	}
+	return s.FileMMapStorage.Flush()
+}
+
+func TestTailer_RewoundFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, fmt.Sprintf("%s.%03d", types.WALBaseName, 0))
+	mmapStorage, err := storage.NewFileMMapStorage(path, 0, storage.FileMMapStorageOps{MMapFileSizeInBytes: 64 * 1024})
+	require.NoError(t, err)
+	store := &heldFlushStorage{FileMMapStorage: mmapStorage, release: make(chan struct{})}
+	w, err := wal.NewWAL(path, 0, formatter.NewStringLineFormatter(), store)
+	require.NoError(t, err)
+	logDraws(t, w, 1, 3)
+
+	tailer, err := walstream.NewTailer(dir, walstream.TailerOptional{
+		Formatter:    formatter.NewStringLineFormatter(),
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	streamer := &recordStreamer{}
+	stop := runTailer(t, tailer, streamer)
+	defer stop()
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 3 }, 5*time.Second, time.Millisecond)
+
+	// The tailer reads a batch whose flush fails, the WAL drops it.
+	store.armed = true
+	for id := uint64(4); id <= 6; id++ {
+		require.NoError(t, w.LogDraw(*drawEntry(id)))
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- w.Flush() }()
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 6 }, 5*time.Second, time.Millisecond)
+	close(store.release)
+	require.Error(t, <-flushed)
+
+	// The request IDs are used again, the file is streamed again.
+	logDraws(t, w, 4, 5)
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 11 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5}, streamer.requestIDs())
+}
+
+// runTailerOnce runs the tailer until it returns, or gives up after a second.
+func runTailerOnce(t *testing.T, tailer *walstream.Tailer, streamer walstream.WALStreamer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return tailer.Run(ctx, streamer)
+}
+
+func writeCheckpoint(t *testing.T, path string, pos walstream.TailerCheckpoint) {
+	data, err := json.Marshal(pos)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func TestTailer_MissingFile(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := filepath.Join(t.TempDir(), "tailer.checkpoint")
+	for seqNo := uint64(0); seqNo < 3; seqNo++ {
+		w := openTestWAL(t, dir, seqNo)
+		logDraws(t, w, seqNo*10+1, seqNo*10+3)
+		require.NoError(t, w.Close())
+	}
+	require.NoError(t, os.Remove(filepath.Join(dir, "wal.001")))
+
+	// The entries of the removed file are not skipped.
+	writeCheckpoint(t, checkpoint, walstream.TailerCheckpoint{SeqNo: 1})
+	tailer, err := walstream.NewTailer(dir, walstream.TailerOptional{
+		Formatter:      formatter.NewStringLineFormatter(),
+		CheckpointPath: checkpoint,
+		PollInterval:   time.Millisecond,
+	})
+	require.NoError(t, err)
+	streamer := &recordStreamer{}
+	require.ErrorIs(t, runTailerOnce(t, tailer, streamer), types.ErrTailerBehind)
+	assert.Empty(t, streamer.requestIDs())
+	assert.Equal(t, uint64(1), tailer.Checkpoint().SeqNo)
+}
+
+func TestTailer_Manifest(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := filepath.Join(t.TempDir(), "tailer.checkpoint")
+	opt := walstream.TailerOptional{
+		Formatter:      formatter.NewStringLineFormatter(),
+		CheckpointPath: checkpoint,
+		PollInterval:   time.Millisecond,
+	}
+	manifest, err := wal.OpenManifest(dir)
+	require.NoError(t, err)
+	for seqNo := uint64(0); seqNo < 3; seqNo++ {
+		w := openTestWAL(t, dir, seqNo, wal.WALOptional{Manifest: manifest})
+		logDraws(t, w, seqNo*10+1, seqNo*10+3)
+		require.NoError(t, w.Close())
+	}
+
+	// The compactor removes wal.000.
+	path := filepath.Join(dir, "wal.000")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	hdrBytes := make([]byte, types.WALHeaderSize)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	_, err = f.Read(hdrBytes)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	hdr, err := storage.DecodeHeader(hdrBytes)
+	require.NoError(t, err)
+	require.Less(t, int64(hdr.DataLength), info.Size())
+	require.NoError(t, manifest.MarkCompacted(0, wal.SegmentCompaction{Entries: 3, Size: types.WALHeaderSize + int64(hdr.DataLength), Action: "delete"}))
+	require.NoError(t, os.Remove(path))
+
+	// A new tailer starts after the compacted files.
+	tailer, err := walstream.NewTailer(dir, opt)
+	require.NoError(t, err)
+	streamer := &recordStreamer{}
+	stop := runTailer(t, tailer, streamer)
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 6 }, 5*time.Second, time.Millisecond)
+	stop()
+	assert.Equal(t, append(sequence(11, 13), sequence(21, 23)...), streamer.requestIDs())
+
+	// A tailer that read the compacted file to its end moves on.
+	writeCheckpoint(t, checkpoint, walstream.TailerCheckpoint{SeqNo: 0, Offset: hdr.DataLength})
+	tailer, err = walstream.NewTailer(dir, opt)
+	require.NoError(t, err)
+	streamer = &recordStreamer{}
+	stop = runTailer(t, tailer, streamer)
+	require.Eventually(t, func() bool { return len(streamer.requestIDs()) == 6 }, 5*time.Second, time.Millisecond)
+	stop()
+
+	// One that did not is behind.
+	writeCheckpoint(t, checkpoint, walstream.TailerCheckpoint{SeqNo: 0, Offset: hdr.DataLength - 1})
+	tailer, err = walstream.NewTailer(dir, opt)
+	require.NoError(t, err)
+	streamer = &recordStreamer{}
+	require.ErrorIs(t, runTailerOnce(t, tailer, streamer), types.ErrTailerBehind)
+	assert.Empty(t, streamer.requestIDs())
+
+	// A file removed without the compactor is lost.
+	require.NoError(t, os.Remove(filepath.Join(dir, "wal.001")))
+	tailer, err = walstream.NewTailer(dir, walstream.TailerOptional{Formatter: formatter.NewStringLineFormatter()})
+	require.NoError(t, err)
+	require.ErrorIs(t, runTailerOnce(t, tailer, &recordStreamer{}), types.ErrManifestMissingSegment)
+}
@@ -0,0 +1,335 @@
+package walstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/replay"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/rewardpool"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/wal/formatter"
+)
+
+const defaultBacklogSize = 100_000
+
+// TCPStreamer is a WALStreamer that ships committed entries to replicas over TCP.
+//
+// It keeps a shadow pool updated with every streamed entry, so a replica can
+// be bootstrapped with a snapshot that matches an exact Position, and a
+// bounded backlog of recent entries so a reconnecting replica only receives
+// what it missed. Entries older than the backlog, e.g. after a primary
+// restart, are read back from the WAL files when Utils is set. A replica
+// that fell behind both is bootstrapped again.
+type TCPStreamer struct {
+	logger      *slog.Logger
+	backlogSize int
+	utils       types.Utils
+	formatter   types.LogFormatter
+
+	// start is the position of the pool passed to NewTCPStreamer. Its Skip is
+	// only known when the WAL files hold the last draw.
+	start      Position
+	startKnown bool
+
+	mu       sync.Mutex
+	shadow   *rewardpool.Pool
+	position Position           // position of the last streamed entry
+	base     Position           // position before the first backlog entry
+	backlog  []ReplicationFrame // entries after base, up to position
+	notify   chan struct{}      // closed and replaced on every Stream
+}
+
+var _ WALStreamer = (*TCPStreamer)(nil)
+
+// TCPStreamerOptional provides optional settings for the TCPStreamer.
+type TCPStreamerOptional struct {
+	// BacklogSize is the number of entries kept for reconnecting replicas.
+	BacklogSize int
+	// Utils lists the WAL files read for the start position and for replicas
+	// behind the backlog.
+	Utils types.Utils
+	// Formatter decodes the WAL files. Defaults to JSON.
+	Formatter types.LogFormatter
+	Logger    *slog.Logger
+}
+
+// NewTCPStreamer creates a TCPStreamer. catalog and lastRequestID must be the
+// state of the pool before the first streamed entry, i.e. right after recovery.
+func NewTCPStreamer(catalog []types.PoolReward, lastRequestID uint64, opts ...TCPStreamerOptional) *TCPStreamer {
+	var opt TCPStreamerOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.BacklogSize <= 0 {
+		opt.BacklogSize = defaultBacklogSize
+	}
+	if opt.Formatter == nil {
+		opt.Formatter = formatter.NewJSONFormatter()
+	}
+
+	s := &TCPStreamer{
+		logger:      opt.Logger,
+		backlogSize: opt.BacklogSize,
+		utils:       opt.Utils,
+		formatter:   opt.Formatter,
+		shadow:      rewardpool.NewPool(catalog),
+		position:    Position{RequestID: lastRequestID},
+		notify:      make(chan struct{}),
+	}
+	// Count the entries committed after the last draw. Without them, the
+	// positions before the next draw are not resumed from.
+	if entries, err := s.readAfter(lastRequestID); err == nil {
+		s.position.Skip = len(entries)
+		s.startKnown = true
+	}
+	s.start = s.position
+	s.base = s.position
+	return s
+}
+
+// Position returns the position of the last streamed entry.
+func (s *TCPStreamer) Position() Position {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position
+}
+
+// Stream applies the entry to the shadow pool and queues it for the replicas.
+// It never waits on the network.
+func (s *TCPStreamer) Stream(log types.WalLogEntry) {
+	if !streamed(log) {
+		return
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to marshal log entry", "error", err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replay.ApplyLog(s.shadow, log)
+	s.position.Advance(log)
+	s.backlog = append(s.backlog, ReplicationFrame{
+		Position: s.position,
+		Entry:    data,
+	})
+	if len(s.backlog) >= 2*s.backlogSize {
+		cut := len(s.backlog) - s.backlogSize
+		s.base = s.backlog[cut-1].Position
+		// Copy so the dropped entries can be garbage collected.
+		s.backlog = append([]ReplicationFrame(nil), s.backlog[cut:]...)
+	}
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// ListenAndServe accepts replicas on listenAddress until ctx is cancelled.
+func (s *TCPStreamer) ListenAndServe(ctx context.Context, listenAddress string) error {
+	lis, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, lis)
+}
+
+// Serve is like ListenAndServe but uses an existing listener.
+func (s *TCPStreamer) Serve(ctx context.Context, lis net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveConn(ctx, conn); err != nil && s.logger != nil {
+				s.logger.Warn("replica disconnected", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+func (s *TCPStreamer) serveConn(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var hello ReplicationHello
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&hello); err != nil {
+		return err
+	}
+	if s.logger != nil {
+		s.logger.Info("replica connected", "remote", conn.RemoteAddr().String(), "position", hello.Position)
+	}
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+
+	pos := hello.Position
+	sent := false
+	for {
+		frames, notify, err := s.framesAfter(pos, sent)
+		if err != nil {
+			return err
+		}
+		sent = true
+
+		for _, f := range frames {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+			pos = &f.Position
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if len(frames) == 0 {
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// framesAfter returns the frames a replica at pos still needs, and a
+// channel closed on the next Stream. Entries before the backlog are read
+// from the WAL files, then the nil channel means the caller asks again.
+// When the entries after pos are not found, or pos is nil, it returns a
+// snapshot frame of the shadow pool instead. sent is set when pos was sent
+// on this connection, so it is resumed from even if not exact.
+func (s *TCPStreamer) framesAfter(pos *Position, sent bool) ([]ReplicationFrame, <-chan struct{}, error) {
+	s.mu.Lock()
+	if pos != nil {
+		if i, ok := s.backlogIndex(*pos, sent); ok {
+			frames := append([]ReplicationFrame(nil), s.backlog[i:]...)
+			notify := s.notify
+			s.mu.Unlock()
+			return frames, notify, nil
+		}
+		if base := s.base; s.utils != nil && s.exact(base) && pos.Compare(base) < 0 {
+			s.mu.Unlock()
+			frames, err := s.readFrames(*pos, base)
+			if err == nil {
+				return frames, nil, nil
+			}
+			if s.logger != nil {
+				s.logger.Warn("replica is behind the WAL, bootstrapping it again", "position", *pos, "error", err)
+			}
+			s.mu.Lock()
+		}
+	}
+	defer s.mu.Unlock()
+
+	snapshot, err := s.shadow.CreateSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot.LastRequestID = s.position.RequestID
+	frame := ReplicationFrame{
+		Position: s.position,
+		Snapshot: snapshot,
+	}
+	return []ReplicationFrame{frame}, s.notify, nil
+}
+
+// exact reports whether p counts every entry after its draw.
+func (s *TCPStreamer) exact(p Position) bool {
+	return s.startKnown || p.RequestID != s.start.RequestID
+}
+
+// backlogIndex returns the index of the first backlog frame after pos.
+func (s *TCPStreamer) backlogIndex(pos Position, sent bool) (int, bool) {
+	if !sent && !s.exact(pos) {
+		return 0, false
+	}
+	if pos == s.base {
+		return 0, true
+	}
+	i, ok := slices.BinarySearchFunc(s.backlog, pos, func(f ReplicationFrame, p Position) int {
+		return f.Position.Compare(p)
+	})
+	return i + 1, ok
+}
+
+// readFrames reads the frames after pos up to base from the WAL files.
+func (s *TCPStreamer) readFrames(pos, base Position) ([]ReplicationFrame, error) {
+	entries, err := s.readAfter(pos.RequestID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Position{RequestID: pos.RequestID}
+	var frames []ReplicationFrame
+	for _, entry := range entries {
+		p.Advance(entry)
+		if p.Compare(pos) <= 0 {
+			continue
+		}
+		if p.Compare(base) > 0 {
+			break
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, ReplicationFrame{Position: p, Entry: data})
+	}
+	if len(frames) == 0 || frames[len(frames)-1].Position != base {
+		return nil, fmt.Errorf("entries after %+v do not reach %+v", pos, base)
+	}
+	return frames, nil
+}
+
+// readAfter returns the streamed entries after the draw with requestID in the
+// WAL files.
+func (s *TCPStreamer) readAfter(requestID uint64) ([]types.WalLogEntry, error) {
+	if s.utils == nil {
+		return nil, errors.New("no WAL files")
+	}
+	paths, err := s.utils.GetWALFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, found, err := ReadAfter(paths, s.formatter, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("draw %d is not in the WAL files", requestID)
+	}
+	return slices.DeleteFunc(entries, func(e types.WalLogEntry) bool {
+		return !streamed(e)
+	}), nil
+}
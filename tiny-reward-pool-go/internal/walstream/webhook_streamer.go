@@ -0,0 +1,320 @@
+package walstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+)
+
+const (
+	defaultWebhookTimeout        = 5 * time.Second
+	defaultWebhookMaxAttempts    = 8
+	defaultWebhookInitialBackoff = 500 * time.Millisecond
+	defaultWebhookMaxBackoff     = time.Minute
+
+	webhookDeadLetterFileName = "dead_letter.jsonl"
+)
+
+// WebhookSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC-SHA256>".
+// See SignWebhook.
+const WebhookSignatureHeader = "X-Rewardpool-Signature"
+
+// WebhookTarget is an endpoint receiving a POST for every matching entry.
+type WebhookTarget struct {
+	// Name identifies the target's queue, it must be unique and usable as a
+	// file name.
+	Name   string
+	URL    string
+	Secret []byte
+	// ItemIDs restricts the target to entries about these items.
+	// Empty means every entry.
+	ItemIDs []string
+	// LogTypes restricts the target to these entry types. Empty means every type.
+	LogTypes []types.LogType
+}
+
+// WebhookDeadLetter is written to the dead-letter file for every entry a
+// target did not accept after MaxAttempts.
+type WebhookDeadLetter struct {
+	Target   string          `json:"target"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// WebhookStreamer is a WALStreamer that POSTs the matching committed
+// entries to partner endpoints. The body is the entry in the JSON WAL
+// format, signed in the WebhookSignatureHeader with the target's secret.
+//
+// Stream only appends the entry to a queue file per target, so a slow
+// endpoint never holds up the StreamingActor. Each target is delivered in
+// order by its own goroutine, and a failed POST is retried with an
+// exponential backoff. After MaxAttempts the entry is moved to the
+// dead-letter file and the next one is sent. Delivery is at least once:
+// endpoints should deduplicate draws by request ID.
+type WebhookStreamer struct {
+	targets        []*webhookTarget
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	now            func() time.Time
+	logger         *slog.Logger
+
+	deadLetterMu sync.Mutex
+	deadLetter   *os.File
+}
+
+var _ WALStreamer = (*WebhookStreamer)(nil)
+
+// WebhookStreamerOptional provides optional settings for the WebhookStreamer.
+type WebhookStreamerOptional struct {
+	// Client sends the requests. Defaults to a client with a 5s timeout.
+	Client         *http.Client
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Now is used for the signature timestamp. Defaults to time.Now.
+	Now    func() time.Time
+	Logger *slog.Logger
+}
+
+type webhookTarget struct {
+	WebhookTarget
+	queue *fileQueue
+}
+
+// NewWebhookStreamer creates a WebhookStreamer. The queues and the
+// dead-letter file are kept in dir, which is created if needed. Entries
+// queued by a previous run are delivered first.
+func NewWebhookStreamer(dir string, targets []WebhookTarget, opts ...WebhookStreamerOptional) (*WebhookStreamer, error) {
+	var opt WebhookStreamerOptional
+	for _, o := range opts {
+		opt = o
+	}
+	if opt.Client == nil {
+		opt.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if opt.MaxAttempts <= 0 {
+		opt.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if opt.InitialBackoff <= 0 {
+		opt.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	deadLetter, err := os.OpenFile(filepath.Join(dir, webhookDeadLetterFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &WebhookStreamer{
+		client:         opt.Client,
+		maxAttempts:    opt.MaxAttempts,
+		initialBackoff: opt.InitialBackoff,
+		maxBackoff:     opt.MaxBackoff,
+		now:            opt.Now,
+		logger:         opt.Logger,
+		deadLetter:     deadLetter,
+	}
+	for _, target := range targets {
+		queue, err := openFileQueue(filepath.Join(dir, target.Name+".queue"))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open the queue of webhook %q: %w", target.Name, err)
+		}
+		s.targets = append(s.targets, &webhookTarget{WebhookTarget: target, queue: queue})
+	}
+	return s, nil
+}
+
+// Stream queues the entry for every target it matches.
+func (s *WebhookStreamer) Stream(log types.WalLogEntry) {
+	var payload []byte
+	for _, t := range s.targets {
+		if !t.matches(log) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(log); err != nil {
+				if s.logger != nil {
+					s.logger.Error("failed to marshal log entry", "error", err)
+				}
+				return
+			}
+		}
+		if err := t.queue.push(payload); err != nil && s.logger != nil {
+			s.logger.Error("failed to queue webhook, entry lost", "target", t.Name, "error", err)
+		}
+	}
+}
+
+// Run delivers the queued entries until ctx is cancelled.
+func (s *WebhookStreamer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range s.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+// Close closes the queue and dead-letter files. Call it after Run returned.
+func (s *WebhookStreamer) Close() error {
+	var errs []error
+	for _, t := range s.targets {
+		errs = append(errs, t.queue.close())
+	}
+	s.deadLetterMu.Lock()
+	errs = append(errs, s.deadLetter.Close())
+	s.deadLetterMu.Unlock()
+	return errors.Join(errs...)
+}
+
+func (s *WebhookStreamer) run(ctx context.Context, t *webhookTarget) {
+	attempts := 0
+	backoff := s.initialBackoff
+	for {
+		payload, consumed, err := t.queue.peek()
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Error("failed to read the webhook queue", "target", t.Name, "error", err)
+			}
+			return
+		}
+		if payload == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.queue.wait():
+				continue
+			}
+		}
+
+		err = s.post(ctx, t, payload)
+		if ctx.Err() != nil {
+			return
+		}
+		attempts++
+		if err != nil && attempts < s.maxAttempts {
+			if s.logger != nil {
+				s.logger.Warn("webhook failed, retrying", "target", t.Name, "attempt", attempts, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, s.maxBackoff)
+			continue
+		}
+
+		if err != nil {
+			s.writeDeadLetter(t, payload, attempts, err)
+		}
+		if err := t.queue.pop(consumed); err != nil && s.logger != nil {
+			s.logger.Error("failed to update the webhook queue", "target", t.Name, "error", err)
+		}
+		attempts, backoff = 0, s.initialBackoff
+	}
+}
+
+func (s *WebhookStreamer) post(ctx context.Context, t *webhookTarget, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(t.Secret, s.now().Unix(), payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookStreamer) writeDeadLetter(t *webhookTarget, payload []byte, attempts int, cause error) {
+	if s.logger != nil {
+		s.logger.Error("webhook failed, moved to the dead-letter file", "target", t.Name, "attempts", attempts, "error", cause)
+	}
+	data, err := json.Marshal(WebhookDeadLetter{
+		Target:   t.Name,
+		URL:      t.URL,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		FailedAt: s.now().UTC(),
+		Payload:  payload,
+	})
+	if err == nil {
+		s.deadLetterMu.Lock()
+		_, err = s.deadLetter.Write(append(data, '\n'))
+		s.deadLetterMu.Unlock()
+	}
+	if err != nil && s.logger != nil {
+		s.logger.Error("failed to write the dead-letter file", "target", t.Name, "error", err)
+	}
+}
+
+// matches reports whether the entry passes the target's filters.
+func (t *webhookTarget) matches(log types.WalLogEntry) bool {
+	if len(t.LogTypes) > 0 && !slices.Contains(t.LogTypes, log.GetType()) {
+		return false
+	}
+	if len(t.ItemIDs) == 0 {
+		return true
+	}
+	switch v := log.(type) {
+	case *types.WalLogDrawItem:
+		return v.Success && slices.Contains(t.ItemIDs, v.ItemID)
+	case *types.WalLogUpdateItem:
+		return slices.Contains(t.ItemIDs, v.ItemID)
+	}
+	return false
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for body sent at
+// timestamp: the HMAC-SHA256 of "<timestamp>.<body>" keyed with secret.
+// Receivers should recompute it and reject old timestamps.
+func SignWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,236 @@
+package walstream_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/walstream"
+)
+
+// webhookEndpoint records the bodies it accepts. fail decides, per body,
+// whether to answer 500 instead.
+type webhookEndpoint struct {
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	attempts map[string]int
+	fail     func(body string, attempt int) bool
+}
+
+func newWebhookEndpoint(t *testing.T, fail func(body string, attempt int) bool) (*webhookEndpoint, string) {
+	e := &webhookEndpoint{attempts: make(map[string]int), fail: fail}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body := string(data)
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.attempts[body]++
+		if e.fail != nil && e.fail(body, e.attempts[body]) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		e.bodies = append(e.bodies, body)
+		e.headers = append(e.headers, r.Header.Clone())
+	}))
+	t.Cleanup(srv.Close)
+	return e, srv.URL
+}
+
+func (e *webhookEndpoint) received() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.bodies...)
+}
+
+func marshalEntry(t *testing.T, log types.WalLogEntry) string {
+	data, err := json.Marshal(log)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func runWebhooks(t *testing.T, s *walstream.WebhookStreamer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		s.Close()
+	})
+}
+
+var webhookOpt = walstream.WebhookStreamerOptional{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+}
+
+func TestWebhookStreamer_FilterAndSignature(t *testing.T) {
+	wins, winsURL := newWebhookEndpoint(t, nil)
+	updates, updatesURL := newWebhookEndpoint(t, nil)
+	secret := []byte("s3cret")
+
+	s, err := walstream.NewWebhookStreamer(t.TempDir(), []walstream.WebhookTarget{
+		{Name: "wins", URL: winsURL, Secret: secret, ItemIDs: []string{"gold"}, LogTypes: []types.LogType{types.LogTypeDraw}},
+		{Name: "updates", URL: updatesURL, Secret: secret, LogTypes: []types.LogType{types.LogTypeUpdate}},
+	}, webhookOpt)
+	require.NoError(t, err)
+	runWebhooks(t, s)
+
+	gold := drawEntry(1)
+	silver := drawEntry(2)
+	silver.ItemID = "silver"
+	failed := &types.WalLogDrawItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeDraw}, RequestID: 3}
+	update := &types.WalLogUpdateItem{WalLogEntryBase: types.WalLogEntryBase{Type: types.LogTypeUpdate}, ItemID: "gold", Quantity: 5, Probability: 10}
+	for _, log := range []types.WalLogEntry{gold, silver, failed, update} {
+		s.Stream(log)
+	}
+
+	require.Eventually(t, func() bool { return len(wins.received()) == 1 && len(updates.received()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []string{marshalEntry(t, gold)}, wins.received())
+	assert.Equal(t, []string{marshalEntry(t, update)}, updates.received())
+
+	// t=<timestamp>,v1=<HMAC-SHA256 of "<timestamp>.<body>">
+	header := wins.headers[0].Get(walstream.WebhookSignatureHeader)
+	parts := strings.Split(header, ",")
+	require.Len(t, parts, 2)
+	timestamp := strings.TrimPrefix(parts[0], "t=")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + wins.received()[0]))
+	assert.Equal(t, "v1="+hex.EncodeToString(mac.Sum(nil)), parts[1])
+	assert.Equal(t, "application/json", wins.headers[0].Get("Content-Type"))
+}
+
+func TestWebhookStreamer_RetryAndDeadLetter(t *testing.T) {
+	poisoned := marshalEntry(t, drawEntry(2))
+	endpoint, url := newWebhookEndpoint(t, func(body string, attempt int) bool {
+		return body == poisoned || attempt < 3
+	})
+	dir := t.TempDir()
+
+	s, err := walstream.NewWebhookStreamer(dir, []walstream.WebhookTarget{{Name: "partner", URL: url}}, webhookOpt)
+	require.NoError(t, err)
+	runWebhooks(t, s)
+
+	for id := uint64(1); id <= 3; id++ {
+		s.Stream(drawEntry(id))
+	}
+
+	// The first and last succeed on their third attempt, in order.
+	require.Eventually(t, func() bool { return len(endpoint.received()) == 2 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{marshalEntry(t, drawEntry(1)), marshalEntry(t, drawEntry(3))}, endpoint.received())
+
+	data, err := os.ReadFile(filepath.Join(dir, "dead_letter.jsonl"))
+	require.NoError(t, err)
+	var dead walstream.WebhookDeadLetter
+	require.NoError(t, json.Unmarshal(data, &dead))
+	assert.Equal(t, "partner", dead.Target)
+	assert.Equal(t, 3, dead.Attempts)
+	assert.JSONEq(t, poisoned, string(dead.Payload))
+}
+
+func TestWebhookStreamer_DurableQueue(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	// A stuck endpoint does not hold up Stream.
+	s, err := walstream.NewWebhookStreamer(dir, []walstream.WebhookTarget{{Name: "partner", URL: slow.URL}}, webhookOpt)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	start := time.Now()
+	for id := uint64(1); id <= 100; id++ {
+		s.Stream(drawEntry(id))
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	cancel()
+	<-done
+	require.NoError(t, s.Close())
+
+	// The queued entries are delivered after a restart.
+	endpoint, url := newWebhookEndpoint(t, nil)
+	s, err = walstream.NewWebhookStreamer(dir, []walstream.WebhookTarget{{Name: "partner", URL: url}}, webhookOpt)
+	require.NoError(t, err)
+	runWebhooks(t, s)
+
+	require.Eventually(t, func() bool { return len(endpoint.received()) == 100 }, 5*time.Second, 5*time.Millisecond)
+	for i, body := range endpoint.received() {
+		assert.Equal(t, marshalEntry(t, drawEntry(uint64(i+1))), body)
+	}
+}
+
+func TestWebhookStreamer_DurableQueueAfterDrain(t *testing.T) {
+	dir := t.TempDir()
+	endpoint, url := newWebhookEndpoint(t, nil)
+	targets := []walstream.WebhookTarget{{Name: "partner", URL: url}}
+
+	// The queue drains and its file is truncated
+	s, err := walstream.NewWebhookStreamer(dir, targets, webhookOpt)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	for id := uint64(1); id <= 3; id++ {
+		s.Stream(drawEntry(id))
+	}
+	require.Eventually(t, func() bool { return len(endpoint.received()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	require.NoError(t, s.Close())
+	data, err := os.ReadFile(filepath.Join(dir, "partner.queue.offset"))
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(data))
+
+	// A crash between the truncate and the offset write leaves a stale offset
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "partner.queue.offset"), []byte("1000"), 0644))
+
+	// Entries pushed after the restart are queued, then the process stops
+	// before delivering them
+	s, err = walstream.NewWebhookStreamer(dir, targets, webhookOpt)
+	require.NoError(t, err)
+	for id := uint64(4); id <= 40; id++ {
+		s.Stream(drawEntry(id))
+	}
+	require.NoError(t, s.Close())
+
+	// They are delivered after the next restart
+	s, err = walstream.NewWebhookStreamer(dir, targets, webhookOpt)
+	require.NoError(t, err)
+	runWebhooks(t, s)
+	require.Eventually(t, func() bool { return len(endpoint.received()) == 40 }, 5*time.Second, 5*time.Millisecond)
+	for i, body := range endpoint.received() {
+		assert.Equal(t, marshalEntry(t, drawEntry(uint64(i+1))), body)
+	}
+}
@@ -2,19 +2,40 @@ package rewardpool_grpc_service
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/actor"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/ratelimit"
+	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/tracing"
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
+// LeaderAddressMetadataKey is the gRPC trailer key carrying the leader's
+// address when a follower rejects a draw.
+const LeaderAddressMetadataKey = "leader-address"
+
 // ActorSystem is an interface that actor.System implements.
 type ActorSystem interface {
 	State() []types.PoolReward
+	StateCtx(ctx context.Context) ([]types.PoolReward, error)
 	Draw() <-chan actor.DrawResponse
+	TryDrawCtx(ctx context.Context) (<-chan actor.DrawResponse, error)
 	Stop()
 	UpdateItem(id string, quantity int, weight int64) error
 	GetRequestID() uint64
@@ -22,32 +43,148 @@ type ActorSystem interface {
 }
 
 // RewardPoolService is a gRPC service that exposes the reward pool functionality.
+// The service rejects requests with UNAVAILABLE until a system is attached
+// and after Drain is called.
 type RewardPoolService struct {
 	UnimplementedRewardPoolServiceServer
-	system ActorSystem
+	system   atomic.Pointer[ActorSystem]
+	draining atomic.Bool
+	limits   atomic.Pointer[serviceLimits]
+	tracer   trace.Tracer
+
+	leaderAddress atomic.Pointer[func() string]
+}
+
+// serviceLimits groups the limits so they can be swapped at once by SetLimits.
+type serviceLimits struct {
+	maxDrawCount  int32
+	globalLimiter *ratelimit.TokenBucket
+	clientLimiter *ratelimit.KeyedLimiter
+}
+
+// ServiceOptional provides optional limits for the RewardPoolService.
+// Zero values disable the corresponding limit.
+type ServiceOptional struct {
+	// MaxDrawCount is the largest `count` accepted in a single DrawRequest.
+	MaxDrawCount int32
+	// GlobalRate / GlobalBurst limit draws per second across all clients.
+	GlobalRate  float64
+	GlobalBurst int
+	// PerClientRate / PerClientBurst limit draws per second for each client.
+	PerClientRate  float64
+	PerClientBurst int
+	// TracerProvider records a span per DrawRequest. Nil disables tracing.
+	TracerProvider trace.TracerProvider
 }
 
 // NewRewardPoolService creates a new RewardPoolService.
-func NewRewardPoolService(system ActorSystem) *RewardPoolService {
-	return &RewardPoolService{
-		system: system,
+// system may be nil and attached later with SetSystem, e.g. once recovery is done.
+func NewRewardPoolService(system ActorSystem, opts ...ServiceOptional) *RewardPoolService {
+	var opt ServiceOptional
+	for _, o := range opts {
+		opt = o
 	}
+
+	tp := opt.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+
+	s := &RewardPoolService{
+		tracer: tp.Tracer(tracing.InstrumentationName),
+	}
+	s.SetLimits(opt)
+	if system != nil {
+		s.SetSystem(system)
+	}
+	return s
 }
 
-// ListenAndServe starts the gRPC server.
-func ListenAndServe(ctx context.Context, system ActorSystem, listenAddress string) error {
-	lis, err := net.Listen("tcp", listenAddress)
-	if err != nil {
-		return err
+// SetLimits replaces the max draw count and the rate limiters, e.g. on a config reload.
+// The buckets start full, so clients are not throttled by the swap itself.
+// TracerProvider is ignored.
+func (s *RewardPoolService) SetLimits(opt ServiceOptional) {
+	s.limits.Store(&serviceLimits{
+		maxDrawCount:  opt.MaxDrawCount,
+		globalLimiter: ratelimit.NewTokenBucket(opt.GlobalRate, opt.GlobalBurst),
+		clientLimiter: ratelimit.NewKeyedLimiter(opt.PerClientRate, opt.PerClientBurst),
+	})
+}
+
+// SetSystem attaches the actor system the service forwards requests to.
+func (s *RewardPoolService) SetSystem(system ActorSystem) {
+	s.system.Store(&system)
+}
+
+// SetLeaderAddress sets how the service finds the leader's address. Draws
+// rejected by a follower then fail with FAILED_PRECONDITION and the address in
+// the LeaderAddressMetadataKey trailer, so clients can redirect.
+func (s *RewardPoolService) SetLeaderAddress(leaderAddress func() string) {
+	s.leaderAddress.Store(&leaderAddress)
+}
+
+// Drain makes the service reject new requests with UNAVAILABLE.
+// Draws that are already running are completed.
+func (s *RewardPoolService) Drain() {
+	s.draining.Store(true)
+}
+
+// getSystem returns the attached system, or an UNAVAILABLE error when the
+// service is not ready or is draining.
+func (s *RewardPoolService) getSystem() (ActorSystem, error) {
+	if s.draining.Load() {
+		return nil, status.Error(codes.Unavailable, "server is draining")
+	}
+	sys := s.system.Load()
+	if sys == nil {
+		return nil, status.Error(codes.Unavailable, "server is not ready")
 	}
-	s := grpc.NewServer()
-	grpcService := NewRewardPoolService(system)
-	RegisterRewardPoolServiceServer(s, grpcService)
+	return *sys, nil
+}
+
+// NewGRPCServer creates a gRPC server with the reward pool, health and
+// reflection services registered. The health status starts as NOT_SERVING.
+func NewGRPCServer(service *RewardPoolService, opts ...grpc.ServerOption) (*grpc.Server, *health.Server) {
+	s := grpc.NewServer(opts...)
+	RegisterRewardPoolServiceServer(s, service)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthServer.SetServingStatus(RewardPoolService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
 
 	// Addon: support grpc-cli or grpccurl list
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
 
+	return s, healthServer
+}
+
+// SetServingStatus updates the overall and RewardPoolService health status.
+func SetServingStatus(healthServer *health.Server, serving bool) {
+	st := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		st = healthpb.HealthCheckResponse_SERVING
+	}
+	healthServer.SetServingStatus("", st)
+	healthServer.SetServingStatus(RewardPoolService_ServiceDesc.ServiceName, st)
+}
+
+// ListenAndServe starts the gRPC server.
+func ListenAndServe(ctx context.Context, system ActorSystem, listenAddress string, opts ...ServiceOptional) error {
+	return ServeService(ctx, NewRewardPoolService(system, opts...), listenAddress)
+}
+
+// ServeService is like ListenAndServe but serves an existing service,
+// so the caller can still change its limits with SetLimits.
+func ServeService(ctx context.Context, service *RewardPoolService, listenAddress string) error {
+	lis, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	s, healthServer := NewGRPCServer(service)
+	SetServingStatus(healthServer, true)
+
 	go func() {
 		<-ctx.Done()
 		s.GracefulStop()
@@ -58,7 +195,15 @@ func ListenAndServe(ctx context.Context, system ActorSystem, listenAddress strin
 
 // GetState returns the current state of the reward pool.
 func (s *RewardPoolService) GetState(ctx context.Context, req *GetStateRequest) (*GetStateResponse, error) {
-	state := s.system.State()
+	// Reads are still served while draining.
+	system := s.system.Load()
+	if system == nil {
+		return nil, status.Error(codes.Unavailable, "server is not ready")
+	}
+	state, err := (*system).StateCtx(ctx)
+	if err != nil {
+		return nil, systemError(err)
+	}
 	items := make([]*RewardItem, 0, len(state))
 	for _, item := range state {
 		items = append(items, &RewardItem{
@@ -88,19 +233,173 @@ func (s *RewardPoolService) Draw(stream RewardPoolService_DrawServer) error {
 			count = 1
 		}
 
-		for i := 0; i < int(count); i++ {
-			resp := <-s.system.Draw()
-			var errMsg string
-			if resp.Err != nil {
-				errMsg = resp.Err.Error()
-			}
-			if err := stream.Send(&DrawResponse{
-				RequestId: resp.RequestID,
-				ItemId:    resp.Item,
-				Error:     errMsg,
-			}); err != nil {
-				return err
-			}
+		if err := s.draw(stream, count); err != nil {
+			return err
+		}
+	}
+}
+
+// draw serves a single DrawRequest under its own span.
+func (s *RewardPoolService) draw(stream RewardPoolService_DrawServer, count int32) error {
+	ctx := tracing.Propagator.Extract(stream.Context(), metadataCarrier(metadataFromContext(stream.Context())))
+	ctx, span := s.tracer.Start(ctx, "RewardPoolService/Draw", trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(attribute.Int("count", int(count)))
+	defer span.End()
+
+	system, err := s.getSystem()
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		return err
+	}
+
+	refund, err := s.admit(stream.Context(), count)
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		return err
+	}
+	// The tokens of the draws not made are given back: the loop stopped
+	// early, or the draw failed, e.g. on an empty pool.
+	drawn := 0
+	defer func() { refund(int(count) - drawn) }()
+
+	for i := 0; i < int(count); i++ {
+		respChan, err := system.TryDrawCtx(ctx)
+		if errors.Is(err, types.ErrSystemBusy) {
+			span.SetStatus(otelcodes.Error, err.Error())
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		if errors.Is(err, types.ErrNotLeader) || errors.Is(err, types.ErrReadOnlyReplica) {
+			span.SetStatus(otelcodes.Error, err.Error())
+			return s.notLeader(stream, err)
+		}
+		if err != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+			return systemError(err)
+		}
+		// The draw is dropped if it is still queued when the client gives up.
+		var resp actor.DrawResponse
+		select {
+		case resp = <-respChan:
+		case <-ctx.Done():
+			span.SetStatus(otelcodes.Error, ctx.Err().Error())
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if errors.Is(resp.Err, types.ErrNotLeader) {
+			span.SetStatus(otelcodes.Error, resp.Err.Error())
+			return s.notLeader(stream, resp.Err)
+		}
+		var errMsg string
+		if resp.Err != nil {
+			errMsg = resp.Err.Error()
+		} else {
+			drawn++
+		}
+		if err := stream.Send(&DrawResponse{
+			RequestId: resp.RequestID,
+			ItemId:    resp.Item,
+			Error:     errMsg,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// systemError converts an error of the actor system to a gRPC status: the
+// errors of the request context to CANCELLED or DEADLINE_EXCEEDED, the
+// others to UNAVAILABLE.
+func systemError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// notLeader reports a draw rejected by a follower. Without a known leader
+// address it is UNAVAILABLE, so clients retry on the same node.
+func (s *RewardPoolService) notLeader(stream grpc.ServerStream, err error) error {
+	var address string
+	if leaderAddress := s.leaderAddress.Load(); leaderAddress != nil {
+		address = (*leaderAddress)()
+	}
+	if address == "" {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	stream.SetTrailer(metadata.Pairs(LeaderAddressMetadataKey, address))
+	return status.Errorf(codes.FailedPrecondition, "%v, leader is at %s", err, address)
+}
+
+// admit checks the request against the max count and the rate limiters.
+// Rejections are reported as RESOURCE_EXHAUSTED. Once admitted, refund gives
+// back the tokens of n draws to both limiters.
+func (s *RewardPoolService) admit(ctx context.Context, count int32) (refund func(n int), err error) {
+	limits := s.limits.Load()
+	if limits.maxDrawCount > 0 && count > limits.maxDrawCount {
+		return nil, status.Errorf(codes.ResourceExhausted, "draw count %d exceeds the limit of %d", count, limits.maxDrawCount)
+	}
+
+	clientID := clientIDFromContext(ctx)
+	if !limits.clientLimiter.AllowN(clientID, int(count)) {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded for client %s", clientID)
+	}
+	if !limits.globalLimiter.AllowN(int(count)) {
+		limits.clientLimiter.Refund(clientID, int(count))
+		return nil, status.Error(codes.ResourceExhausted, "global rate limit exceeded")
+	}
+	return func(n int) {
+		if n <= 0 {
+			return
+		}
+		limits.clientLimiter.Refund(clientID, n)
+		limits.globalLimiter.Refund(n)
+	}, nil
+}
+
+func metadataFromContext(ctx context.Context) metadata.MD {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md
+}
+
+// metadataCarrier adapts gRPC metadata to the OpenTelemetry TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vals := metadata.MD(c).Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// clientIDFromContext identifies the caller by the subject of its verified
+// TLS client certificate, or else by its peer host. Nothing the client sends
+// is trusted, so it cannot change identity to escape its limit.
+func clientIDFromContext(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unknown"
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		if chains := tlsInfo.State.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			return chains[0][0].Subject.String()
+		}
+	}
+	if p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
 		}
+		return p.Addr.String()
 	}
+	return "unknown"
 }
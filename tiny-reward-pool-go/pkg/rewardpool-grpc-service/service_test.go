@@ -2,7 +2,10 @@ package rewardpool_grpc_service_test
 
 import (
 	"context"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -10,9 +13,25 @@ import (
 	"github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/internal/types"
 	generated "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/pkg/rewardpool-grpc-service"
 	grpc_service "github.com/tinnguyenhuuletrong/my-small-app-playground/tiny-reward-pool-go/pkg/rewardpool-grpc-service"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
-type mockActorSystem struct{}
+type mockActorSystem struct {
+	busy      bool
+	drawCount int
+	drawErr   error
+	// stuck leaves the draws unanswered.
+	stuck bool
+}
 
 func (m *mockActorSystem) State() []types.PoolReward {
 	return []types.PoolReward{
@@ -21,10 +40,33 @@ func (m *mockActorSystem) State() []types.PoolReward {
 	}
 }
 
+func (m *mockActorSystem) StateCtx(ctx context.Context) ([]types.PoolReward, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.State(), nil
+}
+
 func (m *mockActorSystem) Draw() <-chan actor.DrawResponse {
 	return nil
 }
 
+func (m *mockActorSystem) TryDrawCtx(ctx context.Context) (<-chan actor.DrawResponse, error) {
+	if m.busy {
+		return nil, types.ErrSystemBusy
+	}
+	if m.drawErr != nil {
+		return nil, m.drawErr
+	}
+	ch := make(chan actor.DrawResponse, 1)
+	if m.stuck {
+		return ch, nil
+	}
+	m.drawCount++
+	ch <- actor.DrawResponse{RequestID: uint64(m.drawCount), Item: "gold"}
+	return ch, nil
+}
+
 func (m *mockActorSystem) Stop() {}
 
 func (m *mockActorSystem) UpdateItem(id string, quantity int, weight int64) error {
@@ -58,3 +100,250 @@ func TestRewardPoolService_GetState(t *testing.T) {
 		assert.Equal(t, expectedItem.Probability, actualItem.Probability)
 	}
 }
+
+func TestRewardPoolService_GetState_Cancelled(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := service.GetState(ctx, &generated.GetStateRequest{})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+// mockDrawStream feeds a fixed list of requests to the Draw handler.
+type mockDrawStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []*generated.DrawRequest
+	sent     []*generated.DrawResponse
+	trailer  metadata.MD
+}
+
+func (m *mockDrawStream) Context() context.Context { return m.ctx }
+
+func (m *mockDrawStream) Recv() (*generated.DrawRequest, error) {
+	if len(m.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := m.requests[0]
+	m.requests = m.requests[1:]
+	return req, nil
+}
+
+func (m *mockDrawStream) SetTrailer(md metadata.MD) { m.trailer = metadata.Join(m.trailer, md) }
+
+func (m *mockDrawStream) Send(resp *generated.DrawResponse) error {
+	m.sent = append(m.sent, resp)
+	return nil
+}
+
+// peerAddr is the address of a test client, its host identifies it.
+type peerAddr string
+
+func (a peerAddr) Network() string { return "tcp" }
+func (a peerAddr) String() string  { return net.JoinHostPort(string(a), "5000") }
+
+func newDrawStream(clientID string, counts ...int32) *mockDrawStream {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: peerAddr(clientID)})
+	stream := &mockDrawStream{ctx: ctx}
+	for _, c := range counts {
+		stream.requests = append(stream.requests, &generated.DrawRequest{Count: c})
+	}
+	return stream
+}
+
+func TestRewardPoolService_Draw_MaxCount(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{MaxDrawCount: 10})
+
+	stream := newDrawStream("client-a", 10)
+	require.NoError(t, service.Draw(stream))
+	assert.Len(t, stream.sent, 10)
+
+	stream = newDrawStream("client-a", 11)
+	err := service.Draw(stream)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Empty(t, stream.sent)
+}
+
+func TestRewardPoolService_Draw_PerClientRateLimit(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{
+		PerClientRate:  0.001,
+		PerClientBurst: 5,
+	})
+
+	stream := newDrawStream("client-a", 5, 1)
+	err := service.Draw(stream)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Len(t, stream.sent, 5)
+
+	// Other clients are not affected
+	stream = newDrawStream("client-b", 5)
+	require.NoError(t, service.Draw(stream))
+	assert.Len(t, stream.sent, 5)
+}
+
+func TestRewardPoolService_Draw_ClientIDMetadataIgnored(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{
+		PerClientRate:  0.001,
+		PerClientBurst: 5,
+	})
+
+	// Rotating the client-id metadata does not give a new bucket.
+	for i, clientID := range []string{"a", "b"} {
+		stream := newDrawStream("10.0.0.1", 5)
+		stream.ctx = metadata.NewIncomingContext(stream.ctx, metadata.Pairs("client-id", clientID))
+		err := service.Draw(stream)
+		if i == 0 {
+			require.NoError(t, err)
+		} else {
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		}
+	}
+}
+
+func TestRewardPoolService_Draw_GlobalRateLimit(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{
+		GlobalRate:  0.001,
+		GlobalBurst: 3,
+	})
+
+	require.NoError(t, service.Draw(newDrawStream("client-a", 2)))
+
+	err := service.Draw(newDrawStream("client-b", 2))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRewardPoolService_SetLimits(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{MaxDrawCount: 5})
+
+	err := service.Draw(newDrawStream("client-a", 8))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	service.SetLimits(grpc_service.ServiceOptional{MaxDrawCount: 10})
+	stream := newDrawStream("client-a", 8)
+	require.NoError(t, service.Draw(stream))
+	assert.Len(t, stream.sent, 8)
+}
+
+func TestRewardPoolService_Draw_Busy(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{busy: true})
+
+	err := service.Draw(newDrawStream("client-a", 1))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRewardPoolService_Draw_RefundsDrawsNotMade(t *testing.T) {
+	system := &mockActorSystem{busy: true}
+	service := grpc_service.NewRewardPoolService(system, grpc_service.ServiceOptional{
+		PerClientRate:  0.001,
+		PerClientBurst: 5,
+		GlobalRate:     0.001,
+		GlobalBurst:    5,
+	})
+
+	// The busy system stops the loop, the tokens of the 5 draws are refunded.
+	err := service.Draw(newDrawStream("client-a", 5))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	system.busy = false
+	stream := newDrawStream("client-a", 5)
+	require.NoError(t, service.Draw(stream))
+	assert.Len(t, stream.sent, 5)
+
+	// Not refunded: the draws were made.
+	err = service.Draw(newDrawStream("client-a", 1))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRewardPoolService_Draw_Deadline(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{stuck: true})
+
+	stream := newDrawStream("client-a", 1)
+	ctx, cancel := context.WithTimeout(stream.ctx, 10*time.Millisecond)
+	defer cancel()
+	stream.ctx = ctx
+	err := service.Draw(stream)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Empty(t, stream.sent)
+}
+
+func TestRewardPoolService_Draw_NotLeader(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{drawErr: types.ErrNotLeader})
+
+	// Leader unknown: retry later
+	err := service.Draw(newDrawStream("client-a", 1))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Leader known: redirect
+	service.SetLeaderAddress(func() string { return "10.0.0.2:50051" })
+	stream := newDrawStream("client-a", 1)
+	err = service.Draw(stream)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, []string{"10.0.0.2:50051"}, stream.trailer.Get(grpc_service.LeaderAddressMetadataKey))
+}
+
+func TestRewardPoolService_Draw_PropagatesTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	service := grpc_service.NewRewardPoolService(&mockActorSystem{}, grpc_service.ServiceOptional{TracerProvider: tp})
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	stream := newDrawStream("client-a", 2)
+	stream.ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", traceparent))
+	require.NoError(t, service.Draw(stream))
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "RewardPoolService/Draw", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+}
+
+func TestRewardPoolService_NotReadyAndDrain(t *testing.T) {
+	service := grpc_service.NewRewardPoolService(nil)
+
+	// No system attached yet
+	_, err := service.GetState(context.Background(), &generated.GetStateRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	err = service.Draw(newDrawStream("client-a", 1))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	service.SetSystem(&mockActorSystem{})
+	require.NoError(t, service.Draw(newDrawStream("client-a", 1)))
+
+	// Draining rejects new draws but still serves reads
+	service.Drain()
+	err = service.Draw(newDrawStream("client-a", 1))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = service.GetState(context.Background(), &generated.GetStateRequest{})
+	assert.NoError(t, err)
+}
+
+func TestNewGRPCServer_Health(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	server, healthServer := grpc_service.NewGRPCServer(grpc_service.NewRewardPoolService(nil))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: generated.RewardPoolService_ServiceDesc.ServiceName})
+		require.NoError(t, err)
+		return resp.Status
+	}
+
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check())
+	grpc_service.SetServingStatus(healthServer, true)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check())
+	grpc_service.SetServingStatus(healthServer, false)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check())
+}